@@ -1,21 +1,173 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
+	cryptossh "golang.org/x/crypto/ssh"
+
 	"tunnelfy/internal/ssh"
 )
 
+// localMapping is a single -local value: an optional subdomain label and the
+// local service address it maps to.
+type localMapping struct {
+	label string
+	addr  string
+}
+
+// localFlags collects repeated -local flags.
+type localFlags []localMapping
+
+func (f *localFlags) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, m := range *f {
+		if m.label == "" {
+			parts = append(parts, m.addr)
+		} else {
+			parts = append(parts, m.label+"="+m.addr)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses "host:port" or "label=host:port", or a comma-separated list of
+// them.
+func (f *localFlags) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		m := localMapping{addr: item}
+		if label, addr, ok := strings.Cut(item, "="); ok {
+			m = localMapping{label: label, addr: addr}
+			if m.label == "" {
+				return fmt.Errorf("empty label in %q", item)
+			}
+		}
+		if m.addr == "" {
+			return fmt.Errorf("empty local address in %q", value)
+		}
+		*f = append(*f, m)
+	}
+	return nil
+}
+
+// labelFlags collects repeated -label key=value flags.
+type labelFlags map[string]string
+
+func (f labelFlags) String() string {
+	parts := make([]string, 0, len(f))
+	for k, v := range f {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses "key=value".
+func (f labelFlags) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("label %q must be key=value", value)
+	}
+	f[k] = v
+	return nil
+}
+
+// pinFlags collects repeated -pin-host-key flags.
+type pinFlags []string
+
+func (f *pinFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *pinFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// listFlags collects repeated flags whose values may also be comma-separated.
+type listFlags []string
+
+func (f *listFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlags) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f = append(*f, item)
+		}
+	}
+	return nil
+}
+
+// defaultKnownHosts returns the user's OpenSSH known_hosts file, or "" if the
+// home directory is unknown.
+func defaultKnownHosts() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// promptHostKey asks on the terminal whether to trust an unknown server. It
+// refuses when stdin isn't a character device or reaches end of file, so
+// unattended runs never hang.
+func promptHostKey(hostname string, key cryptossh.PublicKey) bool {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "The authenticity of host %s can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ",
+		hostname, key.Type(), cryptossh.FingerprintSHA256(key))
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	return strings.EqualFold(strings.TrimSpace(answer), "yes")
+}
+
+// serverHost returns the host of the server address addr, where TCP tunnels
+// are exposed.
+func serverHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 func main() {
 	// Define command-line flags.
 	serverAddr := flag.String("server", "localhost:2222", "SSH server address (e.g., localhost:2222)")
 	username := flag.String("user", "", "SSH username for authentication")
 	keyPath := flag.String("key", "", "Path to the private SSH key file")
-	localAddr := flag.String("local", "localhost:3000", "Local service address to forward (e.g., localhost:3000)")
+	var locals localFlags
+	subdomain := flag.String("subdomain", "", "Subdomain label requested for services given without one, served as <label>.<user>.<zone>")
+	flag.Var(&locals, "local", "Local service to forward as host:port or label=host:port; repeat or separate with commas for multiple services (default localhost:3000)")
+	labels := labelFlags{}
+	flag.Var(labels, "label", "Metadata label key=value attached to the tunnels; repeat for multiple labels")
+	mode := flag.String("mode", "http", "Tunnel mode: http to serve the services at their hostnames, or tcp to expose each on a public TCP port of the server (for SSH, databases and other non-HTTP protocols)")
+	accessToken := flag.String("access-token", "", "Secret that requests to the tunnels must carry in the X-Tunnelfy-Token header or the tunnelfy_token query parameter (empty leaves them open)")
+	var allowIPs, denyIPs listFlags
+	flag.Var(&allowIPs, "allow-ip", "CIDR or address allowed to reach the tunnels, refusing every other one unless -deny-ip alone is used; repeat or separate with commas")
+	flag.Var(&denyIPs, "deny-ip", "CIDR or address refused access to the tunnels unless also allowed by -allow-ip; repeat or separate with commas")
+	basicAuth := flag.String("basic-auth", "", "user:password protecting the tunnels with HTTP basic auth; only a bcrypt hash of the password is sent to the server")
+	probeInterval := flag.Duration("probe-interval", 0, "How often to check the local services and report them offline/online to the server, e.g. 10s (0 disables)")
+	keepAlive := flag.Duration("keepalive", ssh.DefaultKeepAliveInterval, "How often to send keepalives to detect a dead connection (0 disables)")
+	knownHosts := flag.String("known-hosts", defaultKnownHosts(), "known_hosts file the server's host key is verified against")
+	insecureIgnoreHostKey := flag.Bool("insecure-ignore-host-key", false, "Connect without verifying the server's host key when -known-hosts is empty and no -pin-host-key is given; the connection may be intercepted")
+	var pins pinFlags
+	flag.Var(&pins, "pin-host-key", "SHA256 fingerprint of a host key the server may present, accepted even if known_hosts records another; repeat to pin the old and new keys during a rotation")
+	trustOnFirstUse := flag.Bool("trust-on-first-use", false, "Record the host key of a server missing from -known-hosts instead of prompting")
 	verbose := flag.Bool("v", false, "Enable verbose logging")
 
 	flag.Parse()
@@ -27,6 +179,31 @@ func main() {
 	if *keyPath == "" {
 		log.Fatal("Error: -key flag is required")
 	}
+	tunnelMode, err := ssh.ParseTunnelMode(*mode)
+	if err != nil {
+		log.Fatalf("Error: -mode: %v", err)
+	}
+	var basicAuthUser, basicAuthPassword string
+	if *basicAuth != "" {
+		var ok bool
+		basicAuthUser, basicAuthPassword, ok = strings.Cut(*basicAuth, ":")
+		if !ok || basicAuthUser == "" {
+			log.Fatal("Error: -basic-auth must be user:password")
+		}
+	}
+	if *knownHosts == "" && len(pins) == 0 && !*insecureIgnoreHostKey {
+		log.Fatal("Error: no known_hosts file to verify the server with (is $HOME set?); pass -known-hosts or -pin-host-key, or -insecure-ignore-host-key to skip verification")
+	}
+	if len(locals) == 0 {
+		locals = localFlags{{addr: "localhost:3000"}}
+	}
+	if *subdomain != "" {
+		for i := range locals {
+			if locals[i].label == "" {
+				locals[i].label = *subdomain
+			}
+		}
+	}
 
 	// Configure the SSH client.
 	var logger *log.Logger
@@ -36,12 +213,32 @@ func main() {
 		logger = log.New(os.Stderr, "", 0) // Discard logs if not verbose
 	}
 
+	// Forwards are requested individually after connecting, so the client is
+	// configured without a default LocalServiceAddress.
 	config := ssh.ClientConfig{
-		ServerAddress:      *serverAddr,
-		Username:          *username,
-		KeyPath:           *keyPath,
-		LocalServiceAddress: *localAddr,
-		Logger:            logger,
+		ServerAddress: *serverAddr,
+		Username:      *username,
+		KeyPath:       *keyPath,
+		Labels:        labels,
+		AccessToken:   *accessToken,
+		AllowIPs:      allowIPs,
+		DenyIPs:       denyIPs,
+
+		BasicAuthUser:     basicAuthUser,
+		BasicAuthPassword: basicAuthPassword,
+
+		TunnelMode:    tunnelMode,
+		ProbeInterval: *probeInterval,
+
+		KeepAliveInterval: *keepAlive,
+
+		KnownHostsPath:        *knownHosts,
+		InsecureIgnoreHostKey: *insecureIgnoreHostKey,
+		TrustOnFirstUse:       *trustOnFirstUse,
+		HostKeyPrompt:         promptHostKey,
+		PinnedHostKeys:        pins,
+
+		Logger: logger,
 	}
 
 	// Create and connect the SSH client.
@@ -50,24 +247,63 @@ func main() {
 	logger.Printf("  Server: %s", *serverAddr)
 	logger.Printf("  Username: %s", *username)
 	logger.Printf("  Key: %s", *keyPath)
-	logger.Printf("  Local: %s", *localAddr)
+	logger.Printf("  Local: %s", locals.String())
 
-	assignedPort, err := client.Connect()
-	if err != nil {
+	if _, err := client.Connect(); err != nil {
+		if errors.Is(err, ssh.ErrHostKeyChanged) {
+			logger.Fatalf("❌ Host key verification failed, the connection may be intercepted: %v", err)
+		}
+		if errors.Is(err, ssh.ErrHostKeyUnknown) {
+			logger.Fatalf("❌ Host key verification failed: %v (pass -trust-on-first-use to record it)", err)
+		}
 		logger.Fatalf("Failed to connect: %v", err)
 	}
 
+	for _, m := range locals {
+		f, err := client.AddForward(m.addr, m.label)
+		if err != nil {
+			client.Close()
+			logger.Fatalf("Failed to forward %s: %v", m.addr, err)
+		}
+		assignedPort := f.RemotePort
+		switch {
+		case tunnelMode == ssh.TunnelModeTCP:
+			logger.Printf("✅ %s exposed at tcp://%s", m.addr, net.JoinHostPort(serverHost(*serverAddr), strconv.Itoa(int(assignedPort))))
+		case f.PublicURL != "":
+			logger.Printf("✅ %s forwarded on remote port %d", m.addr, assignedPort)
+			logger.Printf("   Public URL: %s", f.PublicURL)
+		case m.label == "":
+			logger.Printf("✅ %s forwarded on remote port %d (host %s.<zone>)", m.addr, assignedPort, *username)
+		default:
+			logger.Printf("✅ %s forwarded on remote port %d (host %s.%s.<zone>)", m.addr, assignedPort, m.label, *username)
+		}
+	}
+
 	logger.Printf("✅ Tunnel established successfully!")
-	logger.Printf("   Remote port assigned by server: %d", assignedPort)
 	logger.Printf("   Press Ctrl+C to stop the client.")
 
 	// Set up a channel to listen for OS interrupt signals.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Block until a signal is received.
-	<-sigChan
-	logger.Println("🛑 Interrupt signal received. Shutting down...")
+	// Block until a signal is received or the connection is lost, e.g. when a
+	// keepalive goes unanswered. A lost connection exits non-zero so a
+	// supervisor can restart the client.
+	select {
+	case <-sigChan:
+	case <-client.Done():
+		if client.ServerShutdown() {
+			logger.Fatalf("❌ Server %s shut down", *serverAddr)
+		}
+		logger.Fatalf("❌ Connection to %s lost", *serverAddr)
+	}
+	logger.Println("🛑 Interrupt signal received. Shutting down... (press Ctrl+C again to force exit)")
+
+	go func() {
+		<-sigChan
+		logger.Println("🛑 Second interrupt received. Forcing exit.")
+		os.Exit(1)
+	}()
 
 	// Close the client connection gracefully.
 	if err := client.Close(); err != nil {
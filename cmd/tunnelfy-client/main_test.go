@@ -0,0 +1,46 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLocalFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    localFlags
+		wantErr bool
+	}{
+		{name: "address", values: []string{"localhost:3000"}, want: localFlags{{addr: "localhost:3000"}}},
+		{
+			name:   "repeated",
+			values: []string{"app=localhost:3000", "api=localhost:8080"},
+			want:   localFlags{{label: "app", addr: "localhost:3000"}, {label: "api", addr: "localhost:8080"}},
+		},
+		{
+			name:   "comma separated",
+			values: []string{"app=localhost:3000, localhost:8080"},
+			want:   localFlags{{label: "app", addr: "localhost:3000"}, {addr: "localhost:8080"}},
+		},
+		{name: "empty label", values: []string{"=localhost:3000"}, wantErr: true},
+		{name: "empty address", values: []string{"app="}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f localFlags
+			var err error
+			for _, v := range tt.values {
+				if err = f.Set(v); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(f, tt.want) {
+				t.Fatalf("got %v, want %v", f, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 
@@ -8,7 +9,10 @@ import (
 )
 
 func main() {
-	application, err := app.New()
+	configPath := flag.String("config", "", "Path of a YAML config file; environment variables override its settings")
+	flag.Parse()
+
+	application, err := app.New(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize application: %v", err)
 	}
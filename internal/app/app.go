@@ -2,130 +2,840 @@ package app
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"golang.org/x/crypto/acme/autocert"
+
+	"tunnelfy/internal/certs"
 	"tunnelfy/internal/config"
+	"tunnelfy/internal/fdlimit"
+	tlog "tunnelfy/internal/log"
+	"tunnelfy/internal/metrics"
 	"tunnelfy/internal/proxy"
+	"tunnelfy/internal/proxyproto"
 	"tunnelfy/internal/ssh"
 )
 
 // App represents the Tunnelfy application.
 type App struct {
 	cfg        *config.Config
+	log        *slog.Logger
 	manager    *proxy.ShardedRouteManager
 	sshServer  *ssh.SSHServer
-	httpServer *http.Server
+	httpServer *http.Server // nil when the HTTP proxy is disabled
+
+	// httpsServer serves the proxy over TLS with ACME certificates: a DNS-01
+	// wildcard certificate from certManager, or per-host certificates from
+	// hostCerts. It is nil unless ACME is configured, and so are both managers
+	// but the one in use.
+	httpsServer *http.Server
+	certManager *certs.DNSManager
+	hostCerts   *autocert.Manager
+
+	// redirectServer redirects plain HTTP to HTTPS; nil unless
+	// HTTPS_REDIRECT_LISTEN is set.
+	redirectServer *http.Server
+
+	// adminServer serves the admin API, /metrics and /readyz apart from the
+	// proxy; nil unless ADMIN_LISTEN is set, in which case the proxy's
+	// listeners serve nothing else.
+	adminServer *http.Server
+
+	// proxyTrusted are the peers whose PROXY protocol headers are honoured;
+	// empty disables PROXY protocol.
+	proxyTrusted []*net.IPNet
+
+	// adminAPI are the patterns of the mounted admin endpoints, each of which
+	// the OpenAPI spec describes.
+	adminAPI []string
 }
 
-// New creates a new App instance.
-func New() (*App, error) {
-	cfg, err := config.Load()
+// New creates a new App instance, configured by the environment and the
+// optional YAML config file at configPath.
+func New(configPath string) (*App, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	logger, err := newLogger(cfg)
 	if err != nil {
 		return nil, err
 	}
+	// Packages without a logger of their own, and the standard log package,
+	// log through the default logger.
+	slog.SetDefault(logger)
 
-	manager := proxy.NewShardedRouteManager(cfg.LogRequests)
+	securityHeaders, err := proxy.ParseSecurityHeaders(cfg.SecurityHeaders)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "SECURITY_HEADERS: " + err.Error()}
+	}
+
+	routeLabeler, err := proxy.ParseRouteLabeler(cfg.MetricsRouteLabel, cfg.Zone, cfg.MetricsHostBuckets)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "METRICS_ROUTE_LABEL: " + err.Error()}
+	}
 
-	authKeys, err := ssh.LoadAuthorizedKeys(cfg.AuthorizedKeys)
+	trustedProxies, err := proxyproto.ParseTrusted(cfg.TrustedProxies)
 	if err != nil {
-		return nil, err // Or wrap the error for more context
+		return nil, &config.ConfigError{Message: "TRUSTED_PROXIES: " + err.Error()}
 	}
 
-	sshSrv := ssh.NewSSHServer(authKeys, cfg.Zone, manager, cfg.LogRequests)
+	var maintenancePage string
+	if cfg.MaintenancePage != "" {
+		page, err := os.ReadFile(cfg.MaintenancePage)
+		if err != nil {
+			return nil, &config.ConfigError{Message: "MAINTENANCE_PAGE: " + err.Error()}
+		}
+		maintenancePage = string(page)
+	}
+
+	// Routes to any of the proxy's own listeners would loop.
+	listenAddrs := []string{cfg.HTTPListen, cfg.AdminListen}
+	if cfg.ACMEEnabled || cfg.ACMEDNSProvider != "" {
+		listenAddrs = append(listenAddrs, cfg.HTTPSListen)
+	}
+	if cfg.HTTPSRedirectListen != "" {
+		listenAddrs = append(listenAddrs, cfg.HTTPSRedirectListen)
+	}
+
+	manager, err := proxy.NewShardedRouteManager(proxy.DefaultRouteShards, cfg.LogRequests, proxy.Options{
+		Logger:          logger,
+		PrewarmConns:    cfg.ProxyPrewarmConns,
+		SecurityHeaders: securityHeaders,
+		ListenAddrs:     listenAddrs,
+		WarmupGrace:     cfg.RouteWarmupGrace,
+		RouteLabeler:    routeLabeler,
+		ExposeUpstream:  cfg.ExposeUpstream,
+		PreserveHost:    cfg.PreserveHost,
+		RequestTimeout:  cfg.RequestTimeout,
+		Transport: proxy.TransportOptions{
+			DialTimeout:           cfg.ProxyDialTimeout,
+			IdleConnTimeout:       cfg.ProxyIdleConnTimeout,
+			TLSHandshakeTimeout:   cfg.ProxyTLSHandshakeTimeout,
+			ResponseHeaderTimeout: cfg.ProxyResponseHeaderTimeout,
+		},
+		AccessLog: proxy.AccessLogOptions{
+			Enabled:       cfg.AccessLog,
+			SampleRate:    cfg.AccessLogSampleRate,
+			SlowThreshold: cfg.AccessLogSlow,
+		},
+		MaintenancePage: maintenancePage,
+		TrustedProxies:  trustedProxies,
+		RateLimit: proxy.RateLimitOptions{
+			RPS:   cfg.RateLimitRPS,
+			Burst: cfg.RateLimitBurst,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Not ready until Start has bound every listener; see Start.
+	manager.SetReady(false)
+	if cfg.MaintenanceMode {
+		manager.SetMaintenance(proxy.Maintenance{
+			Hosts:      cfg.MaintenanceHosts,
+			Users:      cfg.MaintenanceUsers,
+			RetryAfter: int(cfg.MaintenanceRetryAfter / time.Second),
+		})
+	}
+
+	if err := manager.SetDefaultRoute(cfg.DefaultUpstream); err != nil {
+		return nil, &config.ConfigError{Message: "DEFAULT_UPSTREAM: " + err.Error()}
+	}
+	for _, spec := range cfg.ZoneDefaultUpstreams {
+		zone, target, ok := strings.Cut(spec, "=")
+		if !ok || zone == "" || target == "" {
+			return nil, &config.ConfigError{Message: "ZONE_DEFAULT_UPSTREAMS: entries must be zone=upstream, got " + strconv.Quote(spec)}
+		}
+		if err := manager.SetZoneDefaultRoute(zone, target); err != nil {
+			return nil, &config.ConfigError{Message: "ZONE_DEFAULT_UPSTREAMS: " + err.Error()}
+		}
+	}
+
+	proxyTrusted, err := proxyproto.ParseTrusted(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "PROXY_PROTOCOL_TRUSTED: " + err.Error()}
+	}
+
+	// The HTTP proxy is optional too: without it tunnels are raw TCP only.
+	if !cfg.HTTPEnabled {
+		switch {
+		case !cfg.SSHEnabled:
+			return nil, &config.ConfigError{Message: "SSH_ENABLED and HTTP_ENABLED can't both be false"}
+		case cfg.TCPListenHost == "":
+			return nil, &config.ConfigError{Message: "HTTP_ENABLED=false requires TCP_TUNNEL_LISTEN_HOST"}
+		case cfg.TLSCertFile != "" || cfg.ACMEEnabled || cfg.ACMEDNSProvider != "" || cfg.HTTPSRedirectListen != "":
+			return nil, &config.ConfigError{Message: "TLS_CERT, ACME and HTTPS_REDIRECT_LISTEN require HTTP_ENABLED"}
+		}
+	}
+
+	// The SSH server is optional: without it tunnelfy is a plain edge proxy
+	// serving admin-registered routes and the default upstream.
+	var sshSrv *ssh.SSHServer
+	var reservations *ssh.Reservations
+	if cfg.SSHEnabled {
+		reservations, err = ssh.NewReservations(cfg.ReservedSubdomains, cfg.ReservationsFile)
+		if err != nil {
+			return nil, &config.ConfigError{Message: "RESERVED_SUBDOMAINS: " + err.Error()}
+		}
+		if sshSrv, err = newSSHServer(cfg, logger, manager, reservations); err != nil {
+			return nil, err
+		}
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", proxy.FastProxyHandler(manager, cfg.Zone))
-	mux.HandleFunc("/api/routes", proxy.RoutesAPIHandler(manager)) // Note: RoutesAPIHandler should be exported
+	mux.Handle("/", proxy.Instrument(proxy.Recover(proxy.FastProxyHandler(manager, append([]string{cfg.Zone}, cfg.ExtraZones...)...))))
+	// With ADMIN_LISTEN the public listeners carry nothing but the proxy, so
+	// no routing mistake can expose the admin endpoints to tunnel traffic.
+	// Without it they share the public listeners, but only on the zone apex,
+	// which the proxy never routes, so they can't shadow a tunnel's paths.
+	adminMux := mux
+	adminHost := strings.ToLower(strings.TrimSuffix(cfg.Zone, "."))
+	if cfg.AdminListen != "" {
+		adminMux = http.NewServeMux()
+		adminHost = ""
+	}
+	var adminAPI []string
+	handle := func(pattern string, h http.Handler) {
+		adminAPI = append(adminAPI, pattern)
+		adminMux.Handle(adminHost+pattern, h)
+	}
+	handle("/metrics", metrics.Default.Handler())
+	handle("/readyz", proxy.ReadyHandler(manager))
+
+	// The admin API is only mounted behind a token; without one its paths are
+	// served by the proxy like any other, so route tables never leak.
+	if cfg.AdminToken != "" {
+		admin := func(pattern string, h http.Handler) {
+			handle(pattern, proxy.AdminAuth(cfg.AdminToken, h))
+		}
+		admin("/api/routes", proxy.RoutesAPIHandler(manager))
+		admin("/api/routes/export", proxy.RoutesExportHandler(manager))
+		admin("/api/routes/import", proxy.RoutesImportHandler(manager))
+		admin("/api/routes/{host}", proxy.RouteAPIHandler(manager))
+		admin("/api/routes/{host}/debug", proxy.RouteDebugAPIHandler(manager))
+		admin("/api/routes/{host}/bandwidth", proxy.RouteBandwidthAPIHandler(manager))
+		admin("/api/routes/{host}/token", proxy.RouteTokenAPIHandler(manager))
+		admin("/api/maintenance", proxy.MaintenanceAPIHandler(manager))
+		admin("/api/stats", statsHandler(manager, sshSrv, time.Now()))
+		admin("/api/events", proxy.EventsAPIHandler(manager))
+		if reservations != nil {
+			admin("/api/reservations", ssh.ReservationsAPIHandler(reservations))
+			admin("/api/reservations/{name}", ssh.ReservationAPIHandler(reservations))
+		}
+		if !cfg.PublicOpenAPI {
+			admin("/api/openapi.json", proxy.OpenAPIHandler())
+		}
+	} else if cfg.HTTPEnabled || cfg.AdminListen != "" {
+		logger.Warn("ADMIN_TOKEN is not set; the admin API is disabled")
+	}
+	// The spec itself holds nothing sensitive; operators can opt into serving it unauthenticated.
+	if cfg.PublicOpenAPI {
+		handle("/api/openapi.json", proxy.OpenAPIHandler())
+	}
+
+	a := &App{
+		cfg:       cfg,
+		log:       logger,
+		manager:   manager,
+		sshServer: sshSrv,
+
+		proxyTrusted: proxyTrusted,
+		adminAPI:     adminAPI,
+	}
+	if cfg.AdminListen != "" {
+		a.adminServer = &http.Server{
+			Addr:     cfg.AdminListen,
+			Handler:  adminMux,
+			ErrorLog: newServerErrorLog(logger, "admin"),
+		}
+	}
+	if !cfg.HTTPEnabled {
+		return a, nil
+	}
 
 	httpServer := &http.Server{
-		Addr:    cfg.HTTPListen,
-		Handler: mux,
+		Addr:     cfg.HTTPListen,
+		Handler:  mux,
+		ErrorLog: newServerErrorLog(logger, "http"),
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, &config.ConfigError{Message: "TLS_CERT and TLS_KEY must be set together"}
+	}
+	if cfg.ACMEEnabled && cfg.ACMEDNSProvider != "" {
+		return nil, &config.ConfigError{Message: "ACME_ENABLED and ACME_DNS_PROVIDER are mutually exclusive"}
 	}
+	if cfg.TLSCertFile != "" {
+		if cfg.ACMEDNSProvider != "" || cfg.ACMEEnabled {
+			return nil, &config.ConfigError{Message: "TLS_CERT and ACME are mutually exclusive"}
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, &config.ConfigError{Message: "TLS_CERT/TLS_KEY: " + err.Error()}
+		}
+		httpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	a.httpServer = httpServer
 
-	return &App{
-		cfg:        cfg,
-		manager:    manager,
-		sshServer:  sshSrv,
-		httpServer: httpServer,
-	}, nil
+	if cfg.ACMEDNSProvider != "" {
+		if a.certManager, err = newCertManager(cfg); err != nil {
+			return nil, err
+		}
+		a.httpsServer = &http.Server{
+			Addr:      cfg.HTTPSListen,
+			Handler:   mux,
+			TLSConfig: &tls.Config{GetCertificate: a.certManager.GetCertificate},
+			ErrorLog:  newServerErrorLog(logger, "https"),
+		}
+	}
+	if cfg.ACMEEnabled {
+		a.hostCerts = certs.NewHostManager(certs.HostConfig{
+			Zones:        append([]string{cfg.Zone}, cfg.ExtraZones...),
+			DirectoryURL: cfg.ACMEDirectoryURL,
+			Email:        cfg.ACMEEmail,
+			CacheDir:     cfg.ACMECacheDir,
+		})
+		a.httpsServer = &http.Server{
+			Addr:      cfg.HTTPSListen,
+			Handler:   mux,
+			TLSConfig: a.hostCerts.TLSConfig(),
+			ErrorLog:  newServerErrorLog(logger, "https"),
+		}
+		// HTTP-01 challenges arrive on the plain HTTP listener.
+		httpServer.Handler = a.hostCerts.HTTPHandler(mux)
+	}
+	if cfg.HTTPSRedirectListen != "" {
+		// Redirect to whichever listener serves TLS.
+		var tlsListen string
+		switch {
+		case httpServer.TLSConfig != nil:
+			tlsListen = cfg.HTTPListen
+		case a.httpsServer != nil:
+			tlsListen = cfg.HTTPSListen
+		default:
+			return nil, &config.ConfigError{Message: "HTTPS_REDIRECT_LISTEN requires TLS_CERT/TLS_KEY or ACME_DNS_PROVIDER"}
+		}
+		redirect := httpsRedirectHandler(listenPort(tlsListen))
+		if a.hostCerts != nil {
+			redirect = a.hostCerts.HTTPHandler(redirect)
+		}
+		a.redirectServer = &http.Server{
+			Addr:     cfg.HTTPSRedirectListen,
+			Handler:  redirect,
+			ErrorLog: newServerErrorLog(logger, "redirect"),
+		}
+	}
+	return a, nil
 }
 
-// Start starts the SSH and HTTP servers.
-func (a *App) Start() error {
-	// Start SSH listener
-	sshListener, err := net.Listen("tcp", a.cfg.SSHListen)
+// newCertManager builds the ACME DNS-01 manager for a wildcard certificate
+// covering the zone and its subdomains.
+func newCertManager(cfg *config.Config) (*certs.DNSManager, error) {
+	provider, err := certs.NewDNSProvider(cfg.ACMEDNSProvider, cfg.ACMEDNSConfig)
 	if err != nil {
-		return err
+		return nil, &config.ConfigError{Message: "ACME_DNS_PROVIDER: " + err.Error()}
 	}
-	defer sshListener.Close()
-	if a.cfg.LogRequests {
-		log.Printf("SSH listening on %s", a.cfg.SSHListen)
+	return certs.NewDNSManager(certs.DNSConfig{
+		Domains:      []string{cfg.Zone, "*." + cfg.Zone},
+		Provider:     provider,
+		DirectoryURL: cfg.ACMEDirectoryURL,
+		Email:        cfg.ACMEEmail,
+		CacheDir:     cfg.ACMECacheDir,
+		Propagation:  cfg.ACMEDNSPropagation,
+	})
+}
+
+// newSSHServer builds the SSH tunnel server from the configuration.
+func newSSHServer(cfg *config.Config, logger *slog.Logger, manager *proxy.ShardedRouteManager, reservations *ssh.Reservations) (*ssh.SSHServer, error) {
+	authKeys, err := loadAuthorizedKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := ssh.ParsePortPolicy(cfg.AllowedPorts, cfg.DeniedPorts)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "TUNNEL_ALLOWED_PORTS/TUNNEL_DENIED_PORTS: " + err.Error()}
+	}
+
+	if cfg.SSHConnLimitPolicy != "reject" && cfg.SSHConnLimitPolicy != "evict" {
+		return nil, &config.ConfigError{Message: "SSH_CONN_LIMIT_POLICY must be reject or evict, got " + strconv.Quote(cfg.SSHConnLimitPolicy)}
+	}
+
+	if cfg.HostKeyPolicy != "ephemeral" && cfg.HostKeyPolicy != "strict" {
+		return nil, &config.ConfigError{Message: "HOST_KEY_POLICY must be ephemeral or strict, got " + strconv.Quote(cfg.HostKeyPolicy)}
+	}
+
+	if cfg.TunnelTTLMode != "absolute" && cfg.TunnelTTLMode != "sliding" {
+		return nil, &config.ConfigError{Message: "TUNNEL_TTL_MODE must be absolute or sliding, got " + strconv.Quote(cfg.TunnelTTLMode)}
+	}
+
+	qosClasses, err := ssh.ParseQoSClasses(cfg.QoSClasses)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "QOS_CLASSES: " + err.Error()}
+	}
+
+	requestTimeouts, err := ssh.ParseRequestTimeouts(cfg.RequestTimeouts)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "REQUEST_TIMEOUTS: " + err.Error()}
+	}
+
+	opts := ssh.ServerOptions{
+		Logger:                logger,
+		ForwardDeadline:       cfg.ForwardDeadline,
+		ConnIdleTimeout:       cfg.ConnIdleTimeout,
+		ConnIdleTimeoutExempt: cfg.ConnIdleTimeoutExempt,
+		MaxUserConns:          cfg.MaxUserConns,
+		MaxTunnelsPerUser:     cfg.MaxTunnelsPerUser,
+		MaxUserSSHConns:       cfg.MaxUserSSHConns,
+		EvictIdleSSHConns:     cfg.SSHConnLimitPolicy == "evict",
+		SniffProtocol:         cfg.SniffProtocol,
+		UpstreamPorts:         ports,
+		SerialRequests:        cfg.SSHSerialRequests,
+		Reservations:          reservations,
+		StrictHostKey:         cfg.HostKeyPolicy == "strict",
+		QoS: ssh.QoSOptions{
+			Classes:  qosClasses,
+			MaxConns: cfg.QoSMaxConns,
+			BulkRate: int64(cfg.QoSBulkRate),
+		},
+		RequestTimeouts: requestTimeouts,
+		ReconnectGrace:  cfg.ReconnectGrace,
+		TunnelTTL:       cfg.TunnelTTL,
+		SlidingTTL:      cfg.TunnelTTLMode == "sliding",
+		TCPListenHost:   cfg.TCPListenHost,
+		TCPOnly:         !cfg.HTTPEnabled,
+	}
+	if opts.PublicScheme, opts.PublicPort, err = publicURLParts(cfg); err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.HostKeyData != "" && cfg.HostKeyPath != "":
+		return nil, &config.ConfigError{Message: "HOST_KEY_DATA and HOST_KEY_PATH are mutually exclusive"}
+	case cfg.HostKeyData != "":
+		if opts.HostKey, err = ssh.ParseHostKey([]byte(cfg.HostKeyData)); err != nil {
+			return nil, &config.ConfigError{Message: "HOST_KEY_DATA: " + err.Error()}
+		}
+	case cfg.HostKeyPath != "":
+		if opts.HostKey, err = ssh.LoadOrCreateHostKey(cfg.HostKeyPath); err != nil {
+			return nil, &config.ConfigError{Message: "HOST_KEY_PATH: " + err.Error()}
+		}
+	}
+	if cfg.ForwardAuthWebhook != "" {
+		opts.ForwardAuthorizer = ssh.NewWebhookAuthorizer(cfg.ForwardAuthWebhook, cfg.ForwardAuthTimeout, cfg.ForwardAuthFailOpen)
+	}
+	if cfg.TrustedCAKeys != "" {
+		caKeys, err := ssh.LoadCAKeys(cfg.TrustedCAKeys)
+		if err != nil {
+			return nil, &config.ConfigError{Message: "TRUSTED_CA_KEYS: " + indentErrors(err)}
+		}
+		opts.Authenticators = append(opts.Authenticators, ssh.NewCertAuthenticator(caKeys))
+	}
+
+	sshSrv, err := ssh.NewSSHServer(authKeys, cfg.Zone, manager, cfg.LogRequests, opts)
+	if errors.Is(err, ssh.ErrNoAuthConfigured) {
+		return nil, &config.ConfigError{Message: "AUTHORIZED_KEYS_DATA, AUTHORIZED_KEYS_FILE or TRUSTED_CA_KEYS must be set (newline-separated public keys)"}
+	}
+	if errors.Is(err, ssh.ErrNoHostKey) {
+		return nil, &config.ConfigError{Message: "HOST_KEY_POLICY=strict requires HOST_KEY_DATA or HOST_KEY_PATH"}
+	}
+	return sshSrv, err
+}
+
+// loadAuthorizedKeys reads the keys of AUTHORIZED_KEYS_DATA and
+// AUTHORIZED_KEYS_FILE together.
+func loadAuthorizedKeys(cfg *config.Config) (map[string]ssh.AuthorizedKey, error) {
+	keys, err := ssh.LoadAuthorizedKeys(cfg.AuthorizedKeys)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "AUTHORIZED_KEYS_DATA: " + indentErrors(err)}
+	}
+	if cfg.AuthorizedKeysFile == "" {
+		return keys, nil
+	}
+	fileKeys, err := ssh.LoadAuthorizedKeysFile(cfg.AuthorizedKeysFile)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "AUTHORIZED_KEYS_FILE " + cfg.AuthorizedKeysFile + ": " + indentErrors(err)}
+	}
+	for k, v := range fileKeys {
+		keys[k] = v
 	}
+	return keys, nil
+}
+
+// indentErrors formats err, putting each error of a joined one on its own
+// indented line.
+func indentErrors(err error) string {
+	msg := err.Error()
+	if !strings.Contains(msg, "\n") {
+		return msg
+	}
+	return "\n\t" + strings.ReplaceAll(msg, "\n", "\n\t")
+}
+
+// newLogger builds the logger configured by LOG_FORMAT and LOG_LEVEL. Without
+// LOG_LEVEL, request logging (LOG_REQUESTS) is enabled by logging at level
+// debug.
+func newLogger(cfg *config.Config) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if cfg.LogLevel != "" {
+		var err error
+		if level, err = tlog.ParseLevel(cfg.LogLevel); err != nil {
+			return nil, &config.ConfigError{Message: "LOG_LEVEL: " + err.Error()}
+		}
+	} else if cfg.LogRequests {
+		level = slog.LevelDebug
+	}
+	logger, err := tlog.New(os.Stderr, cfg.LogFormat, level)
+	if err != nil {
+		return nil, &config.ConfigError{Message: "LOG_FORMAT: " + err.Error()}
+	}
+	return logger, nil
+}
 
+// fatal logs a server error that leaves the app unable to serve, and exits.
+func (a *App) fatal(msg string, err error) {
+	a.log.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// Start starts the SSH and HTTP servers.
+func (a *App) Start() error {
+	// Start SSH listener, unless the SSH server is disabled.
+	var sshListener net.Listener
 	sshDone := make(chan struct{})
-	go func() {
-		defer close(sshDone)
-		for {
-			nConn, err := sshListener.Accept()
-			if err != nil {
-				// If listener closed, exit accept loop
-				if ne, ok := err.(net.Error); ok && ne.Temporary() {
-					log.Printf("temporary ssh accept error: %v", err)
-					time.Sleep(100 * time.Millisecond)
-					continue
-				}
-				// Permanent error -> break
-				if a.cfg.LogRequests {
-					log.Printf("ssh accept error: %v", err)
-				}
-				return
-			}
-			// Handle connection in background
-			go a.sshServer.HandleConn(nConn) // HandleConn should be exported
+	if a.sshServer == nil {
+		close(sshDone)
+	} else {
+		var err error
+		sshListener, err = a.listen(a.cfg.SSHListen)
+		if err != nil {
+			return err
 		}
-	}()
+		defer sshListener.Close()
+		if a.cfg.LogRequests {
+			a.log.Info("SSH listening", "addr", a.cfg.SSHListen)
+		}
+		go a.acceptSSH(sshListener, sshDone)
+	}
 
-	// Start HTTP server
+	// Start HTTP server, unless the HTTP proxy is disabled. The listener is
+	// bound here rather than in the goroutine so readiness is only reported
+	// once it accepts connections.
 	httpDone := make(chan struct{})
-	go func() {
-		defer close(httpDone)
-		if a.cfg.LogRequests {
-			log.Printf("HTTP proxy listening on %s", a.cfg.HTTPListen)
+	if a.httpServer == nil {
+		close(httpDone)
+	} else {
+		httpListener, err := a.listen(a.cfg.HTTPListen)
+		if err != nil {
+			return err
 		}
-		if err := a.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("http server error: %v", err) // Consider returning error instead of fatal
+		go a.serveHTTP(httpListener, httpDone)
+	}
+
+	// Start the HTTP to HTTPS redirect, if configured.
+	redirectDone := make(chan struct{})
+	if a.redirectServer == nil {
+		close(redirectDone)
+	} else {
+		redirectListener, err := a.listen(a.cfg.HTTPSRedirectListen)
+		if err != nil {
+			return err
 		}
-	}()
+		go func() {
+			defer close(redirectDone)
+			if a.cfg.LogRequests {
+				a.log.Info("HTTPS redirect listening", "addr", a.cfg.HTTPSRedirectListen)
+			}
+			if err := a.redirectServer.Serve(redirectListener); err != nil && err != http.ErrServerClosed {
+				a.fatal("https redirect server error", err)
+			}
+		}()
+	}
+
+	// Start the HTTPS server and, for DNS-01, certificate renewal, if ACME is
+	// configured; per-host certificates are issued and renewed on demand.
+	httpsDone := make(chan struct{})
+	if a.httpsServer == nil {
+		close(httpsDone)
+	} else {
+		httpsListener, err := a.listen(a.cfg.HTTPSListen)
+		if err != nil {
+			return err
+		}
+		if a.certManager != nil {
+			certCtx, stopCerts := context.WithCancel(context.Background())
+			defer stopCerts()
+			go a.certManager.Run(certCtx)
+		}
+		go func() {
+			defer close(httpsDone)
+			if a.cfg.LogRequests {
+				a.log.Info("HTTPS proxy listening", "addr", a.cfg.HTTPSListen)
+			}
+			if err := a.httpsServer.ServeTLS(httpsListener, "", ""); err != nil && err != http.ErrServerClosed {
+				a.fatal("https server error", err)
+			}
+		}()
+	}
+
+	// Start the admin listener, if configured.
+	adminDone := make(chan struct{})
+	if a.adminServer == nil {
+		close(adminDone)
+	} else {
+		adminListener, err := a.listen(a.cfg.AdminListen)
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer close(adminDone)
+			if a.cfg.LogRequests {
+				a.log.Info("admin API listening", "addr", a.cfg.AdminListen)
+			}
+			if err := a.adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				a.fatal("admin server error", err)
+			}
+		}()
+	}
+
+	// Start the control socket, if configured.
+	if a.cfg.ControlSocket != "" {
+		controlListener, err := listenControl(a.cfg.ControlSocket)
+		if err != nil {
+			return err
+		}
+		defer controlListener.Close()
+		if a.cfg.LogRequests {
+			a.log.Info("control socket listening", "path", a.cfg.ControlSocket)
+		}
+		go func() {
+			if err := proxy.ServeControl(controlListener, a.manager); err != nil {
+				a.log.Error("control socket error", "err", err)
+			}
+		}()
+	}
+
+	// Reap tunnels idle for longer than TUNNEL_IDLE_TIMEOUT.
+	if a.cfg.TunnelIdleTimeout > 0 {
+		reapCtx, stopReaper := context.WithCancel(context.Background())
+		defer stopReaper()
+		go a.reapIdleTunnels(reapCtx, a.cfg.TunnelIdleTimeout)
+	}
+
+	// Every listener is bound and the host key loaded: start routing traffic,
+	// after the optional warmup that lets clients reconnect their tunnels.
+	if a.cfg.StartupWarmup > 0 {
+		time.AfterFunc(a.cfg.StartupWarmup, func() { a.manager.SetReady(true) })
+	} else {
+		a.manager.SetReady(true)
+	}
 
 	// Wait for shutdown signal
-	a.waitForShutdown(sshListener, sshDone, httpDone)
+	a.waitForShutdown(sshListener, sshDone, httpDone, httpsDone, redirectDone, adminDone)
 
-	log.Println("shutdown complete")
+	a.log.Info("shutdown complete")
 	return nil
 }
 
+// serveHTTP serves the HTTP proxy on httpListener, over TLS if it has a
+// certificate, until the server is shut down, then closes done.
+func (a *App) serveHTTP(httpListener net.Listener, done chan struct{}) {
+	defer close(done)
+	if a.httpServer.TLSConfig != nil {
+		if a.cfg.LogRequests {
+			a.log.Info("HTTPS proxy listening", "addr", a.cfg.HTTPListen)
+		}
+		if err := a.httpServer.ServeTLS(httpListener, "", ""); err != nil && err != http.ErrServerClosed {
+			a.fatal("https server error", err)
+		}
+		return
+	}
+	if a.cfg.LogRequests {
+		a.log.Info("HTTP proxy listening", "addr", a.cfg.HTTPListen)
+	}
+	if err := a.httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
+		a.fatal("http server error", err)
+	}
+}
+
+// reapIdleTunnels evicts tunnels idle for longer than maxIdle until ctx is
+// done, checking several times per timeout so a tunnel outlives it by at most
+// a fraction of it.
+func (a *App) reapIdleTunnels(ctx context.Context, maxIdle time.Duration) {
+	interval := max(maxIdle/4, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		a.manager.ReapIdle(maxIdle)
+	}
+}
+
+// listen listens on the TCP address addr, reading PROXY protocol headers
+// from trusted load balancers if any are configured.
+func (a *App) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l = fdlimit.NewListener(l)
+	if len(a.proxyTrusted) == 0 {
+		return l, nil
+	}
+	return proxyproto.NewListener(l, a.proxyTrusted), nil
+}
+
+// listenControl listens on the control socket at path, restricting it to the
+// owner since it grants full admin access. A socket file left behind by a
+// crashed run is removed; one still served by another instance is an error.
+func listenControl(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil && errors.Is(err, syscall.EADDRINUSE) {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		l, err = net.Listen("unix", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the unix socket at path unless another process
+// still accepts connections on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("control socket %s: file exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("control socket %s is in use by another instance", path)
+	}
+	slog.Info("removing stale control socket", "path", path)
+	return os.Remove(path)
+}
+
+// acceptSSH accepts SSH connections until the listener is closed, then closes done.
+func (a *App) acceptSSH(sshListener net.Listener, done chan struct{}) {
+	defer close(done)
+	for {
+		nConn, err := sshListener.Accept()
+		if err != nil {
+			// If listener closed, exit accept loop
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				a.log.Warn("temporary ssh accept error", "err", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			// Permanent error -> break
+			if a.cfg.LogRequests {
+				a.log.Debug("ssh accept error", "err", err)
+			}
+			return
+		}
+		// Handle connection in background
+		go a.sshServer.HandleConn(nConn) // HandleConn should be exported
+	}
+}
+
+// reloadAuthorizedKeys re-reads the authorized keys on SIGHUP, picking up
+// changes to AUTHORIZED_KEYS_FILE. The current keys are kept if the new ones
+// can't be loaded.
+func (a *App) reloadAuthorizedKeys() {
+	if a.sshServer == nil {
+		a.log.Warn("SIGHUP: SSH server disabled; no authorized keys to reload")
+		return
+	}
+	keys, err := loadAuthorizedKeys(a.cfg)
+	if err == nil {
+		err = a.sshServer.SetAuthorizedKeys(keys)
+	}
+	if err != nil {
+		a.log.Error("SIGHUP: keeping the current authorized keys", "err", err)
+		return
+	}
+	a.log.Info("SIGHUP: reloaded authorized keys", "keys", len(keys))
+}
+
 // waitForShutdown handles OS signals for graceful shutdown.
-func (a *App) waitForShutdown(sshListener net.Listener, sshDone, httpDone chan struct{}) {
+func (a *App) waitForShutdown(sshListener net.Listener, sshDone, httpDone, httpsDone, redirectDone, adminDone chan struct{}) {
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	sig := <-sigCh
-	log.Printf("signal received: %v; shutting down", sig)
+	for ; sig == syscall.SIGHUP; sig = <-sigCh {
+		a.reloadAuthorizedKeys()
+	}
+	a.log.Info("signal received; shutting down (signal again to force exit)", "signal", sig.String())
+
+	// Keep listening so an impatient second signal can cut a slow shutdown short.
+	go func() {
+		for sig := range sigCh {
+			if sig != syscall.SIGHUP {
+				a.log.Warn("second signal received; forcing exit", "signal", sig.String())
+				os.Exit(1)
+			}
+		}
+	}()
 
 	// Close SSH listener to stop accept loop
-	sshListener.Close()
+	if sshListener != nil {
+		sshListener.Close()
+	}
+
+	// Event streams never go idle, so Shutdown would wait them out until its
+	// deadline.
+	a.manager.CloseEvents()
 
 	// Shutdown HTTP server with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_ = a.httpServer.Shutdown(ctx)
+	if a.httpServer != nil {
+		_ = a.httpServer.Shutdown(ctx)
+	}
+	if a.httpsServer != nil {
+		_ = a.httpsServer.Shutdown(ctx)
+	}
+	if a.redirectServer != nil {
+		_ = a.redirectServer.Shutdown(ctx)
+	}
+	if a.adminServer != nil {
+		_ = a.adminServer.Shutdown(ctx)
+	}
+
+	// Drain the SSH connections once the HTTP servers no longer use their
+	// tunnels, so clients see a clean disconnect rather than a reset.
+	if a.sshServer != nil {
+		drainCtx, cancelDrain := context.WithTimeout(context.Background(), a.cfg.SSHDrainTimeout)
+		defer cancelDrain()
+		_ = a.sshServer.Shutdown(drainCtx)
+	}
 
 	// Wait for goroutines to finish
 	<-sshDone
 	<-httpDone
+	<-httpsDone
+	<-redirectDone
+	<-adminDone
 }
@@ -0,0 +1,618 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"tunnelfy/internal/config"
+	"tunnelfy/internal/proxy"
+)
+
+// newTestApp builds an App without the SSH server from env, which is applied
+// on top of ZONE=tunnelfy.test.
+func newTestApp(t *testing.T, env map[string]string) *App {
+	t.Helper()
+	t.Setenv("ZONE", "tunnelfy.test")
+	t.Setenv("SSH_ENABLED", "false")
+	t.Setenv("LOG_REQUESTS", "false")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	a, err := New("")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	a.manager.SetReady(true)
+	return a
+}
+
+// serve sends a GET for host and path to h and returns the status and body.
+func serve(h http.Handler, host, path string) (int, string) {
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body, _ := io.ReadAll(rec.Result().Body)
+	return rec.Code, string(body)
+}
+
+func TestAdminEndpointsDontShadowTunnels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "app "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name      string
+		host      string
+		path      string
+		wantCode  int
+		wantBody  string
+		adminOnly bool
+	}{
+		{name: "tunnel metrics", host: "alice.tunnelfy.test", path: "/metrics", wantCode: http.StatusOK, wantBody: "app /metrics"},
+		{name: "tunnel readyz", host: "alice.tunnelfy.test", path: "/readyz", wantCode: http.StatusOK, wantBody: "app /readyz"},
+		{name: "tunnel api", host: "alice.tunnelfy.test", path: "/api/routes", wantCode: http.StatusOK, wantBody: "app /api/routes"},
+		{name: "apex metrics", host: "tunnelfy.test:8080", path: "/metrics", wantCode: http.StatusOK, wantBody: "tunnelfy_", adminOnly: true},
+		{name: "apex readyz", host: "tunnelfy.test", path: "/readyz", wantCode: http.StatusOK, adminOnly: true},
+		{name: "apex api", host: "tunnelfy.test", path: "/api/routes", wantCode: http.StatusUnauthorized, adminOnly: true},
+	}
+	for _, adminListen := range []string{"", "127.0.0.1:0"} {
+		a := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "ADMIN_LISTEN": adminListen})
+		if err := a.manager.AddRoute("alice.tunnelfy.test", upstream.URL); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			t.Run(tt.name+" admin_listen="+adminListen, func(t *testing.T) {
+				h := a.httpServer.Handler
+				if tt.adminOnly && adminListen != "" {
+					// The public listener serves nothing but the proxy, which
+					// refuses the apex.
+					if code, _ := serve(h, tt.host, tt.path); code != http.StatusBadRequest {
+						t.Errorf("public listener: got %d, want 400", code)
+					}
+					h = a.adminServer.Handler
+				}
+				code, body := serve(h, tt.host, tt.path)
+				if code != tt.wantCode || !strings.Contains(body, tt.wantBody) {
+					t.Errorf("got %d %q, want %d containing %q", code, body, tt.wantCode, tt.wantBody)
+				}
+			})
+		}
+	}
+}
+
+// authorizedKey returns a freshly generated public key in authorized_keys format.
+func authorizedKey(t *testing.T) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(gossh.MarshalAuthorizedKey(key))
+}
+
+func TestOpenAPISpecCoversAdminAPI(t *testing.T) {
+	for _, public := range []string{"false", "true"} {
+		t.Run("admin_openapi_public="+public, func(t *testing.T) {
+			a := newTestApp(t, map[string]string{
+				"ADMIN_TOKEN":          "secret",
+				"ADMIN_OPENAPI_PUBLIC": public,
+				"SSH_ENABLED":          "true",
+				"AUTHORIZED_KEYS_DATA": authorizedKey(t),
+			})
+			req := httptest.NewRequest(http.MethodGet, "http://tunnelfy.test/api/openapi.json", nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			a.httpServer.Handler.ServeHTTP(rec, req)
+			var spec struct {
+				Paths map[string]any `json:"paths"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+				t.Fatalf("GET /api/openapi.json: %d %v", rec.Code, err)
+			}
+
+			mounted := make(map[string]bool)
+			for _, pattern := range a.adminAPI {
+				mounted[pattern] = true
+				if _, ok := spec.Paths[pattern]; !ok {
+					t.Errorf("%s is mounted but missing from the spec", pattern)
+				}
+			}
+			for path := range spec.Paths {
+				if !mounted[path] {
+					t.Errorf("%s is in the spec but not mounted", path)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminAPIToken(t *testing.T) {
+	tests := []struct {
+		name, token, header string
+		want                int
+	}{
+		{"authorized", "secret", "Bearer secret", http.StatusOK},
+		{"unauthorized", "secret", "Bearer wrong", http.StatusUnauthorized},
+		{"missing", "secret", "", http.StatusUnauthorized},
+		// Without a token the API isn't mounted, and the proxy refuses the apex.
+		{"unconfigured", "", "Bearer ", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, map[string]string{"ADMIN_TOKEN": tt.token})
+			req := httptest.NewRequest(http.MethodGet, "http://tunnelfy.test/api/routes", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			a.httpServer.Handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestRoutesToOwnListenersAreRejected(t *testing.T) {
+	a := newTestApp(t, map[string]string{
+		"HTTP_LISTEN":           "127.0.0.1:18080",
+		"ADMIN_LISTEN":          "127.0.0.1:18090",
+		"ACME_ENABLED":          "true",
+		"ACME_CACHE_DIR":        t.TempDir(),
+		"HTTPS_LISTEN":          "127.0.0.1:18443",
+		"HTTPS_REDIRECT_LISTEN": "127.0.0.1:18081",
+	})
+	for _, target := range []string{"127.0.0.1:18080", "127.0.0.1:18090", "127.0.0.1:18443", "127.0.0.1:18081"} {
+		if err := a.manager.AddRoute("app.tunnelfy.test", target); !errors.Is(err, proxy.ErrSelfUpstream) {
+			t.Errorf("AddRoute to %s: err = %v, want ErrSelfUpstream", target, err)
+		}
+	}
+}
+
+func TestSSHAuthSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "static keys", env: map[string]string{"AUTHORIZED_KEYS_DATA": authorizedKey(t)}},
+		{name: "CA without static keys", env: map[string]string{"TRUSTED_CA_KEYS": authorizedKey(t)}},
+		{name: "neither", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ZONE", "tunnelfy.test")
+			t.Setenv("SSH_ENABLED", "true")
+			t.Setenv("AUTHORIZED_KEYS_DATA", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := New("")
+			var cfgErr *config.ConfigError
+			if tt.wantErr && !errors.As(err, &cfgErr) {
+				t.Fatalf("New: err = %v, want a ConfigError", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("New: %v", err)
+			}
+		})
+	}
+}
+
+func TestSingleBackendMode(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	a := newTestApp(t, map[string]string{
+		"SSH_ENABLED":          "false",
+		"AUTHORIZED_KEYS_DATA": "",
+		"DEFAULT_UPSTREAM":     backend.Listener.Addr().String(),
+	})
+	if a.sshServer != nil {
+		t.Fatal("SSH server configured with SSH_ENABLED=false")
+	}
+	for _, host := range []string{"alice.tunnelfy.test", "api.bob.tunnelfy.test", "x.y.z.tunnelfy.test"} {
+		if status, body := serve(a.httpServer.Handler, host, "/"); status != http.StatusOK || body != "backend" {
+			t.Errorf("%s: got %d %q, want the backend", host, status, body)
+		}
+	}
+	if status, _ := serve(a.httpServer.Handler, "example.com", "/"); status == http.StatusOK {
+		t.Error("a host outside the zone reached the backend")
+	}
+}
+
+func TestListenControl(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, path string)
+		wantErr string
+	}{
+		{"fresh", func(t *testing.T, path string) {}, ""},
+		{"stale socket", func(t *testing.T, path string) {
+			// A crashed run leaves its socket file behind.
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			l.Close()
+		}, ""},
+		{"running instance", func(t *testing.T, path string) {
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					c.Close()
+				}
+			}()
+		}, "in use by another instance"},
+		{"not a socket", func(t *testing.T, path string) {
+			if err := os.WriteFile(path, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, "not a socket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "control.sock")
+			tt.prepare(t, path)
+			l, err := listenControl(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("listenControl error = %v, want %q", err, tt.wantErr)
+				}
+				if _, err := os.Lstat(path); err != nil {
+					t.Fatalf("the existing file was removed: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("listenControl: %v", err)
+			}
+			defer l.Close()
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := fi.Mode().Perm(); perm != 0o600 {
+				t.Fatalf("socket mode = %v, want 0600", perm)
+			}
+			c, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatalf("dial control socket: %v", err)
+			}
+			c.Close()
+		})
+	}
+}
+
+func TestNotReadyUntilStarted(t *testing.T) {
+	t.Setenv("ZONE", "tunnelfy.test")
+	t.Setenv("SSH_ENABLED", "false")
+	t.Setenv("LOG_REQUESTS", "false")
+	a, err := New("")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "app")
+	}))
+	defer upstream.Close()
+	if err := a.manager.AddRoute("alice.tunnelfy.test", upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	h := a.httpServer.Handler
+
+	for _, host := range []string{"alice.tunnelfy.test", "bob.tunnelfy.test"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "starting up") {
+			t.Fatalf("%s before start: got %d %q, want the startup page", host, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Retry-After"); got == "" {
+			t.Fatalf("%s before start: no Retry-After", host)
+		}
+	}
+	if code, _ := serve(h, "tunnelfy.test", "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz before start: got %d, want 503", code)
+	}
+
+	// Start marks the manager ready once every listener is bound.
+	a.manager.SetReady(true)
+	if code, body := serve(h, "alice.tunnelfy.test", "/"); code != http.StatusOK || body != "app" {
+		t.Fatalf("after start: got %d %q, want the tunnel", code, body)
+	}
+	if code, _ := serve(h, "tunnelfy.test", "/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz after start: got %d, want 200", code)
+	}
+}
+
+// scrape fetches /metrics from h and returns each sample's value by series,
+// e.g. `tunnelfy_http_responses_total{code="2xx"}`.
+func scrape(t *testing.T, h http.Handler) map[string]float64 {
+	t.Helper()
+	status, body := serve(h, "tunnelfy.test", "/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("GET /metrics: status %d", status)
+	}
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(body, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, value, ok := strings.Cut(line, " ")
+		v, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			t.Fatalf("malformed sample %q", line)
+		}
+		samples[series] = v
+	}
+	return samples
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "pong")
+	}))
+	defer upstream.Close()
+	a := newTestApp(t, nil)
+	h := a.httpServer.Handler
+
+	// The registry is process-wide, so compare against a baseline.
+	before := scrape(t, h)
+	// Labelled series only appear once counted; the rest are always exposed.
+	for _, series := range []string{
+		"tunnelfy_routes",
+		"tunnelfy_http_proxied_requests_total",
+		"tunnelfy_http_request_duration_seconds_count",
+		`tunnelfy_http_request_duration_seconds_bucket{le="+Inf"}`,
+		"tunnelfy_ssh_handshake_failures_total",
+	} {
+		if _, ok := before[series]; !ok {
+			t.Errorf("/metrics lacks %s", series)
+		}
+	}
+
+	if err := a.manager.AddRoute("alice.tunnelfy.test", upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "http://alice.tunnelfy.test/ping", strings.NewReader("hello"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("proxied request: status %d", rec.Code)
+	}
+
+	after := scrape(t, h)
+	for series, want := range map[string]float64{
+		"tunnelfy_routes": 1,
+		`tunnelfy_http_responses_total{code="2xx"}`:       1,
+		`tunnelfy_http_bytes_total{direction="received"}`: 5,
+		`tunnelfy_http_bytes_total{direction="sent"}`:     4,
+		"tunnelfy_http_request_duration_seconds_count":    1,
+		"tunnelfy_http_proxied_requests_total":            1,
+	} {
+		if got := after[series] - before[series]; got != want {
+			t.Errorf("%s grew by %v, want %v", series, got, want)
+		}
+	}
+
+	a.manager.RemoveRoute("alice.tunnelfy.test")
+	if got := scrape(t, h)["tunnelfy_routes"]; got != before["tunnelfy_routes"] {
+		t.Errorf("tunnelfy_routes = %v after removing the route, want %v", got, before["tunnelfy_routes"])
+	}
+}
+
+func TestSSHForwardingWithoutHTTP(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ZONE", "tunnelfy.test")
+	t.Setenv("SSH_ENABLED", "true")
+	t.Setenv("HTTP_ENABLED", "false")
+	t.Setenv("TCP_TUNNEL_LISTEN_HOST", "127.0.0.1")
+	t.Setenv("LOG_REQUESTS", "false")
+	t.Setenv("AUTHORIZED_KEYS_DATA", string(gossh.MarshalAuthorizedKey(signer.PublicKey())))
+	a, err := New("")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if a.httpServer != nil {
+		t.Fatal("HTTP server configured with HTTP_ENABLED=false")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go a.acceptSSH(l, done)
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	c, err := gossh.Dial("tcp", l.Addr().String(), &gossh.ClientConfig{
+		User:            "alice",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("ssh.Dial: %v", err)
+	}
+	defer c.Close()
+	// Echo whatever arrives on forwarded connections, upper-cased.
+	go func() {
+		for ch := range c.HandleChannelOpen("forwarded-tcpip") {
+			conn, reqs, err := ch.Accept()
+			if err != nil {
+				continue
+			}
+			go gossh.DiscardRequests(reqs)
+			go func() {
+				defer conn.Close()
+				b, _ := io.ReadAll(io.LimitReader(conn, 4))
+				conn.Write([]byte(strings.ToUpper(string(b))))
+			}()
+		}
+	}()
+
+	payload := gossh.Marshal(struct {
+		Addr string
+		Port uint32
+	}{"app", 0})
+	ok, reply, err := c.SendRequest("tcpip-forward", true, payload)
+	if err != nil || !ok || len(reply) < 4 {
+		t.Fatalf("tcpip-forward: ok=%v reply=%q err=%v", ok, reply, err)
+	}
+	port := int(binary.BigEndian.Uint32(reply))
+	if routes := a.manager.ListRoutes(); len(routes) != 0 {
+		t.Errorf("HTTP routes %v registered for a TCP-only tunnel", routes)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("dial the public port: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "PING" {
+		t.Fatalf("read %q, %v: want PING through the tunnel", got, err)
+	}
+}
+
+func TestLoadAuthorizedKeysFromDataAndFile(t *testing.T) {
+	inline, fromFile := authorizedKey(t), authorizedKey(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, []byte(fromFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadAuthorizedKeys(&config.Config{AuthorizedKeys: inline, AuthorizedKeysFile: path})
+	if err != nil {
+		t.Fatalf("loadAuthorizedKeys: %v", err)
+	}
+	if _, ok := keys[inline]; !ok || len(keys) != 2 {
+		t.Fatalf("got %d keys, want the inline and the file's", len(keys))
+	}
+	if _, ok := keys[fromFile]; !ok {
+		t.Fatal("the file's key is missing")
+	}
+
+	if err := os.WriteFile(path, []byte(fromFile+"# revoked\nbroken\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadAuthorizedKeys(&config.Config{AuthorizedKeys: inline, AuthorizedKeysFile: path})
+	var cfgErr *config.ConfigError
+	if !errors.As(err, &cfgErr) || !strings.Contains(err.Error(), path) || !strings.Contains(err.Error(), "line 3:") {
+		t.Fatalf("loadAuthorizedKeys: err = %v, want a ConfigError naming %s line 3", err, path)
+	}
+}
+
+func TestReloadAuthorizedKeysFile(t *testing.T) {
+	newSigner := func() gossh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := gossh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	oldKey, newKey := newSigner(), newSigner()
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	writeKeys := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys(string(gossh.MarshalAuthorizedKey(oldKey.PublicKey())))
+	t.Setenv("ZONE", "tunnelfy.test")
+	t.Setenv("SSH_ENABLED", "true")
+	t.Setenv("LOG_REQUESTS", "false")
+	t.Setenv("AUTHORIZED_KEYS_DATA", "")
+	t.Setenv("AUTHORIZED_KEYS_FILE", path)
+	a, err := New("")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go a.acceptSSH(l, done)
+	defer func() {
+		l.Close()
+		<-done
+	}()
+	authenticates := func(signer gossh.Signer) bool {
+		c, err := gossh.Dial("tcp", l.Addr().String(), &gossh.ClientConfig{
+			User:            "alice",
+			Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+
+	// SIGHUP calls reloadAuthorizedKeys.
+	writeKeys(string(gossh.MarshalAuthorizedKey(newKey.PublicKey())))
+	if !authenticates(oldKey) || authenticates(newKey) {
+		t.Fatal("the keys changed before the reload")
+	}
+	a.reloadAuthorizedKeys()
+	if authenticates(oldKey) || !authenticates(newKey) {
+		t.Fatal("the reload didn't swap the old key for the new one")
+	}
+
+	writeKeys("broken\n")
+	a.reloadAuthorizedKeys()
+	if !authenticates(newKey) {
+		t.Fatal("a broken file replaced the current keys")
+	}
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/metrics"
+)
+
+// serverErrorInterval rate-limits server error log lines per kind, so a
+// scanner hammering the listener with garbage can't flood the logs; every
+// error is still counted in metrics.HTTPServerErrors.
+const serverErrorInterval = 10 * time.Second
+
+// serverErrorKinds classifies the messages net/http logs by prefix. Kinds
+// caused by clients are logged at level info, the rest at level error.
+var serverErrorKinds = []struct {
+	prefix, kind string
+	level        slog.Level
+}{
+	{"http: TLS handshake error", "tls_handshake", slog.LevelInfo},
+	{"http: URL query contains semicolon", "bad_request", slog.LevelInfo},
+	{"http2: ", "http2", slog.LevelInfo},
+	{"http: Accept error", "accept", slog.LevelError},
+	{"http: panic serving", "panic", slog.LevelError},
+	{"http: superfluous response.WriteHeader", "superfluous_write_header", slog.LevelError},
+	{"http: response.Write", "hijacked_write", slog.LevelError},
+}
+
+// serverErrorLog is the ErrorLog of an http.Server: it turns each message
+// into a record tagged with the server and kind, logged at most once per
+// serverErrorInterval per kind with a count of the lines suppressed in
+// between.
+type serverErrorLog struct {
+	log    *slog.Logger
+	server string
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+// newServerErrorLog returns the ErrorLog for the http.Server named server
+// (e.g. "http", "https"), logging to logger.
+func newServerErrorLog(logger *slog.Logger, server string) *log.Logger {
+	w := &serverErrorLog{log: logger, server: server, last: make(map[string]time.Time), suppressed: make(map[string]int)}
+	return log.New(w, "", 0)
+}
+
+// Write logs a single message; log.Logger calls it once per message.
+func (l *serverErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	kind, level := "other", slog.LevelError
+	for _, k := range serverErrorKinds {
+		if strings.HasPrefix(msg, k.prefix) {
+			kind, level = k.kind, k.level
+			break
+		}
+	}
+	metrics.HTTPServerErrors.Inc(kind)
+
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.last[kind]) < serverErrorInterval {
+		l.suppressed[kind]++
+		l.mu.Unlock()
+		return len(p), nil
+	}
+	l.last[kind] = now
+	suppressed := l.suppressed[kind]
+	l.suppressed[kind] = 0
+	l.mu.Unlock()
+
+	l.log.Log(context.Background(), level, "http server error", "server", l.server, "kind", kind, "suppressed", suppressed, "err", logsafe.String(msg))
+	return len(p), nil
+}
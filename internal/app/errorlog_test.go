@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// recordLog is a slog.Handler keeping the records logged to it.
+type recordLog struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordLog) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordLog) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordLog) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordLog) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *recordLog) list() []slog.Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]slog.Record(nil), h.records...)
+}
+
+// attr returns the value of r's attribute key.
+func attr(r slog.Record, key string) string {
+	var v string
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			v = a.Value.String()
+			return false
+		}
+		return true
+	})
+	return v
+}
+
+func TestServerErrorLog(t *testing.T) {
+	rec := &recordLog{}
+	errorLog := newServerErrorLog(slog.New(rec), "https")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.Config.ErrorLog = errorLog
+	srv.StartTLS()
+	defer srv.Close()
+
+	// A plaintext request to the TLS listener fails the handshake; only the
+	// first of a burst is logged.
+	before := metrics.HTTPServerErrors.Value("tls_handshake")
+	const burst = 3
+	for range burst {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.Read(make([]byte, 512))
+		conn.Close()
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("the handshake errors to be counted", func() bool {
+		return metrics.HTTPServerErrors.Value("tls_handshake")-before == burst
+	})
+
+	records := rec.list()
+	if len(records) != 1 {
+		t.Fatalf("%d records logged for a burst of %d, want 1", len(records), burst)
+	}
+	r := records[0]
+	if r.Level != slog.LevelInfo || r.Message != "http server error" {
+		t.Errorf("record %s %q, want an info %q", r.Level, r.Message, "http server error")
+	}
+	if attr(r, "server") != "https" || attr(r, "kind") != "tls_handshake" || attr(r, "suppressed") != "0" {
+		t.Errorf("record attrs server=%s kind=%s suppressed=%s, want https, tls_handshake, 0",
+			attr(r, "server"), attr(r, "kind"), attr(r, "suppressed"))
+	}
+
+	// Once the interval has passed, the next error is logged with the count
+	// of those suppressed; other kinds are limited separately.
+	w := errorLog.Writer().(*serverErrorLog)
+	w.mu.Lock()
+	w.last["tls_handshake"] = time.Now().Add(-serverErrorInterval)
+	w.mu.Unlock()
+	errorLog.Print("http: TLS handshake error from 192.0.2.1:1234: EOF")
+	errorLog.Print("http: panic serving 192.0.2.1:1234: boom")
+	records = rec.list()
+	if len(records) != 3 {
+		t.Fatalf("%d records logged, want 3", len(records))
+	}
+	if got := attr(records[1], "suppressed"); got != "2" {
+		t.Errorf("suppressed = %s, want 2", got)
+	}
+	if r := records[2]; attr(r, "kind") != "panic" || r.Level != slog.LevelError {
+		t.Errorf("panic record: kind %s level %s, want panic at error", attr(r, "kind"), r.Level)
+	}
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// signalChildEnv marks the process TestSecondSignalForcesExit re-runs itself
+// as, which waits for shutdown signals with a shutdown that never finishes.
+const signalChildEnv = "TUNNELFY_TEST_SIGNAL_CHILD"
+
+func TestSecondSignalForcesExit(t *testing.T) {
+	if os.Getenv(signalChildEnv) != "" {
+		// Keep signals that arrive before waitForShutdown listens from
+		// killing the process.
+		signal.Notify(make(chan os.Signal, 1), syscall.SIGINT, syscall.SIGTERM)
+		a := newTestApp(t, nil)
+		never := make(chan struct{})
+		done := make(chan struct{})
+		close(done)
+		a.waitForShutdown(nil, never, done, done, done, done)
+		t.Fatal("waitForShutdown returned with the SSH server still running")
+	}
+
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		t.Run(sig.String(), func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSecondSignalForcesExit$")
+			cmd.Env = append(os.Environ(), signalChildEnv+"=1")
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+
+			// Signal until the process exits: the first signal it handles
+			// starts the shutdown, which hangs, and the next one forces the
+			// exit.
+			tick := time.NewTicker(50 * time.Millisecond)
+			defer tick.Stop()
+			timeout := time.After(10 * time.Second)
+			for {
+				select {
+				case err := <-exited:
+					var exitErr *exec.ExitError
+					if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+						t.Fatalf("exit: %v, want status 1\n%s", err, stderr.String())
+					}
+					if !strings.Contains(stderr.String(), "forcing exit") {
+						t.Fatalf("no forced exit logged:\n%s", stderr.String())
+					}
+					return
+				case <-tick.C:
+					cmd.Process.Signal(sig)
+				case <-timeout:
+					cmd.Process.Kill()
+					t.Fatalf("process didn't exit\n%s", stderr.String())
+				}
+			}
+		})
+	}
+}
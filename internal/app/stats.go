@@ -0,0 +1,75 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"tunnelfy/internal/metrics"
+	"tunnelfy/internal/proxy"
+	"tunnelfy/internal/ssh"
+)
+
+// stats is the JSON health snapshot served at /api/stats, a lightweight
+// alternative to scraping /metrics for simple dashboards and scripts.
+type stats struct {
+	Version       string    `json:"version"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+
+	Routes   int    `json:"routes"`
+	Requests uint64 `json:"requests"`
+	// SSH is absent when the SSH server is disabled.
+	SSH    *ssh.Stats        `json:"ssh,omitempty"`
+	Errors map[string]uint64 `json:"errors"`
+	// Metrics holds every exported metric by name, as on /metrics.
+	Metrics map[string]any `json:"metrics"`
+}
+
+// buildVersion returns the module version the binary was built from, as
+// recorded by the Go toolchain.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// statsHandler serves the stats snapshot. It reads the same counters as the
+// metrics endpoint, so both always agree.
+func statsHandler(manager *proxy.ShardedRouteManager, sshSrv *ssh.SSHServer, started time.Time) http.HandlerFunc {
+	version := buildVersion()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st := stats{
+			Version:       version,
+			StartedAt:     started.UTC(),
+			UptimeSeconds: int64(time.Since(started).Seconds()),
+			Routes:        len(manager.ListRoutes()),
+			Requests:      metrics.HTTPProxiedRequests.Value(),
+			Errors: map[string]uint64{
+				"http_panics":             metrics.HTTPPanics.Value(),
+				"http_upstream_truncated": metrics.HTTPUpstreamTruncated.Value(),
+				"http_upstream_timeouts":  metrics.HTTPUpstreamTimeouts.Value(),
+				"ssh_handshake_failures":  metrics.SSHHandshakeFailures.Value(),
+				"ssh_forwards_rejected":   metrics.SSHForwardsRejected.Sum(),
+				"fd_exhausted":            metrics.FDExhausted.Sum(),
+				"http_server_errors":      metrics.HTTPServerErrors.Sum(),
+			},
+			Metrics: metrics.Default.Values(),
+		}
+		if sshSrv != nil {
+			s := sshSrv.Stats()
+			st.SSH = &s
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(st)
+	}
+}
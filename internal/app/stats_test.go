@@ -0,0 +1,80 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsSnapshot(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	a := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "REQUEST_TIMEOUT": "50ms"})
+	for _, host := range []string{"alice.tunnelfy.test", "bob.tunnelfy.test"} {
+		if err := a.manager.AddRoute(host, upstream.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := func() stats {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://tunnelfy.test/api/stats", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		a.httpServer.Handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /api/stats: status %d: %s", rec.Code, rec.Body)
+		}
+		var st stats
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+			t.Fatalf("decode stats: %v", err)
+		}
+		return st
+	}
+
+	// The counters are process-wide, so compare against a baseline.
+	before := snapshot()
+	if before.Routes != 2 {
+		t.Errorf("routes = %d, want 2", before.Routes)
+	}
+	if before.SSH != nil {
+		t.Errorf("ssh = %+v, want it absent with the SSH server disabled", before.SSH)
+	}
+	if before.Version == "" || before.StartedAt.IsZero() {
+		t.Errorf("version %q, started_at %v: want both set", before.Version, before.StartedAt)
+	}
+
+	const requests = 5
+	for range requests {
+		if status, _ := serve(a.httpServer.Handler, "alice.tunnelfy.test", "/"); status != http.StatusOK {
+			t.Fatalf("proxied request: status %d", status)
+		}
+	}
+	if status, _ := serve(a.httpServer.Handler, "bob.tunnelfy.test", "/slow"); status != http.StatusGatewayTimeout {
+		t.Fatalf("slow request: status %d, want 504", status)
+	}
+
+	after := snapshot()
+	if got := after.Requests - before.Requests; got != requests+1 {
+		t.Errorf("requests grew by %d, want %d", got, requests+1)
+	}
+	if got := after.Errors["http_upstream_timeouts"] - before.Errors["http_upstream_timeouts"]; got != 1 {
+		t.Errorf("http_upstream_timeouts grew by %d, want 1", got)
+	}
+	if got, ok := after.Metrics["tunnelfy_http_proxied_requests_total"]; !ok {
+		t.Errorf("metrics lack tunnelfy_http_proxied_requests_total: %v", after.Metrics)
+	} else if n, _ := got.(float64); uint64(n) != after.Requests {
+		t.Errorf("metrics report %v proxied requests, the snapshot %d", got, after.Requests)
+	}
+	if after.UptimeSeconds < before.UptimeSeconds {
+		t.Errorf("uptime went from %d to %d", before.UptimeSeconds, after.UptimeSeconds)
+	}
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"tunnelfy/internal/config"
+)
+
+// httpsRedirectHandler redirects every request to the same host and URI over
+// HTTPS on port; the default port 443 is left out of the URL.
+func httpsRedirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "missing host", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6 literal
+		}
+		if port != "" && port != "443" {
+			host += ":" + port
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// listenPort returns the port of the listen address addr, e.g. "8443" for
+// ":8443".
+func listenPort(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// publicURLParts returns the scheme and port of the tunnel URLs reported to
+// clients: PUBLIC_URL_SCHEME and PUBLIC_URL_PORT when set, otherwise https
+// when the proxy serves TLS and the port of the listener serving it. The
+// scheme's default port is returned as "".
+func publicURLParts(cfg *config.Config) (scheme, port string, err error) {
+	tlsServed := cfg.TLSCertFile != "" || cfg.ACMEEnabled || cfg.ACMEDNSProvider != ""
+	scheme = strings.ToLower(cfg.PublicURLScheme)
+	switch scheme {
+	case "":
+		scheme = "http"
+		if tlsServed {
+			scheme = "https"
+		}
+	case "http", "https":
+	default:
+		return "", "", &config.ConfigError{Message: "PUBLIC_URL_SCHEME must be http or https, got " + strconv.Quote(cfg.PublicURLScheme)}
+	}
+	port = cfg.PublicURLPort
+	if port == "" {
+		switch {
+		case scheme == "https" && cfg.TLSCertFile == "" && tlsServed:
+			port = listenPort(cfg.HTTPSListen)
+		case scheme == "https" && cfg.TLSCertFile == "":
+			// TLS is terminated in front of the proxy; assume the default port.
+		default:
+			port = listenPort(cfg.HTTPListen)
+		}
+	} else if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", "", &config.ConfigError{Message: "PUBLIC_URL_PORT must be a port number, got " + strconv.Quote(port)}
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	return scheme, port, nil
+}
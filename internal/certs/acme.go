@@ -0,0 +1,278 @@
+// Package certs provisions TLS certificates for the proxy.
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// renewBefore is how long before expiry a certificate is renewed.
+const renewBefore = 30 * 24 * time.Hour
+
+// retryInterval is the delay after a failed issuance before trying again.
+const retryInterval = time.Hour
+
+// DNSConfig configures a DNSManager.
+type DNSConfig struct {
+	// Domains are the names on the certificate, e.g. "zone" and "*.zone".
+	Domains []string
+	// Provider publishes the DNS-01 challenge records.
+	Provider DNSProvider
+	// DirectoryURL is the ACME directory; empty means Let's Encrypt production.
+	DirectoryURL string
+	// Email is the optional account contact.
+	Email string
+	// CacheDir stores the account key and the issued certificate, so restarts
+	// don't issue again.
+	CacheDir string
+	// Propagation is how long to wait after publishing a challenge record
+	// before asking the CA to validate it.
+	Propagation time.Duration
+}
+
+// DNSManager obtains and renews a single certificate, typically a wildcard
+// for the zone, through ACME DNS-01 challenges. HTTP-01 can't issue wildcard
+// certificates, and one wildcard avoids per-host issuance rate limits.
+type DNSManager struct {
+	cfg DNSConfig
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewDNSManager returns a DNSManager for cfg, loading a cached certificate if
+// there is one.
+func NewDNSManager(cfg DNSConfig) (*DNSManager, error) {
+	if len(cfg.Domains) == 0 || cfg.Provider == nil {
+		return nil, errors.New("acme dns: domains and a dns provider are required")
+	}
+	if cfg.DirectoryURL == "" {
+		cfg.DirectoryURL = acme.LetsEncryptURL
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("acme dns: %w", err)
+	}
+	m := &DNSManager{cfg: cfg}
+	if cert, err := tls.LoadX509KeyPair(m.path("cert.pem"), m.path("key.pem")); err == nil {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		m.cert = &cert
+	}
+	return m, nil
+}
+
+// GetCertificate serves the managed certificate; use it as
+// tls.Config.GetCertificate.
+func (m *DNSManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("acme dns: certificate not issued yet")
+	}
+	return m.cert, nil
+}
+
+// Run issues the certificate if needed and keeps renewing it until ctx is done.
+func (m *DNSManager) Run(ctx context.Context) {
+	for {
+		wait := m.untilRenewal()
+		if wait <= 0 {
+			if err := m.issue(ctx); err != nil {
+				slog.Error("acme dns: issuing certificate failed", "domains", m.cfg.Domains, "err", err)
+				wait = retryInterval
+			} else {
+				wait = m.untilRenewal()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// untilRenewal returns how long until the current certificate is due for
+// renewal, or zero if there is none.
+func (m *DNSManager) untilRenewal() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil || m.cert.Leaf == nil || !coversAll(m.cert.Leaf, m.cfg.Domains) {
+		return 0
+	}
+	return max(time.Until(m.cert.Leaf.NotAfter.Add(-renewBefore)), 0)
+}
+
+func coversAll(leaf *x509.Certificate, domains []string) bool {
+	for _, d := range domains {
+		found := false
+		for _, name := range leaf.DNSNames {
+			found = found || strings.EqualFold(name, d)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// issue runs an ACME order with DNS-01 challenges and installs the result.
+func (m *DNSManager) issue(ctx context.Context) error {
+	accountKey, err := m.loadOrCreateKey("account.key")
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: m.cfg.DirectoryURL}
+	acct := &acme.Account{}
+	if m.cfg.Email != "" {
+		acct.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("register account: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.cfg.Domains...))
+	if err != nil {
+		return fmt.Errorf("create order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("wait order: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.cfg.Domains}, certKey)
+	if err != nil {
+		return err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalize order: %w", err)
+	}
+	return m.install(der, certKey)
+}
+
+// authorize completes the DNS-01 challenge of one authorization.
+func (m *DNSManager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	// Wildcard and base names share the record of the base name.
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+	if err := m.cfg.Provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.cfg.Provider.CleanUp(context.WithoutCancel(ctx), fqdn, value); err != nil {
+			slog.Warn("acme dns: cleaning up challenge record failed", "fqdn", fqdn, "err", err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(m.cfg.Propagation):
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accept challenge: %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorize %s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// install caches the issued chain and key and starts serving them.
+func (m *DNSManager) install(der [][]byte, key *ecdsa.PrivateKey) error {
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.path("key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.path("cert.pem"), certPEM, 0o600); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.cert = &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}
+	m.mu.Unlock()
+	slog.Info("acme dns: installed certificate", "domains", leaf.DNSNames, "not_after", leaf.NotAfter)
+	return nil
+}
+
+// loadOrCreateKey loads the ECDSA key cached under name, creating it if missing.
+func (m *DNSManager) loadOrCreateKey(name string) (crypto.Signer, error) {
+	if data, err := os.ReadFile(m.path(name)); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: invalid PEM", m.path(name))
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(m.path(name), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *DNSManager) path(name string) string {
+	return filepath.Join(m.cfg.CacheDir, name)
+}
@@ -0,0 +1,351 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// mockDNS is a DNSProvider keeping its TXT records in memory.
+type mockDNS struct {
+	mu      sync.Mutex
+	records map[string][]string // fqdn -> values
+	err     error
+}
+
+func (p *mockDNS) Present(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.records[fqdn] = append(p.records[fqdn], value)
+	return nil
+}
+
+func (p *mockDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.records[fqdn] = slices.DeleteFunc(p.records[fqdn], func(v string) bool { return v == value })
+	if len(p.records[fqdn]) == 0 {
+		delete(p.records, fqdn)
+	}
+	return nil
+}
+
+func (p *mockDNS) has(fqdn, value string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Contains(p.records[fqdn], value)
+}
+
+// mockCA is a minimal ACME directory issuing certificates once every
+// authorization's dns-01 record is published on its DNS.
+type mockCA struct {
+	dns      *mockDNS
+	cacheDir string // where the account key is cached, to compute challenge records
+	srv      *httptest.Server
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+
+	mu     sync.Mutex
+	authzs map[string]*mockAuthz // id -> authorization
+	issued []byte                // DER of the last issued leaf
+	orders int
+}
+
+type mockAuthz struct {
+	domain string
+	token  string
+	valid  bool
+}
+
+func newMockCA(t *testing.T, dns *mockDNS, cacheDir string) *mockCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mock CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+	ca := &mockCA{dns: dns, cacheDir: cacheDir, caKey: key, caCert: caCert, authzs: make(map[string]*mockAuthz)}
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *mockCA) url(path string) string { return ca.srv.URL + path }
+
+// payload decodes the JWS payload of an ACME POST into v, if non-nil.
+func payload(r *http.Request, v any) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+	if v == nil || jws.Payload == "" {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (ca *mockCA) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	path := r.URL.Path
+	switch {
+	case path == "/directory":
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   ca.url("/nonce"),
+			"newAccount": ca.url("/account"),
+			"newOrder":   ca.url("/order"),
+			"revokeCert": ca.url("/revoke"),
+			"keyChange":  ca.url("/key-change"),
+		})
+	case path == "/nonce":
+		w.WriteHeader(http.StatusOK)
+	case path == "/account":
+		payload(r, nil)
+		w.Header().Set("Location", ca.url("/account/1"))
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case path == "/order":
+		var req struct {
+			Identifiers []acme.AuthzID `json:"identifiers"`
+		}
+		if err := payload(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.orders++
+		var urls []string
+		for i, id := range req.Identifiers {
+			authzID := fmt.Sprintf("%d-%d", ca.orders, i)
+			ca.authzs[authzID] = &mockAuthz{domain: id.Value, token: "token-" + authzID}
+			urls = append(urls, ca.url("/authz/"+authzID))
+		}
+		w.Header().Set("Location", ca.url("/order/1"))
+		writeJSON(w, http.StatusCreated, map[string]any{
+			"status":         "pending",
+			"identifiers":    req.Identifiers,
+			"authorizations": urls,
+			"finalize":       ca.url("/finalize"),
+		})
+	case strings.HasPrefix(path, "/authz/"):
+		payload(r, nil)
+		a := ca.authzs[strings.TrimPrefix(path, "/authz/")]
+		status := "pending"
+		if a.valid {
+			status = "valid"
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"status":     status,
+			"identifier": acme.AuthzID{Type: "dns", Value: a.domain},
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": ca.url("/unused"), "token": a.token, "status": "pending"},
+				{"type": "dns-01", "url": ca.url("/challenge/" + strings.TrimPrefix(path, "/authz/")), "token": a.token, "status": status},
+			},
+		})
+	case strings.HasPrefix(path, "/challenge/"):
+		payload(r, nil)
+		a := ca.authzs[strings.TrimPrefix(path, "/challenge/")]
+		fqdn := "_acme-challenge." + strings.TrimPrefix(a.domain, "*.") + "."
+		if !ca.dns.has(fqdn, ca.challengeRecord(a.token)) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"type": "urn:ietf:params:acme:error:unauthorized", "detail": "no TXT record at " + fqdn})
+			return
+		}
+		a.valid = true
+		writeJSON(w, http.StatusOK, map[string]string{"type": "dns-01", "url": ca.url(path), "token": a.token, "status": "valid"})
+	case path == "/order/1":
+		payload(r, nil)
+		status := "ready"
+		for _, a := range ca.authzs {
+			if !a.valid {
+				status = "pending"
+			}
+		}
+		w.Header().Set("Location", ca.url(path))
+		writeJSON(w, http.StatusOK, map[string]any{"status": status, "finalize": ca.url("/finalize")})
+	case path == "/finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		if err := payload(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ca.sign(req.CSR); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR", "detail": err.Error()})
+			return
+		}
+		w.Header().Set("Location", ca.url("/order/1"))
+		writeJSON(w, http.StatusOK, map[string]any{"status": "valid", "finalize": ca.url("/finalize"), "certificate": ca.url("/cert")})
+	case path == "/cert":
+		payload(r, nil)
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.issued})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// challengeRecord returns the TXT record answering token for the cached
+// account key.
+func (ca *mockCA) challengeRecord(token string) string {
+	data, err := os.ReadFile(filepath.Join(ca.cacheDir, "account.key"))
+	if err != nil {
+		return ""
+	}
+	block, _ := pem.Decode(data)
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	v, _ := (&acme.Client{Key: key}).DNS01ChallengeRecord(token)
+	return v
+}
+
+// sign issues a 90 day certificate for the base64url-encoded CSR.
+func (ca *mockCA) sign(b64 string) error {
+	der, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	ca.issued, err = x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if status >= 400 {
+		w.Header().Set("Content-Type", "application/problem+json")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestDNSManagerIssuesWildcard(t *testing.T) {
+	dns := &mockDNS{records: make(map[string][]string)}
+	cacheDir := t.TempDir()
+	ca := newMockCA(t, dns, cacheDir)
+	domains := []string{"tunnelfy.test", "*.tunnelfy.test"}
+	cfg := DNSConfig{Domains: domains, Provider: dns, DirectoryURL: ca.url("/directory"), CacheDir: cacheDir}
+	m, err := NewDNSManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Fatal("GetCertificate served a certificate before issuance")
+	}
+
+	if err := m.issue(context.Background()); err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cert.Leaf.DNSNames, domains) {
+		t.Fatalf("certificate names = %v, want %v", cert.Leaf.DNSNames, domains)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Fatalf("certificate chain has %d certificates, want leaf and issuer", len(cert.Certificate))
+	}
+	if len(dns.records) != 0 {
+		t.Fatalf("challenge records left behind: %v", dns.records)
+	}
+	if m.untilRenewal() <= 0 {
+		t.Fatal("a fresh certificate is already due for renewal")
+	}
+
+	// A restart serves the cached certificate without a new order.
+	m, err = NewDNSManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := m.GetCertificate(nil); err != nil || !cached.Leaf.Equal(cert.Leaf) {
+		t.Fatalf("restart didn't load the cached certificate: %v", err)
+	}
+	if m.untilRenewal() <= 0 {
+		t.Fatal("the cached certificate is due for renewal")
+	}
+
+	// A certificate missing one of the domains is replaced.
+	cfg.Domains = append(domains, "other.test")
+	if m, err = NewDNSManager(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if m.untilRenewal() != 0 {
+		t.Fatal("a certificate not covering every domain isn't renewed")
+	}
+}
+
+func TestDNSManagerProviderFailure(t *testing.T) {
+	dns := &mockDNS{records: make(map[string][]string), err: errors.New("dns api down")}
+	cacheDir := t.TempDir()
+	ca := newMockCA(t, dns, cacheDir)
+	m, err := NewDNSManager(DNSConfig{Domains: []string{"*.tunnelfy.test"}, Provider: dns, DirectoryURL: ca.url("/directory"), CacheDir: cacheDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.issue(context.Background()); err == nil || !strings.Contains(err.Error(), "dns api down") {
+		t.Fatalf("issue error = %v, want the provider's", err)
+	}
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Fatal("a failed issuance installed a certificate")
+	}
+}
+
+func TestNewDNSManagerRequiresProvider(t *testing.T) {
+	if _, err := NewDNSManager(DNSConfig{Domains: []string{"*.tunnelfy.test"}, CacheDir: t.TempDir()}); err == nil {
+		t.Fatal("NewDNSManager accepted a config without a dns provider")
+	}
+}
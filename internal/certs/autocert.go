@@ -0,0 +1,60 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HostConfig configures a per-host certificate manager.
+type HostConfig struct {
+	// Zones are the zones whose subdomains get certificates.
+	Zones []string
+	// DirectoryURL is the ACME directory; empty means Let's Encrypt production.
+	DirectoryURL string
+	// Email is the optional account contact.
+	Email string
+	// CacheDir stores the account key and the issued certificates.
+	CacheDir string
+}
+
+// NewHostManager returns an autocert manager issuing a certificate for each
+// host under one of the zones on its first TLS handshake, answering HTTP-01
+// challenges through its HTTPHandler and TLS-ALPN-01 through its TLSConfig.
+// Unlike DNSManager it needs no DNS provider, at the cost of one issuance per
+// host counting against the CA's rate limits.
+func NewHostManager(cfg HostConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: zoneHostPolicy(cfg.Zones),
+		Email:      cfg.Email,
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return m
+}
+
+// zoneHostPolicy allows the hosts strictly under one of zones, which are the
+// only hosts the proxy routes.
+func zoneHostPolicy(zones []string) autocert.HostPolicy {
+	suffixes := make([]string, 0, len(zones))
+	for _, z := range zones {
+		if z = strings.Trim(strings.ToLower(z), "."); z != "" {
+			suffixes = append(suffixes, "."+z)
+		}
+	}
+	return func(_ context.Context, host string) error {
+		host = strings.ToLower(host)
+		for _, s := range suffixes {
+			if strings.HasSuffix(host, s) && len(host) > len(s) {
+				return nil
+			}
+		}
+		return fmt.Errorf("acme: host %q is not under a served zone", host)
+	}
+}
@@ -0,0 +1,56 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// DNSProvider publishes the TXT records that answer ACME DNS-01 challenges.
+// fqdn is the fully qualified record name (e.g. "_acme-challenge.zone.") and
+// value the TXT record content.
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// ExecProvider is a DNSProvider that delegates to an external command, so any
+// DNS API can be scripted without building it into tunnelfy. The command is
+// run as "<command> present <fqdn> <value>" and "<command> cleanup <fqdn>
+// <value>" and must exit zero on success.
+type ExecProvider struct {
+	Command string
+}
+
+// Present implements DNSProvider.
+func (p ExecProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+// CleanUp implements DNSProvider.
+func (p ExecProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p ExecProvider) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, p.Command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns %s %s: %w: %s", action, fqdn, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// NewDNSProvider returns the DNSProvider named name, configured by config.
+// "exec" runs the command config.
+func NewDNSProvider(name, config string) (DNSProvider, error) {
+	switch name {
+	case "exec":
+		if config == "" {
+			return nil, fmt.Errorf("dns provider exec requires a command")
+		}
+		return ExecProvider{Command: config}, nil
+	default:
+		return nil, fmt.Errorf("unknown dns provider %q", name)
+	}
+}
@@ -0,0 +1,53 @@
+package certs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExecProvider(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "calls")
+	script := filepath.Join(dir, "dns-hook")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+log+"\n[ \"$3\" != fail ] || { echo api error; exit 1; }\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewDNSProvider("exec", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.tunnelfy.test.", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.tunnelfy.test.", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	err = p.Present(ctx, "_acme-challenge.tunnelfy.test.", "fail")
+	if err == nil || !strings.Contains(err.Error(), "api error") {
+		t.Fatalf("failing command: err = %v, want its output", err)
+	}
+
+	calls, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "present _acme-challenge.tunnelfy.test. v1\ncleanup _acme-challenge.tunnelfy.test. v1\npresent _acme-challenge.tunnelfy.test. fail\n"
+	if string(calls) != want {
+		t.Fatalf("command calls:\n%s\nwant:\n%s", calls, want)
+	}
+}
+
+func TestNewDNSProvider(t *testing.T) {
+	for _, tt := range []struct{ name, config string }{
+		{"exec", ""},
+		{"route53", "key"},
+	} {
+		if _, err := NewDNSProvider(tt.name, tt.config); err == nil {
+			t.Errorf("NewDNSProvider(%q, %q) succeeded, want an error", tt.name, tt.config)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,37 +19,539 @@ type Config struct {
 	HTTPListen     string
 	AuthorizedKeys string
 	LogRequests    bool
+	AdminToken     string
+	// AdminListen, if set, serves the admin API, /metrics and /readyz on a
+	// listener of their own instead of HTTPListen.
+	AdminListen string
+	// AuthorizedKeysFile is an authorized_keys file whose keys are accepted
+	// along with those of AuthorizedKeys.
+	AuthorizedKeysFile string
+	// TrustedCAKeys are newline-separated CA public keys whose user
+	// certificates are accepted, for usernames among their principals.
+	TrustedCAKeys string
+
+	// LogFormat is the log output format, text or json. LogLevel is the
+	// minimum level logged (debug, info, warn or error); when empty, it is
+	// debug if LogRequests is set and info otherwise.
+	LogFormat string
+	LogLevel  string
+
+	// MetricsRouteLabel is the per-route metrics labeling strategy (user,
+	// bucket or none) and MetricsHostBuckets the bucket count for "bucket".
+	MetricsRouteLabel  string
+	MetricsHostBuckets int
+
+	// ControlSocket is the path of a Unix domain socket serving the admin
+	// operations for local tooling. Empty disables it.
+	ControlSocket string
+
+	// PublicOpenAPI serves /api/openapi.json without admin authentication.
+	PublicOpenAPI bool
+
+	// SSHEnabled controls whether the SSH tunnel server runs at all. Disabling
+	// it, together with DefaultUpstream, runs tunnelfy as a single-backend proxy.
+	SSHEnabled bool
+	// HTTPEnabled controls whether the HTTP proxy runs. Disabling it leaves an
+	// SSH server whose tunnels are exposed as raw TCP ports only, which
+	// requires TCPListenHost.
+	HTTPEnabled bool
+	// DefaultUpstream is the catch-all upstream for in-zone hosts without a route.
+	DefaultUpstream string
+
+	// ExtraZones are zones served by the proxy in addition to Zone; tunnels are
+	// always created under Zone.
+	ExtraZones []string
+	// ZoneDefaultUpstreams are "zone=upstream" entries overriding
+	// DefaultUpstream for hosts in that zone.
+	ZoneDefaultUpstreams []string
+
+	// ProxyPrewarmConns is the number of upstream connections opened right
+	// after a route is added, so the first request reuses a warm connection.
+	// Zero disables prewarming.
+	ProxyPrewarmConns int
+
+	// ExposeUpstream adds an X-Tunnel-Upstream debug header to responses.
+	ExposeUpstream bool
+
+	// PreserveHost passes the public Host header on to upstreams.
+	PreserveHost bool
+
+	// Upstream transport timeouts; zero keeps the proxy's defaults, and a
+	// zero ProxyResponseHeaderTimeout waits indefinitely.
+	ProxyDialTimeout           time.Duration
+	ProxyIdleConnTimeout       time.Duration
+	ProxyTLSHandshakeTimeout   time.Duration
+	ProxyResponseHeaderTimeout time.Duration
+
+	// RouteWarmupGrace is how long after creation a route answers upstream
+	// errors with a retryable 503 instead of a 502.
+	RouteWarmupGrace time.Duration
+
+	// ForwardDeadline is how long an authenticated SSH connection may stay
+	// open without establishing a forward before it is closed. Zero disables it.
+	ForwardDeadline time.Duration
+
+	// SecurityHeaders is the raw security header spec injected into proxied
+	// responses that lack them: empty/"false" (off), "true" (defaults), or
+	// newline-separated "Name: value" lines.
+	SecurityHeaders string
+
+	// TunnelIdleTimeout removes tunnels whose route saw no traffic for this
+	// long, reclaiming those left behind by clients that vanished uncleanly.
+	// Zero disables it.
+	TunnelIdleTimeout time.Duration
+
+	// ReconnectGrace keeps a disconnected client's routes this long for it to
+	// reclaim on reconnect; zero removes them at once.
+	ReconnectGrace time.Duration
+
+	// SSHDrainTimeout is how long shutdown waits for SSH connections to
+	// finish their in-flight tunneled connections before closing them.
+	SSHDrainTimeout time.Duration
+
+	// TunnelTTL closes tunnels after this long; zero disables it.
+	// TunnelTTLMode "absolute" counts from when the tunnel opened and
+	// "sliding" from its last activity.
+	TunnelTTL     time.Duration
+	TunnelTTLMode string
+
+	// ConnIdleTimeout closes proxied tunnel connections idle in both directions
+	// for this long. Zero disables it.
+	ConnIdleTimeout time.Duration
+	// ConnIdleTimeoutExempt lists tunnel hosts exempt from ConnIdleTimeout.
+	ConnIdleTimeoutExempt []string
+
+	// MaxUserConns caps a user's concurrent tunneled connections across all
+	// their tunnels. Zero means unlimited.
+	MaxUserConns int
+
+	// MaxTunnelsPerUser caps a user's concurrent tunnels; zero means
+	// unlimited.
+	MaxTunnelsPerUser int
+
+	// MaxUserSSHConns caps a user's concurrent SSH connections; zero means
+	// unlimited. SSHConnLimitPolicy is "reject" (refuse the new connection)
+	// or "evict" (close the user's idlest connection).
+	MaxUserSSHConns    int
+	SSHConnLimitPolicy string
+
+	// HostKeyData is the PEM encoded SSH host key. HostKeyPath is a file
+	// holding it instead, created with a new key if missing. Without either,
+	// HostKeyPolicy "ephemeral" generates a key per start and "strict"
+	// refuses to start.
+	HostKeyData   string
+	HostKeyPath   string
+	HostKeyPolicy string
+
+	// SniffProtocol enables HTTP/raw TCP detection on tunnel connections.
+	SniffProtocol bool
+
+	// AllowedPorts and DeniedPorts are the raw upstream port lists (e.g.
+	// "80,8000-8999") parsed by the SSH server.
+	AllowedPorts string
+	DeniedPorts  string
+
+	// SSHSerialRequests handles each SSH connection's requests one at a time.
+	SSHSerialRequests bool
+
+	// ForwardAuthWebhook is the URL of an external service authorizing each
+	// forward. Empty disables it. ForwardAuthTimeout bounds each call, and
+	// ForwardAuthFailOpen allows forwards when the webhook fails.
+	ForwardAuthWebhook  string
+	ForwardAuthTimeout  time.Duration
+	ForwardAuthFailOpen bool
+
+	// TLSCertFile and TLSKeyFile are a PEM certificate and key; when both are
+	// set HTTPListen serves HTTPS with them instead of plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// HTTPSRedirectListen, if set, is a plain HTTP listener redirecting every
+	// request to HTTPS, for use with TLSCertFile or ACME.
+	HTTPSRedirectListen string
+
+	// ACMEEnabled issues a certificate per tunnel host over ACME HTTP-01 or
+	// TLS-ALPN-01 challenges, served on HTTPSListen.
+	ACMEEnabled bool
+
+	// HTTPSListen is the TLS proxy listener, served when ACMEDNSProvider or
+	// ACMEEnabled is set.
+	HTTPSListen string
+	// ACMEDNSProvider selects the DNS provider ("exec") used to answer ACME
+	// DNS-01 challenges for a wildcard certificate of Zone. Empty disables ACME.
+	// ACMEDNSConfig configures it; for "exec" it is the command to run.
+	ACMEDNSProvider string
+	ACMEDNSConfig   string
+	// ACMEEmail, ACMEDirectoryURL and ACMECacheDir configure the ACME account,
+	// CA and on-disk cache; ACMEDNSPropagation is how long to wait for a
+	// challenge record to propagate before validation.
+	ACMEEmail          string
+	ACMEDirectoryURL   string
+	ACMECacheDir       string
+	ACMEDNSPropagation time.Duration
+
+	// StartupWarmup keeps the proxy answering "starting up" for this long
+	// after all listeners are bound, giving clients time to reconnect their
+	// tunnels before traffic is routed. Zero becomes ready immediately.
+	StartupWarmup time.Duration
+
+	// ProxyProtocolTrusted lists the CIDRs or addresses of load balancers
+	// trusted to send PROXY protocol headers on the SSH and HTTP(S)
+	// listeners. Empty disables PROXY protocol.
+	ProxyProtocolTrusted []string
+
+	// TrustedProxies lists the CIDRs or addresses of reverse proxies whose
+	// X-Forwarded-For header gives the client address checked against
+	// tunnels' IP allow and deny lists.
+	TrustedProxies []string
+
+	// ReservedSubdomains are "name=user" entries reserving "<name>.<zone>"
+	// for a user. ReservationsFile, if set, persists reservations made
+	// through the admin API.
+	ReservedSubdomains []string
+	ReservationsFile   string
+
+	// QoSClasses are "user=class" entries assigning QoS classes (bulk,
+	// standard, interactive). QoSMaxConns is the server-wide tunneled
+	// connection budget QoS applies to (zero disables it) and QoSBulkRate the
+	// throughput of bulk connections while saturated, in bytes per second.
+	QoSClasses  []string
+	QoSMaxConns int
+	QoSBulkRate int
+
+	// RequestTimeout is the default time an upstream may take to respond
+	// before the request is answered with a 504; zero disables it.
+	// RequestTimeouts are "user=duration" overrides for users' tunnels.
+	RequestTimeout  time.Duration
+	RequestTimeouts []string
+
+	// TCPListenHost is the host public listeners of TCP-mode tunnels bind
+	// to; empty disables TCP tunnels.
+	TCPListenHost string
+
+	// PublicURLScheme and PublicURLPort override the scheme and port of the
+	// tunnel URLs reported to clients, for a proxy behind a load balancer
+	// whose public port differs from its listen address. Empty derives them
+	// from the TLS settings and listen addresses.
+	PublicURLScheme string
+	PublicURLPort   string
+
+	// AccessLog enables the access log of proxied requests, logging one in
+	// AccessLogSampleRate requests per route; errors and requests slower
+	// than AccessLogSlow are always logged.
+	AccessLog           bool
+	AccessLogSampleRate int
+	AccessLogSlow       time.Duration
+
+	// RateLimitRPS is the requests per second each tunnel host accepts,
+	// with bursts of up to RateLimitBurst; zero disables rate limiting.
+	RateLimitRPS   int
+	RateLimitBurst int
+
+	// MaintenanceMode starts the proxy in maintenance mode, scoped to
+	// MaintenanceHosts and MaintenanceUsers (every host when both are empty).
+	// MaintenancePage is the path of the page served meanwhile, with a
+	// Retry-After of MaintenanceRetryAfter. The admin API toggles it at runtime.
+	MaintenanceMode       bool
+	MaintenanceHosts      []string
+	MaintenanceUsers      []string
+	MaintenancePage       string
+	MaintenanceRetryAfter time.Duration
 }
 
-// Load loads the configuration from environment variables or a .env file.
-func Load() (*Config, error) {
+// Load loads the configuration from environment variables, a .env file and,
+// if path is set, a YAML config file. Each setting is taken from its
+// environment variable (.env values included), then from the config file,
+// then from its default.
+func Load(path string) (*Config, error) {
 	// Load .env if present
 	_ = godotenv.Load()
 
-	cfg := &Config{
-		Zone:           getenvOrDefault("ZONE", "example.com"),
-		SSHListen:      getenvOrDefault("SSH_LISTEN", ":2222"),
-		HTTPListen:     getenvOrDefault("HTTP_LISTEN", ":8080"),
-		AuthorizedKeys: os.Getenv("AUTHORIZED_KEYS_DATA"),
-		LogRequests:    strings.ToLower(os.Getenv("LOG_REQUESTS")) != "false",
+	var env envReader
+	if path != "" {
+		file, err := loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		env.file = file
 	}
+	cfg := &Config{
+		Zone:           env.string("ZONE", "example.com"),
+		SSHListen:      env.string("SSH_LISTEN", ":2222"),
+		HTTPListen:     env.string("HTTP_LISTEN", ":8080"),
+		AuthorizedKeys: env.string("AUTHORIZED_KEYS_DATA", ""),
+		LogRequests:    strings.ToLower(env.string("LOG_REQUESTS", "")) != "false",
+		AdminToken:     env.string("ADMIN_TOKEN", ""),
+		AdminListen:    env.string("ADMIN_LISTEN", ""),
+
+		AuthorizedKeysFile: env.string("AUTHORIZED_KEYS_FILE", ""),
+		TrustedCAKeys:      env.string("TRUSTED_CA_KEYS", ""),
+
+		LogFormat: env.string("LOG_FORMAT", "text"),
+		LogLevel:  env.string("LOG_LEVEL", ""),
+
+		MetricsRouteLabel:  env.string("METRICS_ROUTE_LABEL", ""),
+		MetricsHostBuckets: env.int("METRICS_HOST_BUCKETS", 0),
+
+		ControlSocket:   env.string("CONTROL_SOCKET", ""),
+		PublicOpenAPI:   env.bool("ADMIN_OPENAPI_PUBLIC", false),
+		SSHEnabled:      env.bool("SSH_ENABLED", true),
+		HTTPEnabled:     env.bool("HTTP_ENABLED", true),
+		DefaultUpstream: env.string("DEFAULT_UPSTREAM", ""),
+
+		ExtraZones:           env.list("EXTRA_ZONES"),
+		ZoneDefaultUpstreams: env.list("ZONE_DEFAULT_UPSTREAMS"),
+
+		ProxyPrewarmConns: env.int("PROXY_PREWARM_CONNS", 0),
+		RouteWarmupGrace:  env.duration("ROUTE_WARMUP_GRACE", 0),
+		ExposeUpstream:    env.bool("EXPOSE_UPSTREAM_HEADER", false),
+		PreserveHost:      env.bool("PRESERVE_HOST", false),
+		ForwardDeadline:   env.duration("SSH_FORWARD_DEADLINE", 30*time.Second),
+		SecurityHeaders:   env.string("SECURITY_HEADERS", ""),
+
+		ProxyDialTimeout:           env.duration("PROXY_DIAL_TIMEOUT", 0),
+		ProxyIdleConnTimeout:       env.duration("PROXY_IDLE_CONN_TIMEOUT", 0),
+		ProxyTLSHandshakeTimeout:   env.duration("PROXY_TLS_HANDSHAKE_TIMEOUT", 0),
+		ProxyResponseHeaderTimeout: env.duration("PROXY_RESPONSE_HEADER_TIMEOUT", 0),
+
+		TunnelIdleTimeout:     env.duration("TUNNEL_IDLE_TIMEOUT", 0),
+		ReconnectGrace:        env.duration("TUNNEL_RECONNECT_GRACE", 0),
+		SSHDrainTimeout:       env.duration("SSH_DRAIN_TIMEOUT", 10*time.Second),
+		TunnelTTL:             env.duration("TUNNEL_TTL", 0),
+		TunnelTTLMode:         env.string("TUNNEL_TTL_MODE", "absolute"),
+		ConnIdleTimeout:       env.duration("TUNNEL_CONN_IDLE_TIMEOUT", 0),
+		ConnIdleTimeoutExempt: env.list("TUNNEL_CONN_IDLE_EXEMPT_HOSTS"),
+		MaxUserConns:          env.int("MAX_USER_CONNS", 0),
+		MaxTunnelsPerUser:     env.int("MAX_TUNNELS_PER_USER", 5),
+		MaxUserSSHConns:       env.int("MAX_USER_SSH_CONNS", 0),
+		SSHConnLimitPolicy:    env.string("SSH_CONN_LIMIT_POLICY", "reject"),
+		HostKeyData:           env.string("HOST_KEY_DATA", ""),
+		HostKeyPath:           env.string("HOST_KEY_PATH", ""),
+		HostKeyPolicy:         env.string("HOST_KEY_POLICY", "ephemeral"),
+		SniffProtocol:         env.bool("TUNNEL_PROTOCOL_SNIFF", false),
+		AllowedPorts:          env.string("TUNNEL_ALLOWED_PORTS", ""),
+		DeniedPorts:           env.string("TUNNEL_DENIED_PORTS", ""),
+
+		SSHSerialRequests: env.bool("SSH_SERIAL_REQUESTS", false),
+
+		ForwardAuthWebhook:  env.string("FORWARD_AUTH_WEBHOOK", ""),
+		ForwardAuthTimeout:  env.duration("FORWARD_AUTH_TIMEOUT", 2*time.Second),
+		ForwardAuthFailOpen: env.bool("FORWARD_AUTH_FAIL_OPEN", false),
+
+		TLSCertFile:         env.string("TLS_CERT", ""),
+		TLSKeyFile:          env.string("TLS_KEY", ""),
+		HTTPSRedirectListen: env.string("HTTPS_REDIRECT_LISTEN", ""),
 
-	if cfg.AuthorizedKeys == "" {
-		// Instead of fatal, return an error to let the caller handle it
-		return nil, &ConfigError{Message: "AUTHORIZED_KEYS_DATA must be set (newline-separated authorized public keys)"}
+		ACMEEnabled:        env.bool("ACME_ENABLED", false),
+		HTTPSListen:        env.string("HTTPS_LISTEN", ":8443"),
+		ACMEDNSProvider:    env.string("ACME_DNS_PROVIDER", ""),
+		ACMEDNSConfig:      env.string("ACME_DNS_EXEC", ""),
+		ACMEEmail:          env.string("ACME_EMAIL", ""),
+		ACMEDirectoryURL:   env.string("ACME_DIRECTORY_URL", ""),
+		ACMECacheDir:       env.string("ACME_CACHE_DIR", "acme"),
+		ACMEDNSPropagation: env.duration("ACME_DNS_PROPAGATION", 30*time.Second),
+
+		StartupWarmup:        env.duration("STARTUP_WARMUP", 0),
+		ProxyProtocolTrusted: env.list("PROXY_PROTOCOL_TRUSTED"),
+
+		TrustedProxies: env.list("TRUSTED_PROXIES"),
+
+		ReservedSubdomains: env.list("RESERVED_SUBDOMAINS"),
+		ReservationsFile:   env.string("RESERVATIONS_FILE", ""),
+
+		QoSClasses:  env.list("QOS_CLASSES"),
+		QoSMaxConns: env.int("QOS_MAX_CONNS", 0),
+		QoSBulkRate: env.int("QOS_BULK_RATE", 1<<20),
+
+		RequestTimeout:  env.duration("REQUEST_TIMEOUT", 0),
+		RequestTimeouts: env.list("REQUEST_TIMEOUTS"),
+
+		TCPListenHost: env.string("TCP_TUNNEL_LISTEN_HOST", ""),
+
+		PublicURLScheme: env.string("PUBLIC_URL_SCHEME", ""),
+		PublicURLPort:   env.string("PUBLIC_URL_PORT", ""),
+
+		AccessLog:           env.bool("ACCESS_LOG", false),
+		AccessLogSampleRate: env.int("ACCESS_LOG_SAMPLE_RATE", 1),
+		AccessLogSlow:       env.duration("ACCESS_LOG_SLOW", time.Second),
+
+		RateLimitRPS:   env.int("RATE_LIMIT_RPS", 0),
+		RateLimitBurst: env.int("RATE_LIMIT_BURST", 0),
+
+		MaintenanceMode:       env.bool("MAINTENANCE_MODE", false),
+		MaintenanceHosts:      env.list("MAINTENANCE_HOSTS"),
+		MaintenanceUsers:      env.list("MAINTENANCE_USERS"),
+		MaintenancePage:       env.string("MAINTENANCE_PAGE", ""),
+		MaintenanceRetryAfter: env.duration("MAINTENANCE_RETRY_AFTER", 5*time.Minute),
+	}
+	if env.err != nil {
+		return nil, env.err
 	}
+	if err := env.unused(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	// An empty AUTHORIZED_KEYS_DATA is allowed here; the SSH server rejects a
+	// configuration without any authentication source as a whole.
 
 	return cfg, nil
 }
 
-// getenvOrDefault is a helper to get an environment variable or a default value.
-func getenvOrDefault(key, def string) string {
+// validate checks the settings Load can check on its own; the app validates
+// the rest as it builds on them.
+func (c *Config) validate() error {
+	if strings.TrimSpace(c.Zone) == "" {
+		return &ConfigError{Message: "ZONE must not be empty"}
+	}
+	listens := []struct {
+		key, addr string
+		used      bool
+	}{
+		{"SSH_LISTEN", c.SSHListen, c.SSHEnabled},
+		{"HTTP_LISTEN", c.HTTPListen, c.HTTPEnabled},
+		{"ADMIN_LISTEN", c.AdminListen, c.AdminListen != ""},
+		{"HTTPS_LISTEN", c.HTTPSListen, c.ACMEEnabled || c.ACMEDNSProvider != ""},
+		{"HTTPS_REDIRECT_LISTEN", c.HTTPSRedirectListen, c.HTTPSRedirectListen != ""},
+	}
+	for _, l := range listens {
+		if !l.used {
+			continue
+		}
+		if err := checkListenAddr(l.addr); err != nil {
+			return &ConfigError{Message: fmt.Sprintf("%s must be a host:port listen address, got %q: %v", l.key, l.addr, err)}
+		}
+	}
+	return nil
+}
+
+// checkListenAddr checks that addr is a host:port address net.Listen accepts,
+// such as ":8080" or "127.0.0.1:http".
+func checkListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if port == "" {
+		return errors.New("missing port")
+	}
+	_, err = net.LookupPort("tcp", port)
+	return err
+}
+
+// envReader reads typed settings, remembering the first parse error so Load
+// can report it once all values have been read. Settings come from their
+// environment variable, falling back to the config file.
+type envReader struct {
+	err error
+	// file holds the config file's settings by environment variable name.
+	file map[string]fileValue
+	// read records the settings looked up, to reject unknown keys in file.
+	read map[string]bool
+}
+
+// get returns the raw value of key, or "" when unset.
+func (e *envReader) get(key string) string {
+	if e.read == nil {
+		e.read = make(map[string]bool)
+	}
+	e.read[key] = true
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
+	return e.file[key].value
+}
+
+// fail records a parse error for key unless an earlier one was already recorded.
+func (e *envReader) fail(key, want string, err error) {
+	if e.err != nil {
+		return
+	}
+	msg := fmt.Sprintf("%s must be %s: %v", key, want, err)
+	if f, ok := e.file[key]; ok && os.Getenv(key) == "" {
+		msg = fmt.Sprintf("%s (%s line %d)", msg, f.path, f.line)
+	}
+	e.err = &ConfigError{Message: msg}
+}
+
+// unused returns an error for the first config file key that names no
+// setting, which is most likely a typo.
+func (e *envReader) unused() error {
+	var first *fileValue
+	var name string
+	for key, f := range e.file {
+		if !e.read[key] && (first == nil || f.line < first.line) {
+			first, name = &f, f.name
+		}
+	}
+	if first == nil {
+		return nil
+	}
+	return &ConfigError{Message: fmt.Sprintf("%s line %d: unknown setting %q", first.path, first.line, name)}
+}
+
+// string returns the value of key, or def when unset.
+func (e *envReader) string(key, def string) string {
+	if v := e.get(key); v != "" {
+		return v
+	}
 	return def
 }
 
+// list splits the comma-separated value of key, dropping empty items.
+func (e *envReader) list(key string) []string {
+	var out []string
+	for _, item := range strings.Split(e.get(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// int returns the integer value of key, or def when unset.
+func (e *envReader) int(key string, def int) int {
+	v := e.get(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail(key, "an integer", err)
+		return def
+	}
+	return n
+}
+
+// bool returns the boolean value of key (e.g. "true", "false", "1"), or def when unset.
+func (e *envReader) bool(key string, def bool) bool {
+	v := e.get(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(key, "a boolean", err)
+		return def
+	}
+	return b
+}
+
+// duration returns the time.Duration value of key (e.g. "30s"), or def when unset.
+func (e *envReader) duration(key string, def time.Duration) time.Duration {
+	v := e.get(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(key, "a duration", err)
+		return def
+	}
+	return d
+}
+
 // ConfigError represents a configuration loading error.
 type ConfigError struct {
 	Message string
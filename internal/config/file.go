@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A config file is a YAML mapping of settings named like their environment
+// variables, in any case:
+//
+//	zone: tunnel.example.com
+//	http_listen: :8080
+//	tunnel_ttl: 12h
+//	extra_zones: [tunnels.example.org, tunnels.example.net]
+//
+// Lists may also be given as comma-separated strings, as in the environment.
+
+// fileValue is a setting read from a config file.
+type fileValue struct {
+	value string
+	// name, path and line locate the setting for error messages.
+	name string
+	path string
+	line int
+}
+
+// loadFile reads the settings of the config file at path, keyed by
+// environment variable name.
+func loadFile(path string) (map[string]fileValue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &ConfigError{Message: "config file: " + err.Error()}
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, &ConfigError{Message: fmt.Sprintf("config file %s: %v", path, err)}
+	}
+	settings := make(map[string]fileValue)
+	if len(doc.Content) == 0 {
+		return settings, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, &ConfigError{Message: fmt.Sprintf("%s line %d: config file must be a mapping of settings", path, root.Line)}
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+		key := strings.ToUpper(k.Value)
+		if prev, ok := settings[key]; ok {
+			return nil, &ConfigError{Message: fmt.Sprintf("%s line %d: %s already set on line %d", path, k.Line, k.Value, prev.line)}
+		}
+		value, err := nodeValue(v)
+		if err != nil {
+			return nil, &ConfigError{Message: fmt.Sprintf("%s line %d: %s %v", path, k.Line, k.Value, err)}
+		}
+		settings[key] = fileValue{value: value, name: k.Value, path: path, line: k.Line}
+	}
+	return settings, nil
+}
+
+// nodeValue returns a setting's value in its environment variable form: a
+// scalar as written, and a list joined with commas.
+func nodeValue(n *yaml.Node) (string, error) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return "", nil
+		}
+		return n.Value, nil
+	case yaml.SequenceNode:
+		items := make([]string, 0, len(n.Content))
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("must be a list of scalars")
+			}
+			if strings.Contains(item.Value, ",") {
+				return "", fmt.Errorf("list items must not contain commas, got %q", item.Value)
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a scalar or a list")
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file with contents and returns its path.
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tunnelfy.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	// Start from a clean environment for the settings under test.
+	for _, key := range []string{"ZONE", "HTTP_LISTEN", "SSH_LISTEN", "TUNNEL_TTL", "EXTRA_ZONES", "MAX_TUNNELS_PER_USER"} {
+		t.Setenv(key, "")
+	}
+	path := writeConfig(t, `
+ZONE: file.example.com
+http_listen: 127.0.0.1:9000
+tunnel_ttl: 2h
+extra_zones: [a.example.org, b.example.org]
+max_tunnels_per_user: 7
+`)
+	t.Setenv("HTTP_LISTEN", "127.0.0.1:9100")
+	t.Setenv("MAX_TUNNELS_PER_USER", "3")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	tests := []struct {
+		name      string
+		got, want any
+	}{
+		{"file over default", cfg.Zone, "file.example.com"},
+		{"env over file", cfg.HTTPListen, "127.0.0.1:9100"},
+		{"default", cfg.SSHListen, ":2222"},
+		{"file duration", cfg.TunnelTTL, 2 * time.Hour},
+		{"file list", cfg.ExtraZones, []string{"a.example.org", "b.example.org"}},
+		{"env int over file", cfg.MaxTunnelsPerUser, 3},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// Without a file, the environment still applies on top of the defaults.
+	cfg, err = Load("")
+	if err != nil {
+		t.Fatalf("Load without a file: %v", err)
+	}
+	if cfg.Zone != "example.com" || cfg.HTTPListen != "127.0.0.1:9100" {
+		t.Errorf("without a file: zone %q, http_listen %q", cfg.Zone, cfg.HTTPListen)
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	for _, key := range []string{"ZONE", "HTTP_LISTEN", "TUNNEL_TTL", "EXTRA_ZONES"} {
+		t.Setenv(key, "")
+	}
+	tests := []struct {
+		name     string
+		contents string
+		wantMsg  string
+	}{
+		{"malformed YAML", "zone: [unclosed\n", "tunnelfy.yaml"},
+		{"not a mapping", "- zone\n- http_listen\n", "line 1: config file must be a mapping"},
+		{"unknown setting", "zone: example.com\n\nzoen: typo.example.com\n", `line 3: unknown setting "zoen"`},
+		{"duplicate setting", "zone: a.example.com\nZONE: b.example.com\n", "line 2: ZONE already set on line 1"},
+		{"nested mapping", "zone:\n  name: example.com\n", "line 1: zone must be a scalar or a list"},
+		{"comma in list item", "extra_zones: [\"a.example.org,b.example.org\"]\n", "list items must not contain commas"},
+		{"bad duration names its line", "zone: example.com\ntunnel_ttl: forever\n", "tunnelfy.yaml line 2)"},
+		{"bad listen address", "http_listen: localhost\n", "HTTP_LISTEN must be a host:port listen address"},
+		{"empty zone", "zone: \" \"\n", "ZONE must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.contents))
+			var cfgErr *ConfigError
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("Load: err = %v, want a ConfigError", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Fatalf("Load: err = %q, want it to mention %q", err, tt.wantMsg)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := Load(filepath.Join(t.TempDir(), "missing.yaml"))
+		var cfgErr *ConfigError
+		if !errors.As(err, &cfgErr) {
+			t.Fatalf("Load: err = %v, want a ConfigError", err)
+		}
+	})
+	t.Run("empty file", func(t *testing.T) {
+		if _, err := Load(writeConfig(t, "")); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+	})
+}
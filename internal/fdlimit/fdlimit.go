@@ -0,0 +1,73 @@
+// Package fdlimit recognizes file descriptor exhaustion (EMFILE, ENFILE) and
+// turns it into a clear, actionable signal instead of cryptic accept and dial
+// failures.
+package fdlimit
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// Backoff is how long an accept loop pauses after running out of file
+// descriptors, giving in-flight connections time to close and free some.
+const Backoff = time.Second
+
+// reportInterval rate-limits the log message; every occurrence is counted.
+const reportInterval = 10 * time.Second
+
+// Operations reported to Report.
+const (
+	OpAccept = "accept"
+	OpDial   = "dial"
+	OpListen = "listen"
+)
+
+var lastReport atomic.Int64
+
+// Exhausted reports whether err was caused by the process (EMFILE) or the
+// system (ENFILE) running out of file descriptors.
+func Exhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// Report counts a file descriptor exhaustion during op (one of the Op
+// constants) on addr and logs what to do about it, at most once per
+// reportInterval so a sustained shortage doesn't flood the logs.
+func Report(op, addr string, err error) {
+	metrics.FDExhausted.Inc(op)
+	now := time.Now().UnixNano()
+	last := lastReport.Load()
+	if now-last < int64(reportInterval) || !lastReport.CompareAndSwap(last, now) {
+		return
+	}
+	slog.Error("file descriptor limit reached: tunnelfy can't open more sockets; "+
+		"raise the open files limit (ulimit -n, LimitNOFILE= under systemd, --ulimit nofile= in Docker) "+
+		"or lower per-tunnel connection caps and PROXY_PREWARM_CONNS", "op", op, "addr", addr, "err", err)
+}
+
+// listener reports file descriptor exhaustion on Accept and backs off.
+type listener struct {
+	net.Listener
+}
+
+// NewListener wraps l so that an Accept failing for lack of file descriptors
+// is reported and returns only after Backoff. Callers retry temporary errors
+// as before, but no longer spin while no descriptor can be had.
+func NewListener(l net.Listener) net.Listener {
+	return &listener{Listener: l}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil && Exhausted(err) {
+		Report(OpAccept, l.Addr().String(), err)
+		time.Sleep(Backoff)
+	}
+	return c, err
+}
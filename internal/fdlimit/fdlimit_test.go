@@ -0,0 +1,93 @@
+package fdlimit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+func TestExhausted(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.ENFILE)}, true},
+		{fmt.Errorf("listen: %w", syscall.EMFILE), true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{net.ErrClosed, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := Exhausted(tt.err); got != tt.want {
+			t.Errorf("Exhausted(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// failingListener fails Accept with err.
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) { return nil, l.err }
+
+func TestListenerBacksOffOnExhaustion(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	lastReport.Store(0)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	l := NewListener(&failingListener{Listener: inner, err: emfile})
+
+	before := metrics.FDExhausted.Value(OpAccept)
+	start := time.Now()
+	if _, err := l.Accept(); !errors.Is(err, syscall.EMFILE) {
+		t.Fatalf("Accept error = %v, want EMFILE passed on", err)
+	}
+	if d := time.Since(start); d < Backoff {
+		t.Fatalf("Accept returned after %v, want a %v backoff", d, Backoff)
+	}
+	if got := metrics.FDExhausted.Value(OpAccept) - before; got != 1 {
+		t.Fatalf("fd exhaustion counted %d times, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "file descriptor limit reached") || !strings.Contains(logs.String(), "ulimit") {
+		t.Fatalf("no actionable log message:\n%s", logs.String())
+	}
+
+	// A sustained shortage is counted every time but logged once.
+	logs.Reset()
+	Report(OpDial, "127.0.0.1:1", emfile)
+	if logs.Len() != 0 {
+		t.Fatalf("repeated report logged again:\n%s", logs.String())
+	}
+	if got := metrics.FDExhausted.Value(OpAccept) - before; got != 1 {
+		t.Fatalf("accept count changed to %d by a dial report", got)
+	}
+
+	// Other errors pass through without a backoff.
+	l = NewListener(&failingListener{Listener: inner, err: net.ErrClosed})
+	start = time.Now()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept error = %v, want ErrClosed", err)
+	}
+	if d := time.Since(start); d >= Backoff {
+		t.Fatalf("a closed listener backed off for %v", d)
+	}
+}
@@ -0,0 +1,63 @@
+// Package logsafe makes untrusted strings (headers, hosts, usernames) safe to
+// write to logs.
+package logsafe
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxLen is the length in bytes beyond which String truncates its input.
+const MaxLen = 256
+
+// String returns s with control characters, invalid UTF-8 and other
+// non-printable runes escaped Go-style (e.g. "\n", "\x00"), so a crafted value
+// can't forge log lines or corrupt terminals, truncated to MaxLen bytes.
+func String(s string) string {
+	truncated := 0
+	if len(s) > MaxLen {
+		// Cut at a rune boundary so a rune split in half isn't escaped as invalid.
+		cut := MaxLen
+		for cut > MaxLen-utf8.UTFMax && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		truncated = len(s) - cut
+		s = s[:cut]
+	}
+	if isSafe(s) && truncated == 0 {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b.WriteString(`\x` + strconv.FormatUint(uint64(s[i])|0x100, 16)[1:])
+		case r == '\\':
+			b.WriteString(`\\`)
+		case unicode.IsPrint(r):
+			b.WriteRune(r)
+		default:
+			q := strconv.QuoteRune(r)
+			b.WriteString(q[1 : len(q)-1])
+		}
+		i += size
+	}
+	if truncated > 0 {
+		b.WriteString("…(" + strconv.Itoa(truncated) + " more bytes)")
+	}
+	return b.String()
+}
+
+// isSafe reports whether s can be logged as is.
+func isSafe(s string) bool {
+	for _, r := range s {
+		if r == utf8.RuneError || r == '\\' || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
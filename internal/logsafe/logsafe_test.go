@@ -0,0 +1,43 @@
+package logsafe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "alice.tunnelfy.test", "alice.tunnelfy.test"},
+		{"unicode", "café ☕", "café ☕"},
+		{"newline", "a\nlevel=ERROR msg=forged", `a\nlevel=ERROR msg=forged`},
+		{"carriage return", "a\r\nb", `a\r\nb`},
+		{"escape sequence", "\x1b[31mred", `\x1b[31mred`},
+		{"nul", "a\x00b", `a\x00b`},
+		{"invalid utf-8", "a\xffb", `a\xffb`},
+		{"backslash", `a\nb`, `a\\nb`},
+		{"bidi override", "a\u202eb", `a\u202eb`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := String(tt.in); got != tt.want {
+				t.Fatalf("String(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringTruncates(t *testing.T) {
+	got := String(strings.Repeat("a", MaxLen+10))
+	if want := strings.Repeat("a", MaxLen) + "…(10 more bytes)"; got != want {
+		t.Fatalf("String of %d bytes = %q, want %q", MaxLen+10, got, want)
+	}
+	// A multibyte rune straddling the limit is cut whole, not escaped.
+	got = String(strings.Repeat("a", MaxLen-1) + "é")
+	if want := strings.Repeat("a", MaxLen-1) + "…(2 more bytes)"; got != want {
+		t.Fatalf("String cut a rune in half: %q", got)
+	}
+}
@@ -0,0 +1,9 @@
+package metrics
+
+// Process resource metrics.
+var (
+	// FDExhausted counts operations that failed because the process or system
+	// ran out of file descriptors, by operation (accept, dial, listen).
+	FDExhausted = Default.NewCounterVec("tunnelfy_fd_exhausted_total",
+		"Operations that failed because the file descriptor limit was reached, by operation.", "op")
+)
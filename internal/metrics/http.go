@@ -0,0 +1,78 @@
+package metrics
+
+// HTTP proxy metrics.
+var (
+	// HTTPPanics counts requests whose handler panicked and was recovered.
+	HTTPPanics = Default.NewCounter("tunnelfy_http_panics_total",
+		"HTTP requests whose handler panicked.")
+
+	// HTTPUpstreamTruncated counts responses whose upstream closed the
+	// connection before the body was complete; the client connection is reset.
+	HTTPUpstreamTruncated = Default.NewCounter("tunnelfy_http_upstream_truncated_total",
+		"Upstream responses cut short by the upstream closing the connection.")
+
+	// HTTPUpstreamTimeouts counts requests answered with a 504 because the
+	// upstream didn't respond within the route's request timeout.
+	HTTPUpstreamTimeouts = Default.NewCounter("tunnelfy_http_upstream_timeouts_total",
+		"Requests answered with a 504 because the upstream didn't respond within the request timeout.")
+
+	// HTTPUpstreamDown counts requests answered with a 503 because their
+	// upstream refused the connection or its host doesn't resolve.
+	HTTPUpstreamDown = Default.NewCounter("tunnelfy_http_upstream_down_total",
+		"Requests answered with a 503 because nothing serves the upstream.")
+
+	// HTTPRateLimited counts requests answered with a 429 because their
+	// route was over the rate limit.
+	HTTPRateLimited = Default.NewCounter("tunnelfy_http_rate_limited_total",
+		"Requests answered with a 429 because their route was over the rate limit.")
+
+	// HTTPProxiedRequests counts every request proxied to a route,
+	// independently of the route labels of HTTPRequests.
+	HTTPProxiedRequests = Default.NewCounter("tunnelfy_http_proxied_requests_total",
+		"Requests proxied to a route.")
+
+	// HTTPServerErrors counts errors reported by the HTTP servers themselves
+	// rather than a handler, such as failed TLS handshakes, by kind; see
+	// the app package's server error log.
+	HTTPServerErrors = Default.NewCounterVec("tunnelfy_http_server_errors_total",
+		"Errors reported by the HTTP servers outside any handler, by kind.", "kind")
+
+	// HTTPRequests counts proxied requests by route label. The label is chosen
+	// by the configured strategy (tunnel user or host bucket), never the raw
+	// host, and is capped at MaxRouteSeries series; per-host request counts are
+	// available through the admin API.
+	HTTPRequests = Default.NewCounterVec("tunnelfy_http_requests_total",
+		"Proxied HTTP requests, by route label.", "route").WithMaxSeries(MaxRouteSeries)
+
+	// HTTPResponses counts the requests served by the proxy handler, proxied
+	// or not, by status class ("2xx", "4xx", ...). Hijacked connections, such
+	// as WebSocket upgrades, are counted under "hijacked".
+	HTTPResponses = Default.NewCounterVec("tunnelfy_http_responses_total",
+		"Requests served by the proxy handler, by status class.", "code")
+
+	// HTTPRequestDuration observes how long the proxy handler took to serve
+	// each request, excluding hijacked connections.
+	HTTPRequestDuration = Default.NewHistogram("tunnelfy_http_request_duration_seconds",
+		"Time the proxy handler took to serve a request, in seconds.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+
+	// HTTPBytes counts the body bytes passed through the proxy handler by
+	// direction: "received" from clients and "sent" to them. Bytes exchanged
+	// over hijacked connections aren't counted.
+	HTTPBytes = Default.NewCounterVec("tunnelfy_http_bytes_total",
+		"Body bytes passed through the proxy handler, by direction.", "direction")
+
+	// AdminEventsDropped counts events not delivered to an /api/events
+	// subscriber whose buffer was full.
+	AdminEventsDropped = Default.NewCounter("tunnelfy_admin_events_dropped_total",
+		"Events dropped for /api/events subscribers that didn't keep up.")
+
+	// Routes is the number of registered routes, from SSH tunnels and the
+	// admin API alike, including placeholders held for reconnecting tunnels.
+	// Default routes aren't counted.
+	Routes = Default.NewGauge("tunnelfy_routes",
+		"Registered routes, including placeholders held for reconnecting tunnels.")
+)
+
+// MaxRouteSeries bounds the series of per-route metrics.
+const MaxRouteSeries = 1000
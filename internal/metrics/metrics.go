@@ -0,0 +1,345 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// collector is implemented by every metric kind the Registry can expose.
+type collector interface {
+	write(w io.Writer)
+	// snapshot returns the metric's name and current value(s) for Values.
+	snapshot() (string, any)
+}
+
+// Registry holds metrics and renders them in the Prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []collector
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Default is the registry the package-level tunnelfy metrics are registered in.
+var Default = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, c)
+	r.mu.Unlock()
+}
+
+// NewCounter creates and registers a counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.register(c)
+	return c
+}
+
+// NewGauge creates and registers a gauge.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	r.register(g)
+	return g
+}
+
+// NewHistogram creates and registers a histogram with the given upper bucket
+// bounds, which must be sorted in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: buckets, counts: make([]atomic.Uint64, len(buckets))}
+	r.register(h)
+	return h
+}
+
+// NewCounterVec creates and registers a counter partitioned by a single label.
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{name: name, help: help, label: label, values: make(map[string]*atomic.Uint64)}
+	r.register(v)
+	return v
+}
+
+// Render renders every registered metric to w.
+func (r *Registry) Render(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]collector(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range metrics {
+		c.write(bw)
+	}
+	bw.Flush()
+}
+
+// Values returns the current value of every registered metric by name: a
+// uint64 for counters, an int64 for gauges, a map of label value to uint64 for
+// counter vectors and a HistogramValue for histograms.
+// It reads the same counters Render exposes, for consumers other than
+// Prometheus such as the JSON stats endpoint.
+func (r *Registry) Values() map[string]any {
+	r.mu.Lock()
+	metrics := append([]collector(nil), r.metrics...)
+	r.mu.Unlock()
+
+	values := make(map[string]any, len(metrics))
+	for _, c := range metrics {
+		name, v := c.snapshot()
+		values[name] = v
+	}
+	return values
+}
+
+// Handler returns an http.Handler serving the registry for Prometheus scrapes.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Render(w)
+	})
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	name string
+	help string
+	v    atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) snapshot() (string, any) {
+	return c.name, c.Value()
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.v.Load())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	name string
+	help string
+	v    atomic.Int64
+}
+
+// Add adjusts the gauge by delta.
+func (g *Gauge) Add(delta int64) {
+	g.v.Add(delta)
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+func (g *Gauge) snapshot() (string, any) {
+	return g.name, g.Value()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.v.Load())
+}
+
+// Histogram counts observations in cumulative buckets, Prometheus style.
+type Histogram struct {
+	name   string
+	help   string
+	bounds []float64
+	// counts holds the observations per bucket, not cumulative; values above
+	// the last bound are only in count.
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Uint64 // float64 bits
+}
+
+// HistogramValue is a histogram's state as returned by Registry.Values.
+type HistogramValue struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+	h.count.Add(1)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+func (h *Histogram) snapshot() (string, any) {
+	return h.name, HistogramValue{Count: h.count.Load(), Sum: math.Float64frombits(h.sum.Load())}
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	// Read count first: concurrent observations then only make the buckets
+	// lag behind it, never exceed it.
+	count := h.count.Load()
+	sum := math.Float64frombits(h.sum.Load())
+	var cumulative uint64
+	for i, b := range h.bounds {
+		cumulative += h.counts[i].Load()
+		cumulative = min(cumulative, count)
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+// OverflowLabel is the label value counted under once a CounterVec reaches its
+// series limit.
+const OverflowLabel = "other"
+
+// CounterVec is a set of counters partitioned by the value of one label.
+type CounterVec struct {
+	name  string
+	help  string
+	label string
+	// maxSeries caps the number of distinct label values; zero is unlimited.
+	maxSeries int
+
+	mu     sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+// WithMaxSeries caps the number of distinct label values at n, counting any
+// further values under OverflowLabel so the series count stays bounded.
+func (v *CounterVec) WithMaxSeries(n int) *CounterVec {
+	v.mu.Lock()
+	v.maxSeries = n
+	v.mu.Unlock()
+	return v
+}
+
+// Series returns the number of distinct label values currently exposed.
+func (v *CounterVec) Series() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return len(v.values)
+}
+
+// Inc increments the counter for labelValue by one.
+func (v *CounterVec) Inc(labelValue string) {
+	v.counter(labelValue).Add(1)
+}
+
+// Add increments the counter for labelValue by n.
+func (v *CounterVec) Add(labelValue string, n uint64) {
+	v.counter(labelValue).Add(n)
+}
+
+// Value returns the current count for labelValue.
+func (v *CounterVec) Value(labelValue string) uint64 {
+	v.mu.RLock()
+	c, ok := v.values[labelValue]
+	v.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	return c.Load()
+}
+
+// counter returns the counter for labelValue, creating it on first use.
+func (v *CounterVec) counter(labelValue string) *atomic.Uint64 {
+	v.mu.RLock()
+	c, ok := v.values[labelValue]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.values[labelValue]; ok {
+		return c
+	}
+	// Keep one slot for the overflow series itself.
+	if v.maxSeries > 0 && len(v.values) >= v.maxSeries-1 {
+		labelValue = OverflowLabel
+	}
+	if c, ok = v.values[labelValue]; !ok {
+		c = new(atomic.Uint64)
+		v.values[labelValue] = c
+	}
+	return c
+}
+
+// Sum returns the total over all label values.
+func (v *CounterVec) Sum() uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	var sum uint64
+	for _, c := range v.values {
+		sum += c.Load()
+	}
+	return sum
+}
+
+func (v *CounterVec) snapshot() (string, any) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	values := make(map[string]uint64, len(v.values))
+	for k, c := range v.values {
+		values[k] = c.Load()
+	}
+	return v.name, values
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", v.name, v.label, escapeLabel(k), v.values[k].Load())
+	}
+	v.mu.RUnlock()
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCounterVecRender(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("test_rejected_total", "Rejections, by reason.", "reason")
+	c := r.NewCounter("test_failures_total", "Failures.")
+	v.Inc(ForwardRejectDenied)
+	v.Add(ForwardRejectMalformed, 2)
+	v.Inc(ForwardRejectDenied)
+	c.Inc()
+
+	var b strings.Builder
+	r.Render(&b)
+	for _, want := range []string{
+		"# TYPE test_rejected_total counter\n",
+		`test_rejected_total{reason="denied"} 2` + "\n",
+		`test_rejected_total{reason="malformed"} 2` + "\n",
+		"test_failures_total 1\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("rendered metrics lack %q:\n%s", want, b.String())
+		}
+	}
+	if got := v.Sum(); got != 4 {
+		t.Errorf("Sum() = %d, want 4", got)
+	}
+}
+
+func TestCounterVecMaxSeries(t *testing.T) {
+	v := NewRegistry().NewCounterVec("test_requests_total", "Requests.", "route").WithMaxSeries(10)
+	for i := range 1000 {
+		v.Inc(fmt.Sprintf("host%d", i))
+	}
+	if got := v.Series(); got != 10 {
+		t.Fatalf("Series() = %d, want the cap of 10", got)
+	}
+	if got := v.Sum(); got != 1000 {
+		t.Fatalf("Sum() = %d, want every increment counted", got)
+	}
+	if got := v.Value(OverflowLabel); got != 1000-9 {
+		t.Fatalf("overflow series = %d, want %d", got, 1000-9)
+	}
+	// Label values seen before the cap keep their own series.
+	v.Inc("host0")
+	if got := v.Value("host0"); got != 2 {
+		t.Fatalf("host0 = %d, want 2", got)
+	}
+}
@@ -0,0 +1,9 @@
+package metrics
+
+// PROXY protocol metrics.
+var (
+	// ProxyProtocolRejected counts connections closed for sending a PROXY
+	// protocol header from an untrusted peer, or a malformed one.
+	ProxyProtocolRejected = Default.NewCounter("tunnelfy_proxy_protocol_rejected_total",
+		"Connections closed for an untrusted or malformed PROXY protocol header.")
+)
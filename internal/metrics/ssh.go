@@ -0,0 +1,71 @@
+package metrics
+
+// SSH server metrics.
+var (
+	// SSHHandshakeFailures counts connections that failed the SSH handshake,
+	// including those whose client never presented an authorized key.
+	SSHHandshakeFailures = Default.NewCounter("tunnelfy_ssh_handshake_failures_total",
+		"SSH connections that failed the handshake.")
+
+	// SSHUnauthorizedKeys counts public keys offered by clients that are not authorized.
+	SSHUnauthorizedKeys = Default.NewCounter("tunnelfy_ssh_unauthorized_keys_total",
+		"Public key authentication attempts with an unauthorized key.")
+
+	// SSHExpiredKeys counts authentications rejected because the authorized
+	// key passed its expiry-time.
+	SSHExpiredKeys = Default.NewCounter("tunnelfy_ssh_expired_keys_total",
+		"Authentications rejected because the authorized key expired.")
+
+	// SSHKeyUserMismatches counts authentications rejected because the
+	// authorized key is bound to another username.
+	SSHKeyUserMismatches = Default.NewCounter("tunnelfy_ssh_key_user_mismatches_total",
+		"Authentications rejected because the authorized key is bound to another username.")
+
+	// SSHForwardDeadlineExceeded counts authenticated connections closed for not
+	// establishing a forward within the configured deadline.
+	SSHForwardDeadlineExceeded = Default.NewCounter("tunnelfy_ssh_forward_deadline_exceeded_total",
+		"SSH connections closed for not establishing a forward in time.")
+
+	// SSHUserConnsLimited counts tunneled connections refused because their
+	// user reached the concurrent connection cap.
+	SSHUserConnsLimited = Default.NewCounter("tunnelfy_ssh_user_conns_limited_total",
+		"Tunneled connections refused because the user reached the concurrent connection cap.")
+
+	// SSHQoSConnsRefused counts tunneled connections refused because the
+	// server reached its QoS connection budget and they weren't interactive.
+	SSHQoSConnsRefused = Default.NewCounter("tunnelfy_ssh_qos_conns_refused_total",
+		"Non-interactive tunneled connections refused because the server reached its QoS connection budget.")
+
+	// SSHUserSSHConnsLimited counts SSH connections refused, or evicted,
+	// because their user reached the concurrent SSH connection cap.
+	SSHUserSSHConnsLimited = Default.NewCounter("tunnelfy_ssh_user_ssh_conns_limited_total",
+		"SSH connections refused or evicted because the user reached the concurrent SSH connection cap.")
+
+	// SSHTunnelsEvicted counts tunnels torn down because the proxy evicted
+	// their route, e.g. for being idle longer than TUNNEL_IDLE_TIMEOUT.
+	SSHTunnelsEvicted = Default.NewCounter("tunnelfy_ssh_tunnels_evicted_total",
+		"Tunnels torn down because their route was evicted, e.g. for being idle.")
+
+	// SSHTunnelsExpired counts tunnels closed because their TTL ran out.
+	SSHTunnelsExpired = Default.NewCounter("tunnelfy_ssh_tunnels_expired_total",
+		"Tunnels closed because their TTL ran out.")
+
+	// SSHForwardsRejected counts rejected tcpip-forward requests by reason.
+	SSHForwardsRejected = Default.NewCounterVec("tunnelfy_ssh_forwards_rejected_total",
+		"tcpip-forward requests rejected by the server, by reason.", "reason")
+)
+
+// Reasons used with SSHForwardsRejected.
+const (
+	ForwardRejectMalformed        = "malformed"
+	ForwardRejectInvalidSubdomain = "invalid_subdomain"
+	ForwardRejectListenFailed     = "listen_failed"
+	ForwardRejectRouteFailed      = "route_failed"
+	ForwardRejectPortDenied       = "port_denied"
+	ForwardRejectDenied           = "denied"
+	ForwardRejectReserved         = "reserved"
+	ForwardRejectInUse            = "in_use"
+	ForwardRejectTunnelLimit      = "tunnel_limit"
+	ForwardRejectKeyTunnelLimit   = "key_tunnel_limit"
+	ForwardRejectKeyExpired       = "key_expired"
+)
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// AccessTokenHeader and AccessTokenParam carry the access token of a
+// token-gated route, as a request header or a query parameter; links shared
+// with tools that can't prompt for credentials use the parameter. Both are
+// stripped before the request is proxied, so the app never sees the token.
+const (
+	AccessTokenHeader = "X-Tunnelfy-Token"
+	AccessTokenParam  = "tunnelfy_token"
+)
+
+// MaxAccessTokenLen bounds access tokens, which are compared in full on every
+// request to their route.
+const MaxAccessTokenLen = 256
+
+// NewAccessToken returns a random access token.
+func NewAccessToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ValidAccessToken reports whether token is usable in a header and a URL
+// unescaped: printable ASCII other than space, at most MaxAccessTokenLen bytes.
+func ValidAccessToken(token string) bool {
+	if token == "" || len(token) > MaxAccessTokenLen {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		if token[i] <= ' ' || token[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// SetRouteAccessToken gates host behind token: requests without it get a 403.
+// An empty token removes the gate. It reports whether host has a route.
+func (m *ShardedRouteManager) SetRouteAccessToken(host, token string) bool {
+	e, ok := m.lookup(host)
+	if !ok {
+		return false
+	}
+	e.setAccessToken(token)
+	if m.logRequests {
+		m.log.Debug("route access token", "host", logsafe.String(host), "gated", token != "")
+	}
+	return true
+}
+
+func (e *UpstreamEntry) setAccessToken(token string) {
+	if token == "" {
+		e.accessToken.Store(nil)
+		return
+	}
+	e.accessToken.Store(&token)
+}
+
+// tokenGated reports whether the route requires an access token.
+func (e *UpstreamEntry) tokenGated() bool {
+	return e.accessToken.Load() != nil
+}
+
+// checkAccessToken reports whether r may use the route, removing the token
+// from r either way. Tokens are compared in constant time.
+func (e *UpstreamEntry) checkAccessToken(r *http.Request) bool {
+	want := e.accessToken.Load()
+	got := r.Header.Get(AccessTokenHeader)
+	r.Header.Del(AccessTokenHeader)
+	if v, ok := stripQueryParam(r.URL, AccessTokenParam); ok && got == "" {
+		got = v
+	}
+	if want == nil {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(*want)) == 1
+}
+
+// stripQueryParam removes every name parameter from u's query, keeping the
+// other parameters as they were sent, and returns the first value.
+func stripQueryParam(u *url.URL, name string) (string, bool) {
+	if !strings.Contains(u.RawQuery, name) {
+		return "", false
+	}
+	var (
+		value string
+		found bool
+		kept  []string
+	)
+	for _, part := range strings.Split(u.RawQuery, "&") {
+		k, v, _ := strings.Cut(part, "=")
+		if k, err := url.QueryUnescape(k); err == nil && k == name {
+			if !found {
+				value, _ = url.QueryUnescape(v)
+				found = true
+			}
+			continue
+		}
+		kept = append(kept, part)
+	}
+	if found {
+		u.RawQuery = strings.Join(kept, "&")
+	}
+	return value, found
+}
+
+// serveForbiddenToken answers a request to a token-gated route with a missing
+// or wrong token.
+func serveForbiddenToken(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "forbidden: this tunnel requires a valid access token", http.StatusForbidden)
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessToken(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RawQuery+"|"+r.Header.Get(AccessTokenHeader))
+	}))
+	defer upstream.Close()
+	m := newTestManager(t, Options{})
+	host := "app." + testZone
+	if err := m.AddRouteWithOptions(host, upstream.URL, RouteOptions{AccessToken: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		header     string
+		wantStatus int
+		wantBody   string // what the app sees: query|token header
+	}{
+		{name: "header", target: "/", header: "s3cret", wantStatus: http.StatusOK, wantBody: "|"},
+		{name: "query", target: "/?a=1&tunnelfy_token=s3cret&b=2", wantStatus: http.StatusOK, wantBody: "a=1&b=2|"},
+		{name: "escaped query", target: "/?tunnelfy_token=s3cr%65t", wantStatus: http.StatusOK, wantBody: "|"},
+		{name: "missing", target: "/", wantStatus: http.StatusForbidden},
+		{name: "wrong header", target: "/", header: "s3cre", wantStatus: http.StatusForbidden},
+		{name: "wrong query", target: "/?tunnelfy_token=nope", wantStatus: http.StatusForbidden},
+		{name: "wrong header, right query", target: "/?tunnelfy_token=s3cret", header: "nope", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+host+tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set(AccessTokenHeader, tt.header)
+			}
+			rec := serveProxy(m, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != tt.wantBody {
+				t.Fatalf("the app saw %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// AccessLogOptions configures the access log of proxied requests.
+type AccessLogOptions struct {
+	// Enabled turns the access log on.
+	Enabled bool
+	// SampleRate logs one in every SampleRate successful requests of a route;
+	// zero or one logs all of them. Routes can override it with
+	// RouteOptions.LogSampleRate.
+	SampleRate int
+	// SlowThreshold, when positive, marks requests taking at least this long
+	// as slow. Slow requests and errors (5xx) are logged regardless of sampling.
+	SlowThreshold time.Duration
+}
+
+// sampleRate returns the effective sample rate of e.
+func (m *ShardedRouteManager) sampleRate(e *UpstreamEntry) int {
+	if e.logSampleRate > 0 {
+		return e.logSampleRate
+	}
+	return m.opts.AccessLog.SampleRate
+}
+
+// shouldLogAccess decides whether a request to e that finished with status
+// after d is logged. Sampling is deterministic: the first of every rate
+// sampled requests is logged.
+func (m *ShardedRouteManager) shouldLogAccess(e *UpstreamEntry, status int, d time.Duration) bool {
+	if status >= http.StatusInternalServerError {
+		return true
+	}
+	if slow := m.opts.AccessLog.SlowThreshold; slow > 0 && d >= slow {
+		return true
+	}
+	rate := m.sampleRate(e)
+	if rate <= 1 {
+		return true
+	}
+	return (e.logSeq.Add(1)-1)%uint64(rate) == 0
+}
+
+// logAccess writes the access log line of a request to e, if sampled.
+func (m *ShardedRouteManager) logAccess(e *UpstreamEntry, host string, r *http.Request, rec *responseRecorder, start time.Time) {
+	d := time.Since(start)
+	status := rec.status
+	if status == 0 && rec.hijacked {
+		status = http.StatusSwitchingProtocols
+	}
+	if !m.shouldLogAccess(e, status, d) {
+		return
+	}
+	m.log.Info("access", "host", logsafe.String(host), "method", logsafe.String(r.Method),
+		"uri", logsafe.String(r.URL.RequestURI()), "status", status, "bytes", rec.written,
+		"duration", d.Round(time.Microsecond), "remote", r.RemoteAddr, "request_id", r.Header.Get(RequestIDHeader))
+}
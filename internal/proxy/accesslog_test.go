@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+)
+
+// recordingHandler keeps the attribute values of every log record, before
+// any quoting by a slog handler.
+type recordingHandler struct {
+	mu     sync.Mutex
+	values map[string][]string // message -> "key=value" attributes
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{values: make(map[string][]string)}
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var add func(prefix string, a slog.Attr)
+	add = func(prefix string, a slog.Attr) {
+		if a.Value.Kind() == slog.KindGroup {
+			for _, g := range a.Value.Group() {
+				add(prefix+a.Key+".", g)
+			}
+			return
+		}
+		h.values[r.Message] = append(h.values[r.Message], prefix+a.Key+"="+a.Value.String())
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		add("", a)
+		return true
+	})
+	return nil
+}
+
+// attrs returns the attributes logged with msg.
+func (h *recordingHandler) attrs(msg string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.values[msg]
+}
+
+func TestLogsSanitizeRequests(t *testing.T) {
+	logs := newRecordingHandler()
+	m := newTestManager(t, Options{
+		Logger:    slog.New(logs),
+		AccessLog: AccessLogOptions{Enabled: true},
+	})
+	host := "app." + testZone
+	if err := m.AddRoute(host, newUpstream(t, "ok").Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	m.SetRouteDebug(host, time.Minute, false)
+
+	r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	r.URL.RawQuery = "q=1\nlevel=ERROR msg=forged"
+	r.Header.Set("X-Evil", "a\r\nX-Forged: 1\x1b[2J")
+	r.Header.Set("X-Long", strings.Repeat("v", 4096))
+	r.Header.Set(RequestIDHeader, "id\nforged")
+	serveProxy(m, r)
+
+	access, debug := logs.attrs("access"), logs.attrs("route debug")
+	if len(access) == 0 || len(debug) == 0 {
+		t.Fatalf("missing logs: access %q, route debug %q", access, debug)
+	}
+	for _, attr := range append(access, debug...) {
+		if i := strings.IndexFunc(attr, unicode.IsControl); i >= 0 {
+			t.Fatalf("logged attribute %q has control character %q", attr, attr[i])
+		}
+		if len(attr) > 1024 {
+			t.Fatalf("logged attribute of %d bytes wasn't truncated", len(attr))
+		}
+	}
+	want := []string{`uri=/?q=1\nlevel=ERROR msg=forged`, `headers.X-Evil=a\r\nX-Forged: 1\x1b[2J`}
+	all := strings.Join(append(access, debug...), "\n")
+	for _, w := range want {
+		if !strings.Contains(all, w) {
+			t.Fatalf("logs lack escaped %q:\n%s", w, all)
+		}
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	const slow = 30 * time.Millisecond
+	logs := newRecordingHandler()
+	m := newTestManager(t, Options{
+		Logger:    slog.New(logs),
+		AccessLog: AccessLogOptions{Enabled: true, SampleRate: 10, SlowThreshold: slow},
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		case "/slow":
+			time.Sleep(slow + 10*time.Millisecond)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	target := upstream.Listener.Addr().String()
+	if err := m.AddRoute("app."+testZone, target); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddRouteWithOptions("busy."+testZone, target, RouteOptions{LogSampleRate: 50}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		path string
+		n    int
+		want int
+	}{
+		{"app." + testZone, "/", 100, 10},
+		{"busy." + testZone, "/", 100, 2},
+		{"app." + testZone, "/error", 20, 20},
+		{"busy." + testZone, "/slow", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+tt.path, func(t *testing.T) {
+			before := len(logs.attrs("access"))
+			for range tt.n {
+				proxyGet(m, tt.host, tt.path)
+			}
+			logged := 0
+			for _, attr := range logs.attrs("access")[before:] {
+				if attr == "uri="+tt.path {
+					logged++
+				}
+			}
+			if logged != tt.want {
+				t.Fatalf("%d requests logged %d times, want %d", tt.n, logged, tt.want)
+			}
+		})
+	}
+}
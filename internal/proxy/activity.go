@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// activityBody records activity on its route for every chunk read, so a
+// long-lived stream (SSE, a large or slow download or upload) keeps its route
+// active for the idle reaper for as long as data flows, not just at its start.
+type activityBody struct {
+	io.ReadCloser
+	entry *UpstreamEntry
+}
+
+func (b *activityBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.entry.touch()
+	}
+	return n, err
+}
+
+// activityConn is activityBody for the upgraded connection of a 101 response
+// (e.g. a WebSocket), which ReverseProxy needs as an io.ReadWriteCloser.
+type activityConn struct {
+	io.ReadWriteCloser
+	entry *UpstreamEntry
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.entry.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.entry.touch()
+	}
+	return n, err
+}
+
+// trackResponseActivity wraps resp's body so reading it records activity on entry.
+func trackResponseActivity(resp *http.Response, entry *UpstreamEntry) {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+			resp.Body = &activityConn{ReadWriteCloser: rwc, entry: entry}
+		}
+		return
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	resp.Body = &activityBody{ReadCloser: resp.Body, entry: entry}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestActiveStreamSurvivesReaper(t *testing.T) {
+	const (
+		maxIdle  = 80 * time.Millisecond
+		interval = 20 * time.Millisecond
+		events   = 15 // 300ms of streaming, well past maxIdle
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range events {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(interval)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	m := newTestManager(t, Options{})
+	host := "stream." + testZone
+	var evicted atomic.Bool
+	if err := m.AddRouteWithOptions(host, upstream.Listener.Addr().String(), RouteOptions{OnEvict: func() { evicted.Store(true) }}); err != nil {
+		t.Fatal(err)
+	}
+	ps := httptest.NewServer(FastProxyHandler(m, testZone))
+	t.Cleanup(ps.Close)
+
+	stop := make(chan struct{})
+	reaped := make(chan struct{})
+	go func() {
+		defer close(reaped)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval / 2):
+				m.ReapIdle(maxIdle)
+			}
+		}
+	}()
+
+	req, _ := http.NewRequest(http.MethodGet, ps.URL+"/", nil)
+	req.Host = host
+	resp, err := ps.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	close(stop)
+	<-reaped
+	if err != nil {
+		t.Fatalf("stream cut short: %v", err)
+	}
+	if evicted.Load() {
+		t.Fatal("the route was reaped while its stream was active")
+	}
+
+	// Once the stream ends, the route goes idle like any other.
+	time.Sleep(maxIdle + interval)
+	if got := m.ReapIdle(maxIdle); len(got) != 1 || !evicted.Load() {
+		t.Fatalf("ReapIdle after the stream = %v, want the idle route evicted", got)
+	}
+}
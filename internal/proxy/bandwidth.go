@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// minThrottleChunk is the smallest read a throttled body is split into, so
+// very low rates still move data in reasonably sized pieces.
+const minThrottleChunk = 1024
+
+// tokenBucket is a token-bucket rate limiter measured in bytes. Its burst
+// is one second worth of tokens. Callers reserve tokens up front and sleep for
+// the returned delay, so concurrent requests share the rate fairly.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long the caller must wait before the
+// bytes they stand for may be passed on.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bandwidthLimit caps a route's throughput, independently per direction.
+type bandwidthLimit struct {
+	rate     int64 // bytes per second
+	chunk    int
+	request  *tokenBucket
+	response *tokenBucket
+}
+
+func newBandwidthLimit(rate int64) *bandwidthLimit {
+	return &bandwidthLimit{
+		rate:     rate,
+		chunk:    int(max(rate/10, minThrottleChunk)),
+		request:  newTokenBucket(rate),
+		response: newTokenBucket(rate),
+	}
+}
+
+// throttledBody rate-limits reads from body through bucket. It streams: each
+// read passes on at most one chunk and then waits for the bucket, so nothing
+// is buffered beyond the copy buffer of the caller.
+type throttledBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+	chunk  int
+}
+
+func (t *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		if d := t.bucket.reserve(n); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return n, t.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
+
+// SetRouteBandwidth caps the throughput of host's route at bytesPerSec in
+// each direction, for request and response bodies. A non-positive rate removes
+// the cap. It applies to requests started afterwards and reports whether host has a route.
+func (m *ShardedRouteManager) SetRouteBandwidth(host string, bytesPerSec int64) bool {
+	e, ok := m.lookup(host)
+	if !ok {
+		return false
+	}
+	e.setBandwidth(bytesPerSec)
+	if m.logRequests {
+		m.log.Debug("route bandwidth", "host", logsafe.String(host), "bytes_per_sec", max(bytesPerSec, 0))
+	}
+	return true
+}
+
+func (e *UpstreamEntry) setBandwidth(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		e.bandwidth.Store(nil)
+		return
+	}
+	e.bandwidth.Store(newBandwidthLimit(bytesPerSec))
+}
+
+// bandwidthRate returns the route's cap in bytes per second, or zero.
+func (e *UpstreamEntry) bandwidthRate() int64 {
+	if l := e.bandwidth.Load(); l != nil {
+		return l.rate
+	}
+	return 0
+}
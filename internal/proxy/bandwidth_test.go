@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(1000)
+	if d := b.reserve(1000); d != 0 {
+		t.Fatalf("reserving the burst waits %v, want 0", d)
+	}
+	if d := b.reserve(500); d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("reserving past the burst waits %v, want about 500ms", d)
+	}
+}
+
+func TestBandwidthLimitedResponse(t *testing.T) {
+	const rate = 100_000
+	body := bytes.Repeat([]byte("x"), 2*rate+rate/2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	t.Cleanup(upstream.Close)
+	m := newTestManager(t, Options{})
+	host := "app." + testZone
+	if err := m.AddRouteWithOptions(host, upstream.Listener.Addr().String(), RouteOptions{BandwidthLimit: rate}); err != nil {
+		t.Fatal(err)
+	}
+	ps := httptest.NewServer(FastProxyHandler(m, testZone))
+	t.Cleanup(ps.Close)
+
+	fetch := func() (firstByte, total time.Duration) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ps.URL+"/", nil)
+		req.Host = host
+		start := time.Now()
+		resp, err := ps.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if _, err := resp.Body.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		firstByte = time.Since(start)
+		n, err := io.Copy(io.Discard, resp.Body)
+		if err != nil || n+1 != int64(len(body)) {
+			t.Fatalf("read %d bytes (err %v), want %d", n+1, err, len(body))
+		}
+		return firstByte, time.Since(start)
+	}
+
+	// A second's burst, then the rest at the rate: about 1.5s.
+	firstByte, total := fetch()
+	if total < 1200*time.Millisecond || total > 4*time.Second {
+		t.Fatalf("throttled transfer of %d bytes at %d B/s took %v, want about 1.5s", len(body), rate, total)
+	}
+	if firstByte > total/2 {
+		t.Fatalf("first byte after %v of %v: the response wasn't streamed", firstByte, total)
+	}
+
+	m.SetRouteBandwidth(host, 0)
+	if _, total := fetch(); total > 500*time.Millisecond {
+		t.Fatalf("unthrottled transfer took %v", total)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxBasicAuthUserLen bounds basic auth usernames.
+const MaxBasicAuthUserLen = 64
+
+// basicAuthRealm is the realm of the challenge sent to clients without valid
+// credentials.
+const basicAuthRealm = `Basic realm="tunnelfy", charset="UTF-8"`
+
+// verifiedKey keys the digests BasicAuth caches verified credentials as. It
+// is random per process, so a cached digest can't be checked against guesses
+// without it, and nothing cached outlives the process.
+var verifiedKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	return key
+}()
+
+// BasicAuth password-protects a route: requests must carry HTTP basic auth
+// credentials for User whose password matches the bcrypt Hash, or get a 401.
+type BasicAuth struct {
+	User string
+	Hash []byte
+
+	// verified is the HMAC, under verifiedKey, of the last credentials that
+	// matched Hash, so a client sending them on every request doesn't pay for
+	// a bcrypt comparison each time. The trade-off: someone able to read the
+	// process's memory gets verifiedKey too and can test guesses against the
+	// digest at HMAC rather than bcrypt speed. Wrong credentials are never
+	// cached and always cost a bcrypt comparison, so guessing over the
+	// network stays slow.
+	verified atomic.Pointer[[sha256.Size]byte]
+}
+
+// NewBasicAuth returns a BasicAuth for user and a bcrypt hash of the password.
+func NewBasicAuth(user string, hash []byte) (*BasicAuth, error) {
+	if user == "" || len(user) > MaxBasicAuthUserLen || strings.ContainsRune(user, ':') ||
+		strings.IndexFunc(user, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+		return nil, fmt.Errorf("basic auth user must be printable text without colons, at most %d bytes", MaxBasicAuthUserLen)
+	}
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return nil, errors.New("basic auth hash must be a bcrypt hash")
+	}
+	return &BasicAuth{User: user, Hash: hash}, nil
+}
+
+// check reports whether r carries the credentials of a.
+func (a *BasicAuth) check(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(a.User)) != 1 {
+		return false
+	}
+	var digest [sha256.Size]byte
+	mac := hmac.New(sha256.New, verifiedKey)
+	mac.Write([]byte(user + ":" + password))
+	mac.Sum(digest[:0])
+	if v := a.verified.Load(); v != nil && subtle.ConstantTimeCompare(v[:], digest[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(a.Hash, []byte(password)) != nil {
+		return false
+	}
+	a.verified.Store(&digest)
+	return true
+}
+
+// checkBasicAuth reports whether r may use the route, removing the
+// credentials of a password-protected route from r so the app never sees
+// them.
+func (e *UpstreamEntry) checkBasicAuth(r *http.Request) bool {
+	if e.basicAuth == nil {
+		return true
+	}
+	ok := e.basicAuth.check(r)
+	r.Header.Del("Authorization")
+	return ok
+}
+
+// serveUnauthorized challenges a request to a password-protected route with
+// missing or wrong credentials.
+func serveUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", basicAuthRealm)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "unauthorized: this tunnel is password protected", http.StatusUnauthorized)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewBasicAuth("bob", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(t, Options{})
+	// The upstream echoes the Authorization header it receives.
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	t.Cleanup(up.Close)
+	host := "staging." + testZone
+	if err := m.AddRouteWithOptions(host, up.Listener.Addr().String(), RouteOptions{BasicAuth: auth}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, user, password string
+		noCredentials        bool
+		want                 int
+	}{
+		{name: "missing", noCredentials: true, want: http.StatusUnauthorized},
+		{name: "wrong password", user: "bob", password: "hunter3", want: http.StatusUnauthorized},
+		{name: "wrong user", user: "alice", password: "hunter2", want: http.StatusUnauthorized},
+		{name: "correct", user: "bob", password: "hunter2", want: http.StatusOK},
+		// Once the correct credentials are cached, others still fail.
+		{name: "correct again", user: "bob", password: "hunter2", want: http.StatusOK},
+		{name: "wrong after correct", user: "bob", password: "hunter22", want: http.StatusUnauthorized},
+		{name: "empty password", user: "bob", password: "", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+			if !tt.noCredentials {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			rec := serveProxy(m, r)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without a WWW-Authenticate challenge")
+			}
+			if tt.want == http.StatusOK && rec.Body.String() != "" {
+				t.Fatalf("app received the credentials: %q", rec.Body)
+			}
+		})
+	}
+}
+
+func TestNewBasicAuthInvalid(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, user string
+		hash       []byte
+	}{
+		{"empty user", "", hash},
+		{"colon in user", "a:b", hash},
+		{"control character in user", "a\nb", hash},
+		{"not bcrypt", "bob", []byte("plaintext")},
+	}
+	for _, tt := range tests {
+		if _, err := NewBasicAuth(tt.user, tt.hash); err == nil {
+			t.Errorf("%s: NewBasicAuth succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// maxControlLine bounds a single control socket request.
+const maxControlLine = 1 << 20
+
+// controlRequest is one line of the control socket protocol.
+type controlRequest struct {
+	Op     string `json:"op"`
+	Host   string `json:"host,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// controlResponse answers a controlRequest on a single line.
+type controlResponse struct {
+	OK     bool              `json:"ok"`
+	Error  string            `json:"error,omitempty"`
+	Routes map[string]string `json:"routes,omitempty"`
+	Route  *RouteInfo        `json:"route,omitempty"`
+}
+
+// ServeControl serves the control protocol on l until it is closed: each
+// connection sends newline-delimited JSON requests such as {"op":"list"},
+// {"op":"get","host":...}, {"op":"add","host":...,"target":...},
+// {"op":"drain","host":...} or {"op":"remove","host":...}, and receives one
+// JSON response line per request. It mirrors the HTTP admin API for local
+// tooling, plus drain, which lets a script stop a route's new requests before
+// removing it; access is controlled by the socket's file permissions.
+func ServeControl(l net.Listener, m *ShardedRouteManager) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go serveControlConn(c, m)
+	}
+}
+
+func serveControlConn(c net.Conn, m *ShardedRouteManager) {
+	defer c.Close()
+	sc := bufio.NewScanner(c)
+	sc.Buffer(make([]byte, 0, 4096), maxControlLine)
+	enc := json.NewEncoder(c)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var req controlRequest
+		var resp controlResponse
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			resp = controlResponse{Error: "invalid JSON request"}
+		} else {
+			resp = handleControl(m, req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+	if err := sc.Err(); err != nil && m.logRequests {
+		m.log.Debug("control connection error", "err", err)
+	}
+}
+
+func handleControl(m *ShardedRouteManager, req controlRequest) controlResponse {
+	switch req.Op {
+	case "list":
+		return controlResponse{OK: true, Routes: m.ListRoutes()}
+	case "get":
+		info, ok := m.GetRouteInfo(normalizeHost(req.Host))
+		if !ok {
+			return controlResponse{Error: "route not found"}
+		}
+		return controlResponse{OK: true, Route: &info}
+	case "add":
+		info, err := routeRequest{Host: req.Host, Target: req.Target}.apply(m)
+		if err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		return controlResponse{OK: true, Route: &info}
+	case "drain":
+		if !m.DrainRoute(normalizeHost(req.Host)) {
+			return controlResponse{Error: "route not found"}
+		}
+		return controlResponse{OK: true}
+	case "remove":
+		// Like DELETE /api/routes/{host}, this tears the tunnel down too.
+		if !m.DeleteRoute(normalizeHost(req.Host)) {
+			return controlResponse{Error: "route not found"}
+		}
+		return controlResponse{OK: true}
+	default:
+		return controlResponse{Error: fmt.Sprintf("unknown op %q", req.Op)}
+	}
+}
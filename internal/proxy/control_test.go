@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// dialControl serves the control socket for m and connects to it.
+func dialControl(t *testing.T, m *ShardedRouteManager) func(req string) controlResponse {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "control.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go ServeControl(l, m)
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	r := bufio.NewReader(c)
+	return func(req string) controlResponse {
+		t.Helper()
+		if _, err := c.Write([]byte(req + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp controlResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatalf("invalid response %q: %v", line, err)
+		}
+		return resp
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	m := newTestManager(t, Options{})
+	evicted := map[string]bool{}
+	host := "app." + testZone
+	addEvictableRoute(t, m, host, evicted)
+	send := dialControl(t, m)
+
+	resp := send(`{"op":"list"}`)
+	if !resp.OK || resp.Routes[host] == "" || len(resp.Routes) != 1 {
+		t.Fatalf("list = %+v, want only %s", resp, host)
+	}
+
+	tests := []struct {
+		req     string
+		wantErr string
+	}{
+		{`{"op":"drain","host":"App.` + testZone + `"}`, ""},
+		{`{"op":"remove","host":"` + host + `"}`, ""},
+		{`{"op":"remove","host":"` + host + `"}`, "route not found"},
+		{`{"op":"drain","host":"` + host + `"}`, "route not found"},
+		{`{"op":"reboot"}`, `unknown op "reboot"`},
+		{`not json`, "invalid JSON request"},
+	}
+	for _, tt := range tests {
+		resp := send(tt.req)
+		if resp.OK != (tt.wantErr == "") || resp.Error != tt.wantErr {
+			t.Fatalf("%s = %+v, want error %q", tt.req, resp, tt.wantErr)
+		}
+	}
+	if !evicted[host] {
+		t.Fatal("remove didn't tear the tunnel down")
+	}
+	if resp := send(`{"op":"list"}`); !resp.OK || len(resp.Routes) != 0 {
+		t.Fatalf("list after remove = %+v", resp)
+	}
+}
+
+func TestDrainedRouteRefusesRequests(t *testing.T) {
+	m := newTestManager(t, Options{})
+	up := newUpstream(t, "ok")
+	host := "app." + testZone
+	if err := m.AddRoute(host, up.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := proxyGet(m, host, "/"); rec.Code != http.StatusOK {
+		t.Fatalf("before drain: status %d", rec.Code)
+	}
+	if !m.DrainRoute(host) {
+		t.Fatal("DrainRoute: route not found")
+	}
+	rec := proxyGet(m, host, "/")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("after drain: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if info, _ := m.GetRouteInfo(host); !info.Draining {
+		t.Fatal("route info doesn't report draining")
+	}
+}
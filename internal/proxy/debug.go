@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// MaxRouteDebugDuration bounds how long verbose header logging stays enabled
+// for a route, so a forgotten toggle can't flood the logs indefinitely.
+const MaxRouteDebugDuration = time.Hour
+
+// redactedHeaders are masked in debug header dumps unless redaction is disabled.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// SetRouteDebug enables verbose request/response header logging for host for
+// duration d (capped at MaxRouteDebugDuration); it switches off by itself once
+// d elapses. A non-positive d disables it immediately. Sensitive headers are
+// redacted unless unredacted is set. It reports whether host has a route.
+func (m *ShardedRouteManager) SetRouteDebug(host string, d time.Duration, unredacted bool) bool {
+	e, ok := m.lookup(host)
+	if !ok {
+		return false
+	}
+	if d <= 0 {
+		e.debugUntil.Store(0)
+		return true
+	}
+	if d > MaxRouteDebugDuration {
+		d = MaxRouteDebugDuration
+	}
+	e.debugUnredacted.Store(unredacted)
+	e.debugUntil.Store(time.Now().Add(d).UnixNano())
+	m.log.Info("route debug enabled", "host", logsafe.String(host), "duration", d)
+	return true
+}
+
+// debugging reports whether verbose header logging is currently enabled.
+func (e *UpstreamEntry) debugging() bool {
+	until := e.debugUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// logHeaders dumps h for a debugged route to log as a group of headers in
+// sorted order.
+func (e *UpstreamEntry) logHeaders(log *slog.Logger, host, what string, h http.Header) {
+	redact := !e.debugUnredacted.Load()
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := make([]any, 0, len(names))
+	for _, name := range names {
+		value := logsafe.String(strings.Join(h[name], ", "))
+		if redact && isRedactedHeader(name) {
+			value = "[REDACTED]"
+		}
+		headers = append(headers, slog.String(logsafe.String(name), value))
+	}
+	log.Info("route debug", "host", logsafe.String(host), "what", what, slog.Group("headers", headers...))
+}
+
+func isRedactedHeader(name string) bool {
+	for _, r := range redactedHeaders {
+		if strings.EqualFold(name, r) {
+			return true
+		}
+	}
+	return false
+}
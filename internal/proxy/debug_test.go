@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteDebugLogsHeaders(t *testing.T) {
+	var logs bytes.Buffer
+	m := newTestManager(t, Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	upstream := newUpstream(t, "ok")
+	debugged, quiet, unredacted := "debug."+testZone, "quiet."+testZone, "raw."+testZone
+	for _, host := range []string{debugged, quiet, unredacted} {
+		if err := m.AddRoute(host, upstream.Listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.SetRouteDebug(debugged, time.Minute, false)
+	m.SetRouteDebug(unredacted, time.Minute, true)
+
+	get := func(host string) string {
+		logs.Reset()
+		r, _ := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		r.Header.Set("X-Trace", "abc")
+		serveProxy(m, r)
+		return logs.String()
+	}
+
+	out := get(debugged)
+	if !strings.Contains(out, "headers.X-Trace=abc") || !strings.Contains(out, "response 200 OK") {
+		t.Fatalf("debugged route didn't log its request and response headers:\n%s", out)
+	}
+	if strings.Contains(out, "s3cret") || !strings.Contains(out, "headers.Authorization=[REDACTED]") {
+		t.Fatalf("Authorization not redacted:\n%s", out)
+	}
+	if out := get(quiet); strings.Contains(out, "route debug") {
+		t.Fatalf("route without debug logged headers:\n%s", out)
+	}
+	if out := get(unredacted); !strings.Contains(out, "s3cret") {
+		t.Fatalf("unredacted route masked Authorization:\n%s", out)
+	}
+
+	// Debugging switches off by itself.
+	m.SetRouteDebug(debugged, time.Millisecond, false)
+	time.Sleep(5 * time.Millisecond)
+	if out := get(debugged); strings.Contains(out, "route debug") {
+		t.Fatalf("expired debug still logged headers:\n%s", out)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/metrics"
+)
+
+// truncationDetector wraps an upstream response body to notice the upstream
+// closing the connection before the body was complete. httputil.ReverseProxy
+// then aborts the client connection (a reset, not a clean end of response), so
+// the client can tell the response was incomplete; this records why.
+type truncationDetector struct {
+	io.ReadCloser
+	resp     *http.Response
+	host     string
+	read     int64
+	reported bool
+}
+
+func (d *truncationDetector) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.read += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && !d.reported {
+		// A cancelled request means the client went away, not the upstream.
+		if d.resp.Request == nil || d.resp.Request.Context().Err() == nil {
+			d.reported = true
+			metrics.HTTPUpstreamTruncated.Inc()
+			slog.Warn("upstream closed response early", "host", logsafe.String(d.host), "status", d.resp.StatusCode,
+				"read", d.read, "content_length", d.resp.ContentLength, "request_id", requestIDOf(d.resp), "err", err)
+		}
+	}
+	return n, err
+}
+
+// detectTruncation wraps resp's body with a truncationDetector. The body of a
+// 101 response is the upgraded connection, which must stay an io.ReadWriteCloser.
+func detectTruncation(resp *http.Response, host string) {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	resp.Body = &truncationDetector{ReadCloser: resp.Body, resp: resp, host: host}
+}
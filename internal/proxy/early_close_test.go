@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// closingUpstream starts an upstream that answers each request with raw and
+// then closes the connection.
+func closingUpstream(t *testing.T, raw string) string {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		buf.WriteString(raw)
+		buf.Flush()
+	}))
+	t.Cleanup(s.Close)
+	return s.Listener.Addr().String()
+}
+
+func TestUpstreamEarlyClose(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           string
+		wantStatus    int // when headers reach the client
+		wantTruncated bool
+	}{
+		{"before headers", "", http.StatusBadGateway, false},
+		{"mid body", "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial", http.StatusOK, true},
+		{"mid chunked body", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\npartial\r\n", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, Options{})
+			host := "app." + testZone
+			if err := m.AddRoute(host, closingUpstream(t, tt.raw)); err != nil {
+				t.Fatal(err)
+			}
+			ps := httptest.NewServer(FastProxyHandler(m, testZone))
+			t.Cleanup(ps.Close)
+
+			before := metrics.HTTPUpstreamTruncated.Value()
+			req, _ := http.NewRequest(http.MethodGet, ps.URL+"/", nil)
+			req.Host = host
+			// Headers may still sit in the proxy's buffer when the connection
+			// is reset, so the client sees either the request or its body fail.
+			resp, err := ps.Client().Do(req)
+			if err == nil {
+				defer resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+				_, err = io.ReadAll(resp.Body)
+			}
+			if truncated := err != nil; truncated != tt.wantTruncated {
+				t.Fatalf("client error = %v, want the response reported incomplete: %v", err, tt.wantTruncated)
+			}
+			if tt.wantTruncated {
+				waitFor(t, "truncation counted", func() bool { return metrics.HTTPUpstreamTruncated.Value() > before })
+			}
+		})
+	}
+}
+
+func TestClientEarlyCloseNotCountedAsTruncation(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	defer close(release)
+	m := newTestManager(t, Options{})
+	host := "app." + testZone
+	if err := m.AddRoute(host, upstream.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	ps := httptest.NewServer(FastProxyHandler(m, testZone))
+	t.Cleanup(ps.Close)
+
+	before := metrics.HTTPUpstreamTruncated.Value()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ps.URL+"/", nil)
+	req.Host = host
+	resp, err := ps.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufio.NewReader(resp.Body).Peek(len("partial"))
+	cancel()
+	resp.Body.Close()
+	time.Sleep(50 * time.Millisecond)
+	if got := metrics.HTTPUpstreamTruncated.Value(); got != before {
+		t.Fatalf("a client going away counted %d truncations", got-before)
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// Event types streamed by EventsAPIHandler.
+const (
+	EventRouteAdded   = "route_added"
+	EventRouteRemoved = "route_removed"
+	EventRequest      = "request"
+)
+
+// Event is a route change or a finished proxied request.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	// Target is the upstream of an added route.
+	Target string `json:"target,omitempty"`
+	// Method, Status, DurationMS and RequestID describe a request. Upgraded
+	// connections are reported with status 101 once they close.
+	Method     string  `json:"method,omitempty"`
+	Status     int     `json:"status,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+}
+
+// eventBuffer is each subscriber's buffer; events for a subscriber with a
+// full buffer are dropped rather than slowing down the proxy.
+const eventBuffer = 256
+
+// eventHeartbeat is how often an idle event stream gets a comment line, so
+// intermediaries don't time it out.
+const eventHeartbeat = 15 * time.Second
+
+// eventHub fans events out to subscribers. Its zero value has none.
+type eventHub struct {
+	// n is the subscriber count, read without the lock so publishing costs
+	// nothing while nobody listens.
+	n    atomic.Int32
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+	// closed is closed by close to end every stream.
+	closed chan struct{}
+}
+
+// done returns a channel closed once the hub is closed.
+func (h *eventHub) done() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed == nil {
+		h.closed = make(chan struct{})
+	}
+	return h.closed
+}
+
+// close ends every current and future stream. It is idempotent.
+func (h *eventHub) close() {
+	done := h.done()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-done:
+	default:
+		close(h.closed)
+	}
+}
+
+// active reports whether anyone is subscribed.
+func (h *eventHub) active() bool {
+	return h.n.Load() > 0
+}
+
+// subscribe registers a subscriber, returning its channel and the func that
+// unregisters it.
+func (h *eventHub) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan Event]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	h.n.Add(1)
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.n.Add(-1)
+		h.mu.Unlock()
+	}
+}
+
+// publish sends e to every subscriber with room for it.
+func (h *eventHub) publish(e Event) {
+	if !h.active() {
+		return
+	}
+	e.Time = time.Now().UTC()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			metrics.AdminEventsDropped.Inc()
+		}
+	}
+}
+
+// finishRequest runs after a proxied request whose response was recorded for
+// the access log or event subscribers.
+func (m *ShardedRouteManager) finishRequest(e *UpstreamEntry, host string, r *http.Request, rec *responseRecorder, start time.Time) {
+	if m.opts.AccessLog.Enabled {
+		m.logAccess(e, host, r, rec, start)
+	}
+	status := rec.status
+	if status == 0 && rec.hijacked {
+		status = http.StatusSwitchingProtocols
+	}
+	m.events.publish(Event{
+		Type:       EventRequest,
+		Host:       host,
+		Method:     r.Method,
+		Status:     status,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		RequestID:  r.Header.Get(RequestIDHeader),
+	})
+}
+
+// CloseEvents ends every /api/events stream, which http.Server.Shutdown would
+// otherwise wait on until its deadline, and makes new ones end immediately.
+func (m *ShardedRouteManager) CloseEvents() {
+	m.events.close()
+}
+
+// EventsAPIHandler serves GET /api/events, a Server-Sent Events stream of
+// route additions and removals and of proxied requests. Each event has its
+// type as the event name and an Event as JSON data. Events are dropped for a
+// client that doesn't keep up. Streams end when the client goes away or on
+// CloseEvents.
+func EventsAPIHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rc := http.NewResponseController(w)
+		events, unsubscribe := m.events.subscribe()
+		defer unsubscribe()
+		closed := m.events.done()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-closed:
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case e := <-events:
+				data, _ := json.Marshal(e)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openEvents subscribes to /api/events on a test server for m.
+func openEvents(t *testing.T, m *ShardedRouteManager) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	s := httptest.NewServer(EventsAPIHandler(m))
+	t.Cleanup(s.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestEventsStreamRouteAdded(t *testing.T) {
+	m := newTestManager(t, Options{})
+	resp, r := openEvents(t, m)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	host := "app." + testZone
+	if err := m.AddRoute(host, "10.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"event: " + EventRouteAdded, `"host":"` + host + `"`} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(line, want) {
+			t.Fatalf("got %q, want it to contain %q", line, want)
+		}
+	}
+}
+
+func TestCloseEventsEndsStreams(t *testing.T) {
+	m := newTestManager(t, Options{})
+	_, r := openEvents(t, m)
+	m.CloseEvents()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("stream didn't end cleanly: %v", err)
+	}
+
+	// Streams opened after closing end at once.
+	_, r = openEvents(t, m)
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("stream didn't end cleanly: %v", err)
+	}
+}
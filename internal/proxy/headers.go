@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultSecurityHeaders is the set of response headers injected when security
+// headers are enabled without an explicit list.
+var DefaultSecurityHeaders = map[string]string{
+	"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "SAMEORIGIN",
+	"Referrer-Policy":           "strict-origin-when-cross-origin",
+}
+
+// ParseSecurityHeaders parses a security header spec. An empty spec or "false"
+// disables injection, "true" selects DefaultSecurityHeaders, and anything else
+// is read as newline-separated "Name: value" lines.
+func ParseSecurityHeaders(spec string) (map[string]string, error) {
+	switch strings.ToLower(strings.TrimSpace(spec)) {
+	case "", "false":
+		return nil, nil
+	case "true":
+		out := make(map[string]string, len(DefaultSecurityHeaders))
+		for k, v := range DefaultSecurityHeaders {
+			out[k] = v
+		}
+		return out, nil
+	}
+
+	out := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(spec))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid security header %q: want \"Name: value\"", line)
+		}
+		out[http.CanonicalHeaderKey(name)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// validSecurityHeaders returns headers with canonical names, or an error if a
+// name isn't a header token or a value is empty or spans lines. A non-nil
+// empty map stays non-nil, as it disables injection.
+func validSecurityHeaders(headers map[string]string) (map[string]string, error) {
+	if headers == nil {
+		return nil, nil
+	}
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		value = strings.TrimSpace(value)
+		if !validHeaderName(name) || value == "" || strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid security header %q: %q", name, value)
+		}
+		out[http.CanonicalHeaderKey(name)] = value
+	}
+	return out, nil
+}
+
+// validHeaderName reports whether name is a plausible header name: letters,
+// digits and hyphens.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// injectMissingHeaders sets each header in defaults that the response doesn't already carry.
+func injectMissingHeaders(h http.Header, defaults map[string]string) {
+	for name, value := range defaults {
+		if h.Get(name) == "" {
+			h.Set(name, value)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "false", want: nil},
+		{spec: "TRUE", want: DefaultSecurityHeaders},
+		{spec: "x-frame-options: DENY\n# comment\n\nContent-Security-Policy: default-src 'self'", want: map[string]string{
+			"X-Frame-Options":         "DENY",
+			"Content-Security-Policy": "default-src 'self'",
+		}},
+		{spec: "X-Frame-Options", wantErr: true},
+		{spec: "X-Frame-Options:", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSecurityHeaders(tt.spec)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSecurityHeaders(%q) = %v, %v; want %v, error %v", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	server := map[string]string{"X-Frame-Options": "SAMEORIGIN", "X-Content-Type-Options": "nosniff"}
+	tests := []struct {
+		name     string
+		route    map[string]string
+		upstream map[string]string
+		want     map[string]string
+	}{
+		{
+			name: "added when absent",
+			want: map[string]string{"X-Frame-Options": "SAMEORIGIN", "X-Content-Type-Options": "nosniff"},
+		},
+		{
+			name:     "not overwritten when present",
+			upstream: map[string]string{"X-Frame-Options": "DENY"},
+			want:     map[string]string{"X-Frame-Options": "DENY", "X-Content-Type-Options": "nosniff"},
+		},
+		{
+			name:  "route override",
+			route: map[string]string{"referrer-policy": "no-referrer"},
+			want:  map[string]string{"Referrer-Policy": "no-referrer", "X-Frame-Options": "", "X-Content-Type-Options": ""},
+		},
+		{
+			name:  "route disables",
+			route: map[string]string{},
+			want:  map[string]string{"X-Frame-Options": "", "X-Content-Type-Options": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, Options{SecurityHeaders: server})
+			up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.upstream {
+					w.Header().Set(k, v)
+				}
+			}))
+			t.Cleanup(up.Close)
+			host := "app." + testZone
+			body, err := json.Marshal(routeRequest{Host: host, Target: up.Listener.Addr().String(), SecurityHeaders: tt.route})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec := serveAPI(RoutesAPIHandler(m), "/api/routes", http.MethodPost, "/api/routes", string(body)); rec.Code != http.StatusCreated {
+				t.Fatalf("POST /api/routes: %d %s", rec.Code, rec.Body)
+			}
+
+			rec := proxyGet(m, host, "/")
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersInvalid(t *testing.T) {
+	m := newTestManager(t, Options{})
+	for _, headers := range []string{`{"":"x"}`, `{"X Frame":"x"}`, `{"X-Frame-Options":""}`, `{"X-A":"a\r\nX-B: b"}`} {
+		body := `{"host":"app.` + testZone + `","target":"10.0.0.1:80","security_headers":` + headers + `}`
+		if rec := serveAPI(RoutesAPIHandler(m), "/api/routes", http.MethodPost, "/api/routes", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("security_headers %s: status %d, want 400", headers, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// statusClasses are the HTTPResponses label values by status code / 100.
+var statusClasses = [...]string{"1xx", "1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// Instrument wraps the proxy handler to record the HTTP request metrics:
+// responses by status class, request durations and body bytes in both
+// directions. Wrap it around Recover so the 500s Recover answers panics with
+// are counted too.
+func Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		next.ServeHTTP(rec, r)
+
+		if body != nil {
+			metrics.HTTPBytes.Add("received", uint64(body.n))
+		}
+		if rec.hijacked {
+			metrics.HTTPResponses.Inc("hijacked")
+			return
+		}
+		metrics.HTTPBytes.Add("sent", uint64(rec.written))
+		metrics.HTTPResponses.Inc(statusClass(rec.status))
+		metrics.HTTPRequestDuration.Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusClass returns the HTTPResponses label for code. A handler that wrote
+// nothing got an implicit 200.
+func statusClass(code int) string {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if i := code / 100; i >= 1 && i < len(statusClasses) {
+		return statusClasses[i]
+	}
+	return "other"
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
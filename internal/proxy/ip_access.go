@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AccessControl restricts a route to client addresses. An address in Allow
+// is always let through; otherwise an address in Deny is refused, and so is
+// every other address when Allow is not empty.
+type AccessControl struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseAccessControl parses allow and deny lists of CIDRs ("10.0.0.0/8",
+// "2001:db8::/32") or single addresses. It returns nil when both are empty.
+func ParseAccessControl(allow, deny []string) (*AccessControl, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a := &AccessControl{}
+	var err error
+	if a.Allow, err = parseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("allow list: %w", err)
+	}
+	if a.Deny, err = parseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("deny list: %w", err)
+	}
+	return a, nil
+}
+
+func parseCIDRs(items []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// permits reports whether a client at ip may use the route; an unknown
+// address may not.
+func (a *AccessControl) permits(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if containsIP(a.Allow, ip) {
+		return true
+	}
+	return len(a.Allow) == 0 && !containsIP(a.Deny, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatCIDRs renders nets for RouteInfo.
+func formatCIDRs(nets []*net.IPNet) []string {
+	if len(nets) == 0 {
+		return nil
+	}
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
+
+// clientIP returns the address r came from. When the peer is one of the
+// trusted proxies, X-Forwarded-For is walked from the right past any further
+// trusted proxies: entries to the left of the first untrusted hop are the
+// client's own and could be spoofed.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+	values := r.Header.Values("X-Forwarded-For")
+	for i := len(values) - 1; i >= 0; i-- {
+		hops := strings.Split(values[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[j]))
+			if hop == nil {
+				return ip
+			}
+			ip = hop
+			if !containsIP(trusted, ip) {
+				return ip
+			}
+		}
+	}
+	return ip
+}
+
+// checkClientIP reports whether the client of r may use e's route.
+func (m *ShardedRouteManager) checkClientIP(e *UpstreamEntry, r *http.Request) bool {
+	if e.accessControl == nil {
+		return true
+	}
+	return e.accessControl.permits(clientIP(r, m.opts.TrustedProxies))
+}
+
+// serveForbiddenIP answers a request from an address the route doesn't admit.
+func serveForbiddenIP(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "forbidden: this tunnel doesn't accept requests from your address", http.StatusForbidden)
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessControlPermits(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		ip          string
+		want        bool
+	}{
+		{"allowed v4", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"outside allow v4", []string{"10.0.0.0/8"}, nil, "192.0.2.1", false},
+		{"allowed v6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"outside allow v6", []string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+		{"v4 list, v6 client", []string{"10.0.0.0/8"}, nil, "::1", false},
+		{"v4-mapped v6 client", []string{"10.0.0.0/8"}, nil, "::ffff:10.0.0.1", true},
+		{"denied v4", nil, []string{"192.0.2.0/24"}, "192.0.2.7", false},
+		{"not denied v4", nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{"denied v6", nil, []string{"2001:db8::/32"}, "2001:db8:1::1", false},
+		{"not denied v6", nil, []string{"2001:db8::/32"}, "fe80::1", true},
+		{"single address", []string{"192.0.2.1"}, nil, "192.0.2.1", true},
+		{"single v6 address", []string{"2001:db8::1"}, nil, "2001:db8::2", false},
+		{"allow wins over deny", []string{"10.1.0.0/16"}, []string{"10.0.0.0/8"}, "10.1.0.1", true},
+		{"deny outside allow", []string{"10.1.0.0/16"}, []string{"10.0.0.0/8"}, "10.2.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := ParseAccessControl(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.permits(net.ParseIP(tt.ip)); got != tt.want {
+				t.Fatalf("permits(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAccessControlInvalid(t *testing.T) {
+	for _, item := range []string{"10.0.0.0/33", "not-an-ip", "2001:db8::/129"} {
+		if _, err := ParseAccessControl([]string{item}, nil); err == nil {
+			t.Errorf("ParseAccessControl(%q) succeeded", item)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, remote string
+		xff          []string
+		want         string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer's header ignored", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"trusted peer", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted v6 peer", "[fd00::1]:1234", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"spoofed left entry", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2", "10.0.0.3"}, "198.51.100.1"},
+		{"garbage hop", "10.0.0.1:1234", []string{"garbage"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r, trusted); !got.Equal(net.ParseIP(tt.want)) {
+				t.Fatalf("clientIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteAccessControl(t *testing.T) {
+	m := newTestManager(t, Options{})
+	up := newUpstream(t, "ok")
+	access, err := ParseAccessControl([]string{"2001:db8::/32"}, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := "app." + testZone
+	if err := m.AddRouteWithOptions(host, up.Listener.Addr().String(), RouteOptions{AccessControl: access}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote string
+		want   int
+	}{
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"[2001:db9::1]:1234", http.StatusForbidden},
+		{"192.0.2.1:1234", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		r.RemoteAddr = tt.remote
+		if rec := serveProxy(m, r); rec.Code != tt.want {
+			t.Errorf("from %s: status %d, want %d", tt.remote, rec.Code, tt.want)
+		}
+	}
+}
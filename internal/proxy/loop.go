@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// hopHeader carries the instance IDs of the tunnelfy proxies a request passed
+// through, so a request arriving back at the same instance is detected as a loop.
+const hopHeader = "X-Tunnelfy-Hop"
+
+// ErrSelfUpstream is returned by AddRoute for targets that point at the proxy's
+// own listeners, which would make every request loop back into the proxy.
+var ErrSelfUpstream = errors.New("upstream target points at this proxy's own listener")
+
+// ErrRouteExists is returned by AddRouteExclusive for a host that already has
+// a route.
+var ErrRouteExists = errors.New("host already has a route")
+
+// newInstanceID returns a random identifier for this proxy process.
+func newInstanceID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isLoop reports whether r already passed through this proxy instance.
+func (m *ShardedRouteManager) isLoop(r *http.Request) bool {
+	for _, v := range r.Header.Values(hopHeader) {
+		if strings.Contains(v, m.instanceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotSelf returns ErrSelfUpstream if u resolves to one of Options.ListenAddrs.
+func (m *ShardedRouteManager) checkNotSelf(u *url.URL) error {
+	if len(m.opts.ListenAddrs) == 0 {
+		return nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	targetIPs := resolveHost(u.Hostname())
+	for _, addr := range m.opts.ListenAddrs {
+		listenHost, listenPort, err := net.SplitHostPort(addr)
+		if err != nil || listenPort != port {
+			continue
+		}
+		for _, ip := range targetIPs {
+			if listenerAccepts(listenHost, ip) {
+				return ErrSelfUpstream
+			}
+		}
+	}
+	return nil
+}
+
+// listenerAccepts reports whether a listener bound to listenHost would accept
+// connections made to ip on this machine.
+func listenerAccepts(listenHost string, ip net.IP) bool {
+	listenIPs := resolveHost(listenHost)
+	if listenHost == "" {
+		listenIPs = []net.IP{net.IPv4zero}
+	}
+	for _, lip := range listenIPs {
+		switch {
+		case lip.IsUnspecified():
+			if ip.IsLoopback() || ip.IsUnspecified() || isLocalIP(ip) {
+				return true
+			}
+		case lip.IsLoopback() && ip.IsLoopback(), lip.Equal(ip):
+			return true
+		}
+	}
+	return false
+}
+
+// resolveHost returns the IPs of host, which may be an IP literal. Resolution
+// failures yield no IPs: an unresolvable target can't loop back either.
+func resolveHost(host string) []net.IP {
+	if host == "" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+// isLocalIP reports whether ip is assigned to one of this machine's interfaces.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
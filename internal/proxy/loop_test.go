@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddRouteRejectsSelf(t *testing.T) {
+	m := newTestManager(t, Options{ListenAddrs: []string{":18080", "127.0.0.1:18090"}})
+	tests := []struct {
+		target string
+		self   bool
+	}{
+		{"127.0.0.1:18080", true},
+		{"localhost:18080", true},
+		{"[::1]:18080", true},
+		{"http://127.0.0.1:18080", true},
+		{"127.0.0.1:18090", true},
+		{"127.0.0.1:18081", false},
+		{"192.0.2.1:18090", false},
+		{"192.0.2.1:18080", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			err := m.AddRoute("app."+testZone, tt.target)
+			if self := errors.Is(err, ErrSelfUpstream); self != tt.self {
+				t.Fatalf("AddRoute(%s): err = %v, want self=%v", tt.target, err, tt.self)
+			}
+		})
+	}
+}
+
+func TestProxyLoopDetected(t *testing.T) {
+	m := newTestManager(t, Options{PreserveHost: true})
+	// The upstream forwards back into the same proxy, as a route to a host
+	// that resolves to the proxy through some other name would.
+	front := httptest.NewServer(FastProxyHandler(m, testZone))
+	defer front.Close()
+	if err := m.AddRoute("loop."+testZone, front.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := proxyGet(m, "loop."+testZone, "/")
+	if rec.Code != http.StatusLoopDetected {
+		t.Fatalf("got %d %q, want 508", rec.Code, rec.Body.String())
+	}
+}
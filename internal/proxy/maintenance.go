@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultMaintenanceRetryAfter is the Retry-After, in seconds, sent during
+// maintenance when none is configured.
+const defaultMaintenanceRetryAfter = 300
+
+// defaultMaintenancePage is served during maintenance without Options.MaintenancePage.
+const defaultMaintenancePage = "down for maintenance, retry later\n"
+
+// Maintenance scopes maintenance mode. While it is on, matching hosts are
+// answered with the maintenance page and a 503 instead of being routed;
+// tunnels and routes are left intact. With no Hosts and no Users every host
+// matches.
+type Maintenance struct {
+	// Hosts are exact hosts under maintenance.
+	Hosts []string `json:"hosts,omitempty"`
+	// Users are users whose hosts ("<user>.<zone>" and its subdomains) are
+	// under maintenance.
+	Users []string `json:"users,omitempty"`
+	// RetryAfter is the Retry-After in seconds; zero uses the default.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// normalized returns a copy of mt with lowercased hosts and users.
+func (mt Maintenance) normalized() *Maintenance {
+	out := &Maintenance{RetryAfter: mt.RetryAfter}
+	for _, h := range mt.Hosts {
+		if h = normalizeHost(h); h != "" {
+			out.Hosts = append(out.Hosts, h)
+		}
+	}
+	for _, u := range mt.Users {
+		if u = strings.ToLower(strings.TrimSpace(u)); u != "" {
+			out.Users = append(out.Users, u)
+		}
+	}
+	if out.RetryAfter <= 0 {
+		out.RetryAfter = defaultMaintenanceRetryAfter
+	}
+	return out
+}
+
+// matches reports whether host, in zone, is under maintenance. The user of a
+// host is the label right before its zone, so "app.alice.<zone>" belongs to
+// alice.
+func (mt *Maintenance) matches(host, zone string) bool {
+	if len(mt.Hosts) == 0 && len(mt.Users) == 0 {
+		return true
+	}
+	if slices.Contains(mt.Hosts, host) {
+		return true
+	}
+	if len(mt.Users) == 0 {
+		return false
+	}
+	rest := host
+	if zone != "" {
+		rest = strings.TrimSuffix(host, "."+zone)
+	}
+	user := rest[strings.LastIndexByte(rest, '.')+1:]
+	return slices.Contains(mt.Users, user)
+}
+
+// SetMaintenance turns maintenance mode on with the given scope, replacing
+// any previous one.
+func (m *ShardedRouteManager) SetMaintenance(mt Maintenance) {
+	n := mt.normalized()
+	m.maintenance.Store(n)
+	m.log.Info("maintenance mode enabled", "hosts", n.Hosts, "users", n.Users)
+}
+
+// ClearMaintenance turns maintenance mode off.
+func (m *ShardedRouteManager) ClearMaintenance() {
+	if m.maintenance.Swap(nil) != nil {
+		m.log.Info("maintenance mode disabled")
+	}
+}
+
+// Maintenance returns the current maintenance scope, or nil when off.
+func (m *ShardedRouteManager) Maintenance() *Maintenance {
+	return m.maintenance.Load()
+}
+
+// serveMaintenance answers the request with the maintenance page if host is
+// under maintenance, reporting whether it did.
+func (m *ShardedRouteManager) serveMaintenance(w http.ResponseWriter, host, zone string) bool {
+	mt := m.maintenance.Load()
+	if mt == nil || !mt.matches(host, zone) {
+		return false
+	}
+	page := m.opts.MaintenancePage
+	if page == "" {
+		page = defaultMaintenancePage
+	}
+	w.Header().Set("Content-Type", http.DetectContentType([]byte(page)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(mt.RetryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(page))
+	return true
+}
+
+// maintenanceStatus is the body of GET /api/maintenance.
+type maintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+	*Maintenance
+}
+
+// MaintenanceAPIHandler serves /api/maintenance. GET reports the current
+// state; PUT turns maintenance mode on with the Maintenance scope in the body
+// (an empty object covers every host); DELETE turns it off.
+func MaintenanceAPIHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			mt := m.Maintenance()
+			writeJSON(w, http.StatusOK, maintenanceStatus{Enabled: mt != nil, Maintenance: mt})
+		case http.MethodPut:
+			var mt Maintenance
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&mt); err != nil {
+				http.Error(w, "invalid JSON body", http.StatusBadRequest)
+				return
+			}
+			if mt.RetryAfter < 0 {
+				http.Error(w, "retry_after must not be negative", http.StatusBadRequest)
+				return
+			}
+			m.SetMaintenance(mt)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			m.ClearMaintenance()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	m := newTestManager(t, Options{MaintenancePage: "<h1>back soon</h1>"})
+	upstream := newUpstream(t, "ok").Listener.Addr().String()
+	hosts := []string{"alice." + testZone, "api.alice." + testZone, "bob." + testZone, "carol." + testZone}
+	for _, host := range hosts {
+		if err := m.AddRoute(host, upstream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := MaintenanceAPIHandler(m)
+	toggle := func(method, body string) {
+		t.Helper()
+		if rec := serveAPI(api, "/api/maintenance", method, "/api/maintenance", body); rec.Code != http.StatusNoContent {
+			t.Fatalf("%s /api/maintenance = %d %s", method, rec.Code, rec.Body)
+		}
+	}
+	// check asserts which of hosts are under maintenance.
+	check := func(down ...string) {
+		t.Helper()
+		for _, host := range hosts {
+			rec := proxyGet(m, host, "/")
+			wantDown := false
+			for _, d := range down {
+				wantDown = wantDown || d == host
+			}
+			if !wantDown {
+				if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+					t.Fatalf("%s: got %d %q, want it routed", host, rec.Code, rec.Body.String())
+				}
+				continue
+			}
+			if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "<h1>back soon</h1>" {
+				t.Fatalf("%s: got %d %q, want the maintenance page", host, rec.Code, rec.Body.String())
+			}
+			if rec.Header().Get("Retry-After") == "" {
+				t.Fatalf("%s: maintenance page without Retry-After", host)
+			}
+		}
+	}
+
+	check()
+	toggle(http.MethodPut, `{}`)
+	check(hosts...)
+	toggle(http.MethodPut, `{"users":["Alice"],"hosts":["carol.`+testZone+`"],"retry_after":60}`)
+	check("alice."+testZone, "api.alice."+testZone, "carol."+testZone)
+	if rec := proxyGet(m, "carol."+testZone, "/"); rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("Retry-After = %q, want the configured 60", rec.Header().Get("Retry-After"))
+	}
+
+	rec := serveAPI(api, "/api/maintenance", http.MethodGet, "/api/maintenance", "")
+	var status struct {
+		Enabled bool     `json:"enabled"`
+		Users   []string `json:"users"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || !status.Enabled || len(status.Users) != 1 || status.Users[0] != "alice" {
+		t.Fatalf("GET /api/maintenance = %s (%v)", rec.Body, err)
+	}
+
+	toggle(http.MethodDelete, "")
+	check()
+	if len(m.ListRoutes()) != len(hosts) {
+		t.Fatal("maintenance mode removed routes")
+	}
+}
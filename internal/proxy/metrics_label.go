@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"tunnelfy/internal/metrics"
+)
+
+// Route label values that don't name a user or bucket.
+const (
+	routeLabelDefault = "default"
+	routeLabelAll     = "all"
+)
+
+// defaultHostBuckets is the bucket count used by the "bucket" strategy when
+// none is configured.
+const defaultHostBuckets = 32
+
+// RouteLabeler maps a route's host to the label its requests are counted under
+// in per-route metrics. It must map the unbounded set of hosts onto a bounded
+// set of labels.
+type RouteLabeler func(host string) string
+
+// ParseRouteLabeler returns the labeler for strategy: "user" labels by tunnel
+// user, the label directly under zone; "bucket" hashes hosts into buckets
+// buckets; "none" counts every route under a single label. An empty strategy
+// means "user".
+func ParseRouteLabeler(strategy, zone string, buckets int) (RouteLabeler, error) {
+	zone = normalizeHost(zone)
+	switch strategy {
+	case "", "user":
+		return func(host string) string { return routeUser(host, zone) }, nil
+	case "bucket":
+		if buckets <= 0 {
+			buckets = defaultHostBuckets
+		}
+		return func(host string) string {
+			h := fnv.New32a()
+			h.Write([]byte(host))
+			return fmt.Sprintf("bucket-%d", h.Sum32()%uint32(buckets))
+		}, nil
+	case "none":
+		return func(string) string { return routeLabelAll }, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q (want user, bucket or none)", strategy)
+	}
+}
+
+// routeUser returns the user of a tunnel host ("label.user.zone", "user.zone"
+// or "*.label.user.zone"), or the overflow label for hosts outside zone.
+func routeUser(host, zone string) string {
+	rest, ok := strings.CutSuffix(host, "."+zone)
+	if !ok || zone == "" || rest == "" {
+		return metrics.OverflowLabel
+	}
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	if rest == "*" {
+		return metrics.OverflowLabel
+	}
+	return rest
+}
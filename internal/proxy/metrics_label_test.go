@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+
+	"tunnelfy/internal/metrics"
+)
+
+func TestParseRouteLabeler(t *testing.T) {
+	tests := []struct {
+		strategy string
+		host     string
+		want     string
+	}{
+		{"user", "alice." + testZone, "alice"},
+		{"", "api.alice." + testZone, "alice"},
+		{"user", "*.app.alice." + testZone, "alice"},
+		{"user", "*." + testZone, metrics.OverflowLabel},
+		{"user", "example.com", metrics.OverflowLabel},
+		{"none", "api.alice." + testZone, routeLabelAll},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy+" "+tt.host, func(t *testing.T) {
+			l, err := ParseRouteLabeler(tt.strategy, testZone, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l(tt.host); got != tt.want {
+				t.Fatalf("label = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := ParseRouteLabeler("host", testZone, 0); err == nil {
+		t.Fatal("an unbounded strategy was accepted")
+	}
+}
+
+func TestRouteMetricSeriesBounded(t *testing.T) {
+	const buckets = 8
+	labeler, err := ParseRouteLabeler("bucket", testZone, buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(t, Options{RouteLabeler: labeler})
+	upstream := newUpstream(t, "ok").Listener.Addr().String()
+	before := metrics.HTTPRequests.Series()
+	for i := range 500 {
+		host := fmt.Sprintf("user%d.%s", i, testZone)
+		if err := m.AddRoute(host, upstream); err != nil {
+			t.Fatal(err)
+		}
+		proxyGet(m, host, "/")
+	}
+	if grown := metrics.HTTPRequests.Series() - before; grown > buckets {
+		t.Fatalf("500 routes added %d series, want at most %d", grown, buckets)
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/metrics"
+)
+
+// responseRecorder wraps an http.ResponseWriter to remember the status code,
+// the body bytes written and whether the response was started or the
+// connection hijacked. Unwrap keeps
+// http.ResponseController (used by ReverseProxy for flushing and upgrades)
+// working through the wrapper.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	written  int64
+	hijacked bool
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.written += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Hijack records the hijack so later handling doesn't write to the connection.
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil {
+		rec.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Recover wraps a handler so a panic while serving a request is logged with the
+// request context and answered with a 500 instead of tearing down the serving
+// goroutine. http.ErrAbortHandler, which ReverseProxy uses to abort a response
+// mid-stream, is re-raised so net/http can close the connection as intended.
+// If the response was already started or the connection hijacked, nothing more
+// is written.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if err, ok := p.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(p)
+			}
+			metrics.HTTPPanics.Inc()
+			slog.Error("panic serving request", "method", logsafe.String(r.Method), "host", logsafe.String(r.Host),
+				"uri", logsafe.String(r.URL.RequestURI()), "remote", r.RemoteAddr, "request_id", r.Header.Get(RequestIDHeader), "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			if rec.status == 0 && !rec.hijacked {
+				http.Error(rec, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
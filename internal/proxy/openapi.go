@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the maintained OpenAPI 3 description of the admin API. Keep it
+// in sync when adding or changing admin endpoints.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPIHandler serves the admin API's OpenAPI spec.
+func OpenAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(openAPISpec)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// prewarmTimeout bounds each prewarm dial.
+const prewarmTimeout = 2 * time.Second
+
+// warmConns are upstream connections dialed ahead of a route's first
+// requests. http.Transport can't be handed connections, so the route's
+// transport takes them from here when it would dial; connections it hasn't
+// taken within the idle connection timeout are closed, like idle pooled ones.
+type warmConns struct {
+	mu    sync.Mutex
+	conns []warmConn
+}
+
+type warmConn struct {
+	addr string
+	net.Conn
+	expiry *time.Timer
+}
+
+// put keeps c, dialed to addr, for ttl.
+func (w *warmConns) put(addr string, c net.Conn, ttl time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wc := warmConn{addr: addr, Conn: c}
+	wc.expiry = time.AfterFunc(ttl, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for i, k := range w.conns {
+			if k.Conn == c {
+				w.conns = append(w.conns[:i], w.conns[i+1:]...)
+				c.Close()
+				return
+			}
+		}
+	})
+	w.conns = append(w.conns, wc)
+}
+
+// take returns a warm connection to addr, or nil if there is none.
+func (w *warmConns) take(addr string) net.Conn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, wc := range w.conns {
+		if wc.addr == addr && wc.expiry.Stop() {
+			w.conns = append(w.conns[:i], w.conns[i+1:]...)
+			return wc.Conn
+		}
+	}
+	return nil
+}
+
+// closeAll closes the connections not taken yet.
+func (w *warmConns) closeAll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, wc := range w.conns {
+		wc.expiry.Stop()
+		wc.Close()
+	}
+	w.conns = nil
+}
+
+// dialAddr returns the address the transport dials for u, with the scheme's
+// default port when u has none.
+func dialAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// prewarm dials PrewarmConns connections to e's upstream through the
+// transport's dialer, without sending requests, and leaves them for the
+// route's transport. It runs in the background and never blocks route
+// registration.
+func (m *ShardedRouteManager) prewarm(host string, e *UpstreamEntry) {
+	addr := dialAddr(e.TargetURL)
+	ttl := m.opts.Transport.IdleConnTimeout
+	var wg sync.WaitGroup
+	for i := 0; i < m.opts.PrewarmConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), prewarmTimeout)
+			defer cancel()
+			c, err := m.dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				if m.logRequests {
+					m.log.Debug("route prewarm failed", "host", logsafe.String(host), "upstream", e.TargetURL.String(), "err", err)
+				}
+				return
+			}
+			e.warm.put(addr, c, ttl)
+		}()
+	}
+	wg.Wait()
+}
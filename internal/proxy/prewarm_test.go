@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrewarmDialsWithoutRequests(t *testing.T) {
+	const prewarm = 2
+	var conns, requests atomic.Int32
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	up.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	up.Start()
+	t.Cleanup(up.Close)
+
+	m := newTestManager(t, Options{PrewarmConns: prewarm})
+	host := "app." + testZone
+	if err := m.AddRoute(host, up.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for conns.Load() < prewarm && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := conns.Load(); n != prewarm {
+		t.Fatalf("upstream saw %d connections after AddRoute, want %d", n, prewarm)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("prewarm sent %d requests, want none", n)
+	}
+
+	// Requests use the warm connections rather than dialing.
+	for i := 0; i < prewarm; i++ {
+		if rec := proxyGet(m, host, "/"); rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+	}
+	if n := conns.Load(); n != prewarm {
+		t.Fatalf("upstream saw %d connections after the first requests, want %d", n, prewarm)
+	}
+}
+
+// closed reports whether c, one end of a net.Pipe, was closed.
+func closed(c net.Conn) bool {
+	c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := c.Write([]byte("x"))
+	return errors.Is(err, io.ErrClosedPipe)
+}
+
+func TestWarmConnsExpire(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	var w warmConns
+	w.put("10.0.0.1:80", client, 10*time.Millisecond)
+	if c := w.take("10.0.0.2:80"); c != nil {
+		t.Fatal("took a connection to another address")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c := w.take("10.0.0.1:80"); c != nil {
+		t.Fatal("took an expired connection")
+	}
+	if !closed(client) {
+		t.Fatal("expired connection wasn't closed")
+	}
+}
+
+func TestCloseIdleConnectionsClosesWarmConns(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	m := newTestManager(t, Options{})
+	host := "app." + testZone
+	if err := m.AddRoute(host, "10.0.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := m.GetEntry(host)
+	e.warm.put("10.0.0.1:80", client, time.Minute)
+	m.CloseIdleConnections()
+	if c := e.warm.take("10.0.0.1:80"); c != nil {
+		t.Fatal("warm connection survived CloseIdleConnections")
+	}
+	if !closed(client) {
+		t.Fatal("warm connection wasn't closed")
+	}
+}
@@ -1,17 +1,178 @@
 package proxy
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"hash/maphash"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"tunnelfy/internal/fdlimit"
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/metrics"
 )
 
-const routeShards = 256
+// DefaultRouteShards is the shard count of the route table unless configured
+// otherwise. More shards cut lock contention under heavy route churn at the
+// cost of a little memory and slower full scans such as ListRoutes.
+const DefaultRouteShards = 256
+
+// maxRouteShards bounds the shard count.
+const maxRouteShards = 1 << 16
+
+// maxPrewarmConns bounds Options.PrewarmConns so a misconfiguration can't make
+// every new route open a flood of upstream connections.
+const maxPrewarmConns = 16
+
+// fdDialer reports dials failing for lack of file descriptors, which would
+// otherwise surface only as unexplained 502s.
+type fdDialer struct {
+	net.Dialer
+}
+
+func (d *fdDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil && fdlimit.Exhausted(err) {
+		fdlimit.Report(fdlimit.OpDial, addr, err)
+	}
+	return c, err
+}
+
+// Options tunes the behaviour of a ShardedRouteManager.
+type Options struct {
+	// PrewarmConns is the number of upstream connections opened in the
+	// background right after AddRoute, so the first real request reuses a warm
+	// connection instead of paying the dial latency. Zero disables prewarming.
+	PrewarmConns int
+
+	// SecurityHeaders are injected into upstream responses that don't already
+	// set them. Nil disables injection. See ParseSecurityHeaders.
+	SecurityHeaders map[string]string
+
+	// ListenAddrs are the proxy's own listen addresses (e.g. ":8080"). Routes
+	// whose target resolves to one of them are rejected with ErrSelfUpstream.
+	ListenAddrs []string
+
+	// WarmupGrace is how long after creation a route's upstream errors are
+	// answered with a retryable 503 instead of a 502, while the backend behind
+	// a freshly opened tunnel may still be starting. Zero disables it.
+	WarmupGrace time.Duration
+
+	// RouteLabeler labels per-route request metrics. Nil disables them. See
+	// ParseRouteLabeler.
+	RouteLabeler RouteLabeler
+
+	// ExposeUpstream adds an UpstreamHeader to responses naming the upstream
+	// the request was routed to. It reveals internal addresses, so it is meant
+	// for debugging only.
+	ExposeUpstream bool
+
+	// PreserveHost sends requests to upstreams with the public Host they were
+	// routed by (e.g. "api.alice.example.com") instead of the upstream's
+	// address, for apps that route or build links by Host. ForwardedHostHeader
+	// carries the public host either way.
+	PreserveHost bool
+
+	// RequestTimeout, when positive, is how long an upstream may take to
+	// respond (send its response headers) before the request is aborted with
+	// a 504. Routes can override it with RouteOptions.RequestTimeout; upgrade
+	// and server-sent events requests are exempt.
+	RequestTimeout time.Duration
+
+	// Transport tunes the upstream transport of every route.
+	Transport TransportOptions
+
+	// AccessLog configures the access log of proxied requests.
+	AccessLog AccessLogOptions
+
+	// MaintenancePage is the body served to hosts under maintenance; empty
+	// uses a short plain-text notice. See SetMaintenance.
+	MaintenancePage string
+
+	// RateLimit limits the request rate of each route; requests over it are
+	// answered with a 429.
+	RateLimit RateLimitOptions
+
+	// TrustedProxies are the reverse proxies in front of tunnelfy whose
+	// X-Forwarded-For is believed when checking RouteOptions.AccessControl.
+	TrustedProxies []*net.IPNet
+
+	// Logger receives the manager's logs; nil uses slog.Default(). Route
+	// changes and proxy errors are logged at level debug, and only when
+	// logRequests is set.
+	Logger *slog.Logger
+}
+
+// UpstreamHeader names the upstream a request was routed to when
+// Options.ExposeUpstream is set. Any other copy is stripped.
+const UpstreamHeader = "X-Tunnel-Upstream"
+
+// ForwardedHostHeader carries the public host a request was routed by to the
+// upstream, which otherwise sees its own address as Host. Any client-supplied
+// copy is replaced, since the proxy routed on the Host it received.
+const ForwardedHostHeader = "X-Forwarded-Host"
+
+// SNIHeader carries the server name the client sent in the TLS handshake to
+// the upstream, for backends serving several certificates or vhosts.
+const SNIHeader = "X-Forwarded-SNI"
+
+// RouteOptions holds per-route settings that override the manager's Options.
+type RouteOptions struct {
+	// User is the user whose tunnel the route serves; empty for routes added
+	// through the admin API.
+	User string
+
+	// Labels is client-provided metadata reported with the route.
+	Labels map[string]string
+
+	// SecurityHeaders replaces Options.SecurityHeaders for this route when non-nil.
+	// An empty, non-nil map disables injection for the route.
+	SecurityHeaders map[string]string
+
+	// BandwidthLimit caps the route's throughput in bytes per second per
+	// direction; zero means unlimited. See SetRouteBandwidth.
+	BandwidthLimit int64
+
+	// FollowRedirects, when positive, makes the proxy follow up to this many
+	// upstream redirects to the same upstream host itself and return the
+	// final response, hiding internal redirect chains. It is capped at
+	// MaxFollowRedirects; zero passes redirects through to the client.
+	FollowRedirects int
+
+	// LogSampleRate overrides AccessLogOptions.SampleRate for the route when
+	// positive.
+	LogSampleRate int
+
+	// RequestTimeout overrides Options.RequestTimeout for the route when
+	// positive.
+	RequestTimeout time.Duration
+
+	// AccessToken, when set, gates the route: requests must carry it in the
+	// AccessTokenHeader header or AccessTokenParam query parameter or get a
+	// 403. See SetRouteAccessToken.
+	AccessToken string
+
+	// AccessControl, when set, restricts the route to client addresses; other
+	// clients get a 403.
+	AccessControl *AccessControl
+
+	// BasicAuth, when set, password-protects the route with HTTP basic auth.
+	BasicAuth *BasicAuth
+
+	// OnEvict is called when the manager itself evicts the route (e.g. the idle
+	// reaper or DeleteRoute), so the owner can tear down the tunnel behind it.
+	// It is not called for RemoveRoute, and never while a shard lock is held.
+	OnEvict func()
+}
 
 // shard is a single shard of the sharded route map.
 type shard struct {
@@ -26,35 +187,237 @@ type UpstreamEntry struct {
 	TargetURL *url.URL
 	Proxy     *httputil.ReverseProxy
 	CreatedAt time.Time
+
+	// lastActive is the UnixNano time of the last lookup or body chunk
+	// proxied, used by the reaper.
+	lastActive atomic.Int64
+	// requests counts requests proxied through the entry.
+	requests atomic.Uint64
+	// debugUntil is the UnixNano time verbose header logging is enabled until.
+	debugUntil atomic.Int64
+	// debugUnredacted disables redaction of sensitive headers while debugging.
+	debugUnredacted atomic.Bool
+	// onEvict is invoked, outside any shard lock, when the manager evicts the route.
+	onEvict func()
+	// transport is the connection pool of Proxy.
+	transport *http.Transport
+	// warm holds the connections prewarm opened until transport takes them.
+	warm *warmConns
+	// user is the user whose tunnel the route serves, if any.
+	user string
+	// labels is the client-provided metadata of the route; never mutated.
+	labels map[string]string
+	// metricLabel is the route's label in per-route metrics; empty disables them.
+	metricLabel string
+	// offline is set while the client reports the service behind the tunnel down.
+	offline atomic.Bool
+	// draining is set by DrainRoute and never cleared; the route is on its
+	// way out.
+	draining atomic.Bool
+	// downAt is when ReportUpstreamDown last reported nothing serving the
+	// upstream, in Unix nanoseconds.
+	downAt atomic.Int64
+	// placeholder marks an imported or held route whose tunnel has not
+	// reconnected yet; it is answered with a retryable 503 and has no Proxy.
+	placeholder bool
+	// bandwidth is the route's throughput cap; nil means unlimited.
+	bandwidth atomic.Pointer[bandwidthLimit]
+	// followRedirects is the number of upstream redirects followed server-side.
+	followRedirects int
+	// logSampleRate overrides the access log sample rate when positive;
+	// logSeq numbers the route's requests for sampling.
+	logSampleRate int
+	logSeq        atomic.Uint64
+	// requestTimeout overrides Options.RequestTimeout when positive.
+	requestTimeout time.Duration
+	// accessToken is the token requests must carry; nil means ungated.
+	accessToken atomic.Pointer[string]
+	// accessControl restricts the route to client addresses; nil admits all.
+	accessControl *AccessControl
+	// basicAuth password-protects the route; nil means unprotected.
+	basicAuth *BasicAuth
+	// securityHeaders is RouteOptions.SecurityHeaders, kept for reporting.
+	securityHeaders map[string]string
+	// limiter enforces Options.RateLimit; created on the first request.
+	limiter atomic.Pointer[requestLimiter]
+}
+
+// touch records activity on the entry.
+func (e *UpstreamEntry) touch() {
+	e.lastActive.Store(time.Now().UnixNano())
+}
+
+// complete reports whether e is a fully constructed entry. Entries are always
+// built completely before being stored, but listing code checks anyway so that
+// a nil or partially constructed entry can't panic an admin call.
+func (e *UpstreamEntry) complete() bool {
+	return e != nil && e.TargetURL != nil
+}
+
+// LastActive returns the time of the last recorded activity on the entry.
+func (e *UpstreamEntry) LastActive() time.Time {
+	return time.Unix(0, e.lastActive.Load())
 }
 
 // ShardedRouteManager holds shards and methods to manipulate them.
 type ShardedRouteManager struct {
-	shards [routeShards]*shard
+	shards []*shard
+	// shardMask is len(shards)-1; the shard count is a power of two.
+	shardMask uint32
+	// shardSeed seeds shardIdx. It is random per manager, so clients choosing
+	// subdomains can't pick hosts that pile onto one shard.
+	shardSeed maphash.Seed
 	// Optional: telemetry counters, eviction policy fields, etc.
 	logRequests bool
+	opts        Options
+	log         *slog.Logger
+	// dialer dials upstreams for every route's Transport.
+	dialer *fdDialer
+
+	// wildcards counts registered "*.suffix" routes so lookups can skip the
+	// wildcard fallback entirely when there are none.
+	wildcards atomic.Int64
+	// fallback is the catch-all entry for hosts without a route, if any.
+	fallback atomic.Pointer[UpstreamEntry]
+	// zoneDefaults maps a zone to its catch-all entry. The map is replaced,
+	// never modified, so lookups need no lock.
+	zoneDefaults   atomic.Pointer[map[string]*UpstreamEntry]
+	zoneDefaultsMu sync.Mutex
+	// notReady is set until startup completes; see SetReady.
+	notReady atomic.Bool
+	// maintenance is the maintenance scope while maintenance mode is on.
+	maintenance atomic.Pointer[Maintenance]
+	// instanceID identifies this proxy in the hop header for loop detection.
+	instanceID string
+	// events streams route and request events to /api/events subscribers.
+	events eventHub
 }
 
-// NewShardedRouteManager constructs the manager and initializes shards.
-func NewShardedRouteManager(logRequests bool) *ShardedRouteManager {
-	m := &ShardedRouteManager{logRequests: logRequests}
-	for i := 0; i < routeShards; i++ {
+// NewShardedRouteManager constructs the manager with a route table of shards
+// shards, typically DefaultRouteShards. shards must be a power of two no
+// greater than 65536.
+func NewShardedRouteManager(shards int, logRequests bool, opts Options) (*ShardedRouteManager, error) {
+	if shards <= 0 || shards > maxRouteShards || shards&(shards-1) != 0 {
+		return nil, fmt.Errorf("route shard count must be a power of two between 1 and %d, got %d", maxRouteShards, shards)
+	}
+	if opts.PrewarmConns > maxPrewarmConns {
+		opts.PrewarmConns = maxPrewarmConns
+	}
+	opts.Transport = opts.Transport.withDefaults()
+	m := &ShardedRouteManager{logRequests: logRequests, opts: opts, log: opts.Logger, instanceID: newInstanceID()}
+	if m.log == nil {
+		m.log = slog.Default()
+	}
+	m.dialer = &fdDialer{Dialer: net.Dialer{Timeout: opts.Transport.DialTimeout, KeepAlive: 30 * time.Second}}
+	m.shards = make([]*shard, shards)
+	m.shardMask = uint32(shards - 1)
+	m.shardSeed = maphash.MakeSeed()
+	for i := range m.shards {
 		m.shards[i] = &shard{m: make(map[string]*UpstreamEntry)}
 	}
-	return m
+	return m, nil
 }
 
-// shardIdx computes a small, fast hash and returns the shard index.
-func (m *ShardedRouteManager) shardIdx(key string) uint8 {
-	var h uint32
-	for i := 0; i < len(key); i++ {
-		h = h*16777619 ^ uint32(key[i]) // FNV-like mix (fast)
-	}
-	return uint8(h % routeShards)
+// shardIdx returns the shard index of key.
+func (m *ShardedRouteManager) shardIdx(key string) uint32 {
+	return uint32(maphash.String(m.shardSeed, key)) & m.shardMask
 }
 
 // AddRoute registers host -> target. target can be "host:port" or "http(s)://host[:port]".
+// A host of the form "*.suffix" registers a wildcard route serving every host under suffix.
 func (m *ShardedRouteManager) AddRoute(host, target string) error {
+	return m.AddRouteWithOptions(host, target, RouteOptions{})
+}
+
+// AddRouteWithOptions registers host -> target like AddRoute, applying per-route options.
+func (m *ShardedRouteManager) AddRouteWithOptions(host, target string, opts RouteOptions) error {
+	return m.addRoute(host, target, opts, false)
+}
+
+// AddRouteExclusive registers host -> target like AddRoute, but fails with
+// ErrRouteExists instead of replacing a route host already has. A placeholder
+// waiting for its tunnel to reconnect doesn't count and is replaced.
+func (m *ShardedRouteManager) AddRouteExclusive(host, target string) error {
+	return m.AddRouteExclusiveWithOptions(host, target, RouteOptions{})
+}
+
+// AddRouteExclusiveWithOptions is AddRouteExclusive with per-route options.
+func (m *ShardedRouteManager) AddRouteExclusiveWithOptions(host, target string, opts RouteOptions) error {
+	return m.addRoute(host, target, opts, true)
+}
+
+// addRoute implements AddRouteWithOptions and, when exclusive is set,
+// AddRouteExclusiveWithOptions.
+func (m *ShardedRouteManager) addRoute(host, target string, opts RouteOptions, exclusive bool) error {
+	entry, err := m.newEntry(host, target, opts)
+	if err != nil {
+		return err
+	}
+	return m.addEntry(host, entry, exclusive)
+}
+
+// addEntry registers the fully constructed entry for host like addRoute.
+func (m *ShardedRouteManager) addEntry(host string, entry *UpstreamEntry, exclusive bool) error {
+	if exclusive {
+		if !m.storeIfFree(host, entry) {
+			return ErrRouteExists
+		}
+	} else {
+		m.store(host, entry)
+	}
+	m.events.publish(Event{Type: EventRouteAdded, Host: host, Target: entry.TargetURL.String()})
+
+	if m.logRequests {
+		m.log.Debug("route add", "host", logsafe.String(host), "upstream", entry.TargetURL.String())
+	}
+	if m.opts.PrewarmConns > 0 {
+		go m.prewarm(host, entry)
+	}
+	return nil
+}
+
+// store registers entry for host, replacing any existing route. entry must be
+// fully constructed: it is visible to concurrent lookups as soon as it is stored.
+func (m *ShardedRouteManager) store(host string, entry *UpstreamEntry) {
+	s := m.shards[m.shardIdx(host)]
+	s.Lock()
+	_, replaced := s.m[host]
+	s.m[host] = entry
+	s.Unlock()
+	if !replaced {
+		m.routeStored(host)
+	}
+}
+
+// storeIfFree is store, unless host has a route other than a placeholder; it
+// reports whether entry was stored. The check and the store happen under
+// the shard lock, so of concurrent calls for one host only one succeeds.
+func (m *ShardedRouteManager) storeIfFree(host string, entry *UpstreamEntry) bool {
+	s := m.shards[m.shardIdx(host)]
+	s.Lock()
+	current, replaced := s.m[host]
+	if current.complete() && !current.placeholder {
+		s.Unlock()
+		return false
+	}
+	s.m[host] = entry
+	s.Unlock()
+	if !replaced {
+		m.routeStored(host)
+	}
+	return true
+}
+
+// routeStored accounts for a route added for a host that had none.
+func (m *ShardedRouteManager) routeStored(host string) {
+	metrics.Routes.Add(1)
+	if isWildcardHost(host) {
+		m.wildcards.Add(1)
+	}
+}
+
+// newEntry builds a fully constructed UpstreamEntry for target, served as host.
+func (m *ShardedRouteManager) newEntry(host, target string, opts RouteOptions) (*UpstreamEntry, error) {
 	// Normalize target into URL
 	var raw string
 	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
@@ -65,74 +428,223 @@ func (m *ShardedRouteManager) AddRoute(host, target string) error {
 	}
 	u, err := url.Parse(raw)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := m.checkNotSelf(u); err != nil {
+		return nil, err
 	}
 
 	// Create an optimized Transport for this upstream.
-	transport := &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		DialContext:           (&net.Dialer{Timeout: 250 * time.Millisecond, KeepAlive: 30 * time.Second}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          1000,
-		MaxIdleConnsPerHost:   250,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		DisableCompression:    true,
+	warm := &warmConns{}
+	transport := m.newTransport(warm)
+
+	securityHeaders := m.opts.SecurityHeaders
+	if opts.SecurityHeaders != nil {
+		securityHeaders = opts.SecurityHeaders
+	}
+
+	entry := &UpstreamEntry{
+		TargetURL: u,
+		CreatedAt: time.Now(),
+		onEvict:   opts.OnEvict,
+		transport: transport,
+		warm:      warm,
+		user:      opts.User,
+		labels:    opts.Labels,
+
+		logSampleRate:  opts.LogSampleRate,
+		requestTimeout: opts.RequestTimeout,
+		accessControl:  opts.AccessControl,
+		basicAuth:      opts.BasicAuth,
+
+		securityHeaders: opts.SecurityHeaders,
+	}
+	if m.opts.RouteLabeler != nil {
+		entry.metricLabel = m.opts.RouteLabeler(host)
+	}
+	entry.setBandwidth(opts.BandwidthLimit)
+	entry.setAccessToken(opts.AccessToken)
+	entry.touch()
+
+	var roundTripper http.RoundTripper = transport
+	if opts.FollowRedirects > 0 {
+		entry.followRedirects = min(opts.FollowRedirects, MaxFollowRedirects)
+		roundTripper = &redirectFollower{next: transport, max: entry.followRedirects}
 	}
 
 	// Precreate a ReverseProxy that reuses this transport and streams quickly.
-	proxy := &httputil.ReverseProxy{
+	// It proxies Upgrade requests (e.g. WebSockets) itself: the Director leaves
+	// the Connection and Upgrade headers alone, and the body of a 101 response
+	// is the upstream connection, which ModifyResponse must not wrap as a plain
+	// io.ReadCloser or the hijacked client connection can't be spliced to it.
+	entry.Proxy = &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
+			// req.Host is still the public host, including every subdomain
+			// level, e.g. "api.alice.example.com".
+			req.Header.Set(ForwardedHostHeader, req.Host)
 			req.URL.Scheme = u.Scheme
 			req.URL.Host = u.Host
-			req.Host = u.Host
+			if !m.opts.PreserveHost {
+				req.Host = u.Host
+			}
 		},
-		Transport:     transport,
+		Transport:     roundTripper,
 		FlushInterval: 10 * time.Millisecond,
 		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
 			if m.logRequests {
-				log.Printf("proxy error: host=%s upstream=%s err=%v", req.Host, u.String(), err)
+				m.log.Debug("proxy error", "host", logsafe.String(req.Host), "upstream", u.String(),
+					"request_id", req.Header.Get(RequestIDHeader), "err", err)
+			}
+			if serveRequestTimeout(rw, req, m.requestTimeout(entry)) || m.serveResponseHeaderTimeout(rw, err) {
+				return
+			}
+			if remaining := m.opts.WarmupGrace - time.Since(entry.CreatedAt); remaining > 0 {
+				retryAfter := int(math.Ceil(remaining.Seconds()))
+				rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				http.Error(rw, "upstream is starting up, retry shortly", http.StatusServiceUnavailable)
+				return
+			}
+			if serveUpstreamDown(rw, entry, err) {
+				return
 			}
 			http.Error(rw, "upstream gateway error", http.StatusBadGateway)
 		},
 		ModifyResponse: func(resp *http.Response) error {
+			stopRequestTimer(resp)
+			detectTruncation(resp, host)
+			trackResponseActivity(resp, entry)
+			if l := entry.bandwidth.Load(); l != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+				resp.Body = &throttledBody{ReadCloser: resp.Body, ctx: resp.Request.Context(), bucket: l.response, chunk: l.chunk}
+			}
+			resp.Header.Del(UpstreamHeader)
+			resp.Header.Del(RequestIDHeader)
+			injectMissingHeaders(resp.Header, securityHeaders)
+			if entry.debugging() {
+				entry.logHeaders(m.log, host, "response "+resp.Status, resp.Header)
+			}
 			return nil
 		},
 	}
+	return entry, nil
+}
 
-	entry := &UpstreamEntry{
-		TargetURL: u,
-		Proxy:     proxy,
-		CreatedAt: time.Now(),
-	}
-
+// RemoveRoute removes the mapping for host.
+func (m *ShardedRouteManager) RemoveRoute(host string) {
 	idx := m.shardIdx(host)
 	s := m.shards[idx]
 	s.Lock()
-	s.m[host] = entry
+	_, existed := s.m[host]
+	delete(s.m, host)
 	s.Unlock()
-
+	if existed {
+		m.routeDeleted(host)
+	}
 	if m.logRequests {
-		log.Printf("route add: %s -> %s", host, entry.TargetURL.String())
+		m.log.Debug("route remove", "host", logsafe.String(host))
 	}
-	return nil
 }
 
-// RemoveRoute removes the mapping for host.
-func (m *ShardedRouteManager) RemoveRoute(host string) {
-	idx := m.shardIdx(host)
-	s := m.shards[idx]
+// DeleteRoute removes host's route and tears down the tunnel behind it, like
+// an eviction: the route's OnEvict callback runs, outside any shard lock. It
+// reports whether host had a route.
+func (m *ShardedRouteManager) DeleteRoute(host string) bool {
+	s := m.shards[m.shardIdx(host)]
 	s.Lock()
+	entry, existed := s.m[host]
 	delete(s.m, host)
 	s.Unlock()
+	if !existed {
+		return false
+	}
+	m.routeDeleted(host)
 	if m.logRequests {
-		log.Printf("route remove: %s", host)
+		m.log.Debug("route delete", "host", logsafe.String(host))
+	}
+	if entry.onEvict != nil {
+		entry.onEvict()
 	}
+	return true
 }
 
 // GetEntry returns the UpstreamEntry for host. This is the hot path for request forwarding.
+// When host has no exact route, the most specific wildcard route covering it is
+// used, and then the default route, if one is set.
 func (m *ShardedRouteManager) GetEntry(host string) (*UpstreamEntry, bool) {
+	return m.getEntry(host, "")
+}
+
+// getEntry is GetEntry for a host in zone: the zone's default route, if set,
+// takes precedence over the global one.
+func (m *ShardedRouteManager) getEntry(host, zone string) (*UpstreamEntry, bool) {
+	e, ok := m.lookup(host)
+	if !ok || !e.complete() {
+		e, ok = m.lookupWildcard(host)
+	}
+	if !ok && zone != "" {
+		if defaults := m.zoneDefaults.Load(); defaults != nil {
+			e, ok = (*defaults)[zone]
+		}
+	}
+	if !ok {
+		e = m.fallback.Load()
+		ok = e != nil
+	}
+	if ok {
+		e.touch()
+	}
+	return e, ok
+}
+
+// SetDefaultRoute makes target the catch-all upstream for hosts without an
+// exact or wildcard route. An empty target removes the catch-all. With no
+// tunnels registered, this turns the proxy into a single-backend edge proxy.
+func (m *ShardedRouteManager) SetDefaultRoute(target string) error {
+	if target == "" {
+		m.fallback.Store(nil)
+		return nil
+	}
+	entry, err := m.newEntry("*", target, RouteOptions{})
+	if err != nil {
+		return err
+	}
+	if entry.metricLabel != "" {
+		entry.metricLabel = routeLabelDefault
+	}
+	m.fallback.Store(entry)
+	if m.logRequests {
+		m.log.Debug("default route", "upstream", entry.TargetURL.String())
+	}
+	return nil
+}
+
+// offlineRetryAfter is the Retry-After, in seconds, sent for offline routes.
+const offlineRetryAfter = 10
+
+// SetRouteOnline marks host's route as online or offline. Requests to an
+// offline route get a 503 instead of a 502 from the dead local service. It
+// reports whether host has a route.
+func (m *ShardedRouteManager) SetRouteOnline(host string, online bool) bool {
+	e, ok := m.lookup(host)
+	if ok {
+		e.offline.Store(!online)
+	}
+	return ok
+}
+
+// DrainRoute stops host's route from taking new requests, which get a
+// retryable 503, while requests in flight finish and the tunnel stays up; the
+// route is then removed with DeleteRoute, or replaced when its client
+// reconnects. It reports whether host has a route.
+func (m *ShardedRouteManager) DrainRoute(host string) bool {
+	e, ok := m.lookup(host)
+	if ok {
+		e.draining.Store(true)
+	}
+	return ok
+}
+
+// lookup returns the UpstreamEntry for host without recording activity.
+func (m *ShardedRouteManager) lookup(host string) (*UpstreamEntry, bool) {
 	idx := m.shardIdx(host)
 	s := m.shards[idx]
 	s.RLock()
@@ -141,44 +653,201 @@ func (m *ShardedRouteManager) GetEntry(host string) (*UpstreamEntry, bool) {
 	return e, ok
 }
 
+// RouteInfo describes a single route for administrative calls.
+type RouteInfo struct {
+	Host       string    `json:"host"`
+	Target     string    `json:"target"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastActive time.Time `json:"last_active"`
+	Requests   uint64    `json:"requests"`
+	// User is the user whose tunnel the route serves, if any.
+	User string `json:"user,omitempty"`
+	// Labels is the client-provided metadata of the route, if any.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Offline is set while the client reports its local service down.
+	Offline bool `json:"offline,omitempty"`
+	// Draining is set once the route was drained through the control socket.
+	Draining bool `json:"draining,omitempty"`
+	// BandwidthLimit is the route's throughput cap in bytes per second, if any.
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+	// FollowRedirects is the number of upstream redirects followed server-side.
+	FollowRedirects int `json:"follow_redirects,omitempty"`
+	// LogSampleRate is the route's access log sample rate override, if any.
+	LogSampleRate int `json:"log_sample_rate,omitempty"`
+	// RequestTimeout is the route's request timeout override, if any.
+	RequestTimeout string `json:"request_timeout,omitempty"`
+	// Placeholder is set while the route waits for its tunnel to reconnect.
+	Placeholder bool `json:"placeholder,omitempty"`
+	// TokenGated is set when requests need the route's access token, which
+	// itself is never reported.
+	TokenGated bool `json:"token_gated,omitempty"`
+	// AllowIPs and DenyIPs are the CIDRs the route admits and refuses.
+	AllowIPs []string `json:"allow_ips,omitempty"`
+	DenyIPs  []string `json:"deny_ips,omitempty"`
+	// BasicAuth is set when requests need basic auth credentials, which
+	// themselves are never reported.
+	BasicAuth bool `json:"basic_auth,omitempty"`
+	// SecurityHeaders is the route's override of SECURITY_HEADERS, if any;
+	// empty when the route disables them.
+	SecurityHeaders map[string]string `json:"security_headers,omitzero"`
+}
+
+// GetRouteInfo returns the target and stats of the route for host. Unlike
+// GetEntry it doesn't count as activity on the route.
+func (m *ShardedRouteManager) GetRouteInfo(host string) (RouteInfo, bool) {
+	e, ok := m.lookup(host)
+	if !ok || !e.complete() {
+		return RouteInfo{}, false
+	}
+	var allow, deny []string
+	if e.accessControl != nil {
+		allow, deny = formatCIDRs(e.accessControl.Allow), formatCIDRs(e.accessControl.Deny)
+	}
+	return RouteInfo{
+		Host:       host,
+		Target:     e.TargetURL.String(),
+		CreatedAt:  e.CreatedAt,
+		LastActive: e.LastActive(),
+		Requests:   e.requests.Load(),
+		User:       e.user,
+		Labels:     e.labels,
+		Offline:    e.offline.Load(),
+		Draining:   e.draining.Load(),
+
+		BandwidthLimit:  e.bandwidthRate(),
+		FollowRedirects: e.followRedirects,
+		LogSampleRate:   e.logSampleRate,
+		RequestTimeout:  formatTimeout(e.requestTimeout),
+		Placeholder:     e.placeholder,
+		TokenGated:      e.tokenGated(),
+		AllowIPs:        allow,
+		DenyIPs:         deny,
+		BasicAuth:       e.basicAuth != nil,
+		SecurityHeaders: e.securityHeaders,
+	}, true
+}
+
 // ListRoutes returns a snapshot of host->target for administrative calls.
+// Routes may be added or removed while it runs; incomplete entries are skipped.
 func (m *ShardedRouteManager) ListRoutes() map[string]string {
 	out := make(map[string]string)
-	for i := 0; i < routeShards; i++ {
-		s := m.shards[i]
+	for _, s := range m.shards {
 		s.RLock()
 		for k, v := range s.m {
-			out[k] = v.TargetURL.String()
+			if v.complete() {
+				out[k] = v.TargetURL.String()
+			}
 		}
 		s.RUnlock()
 	}
 	return out
 }
 
+// CloseIdleConnections closes every route's idle and prewarmed upstream
+// connections, which would otherwise keep their tunnels busy until they time
+// out.
+func (m *ShardedRouteManager) CloseIdleConnections() {
+	for _, s := range m.shards {
+		s.RLock()
+		for _, v := range s.m {
+			if v.transport != nil {
+				v.transport.CloseIdleConnections()
+			}
+			if v.warm != nil {
+				v.warm.closeAll()
+			}
+		}
+		s.RUnlock()
+	}
+}
+
+// normalizeHost strips an optional port (e.g. "alice.example.com:8080"), trims a
+// single trailing dot ("alice.example.com.") and lowercases the host, since
+// hostnames are case-insensitive and routes are keyed in lowercase.
+func normalizeHost(host string) string {
+	if i := strings.IndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
+}
+
 // FastProxyHandler does:
-//  - normalize host (strip port)
-//  - single lookup into shard map (GetEntry)
-//  - optional header injection (low-cost)
-//  - delegate to pre-created ReverseProxy which streams the body
-func FastProxyHandler(m *ShardedRouteManager, zone string) http.HandlerFunc {
+//   - normalize host (strip port and trailing dot, lowercase)
+//   - reject hosts outside zones (no check when zones is empty)
+//   - answer a retryable 503 until the manager is ready
+//   - serve the maintenance page to hosts under maintenance
+//   - single lookup into shard map, falling back to the matched zone's default
+//   - answer a 403 to clients the route's access control refuses
+//   - answer a 429 to routes over the rate limit
+//   - check the access token and basic auth credentials of protected routes
+//   - optional header injection (low-cost)
+//   - delegate to pre-created ReverseProxy which streams the body
+func FastProxyHandler(m *ShardedRouteManager, zones ...string) http.HandlerFunc {
+	zones = normalizeZones(zones)
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Strip optional port from Host (e.g. "alice.example.com:8080")
-		host := r.Host
-		if i := strings.IndexByte(host, ':'); i >= 0 {
-			host = host[:i]
-		}
+		host := normalizeHost(r.Host)
+		requestID := setRequestID(w, r)
 
-		// Quick reject if host doesn't belong to zone to reduce unnecessary lookups.
-		if zone != "" && !strings.HasSuffix(host, "."+zone) {
+		// Quick reject if host doesn't belong to a zone to reduce unnecessary lookups.
+		zone, ok := matchZone(host, zones)
+		if !ok {
 			http.Error(w, "invalid host", http.StatusBadRequest)
 			return
 		}
 
-		entry, ok := m.GetEntry(host)
+		// Until startup completes, clients haven't reconnected their tunnels
+		// yet; a missing route would be a spurious 404.
+		if !m.Ready() {
+			w.Header().Set("Retry-After", strconv.Itoa(startingRetryAfter))
+			http.Error(w, "tunnelfy is starting up, retry shortly", http.StatusServiceUnavailable)
+			return
+		}
+
+		if m.serveMaintenance(w, host, zone) {
+			return
+		}
+
+		// A request carrying our own hop marker came back through an upstream
+		// that points at this proxy; stop it before it amplifies.
+		if m.isLoop(r) {
+			if m.logRequests {
+				m.log.Warn("proxy loop detected", "host", logsafe.String(host), "request_id", requestID)
+			}
+			http.Error(w, "proxy loop detected", http.StatusLoopDetected)
+			return
+		}
+
+		entry, ok := m.getEntry(host, zone)
 		if !ok {
 			http.NotFound(w, r)
 			return
 		}
+		if !m.checkClientIP(entry, r) {
+			serveForbiddenIP(w)
+			return
+		}
+		if m.serveRateLimited(w, entry) {
+			return
+		}
+		if !entry.checkAccessToken(r) {
+			serveForbiddenToken(w)
+			return
+		}
+		if !entry.checkBasicAuth(r) {
+			serveUnauthorized(w)
+			return
+		}
+		r.Header.Add(hopHeader, m.instanceID)
+		r.Header.Del(UpstreamHeader)
+		// Pass the SNI of TLS connections on; never trust a client-supplied one.
+		r.Header.Del(SNIHeader)
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			r.Header.Set(SNIHeader, r.TLS.ServerName)
+		}
+		if m.opts.ExposeUpstream {
+			w.Header().Set(UpstreamHeader, entry.TargetURL.String())
+		}
 
 		// Inject minimal headers for tracing (cheap).
 		if m.logRequests {
@@ -187,7 +856,52 @@ func FastProxyHandler(m *ShardedRouteManager, zone string) http.HandlerFunc {
 			}
 		}
 
+		if entry.offline.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(offlineRetryAfter))
+			http.Error(w, "application offline: the service behind this tunnel is not running", http.StatusServiceUnavailable)
+			return
+		}
+		if entry.draining.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(offlineRetryAfter))
+			http.Error(w, "tunnel closing: try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+
+		if entry.placeholder {
+			w.Header().Set("Retry-After", strconv.Itoa(placeholderRetryAfter))
+			http.Error(w, "tunnel is reconnecting, retry shortly", http.StatusServiceUnavailable)
+			return
+		}
+
+		if entry.debugging() {
+			entry.logHeaders(m.log, host, "request "+logsafe.String(r.Method+" "+r.URL.RequestURI()), r.Header)
+		}
+
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &activityBody{ReadCloser: r.Body, entry: entry}
+			if l := entry.bandwidth.Load(); l != nil {
+				r.Body = &throttledBody{ReadCloser: r.Body, ctx: r.Context(), bucket: l.request, chunk: l.chunk}
+			}
+		}
+
+		if m.opts.AccessLog.Enabled || m.events.active() {
+			rec := &responseRecorder{ResponseWriter: w}
+			defer m.finishRequest(entry, host, r, rec, time.Now())
+			w = rec
+		}
+
+		if timeout := m.requestTimeout(entry); timeout > 0 && !isStreamingRequest(r) {
+			var cancel context.CancelFunc
+			r, cancel = withRequestTimeout(r, timeout)
+			defer cancel()
+		}
+
 		// Serve using pre-created proxy (streams response efficiently).
+		entry.requests.Add(1)
+		metrics.HTTPProxiedRequests.Inc()
+		if entry.metricLabel != "" {
+			metrics.HTTPRequests.Inc(entry.metricLabel)
+		}
 		entry.Proxy.ServeHTTP(w, r)
 	}
 }
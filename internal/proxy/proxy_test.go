@@ -0,0 +1,442 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testZone = "tunnelfy.test"
+
+// newTestManager returns a ready manager with opts.
+func newTestManager(t testing.TB, opts Options) *ShardedRouteManager {
+	t.Helper()
+	m, err := NewShardedRouteManager(DefaultRouteShards, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// newUpstream starts an HTTP server answering every request with body.
+func newUpstream(t testing.TB, body string) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// serveProxy sends r through FastProxyHandler and returns the recorded response.
+func serveProxy(m *ShardedRouteManager, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	FastProxyHandler(m, testZone).ServeHTTP(rec, r)
+	return rec
+}
+
+// proxyGet is serveProxy for a GET of path on host.
+func proxyGet(m *ShardedRouteManager, host, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	return serveProxy(m, r)
+}
+
+func TestAddRouteExclusiveConcurrent(t *testing.T) {
+	tests := []struct {
+		name        string
+		placeholder bool
+	}{
+		{"free host", false},
+		{"placeholder", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, Options{})
+			host := "alice." + testZone
+			if tt.placeholder {
+				if err := m.AddRoute(host, "10.0.0.254:8080"); err != nil {
+					t.Fatal(err)
+				}
+				if !m.HoldRoute(host, time.Minute) {
+					t.Fatal("HoldRoute failed")
+				}
+			}
+			const contenders = 16
+			var wg sync.WaitGroup
+			var wins atomic.Int32
+			winner := make(chan string, contenders)
+			start := make(chan struct{})
+			for i := 0; i < contenders; i++ {
+				target := fmt.Sprintf("10.0.0.%d:8080", i+1)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					switch err := m.AddRouteExclusive(host, target); {
+					case err == nil:
+						wins.Add(1)
+						winner <- "http://" + target
+					case !errors.Is(err, ErrRouteExists):
+						t.Errorf("AddRouteExclusive: %v", err)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+			if n := wins.Load(); n != 1 {
+				t.Fatalf("%d contenders won, want exactly 1", n)
+			}
+			if got, want := m.ListRoutes()[host], <-winner; got != want {
+				t.Fatalf("route target = %q, want the winner's %q", got, want)
+			}
+		})
+	}
+}
+
+func TestNewShardedRouteManagerShardCount(t *testing.T) {
+	tests := []struct {
+		shards int
+		ok     bool
+	}{
+		{1, true},
+		{16, true},
+		{DefaultRouteShards, true},
+		{maxRouteShards, true},
+		{0, false},
+		{-4, false},
+		{100, false},
+		{maxRouteShards * 2, false},
+	}
+	for _, tt := range tests {
+		_, err := NewShardedRouteManager(tt.shards, false, Options{})
+		if (err == nil) != tt.ok {
+			t.Errorf("NewShardedRouteManager(%d): err = %v, want ok=%v", tt.shards, err, tt.ok)
+		}
+	}
+}
+
+// benchShardCounts are the shard counts the route table benchmarks compare.
+var benchShardCounts = []int{16, DefaultRouteShards, 4096}
+
+func BenchmarkGetEntry(b *testing.B) {
+	for _, shards := range benchShardCounts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			m, err := NewShardedRouteManager(shards, false, Options{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			hosts := make([]string, 10000)
+			for i := range hosts {
+				hosts[i] = fmt.Sprintf("user%d.%s", i, testZone)
+				if err := m.AddRoute(hosts[i], "10.0.0.1:8080"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, ok := m.GetEntry(hosts[i%len(hosts)]); !ok {
+						b.Fatal("route not found")
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkAddRoute(b *testing.B) {
+	for _, shards := range benchShardCounts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			m, err := NewShardedRouteManager(shards, false, Options{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					host := fmt.Sprintf("user%d.%s", next.Add(1)%10000, testZone)
+					if err := m.AddRoute(host, "10.0.0.1:8080"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestShardDistribution(t *testing.T) {
+	m := newTestManager(t, Options{})
+	shards := len(m.shards)
+	load := make([]int, shards)
+	// Realistic hosts share long suffixes and differ in short prefixes.
+	const users = 20000
+	for i := 0; i < users; i++ {
+		for _, host := range []string{
+			fmt.Sprintf("user%d.%s", i, testZone),
+			fmt.Sprintf("api.user%d.%s", i, testZone),
+		} {
+			load[m.shardIdx(host)]++
+		}
+	}
+	mean := float64(2*users) / float64(shards)
+	maxLoad := slices.Max(load)
+	if float64(maxLoad) > 1.5*mean {
+		t.Fatalf("max shard load %d exceeds 1.5x the mean %.1f", maxLoad, mean)
+	}
+}
+
+func BenchmarkShardIdx(b *testing.B) {
+	m := newTestManager(b, Options{})
+	host := "api.alice." + testZone
+	for i := 0; i < b.N; i++ {
+		m.shardIdx(host)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"alice.tunnelfy.test", "alice.tunnelfy.test"},
+		{"alice.tunnelfy.test.", "alice.tunnelfy.test"},
+		{"Alice.TunnelFy.Test", "alice.tunnelfy.test"},
+		{"ALICE.tunnelfy.test.:8080", "alice.tunnelfy.test"},
+		{"alice.tunnelfy.test:8080", "alice.tunnelfy.test"},
+	}
+	for _, tt := range tests {
+		if got := normalizeHost(tt.in); got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestProxyNormalizesHost(t *testing.T) {
+	m := newTestManager(t, Options{})
+	upstream := newUpstream(t, "alice")
+	if err := m.AddRoute("alice."+testZone, upstream.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{
+		"alice." + testZone,
+		"alice." + testZone + ".",
+		"Alice.TUNNELFY.test",
+		"ALICE." + testZone + ".:8080",
+	} {
+		t.Run(host, func(t *testing.T) {
+			rec := proxyGet(m, host, "/")
+			if rec.Code != http.StatusOK || rec.Body.String() != "alice" {
+				t.Fatalf("got %d %q, want the route's upstream", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestDefaultRoute(t *testing.T) {
+	m := newTestManager(t, Options{})
+	if err := m.SetDefaultRoute(newUpstream(t, "backend").Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddRoute("alice."+testZone, newUpstream(t, "alice").Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host     string
+		wantBody string
+	}{
+		{"bob." + testZone, "backend"},
+		{"api.bob." + testZone, "backend"},
+		{"anything." + testZone, "backend"},
+		{"alice." + testZone, "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			rec := proxyGet(m, tt.host, "/")
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.wantBody {
+				t.Fatalf("got %d %q, want %q", rec.Code, rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	if err := m.SetDefaultRoute(""); err != nil {
+		t.Fatal(err)
+	}
+	if rec := proxyGet(m, "bob."+testZone, "/"); rec.Code != http.StatusNotFound {
+		t.Fatalf("after removing the default route: got %d, want 404", rec.Code)
+	}
+}
+
+// deadAddr returns a loopback address nothing listens on.
+func deadAddr(t testing.TB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestWarmupGrace(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	m := newTestManager(t, Options{WarmupGrace: grace})
+	host := "app." + testZone
+	if err := m.AddRoute(host, deadAddr(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := proxyGet(m, host, "/")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" ||
+		!strings.Contains(rec.Body.String(), "starting up") {
+		t.Fatalf("during warmup: got %d Retry-After=%q %q, want the warmup 503", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+	// Afterwards the refused dial gets the usual upstream-down page.
+	time.Sleep(grace)
+	rec = proxyGet(m, host, "/")
+	if strings.Contains(rec.Body.String(), "starting up") || rec.Header().Get("Retry-After") != strconv.Itoa(upstreamDownRetryAfter) {
+		t.Fatalf("after warmup: got %d Retry-After=%q %q, want the upstream-down page", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+}
+
+func TestExposeUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An upstream can't spoof the header either.
+		w.Header().Set(UpstreamHeader, "http://spoofed")
+		io.WriteString(w, r.Header.Get(UpstreamHeader))
+	}))
+	t.Cleanup(upstream.Close)
+	target := "http://" + upstream.Listener.Addr().String()
+
+	for _, expose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("expose=%v", expose), func(t *testing.T) {
+			m := newTestManager(t, Options{ExposeUpstream: expose})
+			if err := m.AddRoute("app."+testZone, upstream.Listener.Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://app."+testZone+"/", nil)
+			r.Header.Set(UpstreamHeader, "http://client-supplied")
+			rec := serveProxy(m, r)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Body.String(); got != "" {
+				t.Fatalf("upstream received %s %q, want it stripped", UpstreamHeader, got)
+			}
+			want := ""
+			if expose {
+				want = target
+			}
+			if got := rec.Header().Get(UpstreamHeader); got != want {
+				t.Fatalf("%s = %q, want %q", UpstreamHeader, got, want)
+			}
+		})
+	}
+}
+
+func TestForwardedHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+"|"+r.Header.Get(ForwardedHostHeader))
+	}))
+	t.Cleanup(upstream.Close)
+	upstreamHost := upstream.Listener.Addr().String()
+
+	hosts := []string{
+		"alice." + testZone,
+		"api.alice." + testZone,
+		"v2.api.alice." + testZone,
+	}
+	for _, preserve := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preserve_host=%v", preserve), func(t *testing.T) {
+			m := newTestManager(t, Options{PreserveHost: preserve})
+			for _, host := range hosts {
+				if err := m.AddRoute(host, upstreamHost); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, host := range hosts {
+				r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+				r.Header.Set(ForwardedHostHeader, "spoofed.example.com")
+				rec := serveProxy(m, r)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status = %d, want 200", host, rec.Code)
+				}
+				wantHost := upstreamHost
+				if preserve {
+					wantHost = host
+				}
+				if got, want := rec.Body.String(), wantHost+"|"+host; got != want {
+					t.Errorf("%s: upstream saw Host|%s %q, want %q", host, ForwardedHostHeader, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedSNI(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(SNIHeader))
+	}))
+	t.Cleanup(upstream.Close)
+	m := newTestManager(t, Options{})
+	host := "app." + testZone
+	if err := m.AddRoute(host, upstream.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	ingress := httptest.NewTLSServer(FastProxyHandler(m, testZone))
+	t.Cleanup(ingress.Close)
+	plain := httptest.NewServer(FastProxyHandler(m, testZone))
+	t.Cleanup(plain.Close)
+
+	tests := []struct {
+		name       string
+		url        string
+		serverName string
+		wantSNI    string
+	}{
+		{"tls", ingress.URL, host, host},
+		{"tls without sni", ingress.URL, "", ""},
+		{"plain http", plain.URL, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := ingress.Client().Transport.(*http.Transport).Clone()
+			tr.TLSClientConfig.ServerName = tt.serverName
+			tr.TLSClientConfig.InsecureSkipVerify = true
+			req, _ := http.NewRequest(http.MethodGet, tt.url+"/", nil)
+			req.Host = host
+			// A client-supplied header never reaches the upstream.
+			req.Header.Set(SNIHeader, "spoofed."+testZone)
+			resp, err := (&http.Client{Transport: tr}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != tt.wantSNI {
+				t.Fatalf("got %d, upstream saw %s %q, want %q", resp.StatusCode, SNIHeader, body, tt.wantSNI)
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing the test with what after a few
+// seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
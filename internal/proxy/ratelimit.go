@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// RateLimitOptions limits the request rate of each route, so a single
+// hammered tunnel can't degrade the whole proxy.
+type RateLimitOptions struct {
+	// RPS is the sustained number of requests per second a route accepts;
+	// zero disables rate limiting.
+	RPS int
+	// Burst is how many requests a route accepts at once above the sustained
+	// rate; zero or less uses RPS.
+	Burst int
+}
+
+// requestLimiter is a token bucket counting requests. Unlike tokenBucket it
+// never makes callers wait: a request finding the bucket empty is refused.
+type requestLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // requests per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRequestLimiter(opts RateLimitOptions) *requestLimiter {
+	burst := opts.Burst
+	if burst <= 0 {
+		burst = opts.RPS
+	}
+	return &requestLimiter{rate: float64(opts.RPS), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token for a request. When none is left it returns false and
+// how long until one is.
+func (l *requestLimiter) allow() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimiter returns e's request limiter, creating it on the route's first
+// request. It lives on the entry, so it goes away with the route.
+func (m *ShardedRouteManager) rateLimiter(e *UpstreamEntry) *requestLimiter {
+	if l := e.limiter.Load(); l != nil {
+		return l
+	}
+	e.limiter.CompareAndSwap(nil, newRequestLimiter(m.opts.RateLimit))
+	return e.limiter.Load()
+}
+
+// serveRateLimited answers a 429 with a Retry-After when e's route is over
+// Options.RateLimit, reporting whether it did.
+func (m *ShardedRouteManager) serveRateLimited(w http.ResponseWriter, e *UpstreamEntry) bool {
+	if m.opts.RateLimit.RPS <= 0 {
+		return false
+	}
+	ok, wait := m.rateLimiter(e).allow()
+	if ok {
+		return false
+	}
+	metrics.HTTPRateLimited.Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many requests, retry shortly", http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRateLimitBurst(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     RateLimitOptions
+		requests int
+		want429  int
+	}{
+		{"disabled", RateLimitOptions{}, 10, 0},
+		{"burst", RateLimitOptions{RPS: 1, Burst: 3}, 10, 7},
+		{"burst defaults to rps", RateLimitOptions{RPS: 2}, 10, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, Options{RateLimit: tt.opts})
+			up := newUpstream(t, "ok")
+			hammered, quiet := "app."+testZone, "other."+testZone
+			for _, host := range []string{hammered, quiet} {
+				if err := m.AddRoute(host, up.Listener.Addr().String()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got429 := 0
+			for i := 0; i < tt.requests; i++ {
+				rec := proxyGet(m, hammered, "/")
+				switch rec.Code {
+				case http.StatusOK:
+				case http.StatusTooManyRequests:
+					got429++
+					if rec.Header().Get("Retry-After") == "" {
+						t.Fatal("429 without Retry-After")
+					}
+				default:
+					t.Fatalf("status %d", rec.Code)
+				}
+			}
+			if got429 != tt.want429 {
+				t.Fatalf("got %d 429s, want %d", got429, tt.want429)
+			}
+			// Limits are per route.
+			if rec := proxyGet(m, quiet, "/"); rec.Code != http.StatusOK {
+				t.Fatalf("other route: status %d", rec.Code)
+			}
+		})
+	}
+}
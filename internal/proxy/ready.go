@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// startingRetryAfter is the Retry-After, in seconds, sent while not ready.
+const startingRetryAfter = 1
+
+// SetReady marks the manager ready or not ready to serve traffic. While not
+// ready, FastProxyHandler answers every request with a retryable 503 instead
+// of routing it against a route map that clients haven't repopulated yet.
+// A new manager is ready.
+func (m *ShardedRouteManager) SetReady(ready bool) {
+	m.notReady.Store(!ready)
+}
+
+// Ready reports whether the manager is ready to serve traffic.
+func (m *ShardedRouteManager) Ready() bool {
+	return !m.notReady.Load()
+}
+
+// ReadyHandler serves the readiness endpoint: 200 once m is ready, 503 before.
+func ReadyHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !m.Ready() {
+			http.Error(w, "starting up", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"time"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// evictionCandidate is a route found idle during the read-locked scan.
+type evictionCandidate struct {
+	host  string
+	entry *UpstreamEntry
+}
+
+// ReapIdle evicts every tunnel route (one registered with an OnEvict callback)
+// with no activity for longer than maxIdle and returns the evicted hosts.
+// Routes without an owner to tear down, such as those added through the admin
+// API, are left alone. Each shard is scanned under a short read lock;
+// candidates are then removed one at a time under the write lock, re-checking
+// that the same entry is still registered and still idle, and their OnEvict
+// callbacks run after the lock is released. Tearing down listeners or SSH
+// connections therefore never happens with a shard lock held, so callbacks may
+// safely call back into the manager.
+func (m *ShardedRouteManager) ReapIdle(maxIdle time.Duration) []string {
+	if maxIdle <= 0 {
+		return nil
+	}
+	var evicted []string
+	for _, s := range m.shards {
+
+		cutoff := time.Now().Add(-maxIdle).UnixNano()
+		var candidates []evictionCandidate
+		s.RLock()
+		for host, e := range s.m {
+			if e.onEvict != nil && e.lastActive.Load() < cutoff {
+				candidates = append(candidates, evictionCandidate{host: host, entry: e})
+			}
+		}
+		s.RUnlock()
+
+		for _, c := range candidates {
+			s.Lock()
+			// The route may have been removed, replaced or used since the scan.
+			current, ok := s.m[c.host]
+			removed := ok && current == c.entry && current.lastActive.Load() < cutoff
+			if removed {
+				delete(s.m, c.host)
+			}
+			s.Unlock()
+			if !removed {
+				continue
+			}
+			m.routeDeleted(c.host)
+
+			if m.logRequests {
+				m.log.Debug("route evict", "host", logsafe.String(c.host), "max_idle", maxIdle)
+			}
+			if c.entry.onEvict != nil {
+				c.entry.onEvict()
+			}
+			evicted = append(evicted, c.host)
+		}
+	}
+	return evicted
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReapIdle(t *testing.T) {
+	m := newTestManager(t, Options{})
+	evicted := map[string]bool{}
+	idle, active := "idle."+testZone, "active."+testZone
+	addEvictableRoute(t, m, idle, evicted)
+	addEvictableRoute(t, m, active, evicted)
+	// Routes without a tunnel to tear down are never reaped.
+	if err := m.AddRoute("admin."+testZone, "10.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	m.GetEntry(active)
+	got := m.ReapIdle(25 * time.Millisecond)
+	if !slices.Equal(got, []string{idle}) || !evicted[idle] || evicted[active] {
+		t.Fatalf("evicted %v (callbacks %v), want only %s", got, evicted, idle)
+	}
+	if _, ok := m.GetEntry("admin." + testZone); !ok {
+		t.Fatal("route without OnEvict was reaped")
+	}
+}
+
+// TestReapIdleConcurrent runs the reaper alongside adds, removals and lookups,
+// with eviction callbacks that call back into the manager; run it with -race.
+func TestReapIdleConcurrent(t *testing.T) {
+	m := newTestManager(t, Options{})
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				host := fmt.Sprintf("w%d-%d.%s", w, i%16, testZone)
+				m.AddRouteWithOptions(host, "10.0.0.1:8080", RouteOptions{OnEvict: func() {
+					// Re-entering the manager must not deadlock.
+					m.GetRouteInfo(host)
+					m.RemoveRoute(host)
+				}})
+				m.GetEntry(host)
+				if i%3 == 0 {
+					m.RemoveRoute(host)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 200 {
+			m.ReapIdle(time.Nanosecond)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reaper deadlocked")
+	}
+	close(stop)
+	wg.Wait()
+}
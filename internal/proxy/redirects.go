@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MaxFollowRedirects bounds RouteOptions.FollowRedirects.
+const MaxFollowRedirects = 10
+
+// errRedirectLoop is returned when an upstream redirects to a URL already
+// visited while following its redirects; the client gets a 502.
+var errRedirectLoop = errors.New("upstream redirect loop")
+
+// redirectFollower is a RoundTripper that follows upstream redirects to the
+// same upstream host server-side, so clients only see the final response.
+// Redirects elsewhere, past the limit, or that would need to replay a
+// request body are passed through to the client unchanged.
+type redirectFollower struct {
+	next http.RoundTripper
+	max  int
+}
+
+func (f *redirectFollower) RoundTrip(req *http.Request) (*http.Response, error) {
+	visited := map[string]bool{req.URL.String(): true}
+	for i := 0; ; i++ {
+		resp, err := f.next.RoundTrip(req)
+		if err != nil || i >= f.max || !isRedirect(resp.StatusCode) {
+			return resp, err
+		}
+		loc, err := resp.Location()
+		if err != nil || !sameHost(loc, req.URL) {
+			return resp, nil
+		}
+		next, ok := redirectRequest(req, resp.StatusCode, loc)
+		if !ok {
+			return resp, nil
+		}
+		// Drain a little so the connection can be reused.
+		io.CopyN(io.Discard, resp.Body, 4<<10)
+		resp.Body.Close()
+		if visited[loc.String()] {
+			return nil, errRedirectLoop
+		}
+		visited[loc.String()] = true
+		req = next
+	}
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// sameHost reports whether loc points at the host req was sent to.
+func sameHost(loc, req *url.URL) bool {
+	return loc.Scheme == req.Scheme && strings.EqualFold(loc.Host, req.Host)
+}
+
+// redirectRequest builds the request following a redirect of req to loc. As
+// browsers do, 301, 302 and 303 turn into a bodiless GET (HEAD stays HEAD),
+// while 307 and 308 keep the method and body; it reports false when that body
+// can't be replayed.
+func redirectRequest(req *http.Request, status int, loc *url.URL) (*http.Request, bool) {
+	next := req.Clone(req.Context())
+	next.URL = loc
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	switch status {
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		if hasBody {
+			if req.GetBody == nil {
+				return nil, false
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, false
+			}
+			next.Body = body
+		}
+	default:
+		if req.Method != http.MethodHead {
+			next.Method = http.MethodGet
+		}
+		next.Body = http.NoBody
+		next.ContentLength = 0
+		next.GetBody = nil
+		next.Header.Del("Content-Length")
+		next.Header.Del("Content-Type")
+	}
+	return next, true
+}
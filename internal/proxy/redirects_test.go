@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	const limit = 5
+	mux := http.NewServeMux()
+	mux.Handle("/start", http.RedirectHandler("/middle", http.StatusFound))
+	mux.Handle("/middle", http.RedirectHandler("/final", http.StatusTemporaryRedirect))
+	mux.Handle("/post", http.RedirectHandler("/final", http.StatusSeeOther))
+	mux.Handle("/loop-a", http.RedirectHandler("/loop-b", http.StatusFound))
+	mux.Handle("/loop-b", http.RedirectHandler("/loop-a", http.StatusFound))
+	mux.Handle("/external", http.RedirectHandler("http://example.com/", http.StatusFound))
+	mux.HandleFunc("/chain", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		http.Redirect(w, r, fmt.Sprintf("/chain?n=%d", n+1), http.StatusFound)
+	})
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "final "+r.Method)
+	})
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+
+	m := newTestManager(t, Options{})
+	follow, pass := "follow."+testZone, "pass."+testZone
+	if err := m.AddRouteWithOptions(follow, upstream.Listener.Addr().String(), RouteOptions{FollowRedirects: limit}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddRoute(pass, upstream.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		host         string
+		method       string
+		path         string
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+	}{
+		{"passthrough", pass, http.MethodGet, "/start", http.StatusFound, "", "/middle"},
+		{"follow chain", follow, http.MethodGet, "/start", http.StatusOK, "final GET", ""},
+		{"follow 303 after POST", follow, http.MethodPost, "/post", http.StatusOK, "final GET", ""},
+		{"loop", follow, http.MethodGet, "/loop-a", http.StatusBadGateway, "", ""},
+		{"cross host", follow, http.MethodGet, "/external", http.StatusFound, "", "http://example.com/"},
+		{"past the limit", follow, http.MethodGet, "/chain", http.StatusFound, "", fmt.Sprintf("/chain?n=%d", limit+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, strings.NewReader(""))
+			rec := serveProxy(m, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %q)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Fatalf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Fatalf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+)
+
+// RequestIDHeader carries the ID correlating a request across the client,
+// the proxy's logs and the upstream. A valid ID sent by the client is kept;
+// otherwise the proxy generates one. Either way it is sent to the upstream
+// and returned in the response, replacing any the upstream sets.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds client-supplied request IDs, which end up in logs.
+const maxRequestIDLen = 128
+
+// requestIDEncoding encodes generated request IDs: 10 random bytes make 16
+// characters.
+var requestIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [10]byte
+	_, _ = rand.Read(b[:])
+	return requestIDEncoding.EncodeToString(b[:])
+}
+
+// validRequestID reports whether a client-supplied request ID is printable
+// ASCII without spaces and at most maxRequestIDLen bytes.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDOf returns the request ID of the request resp answers, if known.
+func requestIDOf(resp *http.Response) string {
+	if resp.Request == nil {
+		return ""
+	}
+	return resp.Request.Header.Get(RequestIDHeader)
+}
+
+// setRequestID assigns r its request ID, keeping a valid one the client
+// sent, and sets it on both r and the response.
+func setRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	r.Header.Set(RequestIDHeader, id)
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
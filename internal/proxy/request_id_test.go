@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The upstream can't replace the ID either.
+		w.Header().Set(RequestIDHeader, "upstream-id")
+		io.WriteString(w, r.Header.Get(RequestIDHeader))
+	}))
+	t.Cleanup(upstream.Close)
+	m := newTestManager(t, Options{})
+	host := "app." + testZone
+	if err := m.AddRoute(host, upstream.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, sent string
+		keep       bool
+	}{
+		{name: "supplied", sent: "trace-1234", keep: true},
+		{name: "missing"},
+		{name: "with space", sent: "a b"},
+		{name: "control character", sent: "a\x7fb"},
+		{name: "too long", sent: strings.Repeat("x", maxRequestIDLen+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+			if tt.sent != "" {
+				r.Header.Set(RequestIDHeader, tt.sent)
+			}
+			rec := serveProxy(m, r)
+			id := rec.Header().Get(RequestIDHeader)
+			if got := rec.Body.String(); got != id {
+				t.Fatalf("upstream saw ID %q, client got %q", got, id)
+			}
+			if tt.keep {
+				if id != tt.sent {
+					t.Fatalf("ID %q, want the client's %q", id, tt.sent)
+				}
+				return
+			}
+			if len(id) != 16 || strings.Trim(id, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567") != "" {
+				t.Fatalf("ID %q, want a generated 16 character base32 ID", id)
+			}
+		})
+	}
+
+	if a, b := proxyGet(m, host, "/").Header().Get(RequestIDHeader), proxyGet(m, host, "/").Header().Get(RequestIDHeader); a == b {
+		t.Fatalf("two requests got the same generated ID %q", a)
+	}
+}
+
+func TestRequestIDInProxyErrors(t *testing.T) {
+	logs := newRecordingHandler()
+	m, err := NewShardedRouteManager(DefaultRouteShards, true, Options{Logger: slog.New(logs)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := "down." + testZone
+	if err := m.AddRoute(host, deadAddr(t)); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	r.Header.Set(RequestIDHeader, "trace-5678")
+	rec := serveProxy(m, r)
+	if rec.Code < 500 {
+		t.Fatalf("status %d, want a proxy error", rec.Code)
+	}
+	if got := rec.Header().Get(RequestIDHeader); got != "trace-5678" {
+		t.Fatalf("error response ID %q, want the client's", got)
+	}
+	if attrs := logs.attrs("proxy error"); !slices.Contains(attrs, "request_id=trace-5678") {
+		t.Fatalf("proxy error logged %q, want the request ID", attrs)
+	}
+}
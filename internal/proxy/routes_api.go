@@ -2,17 +2,373 @@ package proxy
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// RoutesAPIHandler returns a JSON map of routes (host -> upstream).
-// Useful for debugging / admin UI.
+// RoutesAPIHandler returns a JSON map of routes (host -> upstream) on GET.
+// Useful for debugging / admin UI. POST registers a route from a JSON body
+// {"host": ..., "target": ...}; the host may be a wildcard ("*.app.alice.zone").
+// DELETE removes the routes of a JSON body {"hosts": [...]}, dropping their
+// tunnels. Other methods get 405 with an Allow header.
 func RoutesAPIHandler(m *ShardedRouteManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		out := m.ListRoutes()
-		w.Header().Set("Content-Type", "application/json")
-		enc := json.NewEncoder(w)
-		enc.SetIndent("", "  ")
-		_ = enc.Encode(out)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			out := m.ListRoutes()
+			writeJSON(w, http.StatusOK, out)
+		case http.MethodPost:
+			addRoute(m, w, r)
+		case http.MethodDelete:
+			deleteRoutes(m, w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// routeRequest is the body of POST /api/routes.
+type routeRequest struct {
+	Host   string `json:"host"`
+	Target string `json:"target"`
+	// BandwidthLimit optionally caps the route in bytes per second.
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+	// FollowRedirects optionally follows upstream redirects server-side.
+	FollowRedirects int `json:"follow_redirects,omitempty"`
+	// LogSampleRate optionally overrides the access log sample rate.
+	LogSampleRate int `json:"log_sample_rate,omitempty"`
+	// RequestTimeout optionally overrides the request timeout, as a Go
+	// duration such as "30s".
+	RequestTimeout string `json:"request_timeout,omitempty"`
+	// AccessToken optionally gates the route behind a shared secret.
+	AccessToken string `json:"access_token,omitempty"`
+	// AllowIPs and DenyIPs optionally restrict the route to client CIDRs.
+	AllowIPs []string `json:"allow_ips,omitempty"`
+	DenyIPs  []string `json:"deny_ips,omitempty"`
+	// SecurityHeaders optionally replaces SECURITY_HEADERS for the route;
+	// an empty object disables them.
+	SecurityHeaders map[string]string `json:"security_headers,omitzero"`
+}
+
+func addRoute(m *ShardedRouteManager, w http.ResponseWriter, r *http.Request) {
+	var req routeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	info, err := req.apply(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// deleteRoutesRequest is the body of DELETE /api/routes.
+type deleteRoutesRequest struct {
+	Hosts []string `json:"hosts"`
+}
+
+// deleteRoutesResult is the response to DELETE /api/routes.
+type deleteRoutesResult struct {
+	Deleted  []string `json:"deleted"`
+	NotFound []string `json:"not_found"`
+}
+
+func deleteRoutes(m *ShardedRouteManager, w http.ResponseWriter, r *http.Request) {
+	var req deleteRoutesRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Hosts) == 0 {
+		http.Error(w, "hosts is required", http.StatusBadRequest)
+		return
+	}
+	res := deleteRoutesResult{Deleted: []string{}, NotFound: []string{}}
+	for _, host := range req.Hosts {
+		if m.DeleteRoute(normalizeHost(host)) {
+			res.Deleted = append(res.Deleted, host)
+		} else {
+			res.NotFound = append(res.NotFound, host)
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// validate checks the request and returns its normalized host.
+func (req routeRequest) validate() (string, error) {
+	host := normalizeHost(req.Host)
+	if host == "" || req.Target == "" || (strings.Contains(host, "*") && !isWildcardHost(host)) {
+		return "", errors.New("host and target are required; wildcards must be of the form *.suffix")
+	}
+	return host, nil
+}
+
+// options validates the request and returns its normalized host and route
+// options.
+func (req routeRequest) options() (string, RouteOptions, error) {
+	host, err := req.validate()
+	if err != nil {
+		return "", RouteOptions{}, err
+	}
+	if req.BandwidthLimit < 0 {
+		return "", RouteOptions{}, errors.New("bandwidth_limit must not be negative")
+	}
+	if req.FollowRedirects < 0 || req.FollowRedirects > MaxFollowRedirects {
+		return "", RouteOptions{}, fmt.Errorf("follow_redirects must be between 0 and %d", MaxFollowRedirects)
+	}
+	if req.LogSampleRate < 0 {
+		return "", RouteOptions{}, errors.New("log_sample_rate must not be negative")
+	}
+	if req.AccessToken != "" && !ValidAccessToken(req.AccessToken) {
+		return "", RouteOptions{}, fmt.Errorf("access_token must be printable ASCII without spaces, at most %d bytes", MaxAccessTokenLen)
+	}
+	access, err := ParseAccessControl(req.AllowIPs, req.DenyIPs)
+	if err != nil {
+		return "", RouteOptions{}, fmt.Errorf("invalid access control: %w", err)
+	}
+	securityHeaders, err := validSecurityHeaders(req.SecurityHeaders)
+	if err != nil {
+		return "", RouteOptions{}, err
+	}
+	var timeout time.Duration
+	if req.RequestTimeout != "" {
+		if timeout, err = time.ParseDuration(req.RequestTimeout); err != nil || timeout < 0 {
+			return "", RouteOptions{}, errors.New("request_timeout must be a non-negative duration such as 30s")
+		}
+	}
+	return host, RouteOptions{
+		BandwidthLimit:  req.BandwidthLimit,
+		FollowRedirects: req.FollowRedirects,
+		LogSampleRate:   req.LogSampleRate,
+		RequestTimeout:  timeout,
+		AccessToken:     req.AccessToken,
+		AccessControl:   access,
+		SecurityHeaders: securityHeaders,
+	}, nil
+}
+
+// apply validates the request and registers its route.
+func (req routeRequest) apply(m *ShardedRouteManager) (RouteInfo, error) {
+	host, opts, err := req.options()
+	if err != nil {
+		return RouteInfo{}, err
+	}
+	if err := m.AddRouteWithOptions(host, req.Target, opts); err != nil {
+		return RouteInfo{}, fmt.Errorf("invalid target: %w", err)
+	}
+	info, _ := m.GetRouteInfo(host)
+	return info, nil
+}
+
+// RouteAPIHandler serves GET /api/routes/{host} with the target and stats of a
+// single route, and DELETE, which removes the route and drops its tunnel. Both
+// answer 404 if the host has no route.
+func RouteAPIHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			info, ok := m.GetRouteInfo(routeHost(r))
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, http.StatusOK, info)
+		case http.MethodDelete:
+			if !m.DeleteRoute(routeHost(r)) {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// RouteBandwidthAPIHandler serves /api/routes/{host}/bandwidth. POST caps the
+// route's throughput at ?rate= bytes per second in each direction; DELETE
+// removes the cap.
+func RouteBandwidthAPIHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rate int64
+		switch r.Method {
+		case http.MethodPost:
+			parsed, err := strconv.ParseInt(r.URL.Query().Get("rate"), 10, 64)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "rate must be a positive number of bytes per second", http.StatusBadRequest)
+				return
+			}
+			rate = parsed
+		case http.MethodDelete:
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !m.SetRouteBandwidth(routeHost(r), rate) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// accessToken is the body of POST /api/routes/{host}/token and its response.
+type accessToken struct {
+	Token string `json:"token"`
+}
+
+// RouteTokenAPIHandler serves /api/routes/{host}/token. POST gates the route
+// behind the access token of an optional JSON body {"token": ...}, generating
+// a random one if the body is empty, and responds with the token; requests
+// with a previous token are refused from then on. DELETE removes the gate.
+func RouteTokenAPIHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := routeHost(r)
+		switch r.Method {
+		case http.MethodPost:
+			var req accessToken
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+				http.Error(w, "invalid JSON body", http.StatusBadRequest)
+				return
+			}
+			if req.Token == "" {
+				token, err := NewAccessToken()
+				if err != nil {
+					http.Error(w, "failed to generate token", http.StatusInternalServerError)
+					return
+				}
+				req.Token = token
+			} else if !ValidAccessToken(req.Token) {
+				http.Error(w, fmt.Sprintf("token must be printable ASCII without spaces, at most %d bytes", MaxAccessTokenLen), http.StatusBadRequest)
+				return
+			}
+			if !m.SetRouteAccessToken(host, req.Token) {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, http.StatusOK, req)
+		case http.MethodDelete:
+			if !m.SetRouteAccessToken(host, "") {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// defaultPlaceholderTTL is used when an import omits the placeholder TTL.
+const defaultPlaceholderTTL = 5 * time.Minute
+
+// RoutesExportHandler serves GET /api/routes/export with a Snapshot of the
+// route table.
+func RoutesExportHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.Snapshot())
+	}
+}
+
+// RoutesImportHandler serves POST /api/routes/import, restoring a Snapshot
+// exported by another instance. Tunnel routes become placeholders for
+// ?placeholder_ttl= (default 5m) while their clients reconnect.
+func RoutesImportHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ttl := defaultPlaceholderTTL
+		if v := r.URL.Query().Get("placeholder_ttl"); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "invalid placeholder_ttl", http.StatusBadRequest)
+				return
+			}
+			ttl = parsed
+		}
+		var snap Snapshot
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&snap); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if snap.Version != snapshotVersion {
+			http.Error(w, fmt.Sprintf("unsupported snapshot version %d", snap.Version), http.StatusBadRequest)
+			return
+		}
+		res, err := m.Restore(snap, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// routeHost returns the normalized {host} of an admin API request, so routes
+// are found whatever the case or trailing dot of the path.
+func routeHost(r *http.Request) string {
+	return normalizeHost(r.PathValue("host"))
+}
+
+// writeJSON writes v as indented JSON with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// defaultRouteDebugDuration is used when a debug toggle omits the duration.
+const defaultRouteDebugDuration = 5 * time.Minute
+
+// RouteDebugAPIHandler serves /api/routes/{host}/debug. POST enables verbose
+// header logging for the route for ?duration= (default 5m, max 1h); pass
+// ?redact=false to log sensitive headers unmasked. DELETE disables it.
+func RouteDebugAPIHandler(m *ShardedRouteManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := routeHost(r)
+		var d time.Duration
+		switch r.Method {
+		case http.MethodPost:
+			d = defaultRouteDebugDuration
+			if v := r.URL.Query().Get("duration"); v != "" {
+				parsed, err := time.ParseDuration(v)
+				if err != nil || parsed <= 0 {
+					http.Error(w, "invalid duration", http.StatusBadRequest)
+					return
+				}
+				d = parsed
+			}
+		case http.MethodDelete:
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !m.SetRouteDebug(host, d, r.URL.Query().Get("redact") == "false") {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveAPI sends a request with body to h on pattern and returns the response.
+func serveAPI(h http.Handler, pattern, method, path, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle(pattern, h)
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	return rec
+}
+
+// addEvictableRoute adds host, recording in evicted whether its tunnel was
+// torn down.
+func addEvictableRoute(t *testing.T, m *ShardedRouteManager, host string, evicted map[string]bool) {
+	t.Helper()
+	err := m.AddRouteWithOptions(host, "10.0.0.1:8080", RouteOptions{OnEvict: func() { evicted[host] = true }})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteRoute(t *testing.T) {
+	tests := []struct {
+		name, path  string
+		wantStatus  int
+		wantEvicted bool
+	}{
+		{"found", "/api/routes/app." + testZone, http.StatusNoContent, true},
+		{"mixed case", "/api/routes/App." + strings.ToUpper(testZone), http.StatusNoContent, true},
+		{"not found", "/api/routes/other." + testZone, http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, Options{})
+			evicted := map[string]bool{}
+			host := "app." + testZone
+			addEvictableRoute(t, m, host, evicted)
+
+			rec := serveAPI(RouteAPIHandler(m), "/api/routes/{host}", http.MethodDelete, tt.path, "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if evicted[host] != tt.wantEvicted {
+				t.Fatalf("evicted = %v, want %v", evicted[host], tt.wantEvicted)
+			}
+			if _, ok := m.GetRouteInfo(host); ok == tt.wantEvicted {
+				t.Fatalf("route still registered = %v", ok)
+			}
+		})
+	}
+}
+
+func TestDeleteRoutes(t *testing.T) {
+	m := newTestManager(t, Options{})
+	evicted := map[string]bool{}
+	a, b, c := "a."+testZone, "b."+testZone, "c."+testZone
+	for _, host := range []string{a, b, c} {
+		addEvictableRoute(t, m, host, evicted)
+	}
+
+	rec := serveAPI(RoutesAPIHandler(m), "/api/routes", http.MethodDelete, "/api/routes",
+		`{"hosts":["`+a+`","B.`+testZone+`","missing.`+testZone+`"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var res deleteRoutesResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	want := deleteRoutesResult{Deleted: []string{a, "B." + testZone}, NotFound: []string{"missing." + testZone}}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("got %+v, want %+v", res, want)
+	}
+	if !evicted[a] || !evicted[b] || evicted[c] {
+		t.Fatalf("evicted = %v, want %s and %s", evicted, a, b)
+	}
+	if got := m.ListRoutes(); len(got) != 1 || got[c] == "" {
+		t.Fatalf("routes left = %v, want only %s", got, c)
+	}
+
+	// Deleting hosts already gone reports them all as not found.
+	rec = serveAPI(RoutesAPIHandler(m), "/api/routes", http.MethodDelete, "/api/routes", `{"hosts":["`+a+`","`+b+`"]}`)
+	res = deleteRoutesResult{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	want = deleteRoutesResult{Deleted: []string{}, NotFound: []string{a, b}}
+	if rec.Code != http.StatusOK || !reflect.DeepEqual(res, want) {
+		t.Fatalf("deleting again: got %d %+v, want 200 %+v", rec.Code, res, want)
+	}
+
+	for _, body := range []string{"", "{", `{"hosts":[]}`, `{"hosts":"` + c + `"}`} {
+		rec := serveAPI(RoutesAPIHandler(m), "/api/routes", http.MethodDelete, "/api/routes", body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("body %q: status = %d, want 400", body, rec.Code)
+		}
+	}
+	if evicted[c] {
+		t.Fatalf("%s evicted by a rejected request", c)
+	}
+}
+
+func TestRouteHandlersNormalizeHost(t *testing.T) {
+	m := newTestManager(t, Options{})
+	if err := m.AddRoute("app."+testZone, "10.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	handlers := []struct {
+		name, pattern, method, suffix string
+		h                             http.Handler
+		want                          int
+	}{
+		{"get", "/api/routes/{host}", http.MethodGet, "", RouteAPIHandler(m), http.StatusOK},
+		{"bandwidth", "/api/routes/{host}/bandwidth", http.MethodPost, "/bandwidth?rate=1024", RouteBandwidthAPIHandler(m), http.StatusNoContent},
+		{"token", "/api/routes/{host}/token", http.MethodPost, "/token", RouteTokenAPIHandler(m), http.StatusOK},
+		{"debug", "/api/routes/{host}/debug", http.MethodPost, "/debug", RouteDebugAPIHandler(m), http.StatusNoContent},
+	}
+	hosts := []struct {
+		host  string
+		found bool
+	}{
+		{"app." + testZone, true},
+		{"App." + strings.ToUpper(testZone), true},
+		{"app." + testZone + ".", true},
+		{"other." + testZone, false},
+	}
+	for _, h := range handlers {
+		for _, host := range hosts {
+			t.Run(h.name+" "+host.host, func(t *testing.T) {
+				want := h.want
+				if !host.found {
+					want = http.StatusNotFound
+				}
+				rec := serveAPI(h.h, h.pattern, h.method, "/api/routes/"+host.host+h.suffix, "")
+				if rec.Code != want {
+					t.Fatalf("status %d, want %d: %s", rec.Code, want, rec.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestRouteHandlersMethods(t *testing.T) {
+	m := newTestManager(t, Options{})
+	if err := m.AddRoute("app."+testZone, "10.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, pattern, path string
+		h                   http.Handler
+		method              string
+		wantStatus          int
+		wantAllow           string
+	}{
+		{"list", "/api/routes", "/api/routes", RoutesAPIHandler(m), http.MethodGet, http.StatusOK, ""},
+		{"list head", "/api/routes", "/api/routes", RoutesAPIHandler(m), http.MethodHead, http.StatusOK, ""},
+		{"list put", "/api/routes", "/api/routes", RoutesAPIHandler(m), http.MethodPut, http.StatusMethodNotAllowed, "GET, HEAD, POST, DELETE"},
+		{"list patch", "/api/routes", "/api/routes", RoutesAPIHandler(m), http.MethodPatch, http.StatusMethodNotAllowed, "GET, HEAD, POST, DELETE"},
+		{"route post", "/api/routes/{host}", "/api/routes/app." + testZone, RouteAPIHandler(m), http.MethodPost, http.StatusMethodNotAllowed, "GET, HEAD, DELETE"},
+		{"bandwidth get", "/api/routes/{host}/bandwidth", "/api/routes/app." + testZone + "/bandwidth", RouteBandwidthAPIHandler(m), http.MethodGet, http.StatusMethodNotAllowed, "POST, DELETE"},
+		{"export post", "/api/routes/export", "/api/routes/export", RoutesExportHandler(m), http.MethodPost, http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"import get", "/api/routes/import", "/api/routes/import", RoutesImportHandler(m), http.MethodGet, http.StatusMethodNotAllowed, http.MethodPost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveAPI(tt.h, tt.pattern, tt.method, tt.path, "")
+			if rec.Code != tt.wantStatus || rec.Header().Get("Allow") != tt.wantAllow {
+				t.Fatalf("got %d Allow=%q, want %d Allow=%q", rec.Code, rec.Header().Get("Allow"), tt.wantStatus, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestListingSkipsIncompleteEntries(t *testing.T) {
+	m := newTestManager(t, Options{})
+	if err := m.AddRoute("app."+testZone, newUpstream(t, "ok").Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	for host, e := range map[string]*UpstreamEntry{"nil." + testZone: nil, "partial." + testZone: {}} {
+		s := m.shards[m.shardIdx(host)]
+		s.Lock()
+		s.m[host] = e
+		s.Unlock()
+	}
+
+	if routes := m.ListRoutes(); len(routes) != 1 {
+		t.Fatalf("ListRoutes = %v, want only the complete route", routes)
+	}
+	if snap := m.Snapshot(); len(snap.Routes) != 1 {
+		t.Fatalf("Snapshot has %d routes, want only the complete one", len(snap.Routes))
+	}
+	for _, host := range []string{"nil." + testZone, "partial." + testZone} {
+		if _, ok := m.GetRouteInfo(host); ok {
+			t.Fatalf("GetRouteInfo(%s) reported an incomplete route", host)
+		}
+		if rec := proxyGet(m, host, "/"); rec.Code != http.StatusNotFound {
+			t.Fatalf("request to %s: got %d, want 404", host, rec.Code)
+		}
+	}
+	if rec := serveAPI(RoutesAPIHandler(m), "/api/routes", http.MethodGet, "/api/routes", ""); rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/routes = %d", rec.Code)
+	}
+}
+
+func TestListingDuringRouteChurn(t *testing.T) {
+	m := newTestManager(t, Options{})
+	target := newUpstream(t, "ok").Listener.Addr().String()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				host := fmt.Sprintf("w%d-%d.%s", w, i%50, testZone)
+				if i%2 == 0 {
+					m.AddRoute(host, target)
+				} else {
+					m.RemoveRoute(host)
+				}
+			}
+		}()
+	}
+
+	list := RoutesAPIHandler(m)
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		for host, target := range m.ListRoutes() {
+			if target == "" {
+				t.Fatalf("ListRoutes listed %s without a target", host)
+			}
+		}
+		m.Snapshot()
+		if rec := serveAPI(list, "/api/routes", http.MethodGet, "/api/routes", ""); rec.Code != http.StatusOK {
+			t.Fatalf("GET /api/routes = %d during churn", rec.Code)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRouteTokenAPI(t *testing.T) {
+	m := newTestManager(t, Options{})
+	host := "app." + testZone
+	if err := m.AddRoute(host, newUpstream(t, "ok").URL); err != nil {
+		t.Fatal(err)
+	}
+	h := RouteTokenAPIHandler(m)
+	path := "/api/routes/" + host + "/token"
+	get := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if token != "" {
+			r.Header.Set(AccessTokenHeader, token)
+		}
+		return serveProxy(m, r).Code
+	}
+	rotate := func(body string) string {
+		t.Helper()
+		rec := serveAPI(h, "/api/routes/{host}/token", http.MethodPost, path, body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s: status %d: %s", path, rec.Code, rec.Body)
+		}
+		var resp accessToken
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Token
+	}
+
+	if got := get(""); got != http.StatusOK {
+		t.Fatalf("ungated route: status %d", got)
+	}
+	first := rotate(`{"token":"first"}`)
+	if first != "first" {
+		t.Fatalf("POST returned token %q, want the one set", first)
+	}
+	if get("") != http.StatusForbidden || get(first) != http.StatusOK {
+		t.Fatal("the route isn't gated by the token set")
+	}
+
+	generated := rotate("")
+	if !ValidAccessToken(generated) || generated == first {
+		t.Fatalf("generated token %q: want a fresh valid token", generated)
+	}
+	if get(first) != http.StatusForbidden || get(generated) != http.StatusOK {
+		t.Fatal("rotation didn't replace the previous token")
+	}
+
+	if rec := serveAPI(h, "/api/routes/{host}/token", http.MethodPost, path, `{"token":"has space"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid token: status %d, want 400", rec.Code)
+	}
+	if rec := serveAPI(h, "/api/routes/{host}/token", http.MethodPost, "/api/routes/nope."+testZone+"/token", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown route: status %d, want 404", rec.Code)
+	}
+	if rec := serveAPI(h, "/api/routes/{host}/token", http.MethodDelete, path, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d, want 204", rec.Code)
+	}
+	if got := get(""); got != http.StatusOK {
+		t.Fatalf("after DELETE: status %d, want the gate removed", got)
+	}
+}
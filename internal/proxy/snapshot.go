@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// snapshotVersion is the current Snapshot format version.
+const snapshotVersion = 1
+
+// placeholderRetryAfter is the Retry-After, in seconds, sent for requests to a
+// placeholder route.
+const placeholderRetryAfter = 5
+
+// Snapshot is a serializable copy of the route table, used to move routes to
+// another instance during an upgrade.
+type Snapshot struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Routes     []SnapshotRoute `json:"routes"`
+}
+
+// SnapshotRoute is a single route in a Snapshot, with the options it was
+// registered with, so that a protected route stays protected on import.
+// Access tokens and basic auth hashes are included: snapshots are as
+// sensitive as the admin token that exports them.
+type SnapshotRoute struct {
+	Host   string `json:"host"`
+	Target string `json:"target"`
+	// User is the user whose tunnel the route serves, if any.
+	User string `json:"user,omitempty"`
+	// Labels is the client-provided metadata of the route, if any.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	BandwidthLimit  int64              `json:"bandwidth_limit,omitempty"`
+	FollowRedirects int                `json:"follow_redirects,omitempty"`
+	LogSampleRate   int                `json:"log_sample_rate,omitempty"`
+	RequestTimeout  string             `json:"request_timeout,omitempty"`
+	AccessToken     string             `json:"access_token,omitempty"`
+	AllowIPs        []string           `json:"allow_ips,omitempty"`
+	DenyIPs         []string           `json:"deny_ips,omitempty"`
+	BasicAuth       *SnapshotBasicAuth `json:"basic_auth,omitempty"`
+	SecurityHeaders map[string]string  `json:"security_headers,omitzero"`
+}
+
+// SnapshotBasicAuth is the basic auth credential of a SnapshotRoute.
+type SnapshotBasicAuth struct {
+	User string `json:"user"`
+	// Hash is the bcrypt hash of the password.
+	Hash string `json:"hash"`
+}
+
+// snapshotRoute returns the SnapshotRoute of e, served as host.
+func snapshotRoute(host string, e *UpstreamEntry) SnapshotRoute {
+	r := SnapshotRoute{
+		Host:   host,
+		Target: e.TargetURL.String(),
+		User:   e.user,
+		Labels: e.labels,
+
+		BandwidthLimit:  e.bandwidthRate(),
+		FollowRedirects: e.followRedirects,
+		LogSampleRate:   e.logSampleRate,
+		RequestTimeout:  formatTimeout(e.requestTimeout),
+		SecurityHeaders: e.securityHeaders,
+	}
+	if token := e.accessToken.Load(); token != nil {
+		r.AccessToken = *token
+	}
+	if e.accessControl != nil {
+		r.AllowIPs, r.DenyIPs = formatCIDRs(e.accessControl.Allow), formatCIDRs(e.accessControl.Deny)
+	}
+	if e.basicAuth != nil {
+		r.BasicAuth = &SnapshotBasicAuth{User: e.basicAuth.User, Hash: string(e.basicAuth.Hash)}
+	}
+	return r
+}
+
+// options validates r and returns its normalized host and route options.
+func (r SnapshotRoute) options() (string, RouteOptions, error) {
+	host, opts, err := routeRequest{
+		Host:            r.Host,
+		Target:          r.Target,
+		BandwidthLimit:  r.BandwidthLimit,
+		FollowRedirects: r.FollowRedirects,
+		LogSampleRate:   r.LogSampleRate,
+		RequestTimeout:  r.RequestTimeout,
+		AccessToken:     r.AccessToken,
+		AllowIPs:        r.AllowIPs,
+		DenyIPs:         r.DenyIPs,
+		SecurityHeaders: r.SecurityHeaders,
+	}.options()
+	if err != nil {
+		return "", RouteOptions{}, err
+	}
+	opts.User = r.User
+	opts.Labels = r.Labels
+	if r.BasicAuth != nil {
+		if opts.BasicAuth, err = NewBasicAuth(r.BasicAuth.User, []byte(r.BasicAuth.Hash)); err != nil {
+			return "", RouteOptions{}, err
+		}
+	}
+	return host, opts, nil
+}
+
+// Snapshot returns the current routes, sorted by host. The default route is
+// configuration rather than state and is not included. Placeholders are
+// exported with their target only.
+func (m *ShardedRouteManager) Snapshot() Snapshot {
+	snap := Snapshot{Version: snapshotVersion, ExportedAt: time.Now().UTC(), Routes: []SnapshotRoute{}}
+	for _, s := range m.shards {
+		s.RLock()
+		for host, e := range s.m {
+			if e.complete() {
+				snap.Routes = append(snap.Routes, snapshotRoute(host, e))
+			}
+		}
+		s.RUnlock()
+	}
+	sort.Slice(snap.Routes, func(i, j int) bool { return snap.Routes[i].Host < snap.Routes[j].Host })
+	return snap
+}
+
+// RestoreResult reports what Restore did with a snapshot's routes.
+type RestoreResult struct {
+	Routes       int `json:"routes"`
+	Placeholders int `json:"placeholders"`
+	Skipped      int `json:"skipped"`
+}
+
+// restoredRoute is a validated route of a snapshot being restored: entry for
+// a route served from here, or nil for a placeholder.
+type restoredRoute struct {
+	host, target string
+	entry        *UpstreamEntry
+}
+
+// Restore registers the routes of snap. Every route is validated first, and
+// an invalid one fails the whole import with nothing registered. Hosts that
+// already have a route are skipped, since their tunnel has already
+// reconnected here. Routes to loopback targets point at tunnel listeners of
+// the exporting host and can't be served from this one; they are registered
+// as placeholders answering a retryable 503 until the client reconnects and
+// replaces them, with its own options, or until placeholderTTL passes.
+func (m *ShardedRouteManager) Restore(snap Snapshot, placeholderTTL time.Duration) (RestoreResult, error) {
+	routes := make([]restoredRoute, 0, len(snap.Routes))
+	for _, r := range snap.Routes {
+		host, opts, err := r.options()
+		if err != nil {
+			return RestoreResult{}, fmt.Errorf("route %q: %w", r.Host, err)
+		}
+		route := restoredRoute{host: host, target: r.Target}
+		if !isLoopbackTarget(r.Target) {
+			if route.entry, err = m.newEntry(host, r.Target, opts); err != nil {
+				return RestoreResult{}, fmt.Errorf("route %q: invalid target: %w", r.Host, err)
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	var res RestoreResult
+	for _, r := range routes {
+		if _, exists := m.lookup(r.host); exists {
+			res.Skipped++
+			continue
+		}
+		if r.entry == nil {
+			m.addPlaceholder(r.host, r.target, placeholderTTL)
+			res.Placeholders++
+			continue
+		}
+		m.addEntry(r.host, r.entry, false)
+		res.Routes++
+	}
+	return res, nil
+}
+
+// addPlaceholder registers a placeholder route for host that removes itself
+// after ttl unless it has been replaced by then.
+func (m *ShardedRouteManager) addPlaceholder(host, target string, ttl time.Duration) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		u = &url.URL{Scheme: "http", Host: target}
+	}
+	entry := newPlaceholder(u)
+	m.store(host, entry)
+	if m.logRequests {
+		m.log.Debug("route placeholder", "host", logsafe.String(host), "ttl", ttl)
+	}
+	m.expirePlaceholder(host, entry, ttl)
+}
+
+// HoldRoute replaces host's route with a placeholder for grace, while the
+// client behind it reconnects: requests are answered with a retryable 503
+// instead of a 404, and a new route for host, typically from the reconnected
+// tunnel, replaces the placeholder. Without a reconnect the placeholder is
+// removed after grace. It reports whether host had a route to hold.
+func (m *ShardedRouteManager) HoldRoute(host string, grace time.Duration) bool {
+	s := m.shards[m.shardIdx(host)]
+	s.Lock()
+	current, ok := s.m[host]
+	held := ok && current.complete() && !current.placeholder
+	var entry *UpstreamEntry
+	if held {
+		entry = newPlaceholder(current.TargetURL)
+		s.m[host] = entry
+	}
+	s.Unlock()
+	if !held {
+		return false
+	}
+	if m.logRequests {
+		m.log.Debug("route held for reconnect", "host", logsafe.String(host), "grace", grace)
+	}
+	m.expirePlaceholder(host, entry, grace)
+	return true
+}
+
+// newPlaceholder returns a placeholder entry for target.
+func newPlaceholder(target *url.URL) *UpstreamEntry {
+	entry := &UpstreamEntry{TargetURL: target, CreatedAt: time.Now(), placeholder: true}
+	entry.touch()
+	return entry
+}
+
+// expirePlaceholder removes host's placeholder entry after ttl unless it has
+// been replaced by then.
+func (m *ShardedRouteManager) expirePlaceholder(host string, entry *UpstreamEntry, ttl time.Duration) {
+	time.AfterFunc(ttl, func() {
+		if m.removeEntry(host, entry) && m.logRequests {
+			m.log.Debug("route placeholder expired", "host", logsafe.String(host))
+		}
+	})
+}
+
+// removeEntry removes host's route only if it is still entry, and reports
+// whether it did.
+func (m *ShardedRouteManager) removeEntry(host string, entry *UpstreamEntry) bool {
+	s := m.shards[m.shardIdx(host)]
+	s.Lock()
+	removed := s.m[host] == entry
+	if removed {
+		delete(s.m, host)
+	}
+	s.Unlock()
+	if removed {
+		m.routeDeleted(host)
+	}
+	return removed
+}
+
+// isLoopbackTarget reports whether target ("host:port" or a URL) points at a
+// loopback address.
+func isLoopbackTarget(target string) bool {
+	host := target
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
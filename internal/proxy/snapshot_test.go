@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basicAuth, err := NewBasicAuth("bob", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := ParseAccessControl([]string{"10.0.0.0/8"}, []string{"2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := newTestManager(t, Options{})
+	routes := []struct {
+		host, target string
+		opts         RouteOptions
+	}{
+		{"admin." + testZone, "10.1.2.3:8080", RouteOptions{
+			BandwidthLimit:  1024,
+			FollowRedirects: 3,
+			LogSampleRate:   10,
+			RequestTimeout:  30 * time.Second,
+			AccessToken:     "s3cret",
+			AccessControl:   access,
+			BasicAuth:       basicAuth,
+			// Empty disables the server's security headers; it must not be
+			// lost as nil, which inherits them.
+			SecurityHeaders: map[string]string{},
+		}},
+		{"alice." + testZone, "127.0.0.1:40000", RouteOptions{User: "alice", Labels: map[string]string{"env": "dev"}}},
+	}
+	for _, r := range routes {
+		if err := src.AddRouteWithOptions(r.host, r.target, r.opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Snapshots travel as JSON.
+	data, err := json.Marshal(src.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	dst := newTestManager(t, Options{})
+	res, err := dst.Restore(snap, time.Minute)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if want := (RestoreResult{Routes: 1, Placeholders: 1}); res != want {
+		t.Fatalf("Restore = %+v, want %+v", res, want)
+	}
+
+	got, _ := dst.GetRouteInfo("admin." + testZone)
+	want, _ := src.GetRouteInfo("admin." + testZone)
+	got.CreatedAt, got.LastActive, want.CreatedAt, want.LastActive = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("imported route = %+v, want %+v", got, want)
+	}
+	if again := dst.Snapshot().Routes[0]; !reflect.DeepEqual(again, snap.Routes[0]) {
+		t.Errorf("re-exported route = %+v, want %+v", again, snap.Routes[0])
+	}
+	if snap.Routes[1].User != "alice" {
+		t.Errorf("exported user = %q, want alice", snap.Routes[1].User)
+	}
+	if info, _ := dst.GetRouteInfo("alice." + testZone); !info.Placeholder {
+		t.Errorf("tunnel route imported as %+v, want a placeholder", info)
+	}
+
+	// The imported route is as protected as the exported one.
+	r, _ := http.NewRequest(http.MethodGet, "http://admin."+testZone+"/", nil)
+	r.RemoteAddr = "10.9.9.9:1234"
+	if code := serveProxy(dst, r).Code; code != http.StatusForbidden {
+		t.Errorf("request without token: got %d, want 403", code)
+	}
+}
+
+func TestRestoreIsAllOrNothing(t *testing.T) {
+	m := newTestManager(t, Options{})
+	snap := Snapshot{Version: snapshotVersion, Routes: []SnapshotRoute{
+		{Host: "a." + testZone, Target: "10.0.0.1:80"},
+		{Host: "b." + testZone, Target: "10.0.0.2:80", AllowIPs: []string{"not-an-ip"}},
+	}}
+	_, err := m.Restore(snap, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "b."+testZone) {
+		t.Fatalf("Restore error = %v, want one naming the invalid route", err)
+	}
+	if routes := m.ListRoutes(); len(routes) != 0 {
+		t.Errorf("routes after failed restore = %v, want none", routes)
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// errRequestTimeout is the cancellation cause of a request whose upstream
+// didn't respond within the route's request timeout.
+var errRequestTimeout = errors.New("upstream request timeout")
+
+// requestTimerKey is the context key of the timer enforcing a request timeout.
+type requestTimerKey struct{}
+
+// requestTimeout returns the timeout applying to requests to e.
+func (m *ShardedRouteManager) requestTimeout(e *UpstreamEntry) time.Duration {
+	if e.requestTimeout > 0 {
+		return e.requestTimeout
+	}
+	return m.opts.RequestTimeout
+}
+
+// isStreamingRequest reports whether r opens a long-lived stream (a WebSocket
+// or other upgrade, or server-sent events), which request timeouts exempt.
+func isStreamingRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// withRequestTimeout bounds how long the upstream may take to respond to r:
+// the upstream request is cancelled after d unless the response headers
+// arrived first (see stopRequestTimer), so slow bodies are never cut off.
+func withRequestTimeout(r *http.Request, d time.Duration) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	timer := time.AfterFunc(d, func() { cancel(errRequestTimeout) })
+	ctx = context.WithValue(ctx, requestTimerKey{}, timer)
+	return r.WithContext(ctx), func() {
+		timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// stopRequestTimer disarms the request timeout of resp's request once the
+// upstream has responded.
+func stopRequestTimer(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	if timer, ok := resp.Request.Context().Value(requestTimerKey{}).(*time.Timer); ok {
+		timer.Stop()
+	}
+}
+
+// formatTimeout formats a route's timeout override for RouteInfo; zero,
+// meaning none, formats as empty.
+func formatTimeout(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// serveRequestTimeout answers a request whose upstream timed out with a 504,
+// reporting whether it did. It is distinct from the 502 of an upstream that
+// refused the connection.
+func serveRequestTimeout(rw http.ResponseWriter, req *http.Request, timeout time.Duration) bool {
+	if !errors.Is(context.Cause(req.Context()), errRequestTimeout) {
+		return false
+	}
+	metrics.HTTPUpstreamTimeouts.Inc()
+	http.Error(rw, fmt.Sprintf("gateway timeout: the app behind this tunnel took longer than %s to respond", timeout), http.StatusGatewayTimeout)
+	return true
+}
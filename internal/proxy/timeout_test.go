@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	wait := func(r *http.Request, d time.Duration) {
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fast")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		wait(r, 3*timeout)
+		io.WriteString(w, "slow")
+	})
+	mux.HandleFunc("/slow-body", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		wait(r, 3*timeout)
+		io.WriteString(w, "slow body")
+	})
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+
+	m := newTestManager(t, Options{RequestTimeout: timeout})
+	app, patient := "app."+testZone, "patient."+testZone
+	if err := m.AddRoute(app, upstream.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddRouteWithOptions(patient, upstream.Listener.Addr().String(), RouteOptions{RequestTimeout: 10 * timeout}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		accept     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"fast", app, "/fast", "", http.StatusOK, "fast"},
+		{"slow", app, "/slow", "", http.StatusGatewayTimeout, "took longer than 100ms"},
+		{"slow body after headers", app, "/slow-body", "", http.StatusOK, "slow body"},
+		{"event stream exempt", app, "/slow", "text/event-stream", http.StatusOK, "slow"},
+		{"route override", patient, "/slow", "", http.StatusOK, "slow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rec := serveProxy(m, r)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Fatalf("got %d %q, want %d containing %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+
+	// A refused connection stays a 502, not a timeout.
+	if err := m.AddRoute("down."+testZone, deadAddr(t)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := proxyGet(m, "down."+testZone, "/"); rec.Code == http.StatusGatewayTimeout {
+		t.Fatalf("refused upstream got %d, want it told apart from a timeout", rec.Code)
+	}
+}
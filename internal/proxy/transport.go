@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// Default upstream transport timeouts, tuned for tunnel listeners on the
+// loopback interface.
+const (
+	DefaultDialTimeout           = 250 * time.Millisecond
+	DefaultIdleConnTimeout       = 90 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultExpectContinueTimeout = 1 * time.Second
+)
+
+// TransportOptions tunes the upstream transport of every route. Zero fields
+// use the defaults above.
+type TransportOptions struct {
+	// DialTimeout bounds connecting to an upstream. The default suits
+	// tunnels; remote upstreams of admin routes may need longer.
+	DialTimeout time.Duration
+	// IdleConnTimeout is how long an idle pooled upstream connection is kept.
+	IdleConnTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake with https upstreams.
+	TLSHandshakeTimeout time.Duration
+	// ExpectContinueTimeout is how long a request with "Expect: 100-continue"
+	// waits for the upstream's go-ahead before sending its body anyway.
+	ExpectContinueTimeout time.Duration
+	// ResponseHeaderTimeout, when positive, is how long the transport waits
+	// for an upstream's response headers after sending the request before
+	// answering a 504. Unlike Options.RequestTimeout it has no per-route
+	// override and applies to upgrade and server-sent events requests too.
+	// Zero waits indefinitely.
+	ResponseHeaderTimeout time.Duration
+}
+
+// withDefaults returns o with its unset timeouts set to the defaults.
+func (o TransportOptions) withDefaults() TransportOptions {
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = DefaultDialTimeout
+	}
+	if o.IdleConnTimeout <= 0 {
+		o.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if o.TLSHandshakeTimeout <= 0 {
+		o.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+	if o.ExpectContinueTimeout <= 0 {
+		o.ExpectContinueTimeout = DefaultExpectContinueTimeout
+	}
+	return o
+}
+
+// newTransport creates the tuned upstream transport of a new route, which
+// uses the route's prewarmed connections before dialing new ones.
+func (m *ShardedRouteManager) newTransport(warm *warmConns) *http.Transport {
+	o := m.opts.Transport
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if c := warm.take(addr); c != nil {
+				return c, nil
+			}
+			return m.dialer.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          1000,
+		MaxIdleConnsPerHost:   250,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		TLSHandshakeTimeout:   o.TLSHandshakeTimeout,
+		ExpectContinueTimeout: o.ExpectContinueTimeout,
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		DisableCompression:    true,
+	}
+}
+
+// serveResponseHeaderTimeout answers a request whose upstream didn't send
+// its response headers within TransportOptions.ResponseHeaderTimeout with a
+// 504, reporting whether it did. Dial timeouts are left to the 502 path, as
+// the upstream never received the request.
+func (m *ShardedRouteManager) serveResponseHeaderTimeout(rw http.ResponseWriter, err error) bool {
+	timeout := m.opts.Transport.ResponseHeaderTimeout
+	if timeout <= 0 {
+		return false
+	}
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return false
+	}
+	if oe := (*net.OpError)(nil); errors.As(err, &oe) && oe.Op == "dial" {
+		return false
+	}
+	metrics.HTTPUpstreamTimeouts.Inc()
+	http.Error(rw, fmt.Sprintf("gateway timeout: the app behind this tunnel took longer than %s to respond", timeout), http.StatusGatewayTimeout)
+	return true
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// upstreamDownRetryAfter is the Retry-After, in seconds, sent when nothing
+// serves a route's upstream.
+const upstreamDownRetryAfter = 5
+
+// upstreamDownPage is served when the upstream refused the connection or its
+// host doesn't resolve: the request reached tunnelfy and the route, so it's
+// the app behind it that isn't running.
+const upstreamDownPage = `<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>503 Service Unavailable</title></head>
+<body>
+<h1>Service unavailable</h1>
+<p>Tunnel is up but your local service isn't responding. Check that the app is running and listening on the forwarded port.</p>
+</body>
+</html>
+`
+
+// upstreamDownWindow is how long after ReportUpstreamDown failed requests to
+// the route are blamed on its upstream not running.
+const upstreamDownWindow = time.Second
+
+// ReportUpstreamDown records that a connection to host's upstream just failed
+// because nothing serves it. The SSH server reports it when a client can't
+// connect to the local service behind a tunnel: the proxy only sees the
+// tunnel connection close, which it can't tell from the app crashing.
+// Requests to the route failing shortly after get the same 503 as when the
+// upstream refuses the dial.
+func (m *ShardedRouteManager) ReportUpstreamDown(host string) {
+	if e, ok := m.lookup(host); ok {
+		e.downAt.Store(time.Now().UnixNano())
+	}
+}
+
+// upstreamDown reports whether err means nothing serves the upstream: dialing
+// it was refused or its host doesn't resolve. Dial timeouts and errors after
+// the connection was made, such as resets, don't tell whether the app is
+// running and are left to the 502 path.
+func upstreamDown(err error) bool {
+	var oe *net.OpError
+	if !errors.As(err, &oe) || oe.Op != "dial" || errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// serveUpstreamDown answers a request whose upstream isn't running with a
+// retryable 503, reporting whether it did: err is such an error, or the
+// upstream was reported down within upstreamDownWindow.
+func serveUpstreamDown(rw http.ResponseWriter, e *UpstreamEntry, err error) bool {
+	if !upstreamDown(err) && time.Since(time.Unix(0, e.downAt.Load())) > upstreamDownWindow {
+		return false
+	}
+	metrics.HTTPUpstreamDown.Inc()
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Retry-After", strconv.Itoa(upstreamDownRetryAfter))
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	rw.Write([]byte(upstreamDownPage))
+	return true
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUpstreamDownClassification(t *testing.T) {
+	dialErr := func(err error) error { return &net.OpError{Op: "dial", Net: "tcp", Err: err} }
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", dialErr(os.NewSyscallError("connect", syscall.ECONNREFUSED)), true},
+		{"wrapped refusal", &url.Error{Op: "Get", URL: "http://app", Err: dialErr(syscall.ECONNREFUSED)}, true},
+		{"no such host", dialErr(&net.DNSError{Err: "no such host", Name: "app", IsNotFound: true}), true},
+		{"temporary DNS failure", dialErr(&net.DNSError{Err: "server misbehaving", Name: "app", IsTemporary: true}), false},
+		{"dial timeout", dialErr(os.ErrDeadlineExceeded), false},
+		{"reset after connect", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, false},
+		{"refusal outside a dial", &net.OpError{Op: "write", Net: "tcp", Err: syscall.ECONNREFUSED}, false},
+		{"other error", errors.New("unexpected EOF"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamDown(tt.err); got != tt.want {
+				t.Fatalf("upstreamDown(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamDownResponses(t *testing.T) {
+	// resetting accepts connections and closes them without answering.
+	resetting, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resetting.Close() })
+	go func() {
+		for {
+			c, err := resetting.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	m := newTestManager(t, Options{})
+	routes := map[string]string{
+		"down." + testZone:     deadAddr(t),
+		"reset." + testZone:    resetting.Addr().String(),
+		"reported." + testZone: resetting.Addr().String(),
+	}
+	for host, target := range routes {
+		if err := m.AddRoute(host, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.ReportUpstreamDown("reported." + testZone)
+
+	tests := []struct {
+		host       string
+		wantStatus int
+	}{
+		{"down." + testZone, http.StatusServiceUnavailable},
+		{"reset." + testZone, http.StatusBadGateway},
+		// The SSH server saw the local service refuse; the proxy only sees
+		// the tunnel connection close.
+		{"reported." + testZone, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			rec := proxyGet(m, tt.host, "/")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			down := tt.wantStatus == http.StatusServiceUnavailable
+			if got := rec.Header().Get("Retry-After"); (got == fmt.Sprint(upstreamDownRetryAfter)) != down {
+				t.Errorf("Retry-After = %q", got)
+			}
+			if got := strings.Contains(rec.Body.String(), "your local service isn't responding"); got != down {
+				t.Errorf("body %q: local service page = %v, want %v", rec.Body, got, down)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wsGUID derives Sec-WebSocket-Accept from Sec-WebSocket-Key (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeWSFrame writes payload as a single text frame, masked as clients must.
+func writeWSFrame(w io.Writer, payload []byte, masked bool) error {
+	header := []byte{0x81, byte(len(payload))}
+	if len(payload) > 125 {
+		return errors.New("payload too long for the test framing")
+	}
+	if !masked {
+		_, err := w.Write(append(header, payload...))
+		return err
+	}
+	header[1] |= 0x80
+	mask := [4]byte{1, 2, 3, 4}
+	frame := append(header, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readWSFrame reads a single short frame and returns its unmasked payload.
+func readWSFrame(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(header[1] & 0x7f)
+	var mask [4]byte
+	if header[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if header[1]&0x80 != 0 {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return payload, nil
+}
+
+// newWSEchoServer starts a WebSocket server echoing every frame back.
+func newWSEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "websocket only", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		rw.Flush()
+		for {
+			payload, err := readWSFrame(rw)
+			if err != nil {
+				return
+			}
+			if err := writeWSFrame(conn, payload, false); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		route  RouteOptions
+		events bool
+	}{
+		{name: "plain"},
+		{name: "bandwidth limit", route: RouteOptions{BandwidthLimit: 1 << 20}},
+		// Upgraded connections outlive the request timeout.
+		{name: "request timeout", opts: Options{RequestTimeout: 50 * time.Millisecond}},
+		{name: "event subscriber", events: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, tt.opts)
+			if tt.events {
+				_, unsubscribe := m.events.subscribe()
+				defer unsubscribe()
+			}
+			echo := newWSEchoServer(t)
+			host := "app." + testZone
+			if err := m.AddRouteWithOptions(host, echo.Listener.Addr().String(), tt.route); err != nil {
+				t.Fatal(err)
+			}
+			ps := httptest.NewServer(FastProxyHandler(m, testZone))
+			t.Cleanup(ps.Close)
+
+			conn, err := net.Dial("tcp", ps.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			key := base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+			io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+host+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+key+"\r\n\r\n")
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+				t.Fatalf("upgrade: status %d, accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+			}
+
+			for _, msg := range []string{"hello", "again"} {
+				time.Sleep(2 * tt.opts.RequestTimeout)
+				if err := writeWSFrame(conn, []byte(msg), true); err != nil {
+					t.Fatal(err)
+				}
+				got, err := readWSFrame(br)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != msg {
+					t.Fatalf("echo = %q, want %q", got, msg)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"strings"
+
+	"tunnelfy/internal/metrics"
+)
+
+// isWildcardHost reports whether host is a wildcard route key ("*.suffix").
+func isWildcardHost(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// routeDeleted updates bookkeeping after host's route was deleted from its shard.
+func (m *ShardedRouteManager) routeDeleted(host string) {
+	metrics.Routes.Add(-1)
+	m.events.publish(Event{Type: EventRouteRemoved, Host: host})
+	if isWildcardHost(host) {
+		m.wildcards.Add(-1)
+	}
+}
+
+// lookupWildcard finds the most specific wildcard route covering host, e.g.
+// "*.app.alice.zone" and then "*.alice.zone" for "x.app.alice.zone". A wildcard
+// doesn't match its own suffix ("app.alice.zone" needs an exact route).
+func (m *ShardedRouteManager) lookupWildcard(host string) (*UpstreamEntry, bool) {
+	if m.wildcards.Load() == 0 {
+		return nil, false
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		if e, ok := m.lookup("*" + host[i:]); ok {
+			return e, true
+		}
+		next := strings.IndexByte(host[i+1:], '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return nil, false
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWildcardPrecedence(t *testing.T) {
+	m := newTestManager(t, Options{})
+	routes := map[string]string{
+		"app.alice." + testZone:       "exact",
+		"*.app.alice." + testZone:     "app wildcard",
+		"*.alice." + testZone:         "alice wildcard",
+		"admin.app.alice." + testZone: "exact under wildcard",
+	}
+	for host, body := range routes {
+		if err := m.AddRoute(host, newUpstream(t, body).Listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host     string
+		wantBody string
+	}{
+		{"app.alice." + testZone, "exact"},
+		{"admin.app.alice." + testZone, "exact under wildcard"},
+		{"tenant1.app.alice." + testZone, "app wildcard"},
+		{"x.tenant1.app.alice." + testZone, "app wildcard"},
+		{"api.alice." + testZone, "alice wildcard"},
+		{"Tenant2.App.Alice." + testZone + ".", "app wildcard"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			rec := proxyGet(m, tt.host, "/")
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.wantBody {
+				t.Fatalf("got %d %q, want %q", rec.Code, rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	// A wildcard doesn't cover its own suffix, and removing it stops the fallback.
+	if rec := proxyGet(m, "alice."+testZone, "/"); rec.Code == http.StatusOK {
+		t.Fatalf("alice.%s matched *.alice.%s", testZone, testZone)
+	}
+	m.RemoveRoute("*.app.alice." + testZone)
+	if rec := proxyGet(m, "tenant1.app.alice."+testZone, "/"); rec.Body.String() != "alice wildcard" {
+		t.Fatalf("after removing *.app: got %q, want the next wildcard", rec.Body.String())
+	}
+}
+
+func TestAddRouteAPIWildcard(t *testing.T) {
+	tests := []struct {
+		host       string
+		wantStatus int
+	}{
+		{"*.app.alice." + testZone, http.StatusCreated},
+		{"app.*.alice." + testZone, http.StatusBadRequest},
+		{"*app.alice." + testZone, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			m := newTestManager(t, Options{})
+			body := `{"host":"` + tt.host + `","target":"10.0.0.1:8080"}`
+			rec := serveAPI(RoutesAPIHandler(m), "POST /api/routes", http.MethodPost, "/api/routes", body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("POST %s: got %d %s, want %d", tt.host, rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+		})
+	}
+}
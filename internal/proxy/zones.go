@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"maps"
+	"strings"
+)
+
+// normalizeZones normalizes zones and drops empty ones.
+func normalizeZones(zones []string) []string {
+	var out []string
+	for _, z := range zones {
+		if z = normalizeHost(z); z != "" {
+			out = append(out, z)
+		}
+	}
+	return out
+}
+
+// matchZone returns the most specific of zones that host is a subdomain of.
+// Every host matches, with an empty zone, when zones is empty.
+func matchZone(host string, zones []string) (string, bool) {
+	if len(zones) == 0 {
+		return "", true
+	}
+	var match string
+	for _, z := range zones {
+		if len(z) > len(match) && strings.HasSuffix(host, "."+z) {
+			match = z
+		}
+	}
+	return match, match != ""
+}
+
+// SetZoneDefaultRoute makes target the catch-all upstream for hosts in zone
+// without an exact or wildcard route, taking precedence over the global
+// default route. An empty target removes the zone's catch-all.
+func (m *ShardedRouteManager) SetZoneDefaultRoute(zone, target string) error {
+	zone = normalizeHost(zone)
+	var entry *UpstreamEntry
+	if target != "" {
+		var err error
+		entry, err = m.newEntry("*."+zone, target, RouteOptions{})
+		if err != nil {
+			return err
+		}
+		if entry.metricLabel != "" {
+			entry.metricLabel = routeLabelDefault
+		}
+	}
+
+	m.zoneDefaultsMu.Lock()
+	defaults := make(map[string]*UpstreamEntry)
+	if cur := m.zoneDefaults.Load(); cur != nil {
+		defaults = maps.Clone(*cur)
+	}
+	if entry == nil {
+		delete(defaults, zone)
+	} else {
+		defaults[zone] = entry
+	}
+	m.zoneDefaults.Store(&defaults)
+	m.zoneDefaultsMu.Unlock()
+
+	if m.logRequests && entry != nil {
+		m.log.Debug("default route for zone", "zone", zone, "upstream", entry.TargetURL.String())
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchZone(t *testing.T) {
+	zones := []string{"a.test", "b.test", "eu.b.test"}
+	tests := []struct {
+		host     string
+		zones    []string
+		wantZone string
+		wantOK   bool
+	}{
+		{"x.a.test", zones, "a.test", true},
+		{"x.b.test", zones, "b.test", true},
+		{"x.eu.b.test", zones, "eu.b.test", true},
+		{"eu.b.test", zones, "b.test", true},
+		{"a.test", zones, "", false},
+		{"x.c.test", zones, "", false},
+		{"xa.test", zones, "", false},
+		{"anything", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			zone, ok := matchZone(tt.host, tt.zones)
+			if zone != tt.wantZone || ok != tt.wantOK {
+				t.Fatalf("matchZone = %q, %v, want %q, %v", zone, ok, tt.wantZone, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestZoneDefaultRoutes(t *testing.T) {
+	m := newTestManager(t, Options{})
+	for _, r := range []struct{ zone, body string }{
+		{"", "global"},
+		{"a.test", "brand-a"},
+		{"EU.b.test", "brand-eu"},
+	} {
+		target := newUpstream(t, r.body).Listener.Addr().String()
+		var err error
+		if r.zone == "" {
+			err = m.SetDefaultRoute(target)
+		} else {
+			err = m.SetZoneDefaultRoute(r.zone, target)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.AddRoute("app.a.test", newUpstream(t, "app").Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	h := FastProxyHandler(m, "a.test", "b.test", "eu.b.test")
+	get := func(host string) (int, string) {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	tests := []struct {
+		host     string
+		wantBody string
+	}{
+		{"unknown.a.test", "brand-a"},
+		{"app.a.test", "app"},
+		{"unknown.b.test", "global"},
+		{"unknown.eu.b.test", "brand-eu"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if code, body := get(tt.host); code != http.StatusOK || body != tt.wantBody {
+				t.Fatalf("got %d %q, want %q", code, body, tt.wantBody)
+			}
+		})
+	}
+
+	if err := m.SetZoneDefaultRoute("a.test", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get("unknown.a.test"); body != "global" {
+		t.Fatalf("after removing the zone's default route: got %q, want the global one", body)
+	}
+}
@@ -0,0 +1,280 @@
+// Package proxyproto reads PROXY protocol (v1 and v2) headers sent by load
+// balancers in front of tunnelfy, so the original client address is used
+// instead of the balancer's. Headers are only honoured from trusted peers.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnelfy/internal/metrics"
+)
+
+// headerTimeout bounds how long a connection may take to send its header.
+const headerTimeout = 5 * time.Second
+
+// v1MaxLen is the longest valid v1 header, including the CRLF.
+const v1MaxLen = 107
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ErrUntrusted is returned by reads on a connection whose peer sent a PROXY
+// header without being trusted to.
+var ErrUntrusted = errors.New("proxyproto: PROXY header from untrusted peer")
+
+// ParseTrusted parses a list of trusted peers, each a CIDR ("10.0.0.0/8") or
+// a single address.
+func ParseTrusted(items []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * len(ip.To16())
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Listener wraps a net.Listener, reading the PROXY header of connections from
+// trusted peers and rejecting connections from other peers that send one, so
+// clients can't spoof their address. Connections without a header are passed
+// through unchanged.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewListener wraps l, trusting PROXY headers from peers in trusted.
+func NewListener(l net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{Listener: l, trusted: trusted}
+}
+
+// Accept returns the next connection. Its header is read lazily, on the
+// first Read or RemoteAddr, so a slow peer doesn't hold up the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, r: bufio.NewReader(c), trusted: l.isTrusted(c.RemoteAddr())}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// conn is a connection whose PROXY header, if any, is consumed before the
+// first read.
+type conn struct {
+	net.Conn
+	r       *bufio.Reader
+	trusted bool
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+
+	// deadline is the read deadline set by the user of the connection, which
+	// is restored once the header has been read under headerTimeout.
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the peer
+// address when there is none.
+func (c *conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader consumes the PROXY header, if any. Failures close the connection
+// and are returned by every later Read.
+func (c *conn) readHeader() {
+	c.mu.Lock()
+	deadline := time.Now().Add(headerTimeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	c.Conn.SetReadDeadline(deadline)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	}()
+
+	remote, err := c.parse()
+	if err == nil {
+		c.remote = remote
+		return
+	}
+	if errors.Is(err, io.EOF) {
+		// Closed before sending anything that could be a header.
+		c.err = err
+		return
+	}
+	metrics.ProxyProtocolRejected.Inc()
+	slog.Info("proxy protocol: rejecting connection", "remote", c.Conn.RemoteAddr(), "err", err)
+	c.err = err
+	c.Conn.Close()
+}
+
+// parse reads a v1 or v2 header if the connection starts with one and returns
+// the client address it carries, or nil when there is none or it is LOCAL.
+func (c *conn) parse() (net.Addr, error) {
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var v2 bool
+	switch first[0] {
+	case v1Prefix[0]:
+		if b, err := c.r.Peek(len(v1Prefix)); err != nil || !bytes.Equal(b, v1Prefix) {
+			return nil, nil
+		}
+	case v2Signature[0]:
+		if b, err := c.r.Peek(len(v2Signature)); err != nil || !bytes.Equal(b, v2Signature) {
+			return nil, nil
+		}
+		v2 = true
+	default:
+		return nil, nil
+	}
+	if !c.trusted {
+		return nil, ErrUntrusted
+	}
+	if v2 {
+		return c.parseV2()
+	}
+	return c.parseV1()
+}
+
+// parseV1 parses "PROXY TCP4|TCP6 <src> <dst> <sport> <dport>\r\n" or
+// "PROXY UNKNOWN ...\r\n".
+func (c *conn) parseV1() (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address %q", fields[2]+" "+fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseV2 parses a binary v2 header.
+func (c *conn) parseV2() (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, fmt.Errorf("reading v2 addresses: %w", err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL: health checks from the balancer itself.
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", verCmd&0x0f)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// UDP, unix sockets or unspecified: keep the peer address.
+		return nil, nil
+	}
+}
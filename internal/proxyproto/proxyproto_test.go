@@ -0,0 +1,125 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseTrusted(t *testing.T) {
+	nets, err := ParseTrusted([]string{"10.0.0.0/8", "192.168.1.7", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"::1", true},
+		{"127.0.0.1", false},
+	} {
+		l := &Listener{trusted: nets}
+		if got := l.isTrusted(&net.TCPAddr{IP: net.ParseIP(tt.ip)}); got != tt.want {
+			t.Errorf("trusted(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", ""} {
+		if _, err := ParseTrusted([]string{bad}); err == nil {
+			t.Errorf("ParseTrusted(%q) succeeded", bad)
+		}
+	}
+}
+
+// v2Header returns a v2 header for cmd carrying src as an IPv4 TCP client.
+func v2Header(cmd byte, src *net.TCPAddr) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|cmd, 0x11, 0, 12)
+	h = append(h, src.IP.To4()...)
+	h = append(h, 127, 0, 0, 1)
+	h = binary.BigEndian.AppendUint16(h, uint16(src.Port))
+	h = binary.BigEndian.AppendUint16(h, 443)
+	return h
+}
+
+func TestListener(t *testing.T) {
+	loopback := []string{"127.0.0.0/8"}
+	elsewhere := []string{"10.0.0.0/8"}
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 51234}
+	tests := []struct {
+		name       string
+		trusted    []string
+		header     string
+		wantRemote string // empty for the peer's own address
+		wantErr    error  // nil when the payload gets through
+	}{
+		{"v1 from trusted peer", loopback, "PROXY TCP4 203.0.113.9 127.0.0.1 51234 443\r\n", "203.0.113.9:51234", nil},
+		{"v1 tcp6 from trusted peer", loopback, "PROXY TCP6 2001:db8::1 ::1 51234 443\r\n", "[2001:db8::1]:51234", nil},
+		{"v1 unknown from trusted peer", loopback, "PROXY UNKNOWN\r\n", "", nil},
+		{"v2 from trusted peer", loopback, string(v2Header(0x1, client)), "203.0.113.9:51234", nil},
+		{"v2 local from trusted peer", loopback, string(v2Header(0x0, client)), "", nil},
+		{"no header from trusted peer", loopback, "", "", nil},
+		{"malformed v1 from trusted peer", loopback, "PROXY TCP4 nonsense\r\n", "", errors.New("any")},
+		{"v1 from untrusted peer", elsewhere, "PROXY TCP4 203.0.113.9 127.0.0.1 51234 443\r\n", "", ErrUntrusted},
+		{"v2 from untrusted peer", elsewhere, string(v2Header(0x1, client)), "", ErrUntrusted},
+		{"no header from untrusted peer", elsewhere, "", "", nil},
+		{"nothing trusted", nil, "PROXY TCP4 203.0.113.9 127.0.0.1 51234 443\r\n", "", ErrUntrusted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := ParseTrusted(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := NewListener(inner, trusted)
+			defer l.Close()
+
+			peer, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+			if _, err := io.WriteString(peer, tt.header+"hello"); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, len("hello"))
+			_, err = io.ReadFull(c, buf)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("read: %v", err)
+			case tt.wantErr == nil && string(buf) != "hello":
+				t.Fatalf("read %q after the header, want the payload", buf)
+			case tt.wantErr == ErrUntrusted && !errors.Is(err, ErrUntrusted):
+				t.Fatalf("read error = %v, want ErrUntrusted", err)
+			case tt.wantErr != nil && err == nil:
+				t.Fatal("connection with a bad header was accepted")
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			want := tt.wantRemote
+			if want == "" {
+				want = peer.LocalAddr().String()
+			}
+			if got := c.RemoteAddr().String(); got != want {
+				t.Fatalf("RemoteAddr = %s, want %s", got, want)
+			}
+		})
+	}
+}
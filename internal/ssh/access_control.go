@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/proxy"
+)
+
+// accessControlRequestType is the global request a client sends to restrict
+// the tunnels it establishes afterwards to client addresses; see
+// proxy.AccessControl. Its payload is an accessControlPayload, and empty
+// lists remove the restriction.
+const accessControlRequestType = "access-control@tunnelfy"
+
+// Bounds on access control requests.
+const (
+	maxAccessControlCIDRs   = 64
+	maxAccessControlPayload = 8 << 10
+)
+
+// accessControlPayload is the payload of an access control request.
+type accessControlPayload struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// parseAccessControl decodes and validates an access control request payload.
+func parseAccessControl(payload []byte) (*proxy.AccessControl, error) {
+	if len(payload) > maxAccessControlPayload {
+		return nil, errors.New("access control payload too large")
+	}
+	var p accessControlPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, fmt.Errorf("invalid access control payload: %w", err)
+	}
+	if n := len(p.Allow) + len(p.Deny); n > maxAccessControlCIDRs {
+		return nil, fmt.Errorf("too many CIDRs: %d > %d", n, maxAccessControlCIDRs)
+	}
+	return proxy.ParseAccessControl(p.Allow, p.Deny)
+}
+
+// handleAccessControl serves an access control request, replacing the
+// restriction of the session's subsequent tunnels.
+func (s *SSHServer) handleAccessControl(req *request, sess *session) {
+	access, err := parseAccessControl(req.Payload)
+	if err != nil {
+		if s.logRequests {
+			s.log.Debug("rejecting access control", "user", logsafe.String(sess.username), "err", err)
+		}
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	sess.accessControl = access
+	req.Reply(true, nil)
+}
+
+// sendAccessControl sends the configured allow and deny lists, which apply
+// to every forward requested afterwards.
+func (c *Client) sendAccessControl() error {
+	payload, err := json.Marshal(accessControlPayload{Allow: c.config.AllowIPs, Deny: c.config.DenyIPs})
+	if err != nil {
+		return err
+	}
+	ok, reply, err := c.conn.SendRequest(accessControlRequestType, true, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send access control: %w", err)
+	}
+	if !ok {
+		if len(reply) > 0 {
+			return fmt.Errorf("server rejected access control: %s", reply)
+		}
+		return errors.New("server rejected access control")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/proxy"
+)
+
+// accessTokenRequestType is the global request a client sends to gate the
+// tunnels it establishes afterwards behind an access token; see
+// proxy.SetRouteAccessToken. Its payload is the raw token, and an empty
+// payload removes the gate. The token is never logged.
+const accessTokenRequestType = "access-token@tunnelfy"
+
+// handleAccessToken serves an access token request, replacing the token of
+// the session's subsequent tunnels.
+func (s *SSHServer) handleAccessToken(req *request, sess *session) {
+	token := string(req.Payload)
+	if token != "" && !proxy.ValidAccessToken(token) {
+		if s.logRequests {
+			s.log.Debug("rejecting access token: invalid token", "user", logsafe.String(sess.username))
+		}
+		req.Reply(false, []byte(fmt.Sprintf("access token must be printable ASCII without spaces, at most %d bytes", proxy.MaxAccessTokenLen)))
+		return
+	}
+	sess.accessToken = token
+	req.Reply(true, nil)
+}
+
+// sendAccessToken sends the configured access token, which gates every
+// forward requested afterwards.
+func (c *Client) sendAccessToken() error {
+	ok, reply, err := c.conn.SendRequest(accessTokenRequestType, true, []byte(c.config.AccessToken))
+	if err != nil {
+		return fmt.Errorf("failed to send access token: %w", err)
+	}
+	if !ok {
+		if len(reply) > 0 {
+			return fmt.Errorf("server rejected access token: %s", reply)
+		}
+		return errors.New("server rejected access token")
+	}
+	return nil
+}
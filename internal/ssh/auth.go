@@ -4,32 +4,122 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// Authenticator is a pluggable source of public key authentication, consulted
+// for keys that aren't in the server's static authorized keys (e.g. a dynamic
+// backend or an SSH CA). Authenticate returns the username the client acts as,
+// or an error to reject the key.
+type Authenticator interface {
+	Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (username string, err error)
+}
+
+// ErrNoAuthConfigured is returned when a server has neither static authorized
+// keys nor an Authenticator, so no client could ever log in.
+var ErrNoAuthConfigured = errors.New("no authentication configured: provide authorized keys or an authenticator")
+
 // LoadAuthorizedKeys reads newline-separated authorized_keys format and returns a map of the
-// canonical marshaled key (string) -> ssh.PublicKey for fast lookups.
-func LoadAuthorizedKeys(keysData string) (map[string]ssh.PublicKey, error) {
-	out := make(map[string]ssh.PublicKey)
+// canonical marshaled key (string) -> AuthorizedKey for fast lookups, with the
+// quota set by each line's options. An empty
+// input yields an empty map; whether that is acceptable is decided by NewSSHServer.
+// Every line that fails to parse is reported, by line number.
+func LoadAuthorizedKeys(keysData string) (map[string]AuthorizedKey, error) {
+	out := make(map[string]AuthorizedKey)
+	var errs []error
 	scanner := bufio.NewScanner(strings.NewReader(keysData))
-	for scanner.Scan() {
+	for n := 1; scanner.Scan(); n++ {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		pub, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: parse authorized key failed: %w", n, err))
+			continue
+		}
+		quota, err := parseKeyQuota(options)
 		if err != nil {
-			return nil, fmt.Errorf("parse authorized key failed: %w", err)
+			errs = append(errs, fmt.Errorf("line %d: authorized key %s: %w", n, ssh.FingerprintSHA256(pub), err))
+			continue
 		}
-		out[string(ssh.MarshalAuthorizedKey(pub))] = pub
+		user, err := parseKeyUser(options)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: authorized key %s: %w", n, ssh.FingerprintSHA256(pub), err))
+			continue
+		}
+		out[string(ssh.MarshalAuthorizedKey(pub))] = AuthorizedKey{PublicKey: pub, Quota: quota, User: user}
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
-	if len(out) == 0 {
-		return nil, errors.New("no authorized keys loaded")
+	if len(errs) > maxKeyErrors {
+		errs = append(errs[:maxKeyErrors], fmt.Errorf("and %d more invalid lines", len(errs)-maxKeyErrors))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
 	}
 	return out, nil
 }
+
+// optionUser binds an authorized key to a username, e.g.
+//
+//	tunnelfy-user="alice" ssh-ed25519 AAAA... alice@laptop
+//
+// The key is then rejected for any other username, so it can't claim another
+// user's subdomains. Keys without it may log in as any username.
+const optionUser = "tunnelfy-user"
+
+// errKeyUserMismatch rejects authentication as a username other than the
+// one the key is bound to.
+var errKeyUserMismatch = errors.New("authorized key bound to another username")
+
+// errInvalidUsername rejects authentication as a username that can't be a
+// DNS label, as it becomes one in the user's hosts.
+var errInvalidUsername = errors.New("username is not a valid DNS label")
+
+// validUsername reports whether user can label its hosts. Hosts are
+// case-insensitive, so usernames are too.
+func validUsername(user string) bool {
+	return validLabel(strings.ToLower(user))
+}
+
+// parseKeyUser returns the username an authorized keys line's options bind
+// the key to, or "" when unbound.
+func parseKeyUser(options []string) (string, error) {
+	var user string
+	for _, opt := range options {
+		name, value, _ := strings.Cut(opt, "=")
+		if !strings.EqualFold(name, optionUser) {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if !validUsername(value) {
+			return "", fmt.Errorf("%s must be a valid DNS label, got %q", optionUser, value)
+		}
+		user = value
+	}
+	return user, nil
+}
+
+// keyUserMatches reports whether a key bound to bound may log in as user.
+// Hosts are case-insensitive, so usernames are too.
+func keyUserMatches(bound, user string) bool {
+	return bound == "" || strings.EqualFold(bound, user)
+}
+
+// maxKeyErrors bounds the invalid lines LoadAuthorizedKeys reports, in case
+// it is handed something other than an authorized keys file.
+const maxKeyErrors = 10
+
+// LoadAuthorizedKeysFile reads an authorized_keys file with LoadAuthorizedKeys.
+func LoadAuthorizedKeysFile(path string) (map[string]AuthorizedKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadAuthorizedKeys(string(data))
+}
@@ -0,0 +1,174 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnelfy/internal/metrics"
+)
+
+// newPublicKey returns a freshly generated public key.
+func newPublicKey(t testing.TB) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// authorizedLine returns key as an authorized_keys line, without the newline.
+func authorizedLine(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+	alice, bob := newPublicKey(t), newPublicKey(t)
+	data := strings.Join([]string{
+		"# team keys",
+		authorizedLine(alice) + " alice@laptop",
+		"",
+		`tunnelfy-user="bob" ` + authorizedLine(bob),
+	}, "\n")
+	keys, err := LoadAuthorizedKeys(data)
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	if k := keys[string(ssh.MarshalAuthorizedKey(alice))]; k.PublicKey == nil || k.User != "" {
+		t.Errorf("alice's key: %+v, want it loaded unbound", k)
+	}
+	if k := keys[string(ssh.MarshalAuthorizedKey(bob))]; k.User != "bob" {
+		t.Errorf("bob's key bound to %q, want bob", k.User)
+	}
+
+	if keys, err := LoadAuthorizedKeys(""); err != nil || len(keys) != 0 {
+		t.Errorf("empty input: %d keys, %v; want none and no error", len(keys), err)
+	}
+}
+
+func TestLoadAuthorizedKeysLineErrors(t *testing.T) {
+	good := authorizedLine(newPublicKey(t))
+	data := strings.Join([]string{
+		good,
+		"ssh-ed25519 not-base64!",
+		"# comment",
+		`tunnelfy-user="not a label" ` + authorizedLine(newPublicKey(t)),
+		good,
+		"garbage",
+	}, "\n")
+	_, err := LoadAuthorizedKeys(data)
+	if err == nil {
+		t.Fatal("LoadAuthorizedKeys accepted invalid lines")
+	}
+	msg := err.Error()
+	// Every bad line is reported, not just the first.
+	for _, want := range []string{"line 2: parse authorized key failed", "line 4: authorized key SHA256:", "line 6: parse authorized key failed"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("error %q doesn't mention %q", msg, want)
+		}
+	}
+	for _, unwanted := range []string{"line 1:", "line 3:", "line 5:"} {
+		if strings.Contains(msg, unwanted) {
+			t.Errorf("error %q blames a valid %s", msg, unwanted)
+		}
+	}
+
+	// Input that isn't an authorized keys file at all is reported briefly.
+	_, err = LoadAuthorizedKeys(strings.Repeat("garbage\n", 3*maxKeyErrors))
+	if err == nil {
+		t.Fatal("LoadAuthorizedKeys accepted garbage")
+	}
+	if n := strings.Count(err.Error(), "\n") + 1; n != maxKeyErrors+1 {
+		t.Errorf("%d error lines, want %d", n, maxKeyErrors+1)
+	}
+	if want := "and 20 more invalid lines"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error doesn't end with %q: %v", want, err)
+	}
+}
+
+func TestLoadAuthorizedKeysFile(t *testing.T) {
+	key := newPublicKey(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, []byte(authorizedLine(key)+"\nbroken\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAuthorizedKeysFile(path); err == nil || !strings.Contains(err.Error(), "line 2:") {
+		t.Fatalf("LoadAuthorizedKeysFile: err = %v, want line 2 reported", err)
+	}
+
+	if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(key), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadAuthorizedKeysFile(path)
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeysFile: %v", err)
+	}
+	if _, ok := keys[string(ssh.MarshalAuthorizedKey(key))]; !ok || len(keys) != 1 {
+		t.Fatalf("got %d keys, want the file's key", len(keys))
+	}
+
+	if _, err := LoadAuthorizedKeysFile(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Fatalf("missing file: err = %v, want not exist", err)
+	}
+}
+
+func TestKeyBoundUsername(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	bound := `tunnelfy-user="alice" ` + authorizedLine(env.signer.PublicKey())
+	if err := env.srv.ReloadAuthorizedKeys(bound); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user string
+		ok   bool
+	}{
+		{"alice", true},
+		{"Alice", true},
+		{"bob", false},
+		{"alice2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			before := metrics.SSHKeyUserMismatches.Value()
+			c, err := ssh.Dial("tcp", env.addr, env.clientConfig(tt.user))
+			if err == nil {
+				c.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("login as %s: err = %v, want success %v", tt.user, err, tt.ok)
+			}
+			var want uint64
+			if !tt.ok {
+				want = 1
+			}
+			if got := metrics.SSHKeyUserMismatches.Value() - before; got != want {
+				t.Fatalf("key user mismatches grew by %d, want %d", got, want)
+			}
+		})
+	}
+
+	// Without a binding the key may log in as anyone.
+	if err := env.srv.ReloadAuthorizedKeys(authorizedLine(env.signer.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		c, err := ssh.Dial("tcp", env.addr, env.clientConfig(user))
+		if err != nil {
+			t.Fatalf("unbound key as %s: %v", user, err)
+		}
+		c.Close()
+	}
+}
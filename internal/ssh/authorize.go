@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ForwardRequest describes a tcpip-forward awaiting authorization.
+type ForwardRequest struct {
+	User          string `json:"user"`
+	Host          string `json:"host"`
+	Label         string `json:"label,omitempty"`
+	RequestedPort uint32 `json:"requested_port"`
+}
+
+// ForwardAuthorizer makes the final decision on a forward after key
+// authentication, e.g. by checking a license or quota. A non-nil error rejects
+// the forward; a *ForwardDeniedError carries a reason for the client.
+type ForwardAuthorizer interface {
+	AuthorizeForward(ctx context.Context, req ForwardRequest) error
+}
+
+// ForwardDeniedError rejects a forward with a reason sent to the client.
+type ForwardDeniedError struct {
+	Reason string
+}
+
+func (e *ForwardDeniedError) Error() string {
+	return "forward denied: " + e.Reason
+}
+
+// WebhookAuthorizer is a ForwardAuthorizer that POSTs the ForwardRequest as
+// JSON to an external service, which answers 200 with {"allow": bool,
+// "reason": string}.
+type WebhookAuthorizer struct {
+	url      string
+	timeout  time.Duration
+	failOpen bool
+	client   *http.Client
+}
+
+// NewWebhookAuthorizer returns a WebhookAuthorizer for url. Each call is
+// bounded by timeout; when the webhook fails or times out, forwards are
+// allowed if failOpen is set and rejected otherwise.
+func NewWebhookAuthorizer(url string, timeout time.Duration, failOpen bool) *WebhookAuthorizer {
+	return &WebhookAuthorizer{url: url, timeout: timeout, failOpen: failOpen, client: &http.Client{}}
+}
+
+// webhookDecision is the webhook's response body.
+type webhookDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// AuthorizeForward implements ForwardAuthorizer.
+func (a *WebhookAuthorizer) AuthorizeForward(ctx context.Context, req ForwardRequest) error {
+	decision, err := a.call(ctx, req)
+	if err != nil {
+		slog.Warn("forward authorization webhook failed", "fail_open", a.failOpen, "err", err)
+		if a.failOpen {
+			return nil
+		}
+		return &ForwardDeniedError{Reason: "authorization unavailable"}
+	}
+	if !decision.Allow {
+		reason := decision.Reason
+		if reason == "" {
+			reason = "denied by policy"
+		}
+		return &ForwardDeniedError{Reason: reason}
+	}
+	return nil
+}
+
+func (a *WebhookAuthorizer) call(ctx context.Context, req ForwardRequest) (webhookDecision, error) {
+	var decision webhookDecision
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return decision, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return decision, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("invalid response: %w", err)
+	}
+	return decision, nil
+}
@@ -0,0 +1,107 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// webhook starts an authorization webhook served by h.
+func webhook(t *testing.T, h http.HandlerFunc) string {
+	t.Helper()
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+// decide answers every authorization request with body.
+func decide(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}
+}
+
+func TestWebhookAuthorizer(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * timeout):
+		}
+		io.WriteString(w, `{"allow":true}`)
+	}
+	failing := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		failOpen   bool
+		wantReason string // empty when the forward is allowed
+	}{
+		{"allow", decide(`{"allow":true}`), false, ""},
+		{"deny", decide(`{"allow":false,"reason":"license expired"}`), false, "license expired"},
+		{"deny without reason", decide(`{"allow":false}`), true, "denied by policy"},
+		{"timeout fail closed", slow, false, "authorization unavailable"},
+		{"timeout fail open", slow, true, ""},
+		{"error status fail closed", failing, false, "authorization unavailable"},
+		{"malformed response fail open", decide(`allow`), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewWebhookAuthorizer(webhook(t, tt.handler), timeout, tt.failOpen)
+			start := time.Now()
+			err := a.AuthorizeForward(context.Background(), ForwardRequest{User: "alice", Host: "alice." + testZone})
+			if elapsed := time.Since(start); elapsed > 5*timeout {
+				t.Fatalf("AuthorizeForward took %v, want it bounded by the %v timeout", elapsed, timeout)
+			}
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("AuthorizeForward = %v, want the forward allowed", err)
+				}
+				return
+			}
+			var denied *ForwardDeniedError
+			if !errors.As(err, &denied) || denied.Reason != tt.wantReason {
+				t.Fatalf("AuthorizeForward = %v, want denied with %q", err, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestForwardAuthorizationWebhook(t *testing.T) {
+	reqs := make(chan ForwardRequest, 2)
+	url := webhook(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ForwardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reqs <- req
+		if req.User == "bob" {
+			io.WriteString(w, `{"allow":false,"reason":"license expired"}`)
+			return
+		}
+		io.WriteString(w, `{"allow":true}`)
+	})
+	env := newTestEnv(t, ServerOptions{ForwardAuthorizer: NewWebhookAuthorizer(url, time.Second, false)})
+
+	forward(t, env.dialRaw(t, "alice"), "app")
+	if got := <-reqs; got.User != "alice" || got.Host != "app.alice."+testZone || got.Label != "app" {
+		t.Fatalf("webhook got %+v, want alice's app forward", got)
+	}
+
+	ok, reply, err := env.dialRaw(t, "bob").SendRequest("tcpip-forward", true, forwardPayload("app", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || string(reply) != "license expired" {
+		t.Fatalf("got ok=%v reply=%q, want the webhook's denial", ok, reply)
+	}
+	<-reqs
+}
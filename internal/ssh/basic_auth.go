@@ -0,0 +1,82 @@
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/proxy"
+)
+
+// basicAuthRequestType is the global request a client sends to
+// password-protect the tunnels it establishes afterwards with HTTP basic
+// auth; see proxy.BasicAuth. Its payload is a basicAuthPayload carrying a
+// bcrypt hash, so the password itself never leaves the client, and an empty
+// payload removes the protection. The hash is never logged.
+const basicAuthRequestType = "basic-auth@tunnelfy"
+
+// maxBasicAuthPayload bounds basic auth requests.
+const maxBasicAuthPayload = 1 << 10
+
+// basicAuthPayload is the payload of a basic auth request.
+type basicAuthPayload struct {
+	User string `json:"user"`
+	Hash string `json:"hash"`
+}
+
+// parseBasicAuth decodes and validates a basic auth request payload.
+func parseBasicAuth(payload []byte) (*proxy.BasicAuth, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	if len(payload) > maxBasicAuthPayload {
+		return nil, errors.New("basic auth payload too large")
+	}
+	var p basicAuthPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, fmt.Errorf("invalid basic auth payload: %w", err)
+	}
+	return proxy.NewBasicAuth(p.User, []byte(p.Hash))
+}
+
+// handleBasicAuth serves a basic auth request, replacing the credentials of
+// the session's subsequent tunnels.
+func (s *SSHServer) handleBasicAuth(req *request, sess *session) {
+	auth, err := parseBasicAuth(req.Payload)
+	if err != nil {
+		if s.logRequests {
+			s.log.Debug("rejecting basic auth", "user", logsafe.String(sess.username), "err", err)
+		}
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	sess.basicAuth = auth
+	req.Reply(true, nil)
+}
+
+// sendBasicAuth hashes the configured basic auth password and sends it with
+// the username; the credentials protect every forward requested afterwards.
+func (c *Client) sendBasicAuth() error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(c.config.BasicAuthPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash basic auth password: %w", err)
+	}
+	payload, err := json.Marshal(basicAuthPayload{User: c.config.BasicAuthUser, Hash: string(hash)})
+	if err != nil {
+		return err
+	}
+	ok, reply, err := c.conn.SendRequest(basicAuthRequestType, true, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send basic auth: %w", err)
+	}
+	if !ok {
+		if len(reply) > 0 {
+			return fmt.Errorf("server rejected basic auth: %s", reply)
+		}
+		return errors.New("server rejected basic auth")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// errNotCertificate is returned by CertAuthenticator for plain public keys,
+// which it leaves to the other authentication sources.
+var errNotCertificate = errors.New("not a certificate")
+
+// CertAuthenticator is an Authenticator accepting OpenSSH user certificates
+// signed by a trusted CA. The username the client logs in as must be one of
+// the certificate's principals; certificates without principals, which
+// OpenSSH would accept for any username, are refused so a certificate can't
+// claim every user's subdomains. Validity windows and CA signatures are
+// checked by ssh.CertChecker, and certificates with critical options, such as
+// source-address, are refused as unsupported.
+type CertAuthenticator struct {
+	checker ssh.CertChecker
+	cas     map[string]bool
+}
+
+// NewCertAuthenticator returns a CertAuthenticator trusting caKeys.
+func NewCertAuthenticator(caKeys []ssh.PublicKey) *CertAuthenticator {
+	a := &CertAuthenticator{cas: make(map[string]bool, len(caKeys))}
+	for _, k := range caKeys {
+		a.cas[string(k.Marshal())] = true
+	}
+	a.checker.IsUserAuthority = func(auth ssh.PublicKey) bool {
+		return a.cas[string(auth.Marshal())]
+	}
+	return a
+}
+
+// Authenticate implements Authenticator.
+func (a *CertAuthenticator) Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (string, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return "", errNotCertificate
+	}
+	err := a.check(conn, cert)
+	if err != nil {
+		slog.Info("rejecting certificate", "key_id", logsafe.String(cert.KeyId), "serial", cert.Serial, "user", logsafe.String(conn.User()), "err", err)
+		return "", err
+	}
+	return conn.User(), nil
+}
+
+func (a *CertAuthenticator) check(conn ssh.ConnMetadata, cert *ssh.Certificate) error {
+	if len(cert.ValidPrincipals) == 0 {
+		return errors.New("certificate has no principals")
+	}
+	// CertChecker leaves source-address to the Permissions it returns, which
+	// Authenticate doesn't pass on, so it would go unenforced.
+	for opt := range cert.CriticalOptions {
+		return fmt.Errorf("unsupported critical option %q in certificate", opt)
+	}
+	_, err := a.checker.Authenticate(conn, cert)
+	return err
+}
+
+// LoadCAKeys parses newline-separated CA public keys in authorized_keys
+// format; a cert-authority option in front of a key is allowed, so lines
+// can be copied from an OpenSSH authorized_keys file. Every line that fails
+// to parse is reported, by line number.
+func LoadCAKeys(data string) ([]ssh.PublicKey, error) {
+	var (
+		keys []ssh.PublicKey
+		errs []error
+	)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: parse CA key failed: %w", n, err))
+			continue
+		}
+		if _, ok := pub.(*ssh.Certificate); ok {
+			errs = append(errs, fmt.Errorf("line %d: a certificate can't be a CA key", n))
+			continue
+		}
+		keys = append(keys, pub)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,147 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSigner returns a freshly generated signer.
+func newTestSigner(t testing.TB) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// issueCert has ca sign a user certificate for key, adjusted by modify, and
+// returns a signer presenting it.
+func issueCert(t testing.TB, ca, key ssh.Signer, modify func(*ssh.Certificate)) ssh.Signer {
+	t.Helper()
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice@test",
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if modify != nil {
+		modify(cert)
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	ca, otherCA := newTestSigner(t), newTestSigner(t)
+	env := newTestEnv(t, ServerOptions{
+		Authenticators: []Authenticator{NewCertAuthenticator([]ssh.PublicKey{ca.PublicKey()})},
+	})
+	hourAgo := uint64(time.Now().Add(-time.Hour).Unix())
+
+	tests := []struct {
+		name   string
+		user   string
+		ca     ssh.Signer
+		modify func(*ssh.Certificate)
+		ok     bool
+	}{
+		{name: "valid", user: "alice", ca: ca, ok: true},
+		{name: "one of several principals", user: "bob", ca: ca, ok: true, modify: func(c *ssh.Certificate) {
+			c.ValidPrincipals = []string{"alice", "bob"}
+		}},
+		{name: "expired", user: "alice", ca: ca, modify: func(c *ssh.Certificate) {
+			c.ValidAfter, c.ValidBefore = hourAgo-3600, hourAgo
+		}},
+		{name: "not yet valid", user: "alice", ca: ca, modify: func(c *ssh.Certificate) {
+			c.ValidAfter = uint64(time.Now().Add(time.Hour).Unix())
+			c.ValidBefore = uint64(time.Now().Add(2 * time.Hour).Unix())
+		}},
+		{name: "other principal", user: "bob", ca: ca},
+		{name: "no principals", user: "alice", ca: ca, modify: func(c *ssh.Certificate) {
+			c.ValidPrincipals = nil
+		}},
+		{name: "untrusted CA", user: "alice", ca: otherCA},
+		{name: "host certificate", user: "alice", ca: ca, modify: func(c *ssh.Certificate) {
+			c.CertType = ssh.HostCert
+		}},
+		{name: "source-address", user: "alice", ca: ca, modify: func(c *ssh.Certificate) {
+			c.CriticalOptions = map[string]string{"source-address": "192.0.2.0/24"}
+		}},
+		{name: "force-command", user: "alice", ca: ca, modify: func(c *ssh.Certificate) {
+			c.CriticalOptions = map[string]string{"force-command": "/bin/true"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := env.clientConfig(tt.user)
+			cfg.Auth = []ssh.AuthMethod{ssh.PublicKeys(issueCert(t, tt.ca, newTestSigner(t), tt.modify))}
+			c, err := ssh.Dial("tcp", env.addr, cfg)
+			if err == nil {
+				defer c.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("login as %s: err = %v, want success %v", tt.user, err, tt.ok)
+			}
+			if tt.ok {
+				// The certificate's user owns the user's subdomains.
+				port := forward(t, c, "app")
+				if port == 0 {
+					t.Fatal("forward got no port")
+				}
+				if _, ok := env.manager.GetRouteInfo("app." + tt.user + "." + testZone); !ok {
+					t.Fatalf("no route for app.%s", tt.user)
+				}
+			}
+		})
+	}
+
+	// Plain authorized keys keep working alongside certificates.
+	c, err := ssh.Dial("tcp", env.addr, env.clientConfig("carol"))
+	if err != nil {
+		t.Fatalf("authorized key: %v", err)
+	}
+	c.Close()
+}
+
+func TestLoadCAKeys(t *testing.T) {
+	ca := newTestSigner(t)
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+	keys, err := LoadCAKeys("# team CA\ncert-authority " + line + "\n\n" + line + "\n")
+	if err != nil {
+		t.Fatalf("LoadCAKeys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+
+	cert := issueCert(t, ca, newTestSigner(t), nil).PublicKey()
+	_, err = LoadCAKeys(line + "\nbroken\n" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))))
+	if err == nil {
+		t.Fatal("LoadCAKeys accepted invalid lines")
+	}
+	for _, want := range []string{"line 2: parse CA key failed", "line 3: a certificate can't be a CA key"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
@@ -3,10 +3,16 @@ package ssh
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -21,15 +27,101 @@ type ClientConfig struct {
 	// KeyPath is the path to the private SSH key file.
 	KeyPath string
 	// LocalServiceAddress is the address of the local service to forward (e.g., "localhost:3000").
+	// When empty, Connect only establishes the connection and forwards are added with AddForward.
 	LocalServiceAddress string
+	// Labels is optional metadata (e.g. "env": "staging") the server attaches
+	// to the client's tunnels and reports in its admin API and logs.
+	Labels map[string]string
+	// AccessToken, if set, gates the client's tunnels: requests to them must
+	// carry it in the X-Tunnelfy-Token header or the tunnelfy_token query
+	// parameter, or the server answers 403.
+	AccessToken string
+	// AllowIPs and DenyIPs, if set, restrict the client's tunnels to client
+	// addresses, as CIDRs or single addresses: an address in AllowIPs is
+	// always admitted, and otherwise refused if it is in DenyIPs or AllowIPs
+	// is not empty.
+	AllowIPs []string
+	DenyIPs  []string
+	// BasicAuthUser, if set, password-protects the client's tunnels with HTTP
+	// basic auth for this user and BasicAuthPassword. Only a bcrypt hash of
+	// the password is sent to the server.
+	BasicAuthUser     string
+	BasicAuthPassword string
+	// TunnelMode is the mode of the client's tunnels; empty means
+	// TunnelModeHTTP. With TunnelModeTCP the RemotePort AddForward returns is the
+	// tunnel's public port on the server.
+	TunnelMode TunnelMode
+	// ProbeInterval, when positive, is how often the local services of the
+	// client's forwards are probed; the server is told when one goes down or
+	// recovers, so the public URL shows an offline page instead of a 502.
+	ProbeInterval time.Duration
+	// KeepAliveInterval, when positive, is how often a keepalive request is
+	// sent to detect a dead connection, which is then closed so Done fires.
+	// Zero disables keepalives; tunnelfy-client uses DefaultKeepAliveInterval.
+	KeepAliveInterval time.Duration
+	// KnownHostsPath is the known_hosts file the server's host key is
+	// verified against; it is created if missing. When it and PinnedHostKeys
+	// are empty, Connect fails unless InsecureIgnoreHostKey is set.
+	KnownHostsPath string
+	// InsecureIgnoreHostKey connects without verifying the server's host key
+	// when neither KnownHostsPath nor PinnedHostKeys is set, leaving the
+	// connection open to interception.
+	InsecureIgnoreHostKey bool
+	// TrustOnFirstUse records the key of a server missing from
+	// KnownHostsPath instead of refusing to connect.
+	TrustOnFirstUse bool
+	// HostKeyPrompt, if set, is asked whether to trust and record the key of
+	// a server missing from KnownHostsPath when TrustOnFirstUse is off.
+	HostKeyPrompt func(hostname string, key ssh.PublicKey) bool
+	// PinnedHostKeys are SHA256 fingerprints ("SHA256:...") of host keys the
+	// server may present, e.g. both the old and the new key while the server's
+	// key is rotated. A pinned key is accepted even where known_hosts records
+	// another, and is then added to it; with pins set, an unknown key that
+	// isn't pinned is refused rather than trusted or prompted for.
+	PinnedHostKeys []string
 	// Logger is an optional logger for client messages.
 	Logger *log.Logger
 }
 
+// Forward describes a remote port forward held by the client.
+type Forward struct {
+	// Label is the subdomain label requested from the server. Empty requests the user's default host.
+	Label string
+	// LocalAddress is the local service address the forward maps to.
+	LocalAddress string
+	// RemotePort is the port assigned by the server.
+	RemotePort uint32
+	// PublicURL is the URL the server serves the forward at, if it reported
+	// one; TCP tunnels have none.
+	PublicURL string
+}
+
+// ErrAlreadyConnected is returned by Connect while the connection of an
+// earlier Connect is still up.
+var ErrAlreadyConnected = errors.New("client is already connected")
+
 // Client represents an SSH tunnel client.
 type Client struct {
 	config ClientConfig
 	conn   *ssh.Client
+
+	// connMu serializes Connect and Close, so concurrent calls can't replace
+	// a live connection and leak it along with its goroutines.
+	connMu sync.Mutex
+
+	mu       sync.Mutex
+	forwards []Forward
+
+	// wg tracks the client's background goroutines so Close can wait for them.
+	wg sync.WaitGroup
+	// done is closed once the connection has ended and the monitor has exited.
+	done chan struct{}
+	// closing is set by Close so the monitor doesn't report the closure as a failure.
+	closing atomic.Bool
+	// serverShutdown is set when the server announces it is shutting down;
+	// requestsDone is closed once the connection's global requests are served.
+	serverShutdown atomic.Bool
+	requestsDone   chan struct{}
 }
 
 // NewClient creates a new SSH tunnel client.
@@ -40,10 +132,30 @@ func NewClient(config ClientConfig) *Client {
 	return &Client{config: config}
 }
 
-// Connect establishes an SSH connection and requests a remote port forward.
-// It blocks until the connection is established or an error occurs.
-// The caller should handle disconnections and potentially call Connect again.
+// Connect establishes an SSH connection and, when LocalServiceAddress is set,
+// requests a remote port forward for it. It blocks until the connection is established or an error occurs.
+// The caller should handle disconnections and potentially call Connect again
+// once Done is closed; while the connection is up, Connect returns
+// ErrAlreadyConnected.
 func (c *Client) Connect() (assignedRemotePort uint32, err error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.done != nil {
+		select {
+		case <-c.done:
+			// The previous connection ended: wait for its goroutines and
+			// start afresh, since its forwards died with it.
+			c.wg.Wait()
+			c.closing.Store(false)
+			c.serverShutdown.Store(false)
+			c.mu.Lock()
+			c.forwards = nil
+			c.mu.Unlock()
+		default:
+			return 0, ErrAlreadyConnected
+		}
+	}
+
 	c.config.Logger.Printf("Attempting to connect to %s as %s", c.config.ServerAddress, c.config.Username)
 
 	// Load the private key.
@@ -57,76 +169,331 @@ func (c *Client) Connect() (assignedRemotePort uint32, err error) {
 		return 0, fmt.Errorf("failed to parse private key: %w", err)
 	}
 
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		return 0, err
+	}
+
 	// SSH client configuration.
 	sshConfig := &ssh.ClientConfig{
 		User:            c.config.Username,
 		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Production-ready should use a known_hosts mechanism
+		HostKeyCallback: hostKeyCallback,
+		// The server explains rejections, such as an expired key, in a banner.
+		BannerCallback: func(message string) error {
+			c.config.Logger.Printf("server: %s", strings.TrimSpace(message))
+			return nil
+		},
 		// Add a timeout for the initial handshake.
 		Timeout: 15 * time.Second,
 	}
 
-	// Dial the SSH server.
-	c.conn, err = ssh.Dial("tcp", c.config.ServerAddress, sshConfig)
+	// Dial the SSH server. The connection's global requests are served by
+	// handleGlobalRequests, which watches for a shutdown notice.
+	var reqs <-chan *ssh.Request
+	c.conn, reqs, err = dial(c.config.ServerAddress, sshConfig)
 	if err != nil {
+		// A rejected host key is not a connectivity problem; report it as is
+		// so it isn't mistaken for one and silently retried.
+		if errors.Is(err, ErrHostKeyChanged) || errors.Is(err, ErrHostKeyUnknown) {
+			return 0, err
+		}
 		return 0, fmt.Errorf("failed to dial SSH server: %w", err)
 	}
 	c.config.Logger.Printf("Successfully connected to SSH server %s", c.config.ServerAddress)
 
+	c.done = make(chan struct{})
+	c.requestsDone = make(chan struct{})
+	c.wg.Add(1)
+	go c.monitorConnection()
+	c.wg.Add(1)
+	go c.handleGlobalRequests(reqs)
+	c.wg.Add(1)
+	go c.handleForwardedChannels(c.conn.HandleChannelOpen("forwarded-tcpip"))
+	if c.config.ProbeInterval > 0 {
+		c.wg.Add(1)
+		go c.probeLocalServices()
+	}
+	if c.config.KeepAliveInterval > 0 {
+		c.wg.Add(1)
+		go c.keepAlive()
+	}
+
+	if len(c.config.Labels) > 0 {
+		if err := c.sendLabels(); err != nil {
+			c.closing.Store(true)
+			c.conn.Close()
+			c.wg.Wait()
+			return 0, err
+		}
+	}
+	if c.config.TunnelMode != "" && c.config.TunnelMode != TunnelModeHTTP {
+		if err := c.sendTunnelMode(); err != nil {
+			c.closing.Store(true)
+			c.conn.Close()
+			c.wg.Wait()
+			return 0, err
+		}
+	}
+	if c.config.AccessToken != "" {
+		if err := c.sendAccessToken(); err != nil {
+			c.closing.Store(true)
+			c.conn.Close()
+			c.wg.Wait()
+			return 0, err
+		}
+	}
+
+	if len(c.config.AllowIPs) > 0 || len(c.config.DenyIPs) > 0 {
+		if err := c.sendAccessControl(); err != nil {
+			c.closing.Store(true)
+			c.conn.Close()
+			c.wg.Wait()
+			return 0, err
+		}
+	}
+
+	if c.config.BasicAuthUser != "" {
+		if err := c.sendBasicAuth(); err != nil {
+			c.closing.Store(true)
+			c.conn.Close()
+			c.wg.Wait()
+			return 0, err
+		}
+	}
+
+	if c.config.LocalServiceAddress == "" {
+		return 0, nil
+	}
+	f, err := c.AddForward(c.config.LocalServiceAddress, "")
+	if err != nil {
+		c.closing.Store(true)
+		c.conn.Close()
+		c.wg.Wait()
+		return 0, err
+	}
+	return f.RemotePort, nil
+}
+
+// dial connects to the SSH server at addr like ssh.Dial, but returns the
+// connection's global requests for the caller to serve rather than refusing
+// them all.
+func dial(addr string, config *ssh.ClientConfig) (*ssh.Client, <-chan *ssh.Request, error) {
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ssh.NewClient(c, chans, closedRequests), reqs, nil
+}
+
+// sendLabels sends the configured labels, which apply to every forward
+// requested afterwards.
+func (c *Client) sendLabels() error {
+	payload, err := json.Marshal(c.config.Labels)
+	if err != nil {
+		return err
+	}
+	ok, reply, err := c.conn.SendRequest(labelsRequestType, true, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send labels: %w", err)
+	}
+	if !ok {
+		if len(reply) > 0 {
+			return fmt.Errorf("server rejected labels: %s", reply)
+		}
+		return errors.New("server rejected labels")
+	}
+	return nil
+}
+
+// AddForward requests an additional remote port forward over the established
+// connection, mapped to localAddr. A non-empty label asks the server for the
+// host "<label>.<username>.<zone>" instead of the user's default host. It
+// returns the forward as established, with the port and public URL the server
+// assigned.
+func (c *Client) AddForward(localAddr, label string) (Forward, error) {
+	if c.conn == nil {
+		return Forward{}, errors.New("client is not connected")
+	}
+
 	// Request remote port forwarding for port 0 (dynamic allocation).
 	// The payload for tcpip-forward is: uint32(addr_len) + addr_bytes + uint32(port)
-	// We are forwarding to 0.0.0.0:0, but the server will interpret this as a request for any available port.
-	// The actual target for the forwarding is specified by the client and is handled by the server.
-	// For this client, we just need to request the port.
-	addr := "0.0.0.0"
-	addrBytes := []byte(addr)
-	payload := new(bytes.Buffer)
+	// The bind address carries the requested label; an unlabeled forward binds
+	// 0.0.0.0, which the server interprets as the user's default host.
+	addr := label
+	if addr == "" {
+		addr = "0.0.0.0"
+	}
 
-	binary.Write(payload, binary.BigEndian, uint32(len(addrBytes)))
-	payload.Write(addrBytes)
-	binary.Write(payload, binary.BigEndian, uint32(0)) // Request port 0
+	// The forward doesn't carry the local port, which the server may restrict.
+	if err := c.sendLocalPort(localAddr); err != nil {
+		return Forward{}, err
+	}
 
-	ok, replyPayload, err := c.conn.SendRequest("tcpip-forward", true, payload.Bytes())
+	ok, replyPayload, err := c.conn.SendRequest("tcpip-forward", true, forwardPayload(addr, 0))
 	if err != nil {
-		c.conn.Close()
-		return 0, fmt.Errorf("failed to send tcpip-forward request: %w", err)
+		return Forward{}, fmt.Errorf("failed to send tcpip-forward request: %w", err)
 	}
 	if !ok {
-		c.conn.Close()
-		return 0, errors.New("server rejected tcpip-forward request")
+		if len(replyPayload) > 0 {
+			return Forward{}, fmt.Errorf("server rejected tcpip-forward request for %q: %s", label, replyPayload)
+		}
+		return Forward{}, fmt.Errorf("server rejected tcpip-forward request for %q", label)
 	}
 
-	// The reply payload for a successful tcpip-forward is just the assigned port (uint32).
-	if len(replyPayload) != 4 {
-		c.conn.Close()
-		return 0, fmt.Errorf("server returned malformed reply payload for tcpip-forward: %v", replyPayload)
+	assignedRemotePort, publicURL, err := parseForwardReply(replyPayload)
+	if err != nil {
+		return Forward{}, err
+	}
+	if publicURL != "" {
+		c.config.Logger.Printf("Server assigned remote port %d for %s, served at %s", assignedRemotePort, localAddr, publicURL)
+	} else {
+		c.config.Logger.Printf("Server assigned remote port %d for %s", assignedRemotePort, localAddr)
 	}
 
-	assignedRemotePort = binary.BigEndian.Uint32(replyPayload[:4])
-	c.config.Logger.Printf("Server assigned remote port: %d", assignedRemotePort)
+	f := Forward{Label: label, LocalAddress: localAddr, RemotePort: assignedRemotePort, PublicURL: publicURL}
+	c.mu.Lock()
+	c.forwards = append(c.forwards, f)
+	c.mu.Unlock()
 
-	// The connection is now established and the port is forwarded.
-	// The client should now listen for incoming connections on the remote port
-	// and forward them to the local service. However, the `golang.org/x/crypto/ssh`
-	// client library doesn't directly expose the listener for remote forwards.
-	// The server-side (tunnelfy) handles the listening and forwarding.
-	// This client's job is to maintain the connection so the tunnel stays active.
-	// We can start a goroutine to monitor the connection and handle disconnects.
-	go c.monitorConnection()
+	// The server listens on the assigned port and hands each connection to
+	// handleForwardedChannels through a forwarded-tcpip channel.
+	return f, nil
+}
 
-	return assignedRemotePort, nil
+// Forwards returns a snapshot of the forwards currently held by the client.
+func (c *Client) Forwards() []Forward {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Forward(nil), c.forwards...)
 }
 
-// monitorConnection keeps the SSH connection alive and handles disconnections.
-func (c *Client) monitorConnection() {
-	if c.conn == nil {
+// forwardReply encodes a successful tcpip-forward reply: the assigned port
+// (uint32) as RFC 4254 has it, followed, when publicURL is set, by the URL as
+// an SSH string (uint32 length and bytes). Clients reading only the port,
+// such as OpenSSH, ignore the rest.
+func forwardReply(port uint32, publicURL string) []byte {
+	payload := binary.BigEndian.AppendUint32(make([]byte, 0, 8+len(publicURL)), port)
+	if publicURL != "" {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(publicURL)))
+		payload = append(payload, publicURL...)
+	}
+	return payload
+}
+
+// parseForwardReply returns the assigned port and public URL from a
+// successful tcpip-forward reply; see forwardReply. The URL is empty when the
+// server sent none, as older servers and TCP tunnels don't, or when it is
+// malformed. Trailing data is ignored so that servers can extend the reply
+// further without breaking older clients.
+func parseForwardReply(payload []byte) (port uint32, publicURL string, err error) {
+	if len(payload) < 4 {
+		return 0, "", fmt.Errorf("server returned malformed reply payload for tcpip-forward: %v", payload)
+	}
+	port = binary.BigEndian.Uint32(payload[:4])
+	rest := payload[4:]
+	if len(rest) >= 4 {
+		if n := binary.BigEndian.Uint32(rest[:4]); uint64(n) <= uint64(len(rest)-4) {
+			publicURL = string(rest[4 : 4+n])
+		}
+	}
+	return port, publicURL, nil
+}
+
+// forwardPayload encodes a tcpip-forward / cancel-tcpip-forward request payload.
+func forwardPayload(addr string, port uint32) []byte {
+	payload := new(bytes.Buffer)
+	binary.Write(payload, binary.BigEndian, uint32(len(addr)))
+	payload.WriteString(addr)
+	binary.Write(payload, binary.BigEndian, port)
+	return payload.Bytes()
+}
+
+// handleForwardedChannels serves the forwarded-tcpip channels the server opens
+// for connections to the client's tunnels until the connection ends.
+func (c *Client) handleForwardedChannels(chans <-chan ssh.NewChannel) {
+	defer c.wg.Done()
+	for newChan := range chans {
+		var payload forwardedTCPPayload
+		if err := ssh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+			newChan.Reject(ssh.Prohibited, "malformed forwarded-tcpip payload")
+			continue
+		}
+		go c.serveForwardedChannel(newChan, c.localAddressFor(payload.Port))
+	}
+}
+
+// serveForwardedChannel connects newChan to the local service at localAddr.
+// The local service is dialed first, so a service that is down rejects the
+// channel with ConnectionFailed and the server can tell the connection failed.
+func (c *Client) serveForwardedChannel(newChan ssh.NewChannel, localAddr string) {
+	local, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		c.config.Logger.Printf("Failed to dial local service %s: %v", localAddr, err)
+		newChan.Reject(ssh.ConnectionFailed, fmt.Sprintf("failed to connect to %s", localAddr))
+		return
+	}
+	defer local.Close()
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		c.config.Logger.Printf("Failed to accept forwarded connection: %v", err)
 		return
 	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(local, ch)
+		closeWrite(local)
+		close(done)
+	}()
+	io.Copy(ch, local)
+	ch.CloseWrite()
+	<-done
+}
+
+// localAddressFor returns the local service address of the forward assigned
+// remotePort, falling back to LocalServiceAddress.
+func (c *Client) localAddressFor(remotePort uint32) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.forwards {
+		if f.RemotePort == remotePort {
+			return f.LocalAddress
+		}
+	}
+	return c.config.LocalServiceAddress
+}
+
+// Done returns a channel that is closed once the connection established by
+// Connect has ended, whether through Close or a disconnect. It is nil before Connect.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// monitorConnection keeps the SSH connection alive and handles disconnections.
+func (c *Client) monitorConnection() {
+	defer c.wg.Done()
+	defer close(c.done)
 
 	// Wait for the connection to close.
 	// This can happen due to network issues, server shutdown, etc.
 	err := c.conn.Wait()
-	if err != nil {
+	// A shutdown notice may still be queued when the connection ends.
+	<-c.requestsDone
+	if c.closing.Load() {
+		// Closed by Close, which reports the outcome itself.
+		return
+	}
+	if c.serverShutdown.Load() {
+		c.config.Logger.Printf("SSH connection closed: the server is shutting down.")
+	} else if err != nil {
 		c.config.Logger.Printf("SSH connection closed: %v", err)
 	} else {
 		c.config.Logger.Printf("SSH connection closed gracefully.")
@@ -135,11 +502,17 @@ func (c *Client) monitorConnection() {
 	// For now, we just log the closure.
 }
 
-// Close gracefully closes the SSH connection.
+// Close gracefully closes the SSH connection. It returns once the client's
+// background goroutines have exited.
 func (c *Client) Close() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 	c.config.Logger.Printf("Closing SSH connection...")
 	if c.conn != nil {
+		c.closing.Store(true)
+		c.cancelForwards()
 		err := c.conn.Close()
+		c.wg.Wait()
 		if err != nil {
 			return fmt.Errorf("failed to close SSH connection: %w", err)
 		}
@@ -149,6 +522,25 @@ func (c *Client) Close() error {
 	return errors.New("client is not connected")
 }
 
+// cancelForwards asks the server to tear down every forward held by the client.
+// Failures are logged; the connection is closed afterwards regardless.
+func (c *Client) cancelForwards() {
+	c.mu.Lock()
+	forwards := c.forwards
+	c.forwards = nil
+	c.mu.Unlock()
+
+	for _, f := range forwards {
+		addr := f.Label
+		if addr == "" {
+			addr = "0.0.0.0"
+		}
+		if _, _, err := c.conn.SendRequest("cancel-tcpip-forward", true, forwardPayload(addr, f.RemotePort)); err != nil {
+			c.config.Logger.Printf("Failed to cancel forward on remote port %d: %v", f.RemotePort, err)
+		}
+	}
+}
+
 // A simple example of how to use the client.
 // This would typically be in a main package or another service.
 /*
@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForwardReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		wantPort uint32
+		wantURL  string
+		wantErr  bool
+	}{
+		{name: "port and URL", payload: forwardReply(41234, "https://alice.tunnelfy.test"), wantPort: 41234, wantURL: "https://alice.tunnelfy.test"},
+		{name: "port only", payload: forwardReply(41234, ""), wantPort: 41234},
+		{name: "older server", payload: []byte{0, 0, 0xa1, 0x12}, wantPort: 41234},
+		{name: "trailing data", payload: append(forwardReply(1, "http://a.b"), 0xff, 0xff), wantPort: 1, wantURL: "http://a.b"},
+		{name: "truncated URL", payload: forwardReply(1, "http://a.b")[:10], wantPort: 1},
+		{name: "short length", payload: []byte{0, 0, 0, 1, 0, 0}, wantPort: 1},
+		{name: "empty", payload: nil, wantErr: true},
+		{name: "short port", payload: []byte{0, 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, url, err := parseForwardReply(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if port != tt.wantPort || url != tt.wantURL {
+				t.Fatalf("got %d %q, want %d %q", port, url, tt.wantPort, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestAddForwardReturnsPublicURL(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	c := env.connect(t, "alice", ClientConfig{})
+	f, err := c.AddForward(localService(t, "ok"), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(f.PublicURL, "app.alice."+testZone) || f.RemotePort == 0 {
+		t.Fatalf("got %+v, want the public URL of app.alice.%s and its port", f, testZone)
+	}
+}
+
+func TestCloseLeavesNoGoroutines(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	local := localService(t, "ok")
+	before := runtime.NumGoroutine()
+
+	c := NewClient(ClientConfig{
+		ServerAddress:         env.addr,
+		Username:              "alice",
+		KeyPath:               env.keyPath,
+		LocalServiceAddress:   local,
+		InsecureIgnoreHostKey: true,
+		KeepAliveInterval:     10 * time.Millisecond,
+		ProbeInterval:         10 * time.Millisecond,
+		Logger:                log.New(io.Discard, "", 0),
+	})
+	if _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("Done isn't closed when Close returns")
+	}
+	// The server side of the connection winds down asynchronously.
+	waitFor(t, "the client's goroutines to exit", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+func TestConnectTwice(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	c := env.connect(t, "alice", ClientConfig{})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Connect()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, ErrAlreadyConnected) {
+			t.Fatalf("Connect while connected: err = %v, want ErrAlreadyConnected", err)
+		}
+	}
+	if n := env.srv.Stats().Connections; n != 1 {
+		t.Fatalf("server has %d connections, want the first one only", n)
+	}
+
+	// Once the connection has ended, Connect starts a fresh one.
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Connect(); err != nil {
+		t.Fatalf("Connect after Close: %v", err)
+	}
+	if _, err := c.AddForward(localService(t, "again"), "app"); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := env.get(t, "app.alice."+testZone, "/"); status != http.StatusOK || body != "again" {
+		t.Fatalf("got %d %q, want the reconnected tunnel", status, body)
+	}
+	waitFor(t, "the first connection to close on the server", func() bool {
+		return env.srv.Stats().Connections == 1
+	})
+}
@@ -0,0 +1,112 @@
+package ssh
+
+import "sync"
+
+// keyedQueue runs functions concurrently, except that functions sharing a key
+// run one at a time in submission order.
+type keyedQueue struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	tails map[string]chan struct{}
+}
+
+func newKeyedQueue() *keyedQueue {
+	return &keyedQueue{tails: make(map[string]chan struct{})}
+}
+
+// run starts fn in a goroutine once every function previously submitted with
+// the same key has finished. An empty key imposes no ordering.
+func (q *keyedQueue) run(key string, fn func()) {
+	q.wg.Add(1)
+	if key == "" {
+		go func() {
+			defer q.wg.Done()
+			fn()
+		}()
+		return
+	}
+
+	q.mu.Lock()
+	prev := q.tails[key]
+	done := make(chan struct{})
+	q.tails[key] = done
+	q.mu.Unlock()
+
+	go func() {
+		defer q.wg.Done()
+		if prev != nil {
+			<-prev
+		}
+		fn()
+		close(done)
+		q.mu.Lock()
+		if q.tails[key] == done {
+			delete(q.tails, key)
+		}
+		q.mu.Unlock()
+	}()
+}
+
+// wait blocks until every submitted function has finished.
+func (q *keyedQueue) wait() {
+	q.wg.Wait()
+}
+
+// orderingKey returns the key global requests must be serialized by: forward
+// and cancel requests for the same explicit port, so a cancel never overtakes
+// the forward it refers to. Requests for port 0 get a fresh port and need no
+// ordering.
+func orderingKey(reqType string, payload []byte) string {
+	if reqType != "tcpip-forward" && reqType != "cancel-tcpip-forward" {
+		return ""
+	}
+	_, port, err := parseForwardRequest(payload)
+	if err != nil || port == "0" {
+		return ""
+	}
+	return port
+}
+
+// replyOrder sends a connection's global request replies in the order the
+// requests arrived. Replies carry no request ID, so clients match them to
+// their requests first in, first out; requests handled concurrently would
+// otherwise have their replies attributed to the wrong request.
+type replyOrder struct {
+	mu      sync.Mutex
+	nextSeq uint64
+	sent    uint64
+	ready   map[uint64]func()
+}
+
+func newReplyOrder() *replyOrder {
+	return &replyOrder{ready: make(map[uint64]func())}
+}
+
+// slot reserves the next reply position, to be called in arrival order for
+// each request wanting a reply.
+func (o *replyOrder) slot() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := o.nextSeq
+	o.nextSeq++
+	return n
+}
+
+// deliver runs send, which writes the reply of slot n, once the replies of
+// every earlier slot have been written. It doesn't wait for them: a reply
+// that isn't due yet is held and written by the deliver call that fills the
+// gap before it.
+func (o *replyOrder) deliver(n uint64, send func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ready[n] = send
+	for {
+		send, ok := o.ready[o.sent]
+		if !ok {
+			return
+		}
+		delete(o.ready, o.sent)
+		o.sent++
+		send()
+	}
+}
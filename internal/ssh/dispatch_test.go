@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReplyOrder(t *testing.T) {
+	o := newReplyOrder()
+	slots := make([]uint64, 4)
+	for i := range slots {
+		slots[i] = o.slot()
+	}
+	var sent []int
+	// Requests finish in an order of their own; replies go out in arrival order.
+	for _, i := range []int{2, 0, 3, 1} {
+		o.deliver(slots[i], func() { sent = append(sent, i) })
+	}
+	if want := []int{0, 1, 2, 3}; !slices.Equal(sent, want) {
+		t.Fatalf("replies sent in order %v, want %v", sent, want)
+	}
+}
+
+func TestKeyedQueueOrdersSameKey(t *testing.T) {
+	q := newKeyedQueue()
+	release := make(chan struct{})
+	var got []string
+	results := make(chan string, 3)
+	q.run("8080", func() {
+		<-release
+		results <- "forward"
+	})
+	q.run("8080", func() { results <- "cancel" })
+	q.run("", func() { results <- "other" })
+
+	// The unrelated request doesn't wait for the blocked forward.
+	if r := <-results; r != "other" {
+		t.Fatalf("first finished %q, want the unrelated request", r)
+	}
+	close(release)
+	q.wait()
+	close(results)
+	for r := range results {
+		got = append(got, r)
+	}
+	if want := []string{"forward", "cancel"}; !slices.Equal(got, want) {
+		t.Fatalf("same-port requests ran as %v, want %v", got, want)
+	}
+}
+
+// blockingAuthorizer holds every forward until release is closed.
+type blockingAuthorizer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a *blockingAuthorizer) AuthorizeForward(ctx context.Context, req ForwardRequest) error {
+	a.started <- struct{}{}
+	<-a.release
+	return nil
+}
+
+func TestSlowForwardDoesNotBlockKeepalive(t *testing.T) {
+	auth := &blockingAuthorizer{started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(auth.release)
+	env := newTestEnv(t, ServerOptions{ForwardAuthorizer: auth})
+	c := env.dialRaw(t, "alice")
+
+	// The forward wants no reply, so the keepalive's reply isn't queued
+	// behind it.
+	if _, _, err := c.SendRequest("tcpip-forward", false, forwardPayload("app", 0)); err != nil {
+		t.Fatal(err)
+	}
+	<-auth.started
+	done := make(chan bool, 1)
+	go func() {
+		ok, _, err := c.SendRequest(keepAliveRequestType, true, nil)
+		done <- ok && err == nil
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("keepalive failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepalive blocked behind a slow forward")
+	}
+}
+
+func TestMalformedRequestsGetOneReply(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	c := env.dialRaw(t, "alice")
+	requests := []struct {
+		typ     string
+		payload []byte
+	}{
+		{"unknown@example.com", nil},
+		{"tcpip-forward", nil},
+		{"tcpip-forward", []byte{0, 0, 0, 99, 'x'}},
+		{"cancel-tcpip-forward", []byte{1}},
+		{statusRequestType, []byte("{not json")},
+		{labelsRequestType, []byte("\xff\xfe")},
+		{localPortRequestType, []byte("port")},
+		{tunnelModeRequestType, []byte("carrier-pigeon")},
+	}
+	for _, r := range requests {
+		done := make(chan bool, 1)
+		go func() {
+			ok, _, err := c.SendRequest(r.typ, true, r.payload)
+			done <- err == nil && !ok
+		}()
+		select {
+		case rejected := <-done:
+			if !rejected {
+				t.Errorf("%s %q: want a failure reply", r.typ, r.payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %q: no reply", r.typ, r.payload)
+		}
+	}
+	// A stray extra reply would be taken as this keepalive's.
+	if ok, _, err := c.SendRequest(keepAliveRequestType, true, nil); err != nil || !ok {
+		t.Fatalf("keepalive after malformed requests: ok=%v err=%v", ok, err)
+	}
+}
@@ -0,0 +1,130 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnelfy/internal/proxy"
+)
+
+func TestHostKeyPolicy(t *testing.T) {
+	configured, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		configured ssh.Signer
+		strict     bool
+		wantErr    error
+	}{
+		{"configured", configured, false, nil},
+		{"configured strict", configured, true, nil},
+		{"absent ephemeral", nil, false, nil},
+		{"absent strict", nil, true, ErrNoHostKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := hostKey(tt.configured, tt.strict)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("hostKey error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if signer == nil {
+				t.Fatal("hostKey returned no key")
+			}
+			if tt.configured != nil && !bytes.Equal(signer.PublicKey().Marshal(), tt.configured.PublicKey().Marshal()) {
+				t.Fatal("hostKey replaced the configured key")
+			}
+		})
+	}
+
+	manager, err := proxy.NewShardedRouteManager(proxy.DefaultRouteShards, false, proxy.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]AuthorizedKey{
+		string(ssh.MarshalAuthorizedKey(configured.PublicKey())): {PublicKey: configured.PublicKey()},
+	}
+	if _, err := NewSSHServer(keys, testZone, manager, false, ServerOptions{StrictHostKey: true}); !errors.Is(err, ErrNoHostKey) {
+		t.Fatalf("NewSSHServer in strict mode without a key: err = %v, want ErrNoHostKey", err)
+	}
+}
+
+func TestServerPresentsConfiguredHostKey(t *testing.T) {
+	signer, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, ServerOptions{HostKey: signer, StrictHostKey: true})
+	cfg := env.clientConfig("alice")
+	cfg.HostKeyCallback = ssh.FixedHostKey(signer.PublicKey())
+	c, err := ssh.Dial("tcp", env.addr, cfg)
+	if err != nil {
+		t.Fatalf("dial verifying the configured host key: %v", err)
+	}
+	c.Close()
+}
+
+func TestLoadOrCreateHostKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh_host_ed25519_key")
+	created, err := LoadOrCreateHostKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("the generated key wasn't persisted: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("host key file mode = %v, want 0600", perm)
+	}
+
+	reloaded, err := LoadOrCreateHostKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ssh.FingerprintSHA256(reloaded.PublicKey()), ssh.FingerprintSHA256(created.PublicKey()); got != want {
+		t.Fatalf("reloaded key %s, want the persisted %s", got, want)
+	}
+
+	// Instances starting together end up with one key.
+	shared := filepath.Join(t.TempDir(), "shared_key")
+	fingerprints := make(chan string, 8)
+	var wg sync.WaitGroup
+	for range cap(fingerprints) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s, err := LoadOrCreateHostKey(shared); err == nil {
+				fingerprints <- ssh.FingerprintSHA256(s.PublicKey())
+			} else {
+				fingerprints <- err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	close(fingerprints)
+	first := <-fingerprints
+	for fp := range fingerprints {
+		if fp != first {
+			t.Fatalf("concurrent loads got %s and %s", first, fp)
+		}
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad_key")
+	if err := os.WriteFile(bad, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateHostKey(bad); err == nil {
+		t.Fatal("an unparsable host key file was accepted")
+	}
+}
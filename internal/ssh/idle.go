@@ -0,0 +1,90 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errIdleTimeout describes a proxied connection closed for being idle in both
+// directions for longer than the configured timeout.
+var errIdleTimeout = errors.New("connection idle timeout")
+
+// idleCopier copies both directions of a proxied connection and shares a
+// single activity timestamp between them, so a connection busy in one
+// direction is never considered idle.
+type idleCopier struct {
+	timeout    time.Duration
+	lastActive atomic.Int64
+}
+
+func newIdleCopier(timeout time.Duration) *idleCopier {
+	c := &idleCopier{timeout: timeout}
+	c.lastActive.Store(time.Now().UnixNano())
+	return c
+}
+
+// idle reports whether neither direction has seen data within the timeout.
+func (c *idleCopier) idle() bool {
+	return time.Since(time.Unix(0, c.lastActive.Load())) >= c.timeout
+}
+
+// copy copies from src to dst until EOF or error, recording activity on
+// every chunk.
+func (c *idleCopier) copy(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			c.lastActive.Store(time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watch calls onIdle once the connection has been idle for the timeout,
+// unless done is closed first. Unlike read deadlines, this works for SSH
+// channels as well as TCP connections.
+func (c *idleCopier) watch(done <-chan struct{}, onIdle func()) {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			if c.idle() {
+				onIdle()
+				return
+			}
+			remaining := c.timeout - time.Since(time.Unix(0, c.lastActive.Load()))
+			timer.Reset(max(remaining, time.Millisecond))
+		}
+	}
+}
+
+// ParseRequestTimeouts parses "user=duration" entries into a map of user to
+// request timeout.
+func ParseRequestTimeouts(specs []string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(specs))
+	for _, spec := range specs {
+		user, value, ok := strings.Cut(spec, "=")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("entries must be user=duration, got %q", spec)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q for %s (want a positive duration such as 2m)", value, user)
+		}
+		timeouts[user] = d
+	}
+	return timeouts, nil
+}
@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleConnectionClosed(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	env := newTestEnv(t, ServerOptions{
+		ConnIdleTimeout:       timeout,
+		ConnIdleTimeoutExempt: []string{"ws.alice." + testZone},
+	})
+	c := env.connect(t, "alice", ClientConfig{})
+	for _, label := range []string{"app", "ws"} {
+		if _, err := c.AddForward(localService(t, label), label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	routes := env.manager.ListRoutes()
+
+	tests := []struct {
+		host       string
+		wantClosed bool
+	}{
+		{"app.alice." + testZone, true},
+		{"ws.alice." + testZone, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(routes[tt.host], "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * timeout))
+			_, err = conn.Read(make([]byte, 1))
+			if closed := !errors.Is(err, os.ErrDeadlineExceeded); closed != tt.wantClosed {
+				t.Fatalf("idle connection closed = %v (read err %v), want %v", closed, err, tt.wantClosed)
+			}
+		})
+	}
+}
+
+func TestIdleCopierWatch(t *testing.T) {
+	c := newIdleCopier(50 * time.Millisecond)
+	done := make(chan struct{})
+	fired := make(chan time.Time, 1)
+	start := time.Now()
+	go c.watch(done, func() { fired <- time.Now() })
+
+	// Activity pushes the deadline back.
+	time.Sleep(30 * time.Millisecond)
+	c.lastActive.Store(time.Now().UnixNano())
+	select {
+	case at := <-fired:
+		if at.Sub(start) < 75*time.Millisecond {
+			t.Fatalf("fired after %v despite activity at 30ms", at.Sub(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection never reported")
+	}
+	close(done)
+}
@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"errors"
+	"time"
+)
+
+// keepAliveRequestType is the OpenSSH keepalive request. Servers answer it
+// without side effects, so its reply proves the connection is alive.
+const keepAliveRequestType = "keepalive@openssh.com"
+
+// errKeepAliveTimeout reports a keepalive that got no reply within the interval.
+var errKeepAliveTimeout = errors.New("no keepalive reply")
+
+// DefaultKeepAliveInterval is the keepalive interval of tunnelfy-client.
+const DefaultKeepAliveInterval = 30 * time.Second
+
+// keepAlive sends a keepalive request every KeepAliveInterval until the
+// connection ends. A request that fails, or gets no reply within the interval,
+// means the connection is dead (e.g. dropped by a NAT or firewall); it is
+// closed so that Done fires and the caller can reconnect. Any reply counts as
+// alive: OpenSSH servers answer keepalives with a failure.
+func (c *Client) keepAlive() {
+	defer c.wg.Done()
+	interval := c.config.KeepAliveInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := c.conn.SendRequest(keepAliveRequestType, true, nil)
+			replied <- err
+		}()
+
+		timer := time.NewTimer(interval)
+		var err error
+		select {
+		case err = <-replied:
+		case <-timer.C:
+			err = errKeepAliveTimeout
+		case <-c.done:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+		if err != nil {
+			c.config.Logger.Printf("Keepalive failed, closing dead connection: %v", err)
+			c.conn.Close()
+			return
+		}
+	}
+}
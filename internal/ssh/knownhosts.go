@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyChanged is returned by Connect when the server presents a host
+// key other than the one recorded in the known_hosts file, which may mean the
+// connection is being intercepted.
+var ErrHostKeyChanged = errors.New("server host key changed")
+
+// ErrHostKeyUnknown is returned by Connect when the server isn't in the
+// known_hosts file and its key was neither trusted on first use nor accepted
+// through HostKeyPrompt.
+var ErrHostKeyUnknown = errors.New("server host key unknown")
+
+// ErrNoHostKeyVerification is returned by Connect when the client has neither
+// a known_hosts file nor pinned keys to verify the server with and
+// InsecureIgnoreHostKey isn't set.
+var ErrNoHostKeyVerification = errors.New("no known_hosts file or pinned host keys to verify the server with")
+
+// pinnedHostKeys parses PinnedHostKeys into a set of fingerprints.
+func (c *Client) pinnedHostKeys() (map[string]bool, error) {
+	pins := make(map[string]bool, len(c.config.PinnedHostKeys))
+	for _, p := range c.config.PinnedHostKeys {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "SHA256:") || len(p) == len("SHA256:") {
+			return nil, fmt.Errorf("pinned host key %q is not a SHA256 fingerprint (SHA256:...)", p)
+		}
+		pins[p] = true
+	}
+	return pins, nil
+}
+
+// hostKeyCallback returns the HostKeyCallback verifying the server against
+// the client's known_hosts file and pinned keys. Without either it fails with
+// ErrNoHostKeyVerification, unless InsecureIgnoreHostKey opts out of
+// verification.
+func (c *Client) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	pins, err := c.pinnedHostKeys()
+	if err != nil {
+		return nil, err
+	}
+	path := c.config.KnownHostsPath
+	if path == "" && len(pins) > 0 {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); !pins[fingerprint] {
+				return fmt.Errorf("%w for %s: got %s %s, which is not one of the pinned keys",
+					ErrHostKeyChanged, hostname, key.Type(), fingerprint)
+			}
+			return nil
+		}, nil
+	}
+	if path == "" {
+		if !c.config.InsecureIgnoreHostKey {
+			return nil, ErrNoHostKeyVerification
+		}
+		c.config.Logger.Printf("WARNING: no known_hosts file configured; the server's host key is not verified")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	// knownhosts.New requires the file to exist; a missing one just means no
+	// host is known yet.
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create known_hosts directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open known_hosts: %w", err)
+	}
+	f.Close()
+
+	known, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("load known_hosts %s: %w", path, err)
+	}
+	var mu sync.Mutex
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		switch {
+		case pins[fingerprint]:
+			// A pinned key is trusted even if known_hosts records another:
+			// that is a planned rotation, not an attack.
+			if len(keyErr.Want) > 0 {
+				c.config.Logger.Printf("Server %s rotated its host key to pinned %s %s", hostname, key.Type(), fingerprint)
+			}
+		case len(keyErr.Want) > 0:
+			want := keyErr.Want[0]
+			hint := "if the server's key was rotated on purpose, remove that line or pin the new key"
+			if len(pins) > 0 {
+				hint = "the new key is not one of the pinned keys, so this is not a planned rotation"
+			}
+			return fmt.Errorf("%w for %s: got %s %s, but %s:%d has %s %s; %s",
+				ErrHostKeyChanged, hostname, key.Type(), fingerprint,
+				want.Filename, want.Line, want.Key.Type(), ssh.FingerprintSHA256(want.Key), hint)
+		case len(pins) > 0:
+			return fmt.Errorf("%w: %s presented %s %s, which is neither in %s nor one of the pinned keys", ErrHostKeyUnknown, hostname, key.Type(), fingerprint, path)
+		default:
+			trusted := c.config.TrustOnFirstUse
+			if !trusted && c.config.HostKeyPrompt != nil {
+				trusted = c.config.HostKeyPrompt(hostname, key)
+			}
+			if !trusted {
+				return fmt.Errorf("%w: %s presented %s %s, which is not in %s", ErrHostKeyUnknown, hostname, key.Type(), fingerprint, path)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := appendKnownHost(path, hostname, key); err != nil {
+			return err
+		}
+		c.config.Logger.Printf("Added %s (%s %s) to %s", hostname, key.Type(), fingerprint, path)
+		return nil
+	}, nil
+}
+
+// appendKnownHost records key for hostname in the known_hosts file at path.
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open known_hosts: %w", err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("write known_hosts: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,149 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKeyVerification(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(other.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := knownhosts.Line([]string{knownhosts.Normalize(env.addr)}, otherKey) + "\n"
+
+	tests := []struct {
+		name       string
+		knownHosts string // contents; "-" leaves KnownHostsPath empty
+		insecure   bool
+		tofu       bool
+		wantErr    error
+	}{
+		{name: "no known_hosts", knownHosts: "-", wantErr: ErrNoHostKeyVerification},
+		{name: "no known_hosts, insecure", knownHosts: "-", insecure: true},
+		{name: "unknown host", wantErr: ErrHostKeyUnknown},
+		{name: "unknown host, trust on first use", tofu: true},
+		{name: "changed key", knownHosts: changed, tofu: true, wantErr: ErrHostKeyChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ClientConfig{
+				ServerAddress:         env.addr,
+				Username:              "alice",
+				KeyPath:               env.keyPath,
+				InsecureIgnoreHostKey: tt.insecure,
+				TrustOnFirstUse:       tt.tofu,
+				Logger:                log.New(io.Discard, "", 0),
+			}
+			if tt.knownHosts != "-" {
+				cfg.KnownHostsPath = filepath.Join(t.TempDir(), "known_hosts")
+				if err := os.WriteFile(cfg.KnownHostsPath, []byte(tt.knownHosts), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := NewClient(cfg)
+			_, err := c.Connect()
+			if err == nil {
+				c.Close()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Connect: err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPinnedHostKeys(t *testing.T) {
+	newKey := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	hostKey, oldKey, otherKey := newKey(), newKey(), newKey()
+	env := newTestEnv(t, ServerOptions{HostKey: hostKey})
+	fp := func(s ssh.Signer) string { return ssh.FingerprintSHA256(s.PublicKey()) }
+	recorded := func(s ssh.Signer) string {
+		return knownhosts.Line([]string{knownhosts.Normalize(env.addr)}, s.PublicKey()) + "\n"
+	}
+
+	tests := []struct {
+		name       string
+		pins       []string
+		knownHosts string // contents; empty leaves KnownHostsPath empty
+		wantErr    error
+		wantMsg    string
+	}{
+		{name: "matching pin", pins: []string{fp(hostKey)}},
+		{name: "rotation set, new key", pins: []string{fp(oldKey), fp(hostKey)}},
+		{name: "rotation set, old key", pins: []string{fp(hostKey), fp(otherKey)}},
+		{name: "mismatch", pins: []string{fp(oldKey), fp(otherKey)}, wantErr: ErrHostKeyChanged, wantMsg: "not one of the pinned keys"},
+		{name: "known_hosts rotated to pin", pins: []string{fp(hostKey)}, knownHosts: recorded(oldKey)},
+		{name: "known_hosts changed outside pins", pins: []string{fp(otherKey)}, knownHosts: recorded(oldKey), wantErr: ErrHostKeyChanged, wantMsg: "not a planned rotation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ClientConfig{
+				ServerAddress:  env.addr,
+				Username:       "alice",
+				KeyPath:        env.keyPath,
+				PinnedHostKeys: tt.pins,
+				Logger:         log.New(io.Discard, "", 0),
+			}
+			if tt.knownHosts != "" {
+				cfg.KnownHostsPath = filepath.Join(t.TempDir(), "known_hosts")
+				if err := os.WriteFile(cfg.KnownHostsPath, []byte(tt.knownHosts), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := NewClient(cfg)
+			_, err := c.Connect()
+			if err == nil {
+				c.Close()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Connect: err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("Connect: err = %v, want it to mention %q", err, tt.wantMsg)
+			}
+		})
+	}
+
+	t.Run("malformed pin", func(t *testing.T) {
+		c := NewClient(ClientConfig{
+			ServerAddress:  env.addr,
+			Username:       "alice",
+			KeyPath:        env.keyPath,
+			PinnedHostKeys: []string{"MD5:ab:cd"},
+			Logger:         log.New(io.Discard, "", 0),
+		})
+		_, err := c.Connect()
+		if err == nil {
+			c.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), "SHA256") {
+			t.Fatalf("Connect: err = %v, want a malformed pin error", err)
+		}
+	})
+}
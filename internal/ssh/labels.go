@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// labelsRequestType is the global request a client sends to attach metadata
+// labels to the tunnels it establishes afterwards. Its payload is a JSON
+// object of string labels.
+const labelsRequestType = "labels@tunnelfy"
+
+// Bounds on client-provided labels.
+const (
+	maxLabels          = 16
+	maxLabelKeyLen     = 63
+	maxLabelValueLen   = 255
+	maxLabelsPayloadSz = 8 << 10
+)
+
+// parseLabels decodes and validates a labels request payload. Keys are
+// lowercase letters, digits, '.', '_' and '-'; values are printable text.
+func parseLabels(payload []byte) (map[string]string, error) {
+	if len(payload) > maxLabelsPayloadSz {
+		return nil, fmt.Errorf("labels payload too large")
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(payload, &labels); err != nil {
+		return nil, fmt.Errorf("invalid labels payload: %w", err)
+	}
+	if len(labels) > maxLabels {
+		return nil, fmt.Errorf("too many labels: %d > %d", len(labels), maxLabels)
+	}
+	for k, v := range labels {
+		if !validLabelKey(k) {
+			return nil, fmt.Errorf("invalid label key %q", k)
+		}
+		if len(v) > maxLabelValueLen || strings.IndexFunc(v, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+			return nil, fmt.Errorf("invalid value for label %q", k)
+		}
+	}
+	if v, ok := labels[qosLabel]; ok {
+		if _, err := ParseQoSClass(v); err != nil {
+			return nil, err
+		}
+	}
+	return labels, nil
+}
+
+func validLabelKey(k string) bool {
+	if k == "" || len(k) > maxLabelKeyLen {
+		return false
+	}
+	for _, r := range k {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '.' && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// formatLabels renders labels as sorted "k=v" pairs for logs.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	var many []string
+	for i := range maxLabels + 1 {
+		many = append(many, fmt.Sprintf(`"k%d":"v"`, i))
+	}
+	tests := []struct {
+		name    string
+		payload string
+		wantErr bool
+	}{
+		{"valid", `{"env":"staging","app.name":"check-out_1"}`, false},
+		{"empty", `{}`, false},
+		{"qos class", `{"qos":"bulk"}`, false},
+		{"not an object", `["env"]`, true},
+		{"too many", "{" + strings.Join(many, ",") + "}", true},
+		{"uppercase key", `{"Env":"staging"}`, true},
+		{"empty key", `{"":"staging"}`, true},
+		{"long key", `{"` + strings.Repeat("k", maxLabelKeyLen+1) + `":"v"}`, true},
+		{"long value", `{"env":"` + strings.Repeat("v", maxLabelValueLen+1) + `"}`, true},
+		{"control character", `{"env":"a\nb"}`, true},
+		{"unknown qos class", `{"qos":"urgent"}`, true},
+		{"payload too large", `{"env":"` + strings.Repeat("v", maxLabelsPayloadSz) + `"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseLabels([]byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLabels(%.40q) error = %v, want error %v", tt.payload, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientLabelsReachRouteInfo(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	labels := map[string]string{"env": "staging", "app": "checkout"}
+	env.connect(t, "alice", ClientConfig{LocalServiceAddress: localService(t, "hello"), Labels: labels})
+
+	info, ok := env.manager.GetRouteInfo("alice." + testZone)
+	if !ok {
+		t.Fatal("no route for alice")
+	}
+	if !maps.Equal(info.Labels, labels) {
+		t.Fatalf("route labels = %v, want %v", info.Labels, labels)
+	}
+
+	c := env.dialRaw(t, "bob")
+	ok, reply, err := c.SendRequest(labelsRequestType, true, []byte(`{"Env":"staging"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || !strings.Contains(string(reply), "invalid label key") {
+		t.Fatalf("got ok=%v reply=%q, want invalid labels rejected", ok, reply)
+	}
+}
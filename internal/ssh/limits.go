@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// userConnWait is how long a connection waits for a slot when its user is at
+// the concurrent connection cap before it is refused.
+const userConnWait = 500 * time.Millisecond
+
+// connLimiter caps concurrent connections per user with one semaphore per user.
+type connLimiter struct {
+	max  int
+	wait time.Duration
+
+	mu   sync.Mutex
+	sems map[string]*userSem
+}
+
+// userSem is a user's semaphore; refs counts the connections holding or
+// waiting for a slot, and it is dropped from the limiter when none are left.
+type userSem struct {
+	slots chan struct{}
+	refs  int
+}
+
+// newConnLimiter returns a limiter allowing max concurrent connections per
+// user; max <= 0 disables limiting.
+func newConnLimiter(max int, wait time.Duration) *connLimiter {
+	return &connLimiter{max: max, wait: wait, sems: make(map[string]*userSem)}
+}
+
+// acquire takes a connection slot for user, waiting up to the limiter's wait
+// for one to free up. It returns a release func, or false if no slot was free.
+func (l *connLimiter) acquire(user string) (release func(), ok bool) {
+	if l.max <= 0 {
+		return func() {}, true
+	}
+	sem := l.ref(user)
+	select {
+	case sem.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case sem.slots <- struct{}{}:
+		case <-timer.C:
+			l.unref(user, sem)
+			return nil, false
+		}
+	}
+	return func() {
+		<-sem.slots
+		l.unref(user, sem)
+	}, true
+}
+
+// ref returns user's semaphore, creating it if needed, and counts a reference.
+func (l *connLimiter) ref(user string) *userSem {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.sems[user]
+	if !ok {
+		sem = &userSem{slots: make(chan struct{}, l.max)}
+		l.sems[user] = sem
+	}
+	sem.refs++
+	return sem
+}
+
+// unref drops a reference to sem, deleting it once it has none.
+func (l *connLimiter) unref(user string, sem *userSem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem.refs--
+	if sem.refs == 0 {
+		delete(l.sems, user)
+	}
+}
+
+// evictWait bounds how long a connection waits for the one it evicted to
+// clean up its tunnels, so that cleanup can't remove routes it registers.
+const evictWait = 5 * time.Second
+
+// connLimitRejectWindow is how long a connection refused by the SSH
+// connection cap stays open to tell its client why through request replies.
+const connLimitRejectWindow = 5 * time.Second
+
+// trackedConn is an SSH connection registered with a connTracker.
+type trackedConn struct {
+	conn ssh.Conn
+	// done is closed once the connection's tunnels have been cleaned up.
+	done chan struct{}
+	// lastActive is the UnixNano time of the connection's last global request.
+	lastActive atomic.Int64
+}
+
+func (c *trackedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// connTracker caps concurrent SSH connections per user. At the cap a new
+// connection is refused or, with evict set, replaces the user's connection
+// that has been idle the longest.
+type connTracker struct {
+	max   int
+	evict bool
+
+	mu    sync.Mutex
+	conns map[string][]*trackedConn
+}
+
+// newConnTracker returns a tracker allowing max SSH connections per user;
+// max <= 0 disables the cap.
+func newConnTracker(max int, evict bool) *connTracker {
+	return &connTracker{max: max, evict: evict, conns: make(map[string][]*trackedConn)}
+}
+
+// add registers conn for user. At the cap it returns ok false, or, when
+// evicting, the connection it displaced, which the caller must close.
+func (t *connTracker) add(user string, conn ssh.Conn) (tc, evicted *trackedConn, ok bool) {
+	tc = &trackedConn{conn: conn, done: make(chan struct{})}
+	tc.touch()
+	if t.max <= 0 {
+		return tc, nil, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := t.conns[user]
+	if len(conns) >= t.max {
+		if !t.evict {
+			return nil, nil, false
+		}
+		oldest := 0
+		for i, c := range conns {
+			if c.lastActive.Load() < conns[oldest].lastActive.Load() {
+				oldest = i
+			}
+		}
+		evicted = conns[oldest]
+		conns = append(conns[:oldest], conns[oldest+1:]...)
+	}
+	t.conns[user] = append(conns, tc)
+	return tc, evicted, true
+}
+
+// remove unregisters tc; removing a connection that was evicted is a no-op.
+func (t *connTracker) remove(user string, tc *trackedConn) {
+	if t.max <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := t.conns[user]
+	for i, c := range conns {
+		if c == tc {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(t.conns, user)
+	} else {
+		t.conns[user] = conns
+	}
+}
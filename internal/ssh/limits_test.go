@@ -0,0 +1,214 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// limiterUsers returns how many users l holds a semaphore for.
+func limiterUsers(l *connLimiter) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.sems)
+}
+
+func TestConnLimiterForgetsIdleUsers(t *testing.T) {
+	l := newConnLimiter(2, 10*time.Millisecond)
+	var wg sync.WaitGroup
+	for i := range 50 {
+		user := fmt.Sprintf("user%d", i%5)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Some of these time out at the cap, which must drop their
+			// reference too.
+			if release, ok := l.acquire(user); ok {
+				time.Sleep(time.Millisecond)
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+	if n := limiterUsers(l); n != 0 {
+		t.Fatalf("limiter holds %d users after every slot was released", n)
+	}
+
+	release, ok := l.acquire("alice")
+	if !ok {
+		t.Fatal("acquire after cleanup failed")
+	}
+	if n := limiterUsers(l); n != 1 {
+		t.Fatalf("limiter holds %d users, want 1", n)
+	}
+	release()
+	if n := limiterUsers(l); n != 0 {
+		t.Fatalf("limiter holds %d users after release", n)
+	}
+}
+
+func TestTunnelLimiterEmptiesWhenConnectionsClose(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{MaxTunnelsPerUser: 2})
+	for i := range 10 {
+		c := env.dialRaw(t, fmt.Sprintf("user%d", i))
+		forward(t, c, "app")
+		forward(t, c, "api")
+		c.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for limiterUsers(env.srv.userTunnels) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel limiter still holds %d users", limiterUsers(env.srv.userTunnels))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxTunnelsPerUser(t *testing.T) {
+	const limit = 3
+	env := newTestEnv(t, ServerOptions{MaxTunnelsPerUser: limit})
+	conns := []*ssh.Client{env.dialRaw(t, "alice"), env.dialRaw(t, "alice")}
+
+	// Race more forwards than the limit across both of alice's connections.
+	type accepted struct {
+		c     *ssh.Client
+		label string
+		port  uint32
+	}
+	var (
+		mu   sync.Mutex
+		won  []accepted
+		wg   sync.WaitGroup
+		errs = make(chan error, 4*limit)
+	)
+	for i := range 4 * limit {
+		c, label := conns[i%len(conns)], fmt.Sprintf("app%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, reply, err := c.SendRequest("tcpip-forward", true, forwardPayload(label, 0))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if ok {
+				mu.Lock()
+				won = append(won, accepted{c, label, binary.BigEndian.Uint32(reply)})
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if len(won) != limit {
+		t.Fatalf("%d forwards accepted, want %d", len(won), limit)
+	}
+	if ok, _, _ := conns[0].SendRequest("tcpip-forward", true, forwardPayload("extra", 0)); ok {
+		t.Fatal("forward over the limit accepted")
+	}
+	if ok, _, _ := env.dialRaw(t, "bob").SendRequest("tcpip-forward", true, forwardPayload("app", 0)); !ok {
+		t.Fatal("another user's forward rejected by alice's limit")
+	}
+
+	// Cancelling a tunnel frees its slot.
+	first := won[0]
+	if ok, _, err := first.c.SendRequest("cancel-tcpip-forward", true, forwardPayload(first.label, first.port)); err != nil || !ok {
+		t.Fatalf("cancel-tcpip-forward: ok=%v err=%v", ok, err)
+	}
+	c := conns[0]
+	if ok, _, _ := c.SendRequest("tcpip-forward", true, forwardPayload("after-cancel", 0)); !ok {
+		t.Fatal("forward rejected after a cancel freed a slot")
+	}
+
+	// Closing a connection frees every slot its tunnels held, and only those.
+	conns[1].Close()
+	held := 1 // after-cancel
+	for _, a := range won[1:] {
+		if a.c == conns[0] {
+			held++
+		}
+	}
+	for i := range limit - held {
+		label := fmt.Sprintf("after-close%d", i)
+		waitFor(t, "a slot freed by the closed connection", func() bool {
+			ok, _, _ := c.SendRequest("tcpip-forward", true, forwardPayload(label, 0))
+			return ok
+		})
+	}
+	if ok, _, _ := c.SendRequest("tcpip-forward", true, forwardPayload("over", 0)); ok {
+		t.Fatal("forward over the limit accepted after the other connection closed")
+	}
+}
+
+func TestUserSSHConnLimit(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{MaxUserSSHConns: 2})
+	first := env.dialRaw(t, "alice")
+	forward(t, first, "one")
+	forward(t, env.dialRaw(t, "alice"), "two")
+
+	over := env.dialRaw(t, "alice")
+	ok, reply, err := over.SendRequest("tcpip-forward", true, forwardPayload("three", 0))
+	if ok || err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("third connection: ok=%v err=%v, want it refused", ok, err)
+	}
+	if err == nil && !strings.Contains(string(reply), "too many SSH connections") {
+		t.Fatalf("third connection refused with %q", reply)
+	}
+
+	// The cap is per user.
+	forward(t, env.dialRaw(t, "bob"), "app")
+
+	// Closing a connection frees its slot.
+	first.Close()
+	waitFor(t, "a free slot", func() bool {
+		c, err := ssh.Dial("tcp", env.addr, env.clientConfig("alice"))
+		if err != nil {
+			return false
+		}
+		ok, _, _ := c.SendRequest("tcpip-forward", true, forwardPayload("three", 0))
+		if !ok {
+			c.Close()
+			return false
+		}
+		t.Cleanup(func() { c.Close() })
+		return true
+	})
+}
+
+func TestUserSSHConnLimitEvictsIdlest(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{MaxUserSSHConns: 2, EvictIdleSSHConns: true})
+	idle := env.dialRaw(t, "alice")
+	forward(t, idle, "one")
+	active := env.dialRaw(t, "alice")
+	forward(t, active, "two")
+	time.Sleep(5 * time.Millisecond)
+	if _, _, err := active.SendRequest(keepAliveRequestType, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	forward(t, env.dialRaw(t, "alice"), "three")
+	closed := make(chan error, 1)
+	go func() { closed <- idle.Wait() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idlest connection wasn't evicted")
+	}
+	if _, _, err := active.SendRequest(keepAliveRequestType, true, nil); err != nil {
+		t.Fatalf("the active connection was evicted: %v", err)
+	}
+	waitFor(t, "the evicted connection's tunnel removed", func() bool {
+		_, ok := env.manager.GetRouteInfo("one.alice." + testZone)
+		return !ok
+	})
+}
@@ -0,0 +1,47 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+)
+
+// The loopback ports tunnel listeners are bound to when the client lets the
+// server choose. The range stays below Linux's default ephemeral range
+// (32768-60999), so tunnel listeners don't take the ports the kernel picks for
+// outgoing connections, such as the proxy's own dials to them.
+const (
+	tunnelPortLo = 16384
+	tunnelPortHi = 32767
+)
+
+// maxPortProbes bounds how many taken ports listenLoopback skips before
+// leaving the choice to the OS.
+const maxPortProbes = 32
+
+// nextTunnelPort is the cursor listenLoopback hands out ports from.
+var nextTunnelPort atomic.Uint32
+
+// listenLoopback listens on 127.0.0.1:port. For port "0" it binds the next
+// free port of its range itself rather than asking the OS for one:
+// the kernel searches its ephemeral range on each such bind, which grows
+// slow with thousands of tunnel listeners bound, while binding a given port
+// is a single lookup.
+func listenLoopback(port string) (net.Listener, error) {
+	if port != "0" {
+		return net.Listen("tcp", "127.0.0.1:"+port)
+	}
+	for i := 0; i < maxPortProbes; i++ {
+		p := tunnelPortLo + nextTunnelPort.Add(1)%(tunnelPortHi-tunnelPortLo+1)
+		l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(int(p)))
+		if err == nil {
+			return l, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return net.Listen("tcp", "127.0.0.1:0")
+}
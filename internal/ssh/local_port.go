@@ -0,0 +1,80 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// localPortRequestType is the global request a client sends to declare the
+// port of the local service its next forwards map to, which the forwards
+// themselves don't carry. Its payload is the port in decimal. The server
+// enforces ServerOptions.UpstreamPorts on it; the declaration can't be
+// verified, so the policy keeps honest clients from exposing sensitive
+// services by mistake rather than stopping a hostile one.
+const localPortRequestType = "local-port@tunnelfy"
+
+// errLocalPortRequired rejects forwards that don't declare their local port
+// on a server restricting local ports, such as plain `ssh -R` forwards.
+var errLocalPortRequired = errors.New("this server restricts the local ports tunnels may expose; declare the local port first (tunnelfy-client does)")
+
+// handleLocalPort serves a local port request, replacing the local port of
+// the session's subsequent tunnels.
+func (s *SSHServer) handleLocalPort(req *request, sess *session) {
+	port, err := parsePort(string(req.Payload))
+	if err != nil {
+		if s.logRequests {
+			s.log.Debug("rejecting local port", "user", logsafe.String(sess.username), "err", err)
+		}
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	sess.localPort = port
+	req.Reply(true, nil)
+}
+
+// portAllowed applies ServerOptions.UpstreamPorts to the port the forward
+// requests, unless the client left it to the server, and to the local port
+// the session declared. Without a declared local port the forward is
+// rejected with errLocalPortRequired whenever the policy restricts anything.
+func (s *SSHServer) portAllowed(requestedPort string, sess *session) error {
+	port, err := strconv.ParseUint(requestedPort, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", requestedPort)
+	}
+	policy := s.opts.UpstreamPorts
+	if port != 0 && !policy.Allows(uint32(port)) {
+		return fmt.Errorf("port %d is not allowed on this server", port)
+	}
+	if !policy.restricts() {
+		return nil
+	}
+	if sess.localPort == 0 {
+		return errLocalPortRequired
+	}
+	if !policy.Allows(sess.localPort) {
+		return fmt.Errorf("local port %d is not allowed on this server", sess.localPort)
+	}
+	return nil
+}
+
+// sendLocalPort declares the port of localAddr for the forward requested
+// next. Servers predating the request refuse it without a reason, which is
+// ignored: they don't restrict local ports.
+func (c *Client) sendLocalPort(localAddr string) error {
+	_, port, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return fmt.Errorf("invalid local address %q: %w", localAddr, err)
+	}
+	ok, reply, err := c.conn.SendRequest(localPortRequestType, true, []byte(port))
+	if err != nil {
+		return fmt.Errorf("failed to send local port: %w", err)
+	}
+	if !ok && len(reply) > 0 {
+		return fmt.Errorf("server rejected local port: %s", reply)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnelfy/internal/metrics"
+)
+
+func TestRejectionCounters(t *testing.T) {
+	policy, err := ParsePortPolicy("", "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, ServerOptions{UpstreamPorts: policy})
+
+	t.Run("unauthorized key", func(t *testing.T) {
+		keys, failures := metrics.SSHUnauthorizedKeys.Value(), metrics.SSHHandshakeFailures.Value()
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := env.clientConfig("alice")
+		cfg.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+		if c, err := ssh.Dial("tcp", env.addr, cfg); err == nil {
+			c.Close()
+			t.Fatal("an unauthorized key was accepted")
+		}
+		if got := metrics.SSHUnauthorizedKeys.Value(); got != keys+1 {
+			t.Errorf("unauthorized keys = %d, want %d", got, keys+1)
+		}
+		waitFor(t, "the handshake failure to be counted", func() bool {
+			return metrics.SSHHandshakeFailures.Value() == failures+1
+		})
+	})
+
+	t.Run("handshake failure", func(t *testing.T) {
+		failures := metrics.SSHHandshakeFailures.Value()
+		conn, err := net.Dial("tcp", env.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		conn.Close()
+		waitFor(t, "the handshake failure to be counted", func() bool {
+			return metrics.SSHHandshakeFailures.Value() == failures+1
+		})
+	})
+
+	c := env.dialRaw(t, "alice")
+	forwards := []struct {
+		reason  string
+		payload []byte
+	}{
+		{metrics.ForwardRejectMalformed, []byte{0, 0}},
+		{metrics.ForwardRejectInvalidSubdomain, forwardPayload("not_a_label", 0)},
+		{metrics.ForwardRejectPortDenied, forwardPayload("app", 9090)},
+	}
+	for _, f := range forwards {
+		t.Run("forward "+f.reason, func(t *testing.T) {
+			before := metrics.SSHForwardsRejected.Value(f.reason)
+			ok, _, err := c.SendRequest("tcpip-forward", true, f.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				t.Fatal("forward accepted")
+			}
+			if got := metrics.SSHForwardsRejected.Value(f.reason); got != before+1 {
+				t.Fatalf("rejected forwards{reason=%q} = %d, want %d", f.reason, got, before+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package ssh
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of TCP ports.
+type portRange struct{ lo, hi uint32 }
+
+// PortPolicy restricts which upstream ports tunnels may expose. A port must
+// match the allowlist, when one is set, and must not match the denylist.
+type PortPolicy struct {
+	allow []portRange
+	deny  []portRange
+}
+
+// ParsePortPolicy parses comma-separated allow and deny lists of ports and
+// port ranges, e.g. "80,443,8000-8999". Empty lists impose no restriction.
+func ParsePortPolicy(allow, deny string) (*PortPolicy, error) {
+	p := &PortPolicy{}
+	var err error
+	if p.allow, err = parsePortRanges(allow); err != nil {
+		return nil, fmt.Errorf("allowed ports: %w", err)
+	}
+	if p.deny, err = parsePortRanges(deny); err != nil {
+		return nil, fmt.Errorf("denied ports: %w", err)
+	}
+	return p, nil
+}
+
+func parsePortRanges(spec string) ([]portRange, error) {
+	var ranges []portRange
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		loStr, hiStr, isRange := strings.Cut(field, "-")
+		lo, err := parsePort(loStr)
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if isRange {
+			if hi, err = parsePort(hiStr); err != nil {
+				return nil, err
+			}
+			if hi < lo {
+				return nil, fmt.Errorf("invalid port range %q", field)
+			}
+		}
+		ranges = append(ranges, portRange{lo, hi})
+	}
+	return ranges, nil
+}
+
+func parsePort(s string) (uint32, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint32(n), nil
+}
+
+// Allows reports whether port may be exposed. A nil policy allows every port.
+func (p *PortPolicy) Allows(port uint32) bool {
+	if p == nil {
+		return true
+	}
+	if len(p.allow) > 0 && !inRanges(p.allow, port) {
+		return false
+	}
+	return !inRanges(p.deny, port)
+}
+
+func inRanges(ranges []portRange, port uint32) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// restricts reports whether the policy rejects any port.
+func (p *PortPolicy) restricts() bool {
+	return p != nil && (len(p.allow) > 0 || len(p.deny) > 0)
+}
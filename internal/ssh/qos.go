@@ -0,0 +1,150 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// QoSClass is the priority class of a tunnel under load. Higher classes are
+// treated better: bulk tunnels are throttled first and only interactive
+// tunnels get new connections once the server is full.
+type QoSClass int
+
+const (
+	QoSBulk QoSClass = iota
+	QoSStandard
+	QoSInteractive
+)
+
+// qosLabel is the label a client sets to request a QoS class for its tunnels.
+const qosLabel = "qos"
+
+func (c QoSClass) String() string {
+	switch c {
+	case QoSBulk:
+		return "bulk"
+	case QoSInteractive:
+		return "interactive"
+	default:
+		return "standard"
+	}
+}
+
+// ParseQoSClass parses "bulk", "standard" or "interactive".
+func ParseQoSClass(s string) (QoSClass, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "bulk":
+		return QoSBulk, nil
+	case "standard":
+		return QoSStandard, nil
+	case "interactive":
+		return QoSInteractive, nil
+	}
+	return 0, fmt.Errorf("unknown QoS class %q (want bulk, standard or interactive)", s)
+}
+
+// ParseQoSClasses parses "user=class" entries into a map of user to class.
+func ParseQoSClasses(specs []string) (map[string]QoSClass, error) {
+	classes := make(map[string]QoSClass, len(specs))
+	for _, spec := range specs {
+		user, class, ok := strings.Cut(spec, "=")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("entries must be user=class, got %q", spec)
+		}
+		c, err := ParseQoSClass(class)
+		if err != nil {
+			return nil, err
+		}
+		classes[user] = c
+	}
+	return classes, nil
+}
+
+// QoSOptions configures differentiated treatment of tunnels under load.
+type QoSOptions struct {
+	// Classes assigns QoS classes to users; other users are standard. A
+	// client may lower its tunnels' class with the "qos" label, but never
+	// raise it above its assigned class.
+	Classes map[string]QoSClass
+
+	// MaxConns is the server-wide budget of concurrent tunneled connections
+	// that QoS applies to; zero disables QoS. From three quarters of it on the
+	// server is saturated and bulk connections are throttled to BulkRate;
+	// at MaxConns only interactive connections are admitted.
+	MaxConns int
+	// BulkRate is the throughput, in bytes per second per direction, of each
+	// bulk connection while the server is saturated.
+	BulkRate int64
+}
+
+// qosScheduler tracks the server's tunneled connections for QoS.
+type qosScheduler struct {
+	opts   QoSOptions
+	active atomic.Int64
+}
+
+func newQoSScheduler(opts QoSOptions) *qosScheduler {
+	return &qosScheduler{opts: opts}
+}
+
+// classFor returns the class of a tunnel of user that requested class
+// requested (empty for none).
+func (q *qosScheduler) classFor(user, requested string) QoSClass {
+	class, ok := q.opts.Classes[user]
+	if !ok {
+		class = QoSStandard
+	}
+	if r, err := ParseQoSClass(requested); err == nil && r < class {
+		class = r
+	}
+	return class
+}
+
+// admit takes a connection slot for a connection of class. Interactive
+// connections are always admitted; others are refused once MaxConns are
+// active. It returns a release func, or false if the connection is refused.
+func (q *qosScheduler) admit(class QoSClass) (release func(), ok bool) {
+	if q.opts.MaxConns <= 0 {
+		return func() {}, true
+	}
+	n := q.active.Add(1)
+	if class < QoSInteractive && n > int64(q.opts.MaxConns) {
+		q.active.Add(-1)
+		return nil, false
+	}
+	return func() { q.active.Add(-1) }, true
+}
+
+// saturated reports whether the server is loaded enough to throttle bulk
+// connections.
+func (q *qosScheduler) saturated() bool {
+	if q.opts.MaxConns <= 0 {
+		return false
+	}
+	return q.active.Load()*4 >= int64(q.opts.MaxConns)*3
+}
+
+// throttle returns the writer a connection of class writes through: bulk
+// connections are slowed to BulkRate while the server is saturated.
+func (q *qosScheduler) throttle(class QoSClass, w io.Writer) io.Writer {
+	if class != QoSBulk || q.opts.MaxConns <= 0 || q.opts.BulkRate <= 0 {
+		return w
+	}
+	return &bulkWriter{w: w, q: q}
+}
+
+// bulkWriter paces writes of a bulk connection while the server is saturated.
+type bulkWriter struct {
+	w io.Writer
+	q *qosScheduler
+}
+
+func (b *bulkWriter) Write(p []byte) (int, error) {
+	if b.q.saturated() {
+		time.Sleep(time.Duration(int64(len(p)) * int64(time.Second) / b.q.opts.BulkRate))
+	}
+	return b.w.Write(p)
+}
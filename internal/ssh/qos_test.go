@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestQoSClassFor(t *testing.T) {
+	classes, err := ParseQoSClasses([]string{"alice=interactive", "bob=bulk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newQoSScheduler(QoSOptions{Classes: classes})
+	tests := []struct {
+		user, requested string
+		want            QoSClass
+	}{
+		{"alice", "", QoSInteractive},
+		{"alice", "bulk", QoSBulk},
+		{"bob", "interactive", QoSBulk},
+		{"carol", "", QoSStandard},
+		{"carol", "interactive", QoSStandard},
+		{"carol", "bulk", QoSBulk},
+		{"carol", "bogus", QoSStandard},
+	}
+	for _, tt := range tests {
+		if got := q.classFor(tt.user, tt.requested); got != tt.want {
+			t.Errorf("classFor(%s, %q) = %v, want %v", tt.user, tt.requested, got, tt.want)
+		}
+	}
+	if _, err := ParseQoSClasses([]string{"alice=urgent"}); err == nil {
+		t.Error("unknown class accepted")
+	}
+}
+
+func TestQoSAdmit(t *testing.T) {
+	q := newQoSScheduler(QoSOptions{MaxConns: 2})
+	var releases []func()
+	for range 2 {
+		release, ok := q.admit(QoSStandard)
+		if !ok {
+			t.Fatal("connection under the budget refused")
+		}
+		releases = append(releases, release)
+	}
+	for _, class := range []QoSClass{QoSBulk, QoSStandard} {
+		if _, ok := q.admit(class); ok {
+			t.Fatalf("%v connection admitted over the budget", class)
+		}
+	}
+	release, ok := q.admit(QoSInteractive)
+	if !ok {
+		t.Fatal("interactive connection refused over the budget")
+	}
+	release()
+	releases[0]()
+	if _, ok := q.admit(QoSBulk); !ok {
+		t.Fatal("bulk connection refused after a slot freed up")
+	}
+}
+
+func TestQoSThrottlesBulkFirst(t *testing.T) {
+	const (
+		rate = 100_000
+		size = rate / 5 // 200ms at the bulk rate
+	)
+	q := newQoSScheduler(QoSOptions{MaxConns: 4, BulkRate: rate})
+	write := func(class QoSClass) time.Duration {
+		start := time.Now()
+		if _, err := q.throttle(class, io.Discard).Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	if d := write(QoSBulk); d > 50*time.Millisecond {
+		t.Fatalf("bulk write took %v before saturation, want it unthrottled", d)
+	}
+	// Three of four connections saturate the server.
+	for range 3 {
+		release, _ := q.admit(QoSStandard)
+		defer release()
+	}
+	if d := write(QoSBulk); d < 150*time.Millisecond {
+		t.Fatalf("bulk write took %v while saturated, want about 200ms", d)
+	}
+	for _, class := range []QoSClass{QoSStandard, QoSInteractive} {
+		if d := write(class); d > 50*time.Millisecond {
+			t.Fatalf("%v write took %v while saturated, want it unthrottled", class, d)
+		}
+	}
+}
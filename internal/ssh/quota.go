@@ -0,0 +1,133 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Authorized keys options carrying a key's quota, e.g.
+//
+//	expiry-time="20270101",tunnelfy-max-tunnels="3",tunnelfy-bandwidth="1000000" ssh-ed25519 AAAA... alice
+//
+// expiry-time has the OpenSSH syntax, YYYYMMDD[HHMM[SS]], in UTC. Other
+// options, such as OpenSSH's own, are ignored.
+const (
+	optionExpiryTime = "expiry-time"
+	optionMaxTunnels = "tunnelfy-max-tunnels"
+	optionBandwidth  = "tunnelfy-bandwidth"
+)
+
+// errKeyExpired rejects authentication with a key past its expiry-time.
+var errKeyExpired = errors.New("authorized key expired")
+
+// KeyQuota holds the limits an authorized key's options put on it.
+type KeyQuota struct {
+	// Expires is when the key stops being accepted; zero never.
+	Expires time.Time
+	// MaxTunnels caps the key's open tunnels across all its connections and
+	// usernames; zero is unlimited.
+	MaxTunnels int
+	// Bandwidth caps the throughput of each of the key's HTTP tunnels, in
+	// bytes per second; zero is unlimited.
+	Bandwidth int64
+}
+
+// expired reports whether the key has expired at now.
+func (q KeyQuota) expired(now time.Time) bool {
+	return !q.Expires.IsZero() && !now.Before(q.Expires)
+}
+
+// AuthorizedKey is an authorized public key and the quota of its line.
+type AuthorizedKey struct {
+	ssh.PublicKey
+	Quota KeyQuota
+	// User, if set, is the only username the key may log in as.
+	User string
+}
+
+// parseKeyQuota reads the quota options of an authorized keys line.
+func parseKeyQuota(options []string) (KeyQuota, error) {
+	var q KeyQuota
+	for _, opt := range options {
+		name, value, _ := strings.Cut(opt, "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(name) {
+		case optionExpiryTime:
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return KeyQuota{}, err
+			}
+			q.Expires = t
+		case optionMaxTunnels:
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return KeyQuota{}, fmt.Errorf("%s must be a positive integer, got %q", optionMaxTunnels, value)
+			}
+			q.MaxTunnels = n
+		case optionBandwidth:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return KeyQuota{}, fmt.Errorf("%s must be a positive number of bytes per second, got %q", optionBandwidth, value)
+			}
+			q.Bandwidth = n
+		}
+	}
+	return q, nil
+}
+
+// parseExpiryTime parses an OpenSSH expiry-time, YYYYMMDD[HHMM[SS]], as UTC.
+func parseExpiryTime(s string) (time.Time, error) {
+	s = strings.TrimSuffix(s, "Z")
+	var layout string
+	switch len(s) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("%s must be YYYYMMDD[HHMM[SS]], got %q", optionExpiryTime, s)
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be YYYYMMDD[HHMM[SS]], got %q", optionExpiryTime, s)
+	}
+	return t, nil
+}
+
+// keyTunnels counts each key's open tunnels against its quota's MaxTunnels.
+type keyTunnels struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+// acquire takes a tunnel slot for key if it holds fewer than max, returning
+// a release func. A max of zero is unlimited.
+func (k *keyTunnels) acquire(key string, max int) (release func(), ok bool) {
+	if max <= 0 || key == "" {
+		return func() {}, true
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.m[key] >= max {
+		return nil, false
+	}
+	if k.m == nil {
+		k.m = make(map[string]int)
+	}
+	k.m[key]++
+	return func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if k.m[key]--; k.m[key] <= 0 {
+			delete(k.m, key)
+		}
+	}, true
+}
@@ -0,0 +1,104 @@
+package ssh
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// setQuota makes the test key of env carry q.
+func (e *testEnv) setQuota(t *testing.T, q KeyQuota) {
+	t.Helper()
+	keys := map[string]AuthorizedKey{
+		string(ssh.MarshalAuthorizedKey(e.signer.PublicKey())): {PublicKey: e.signer.PublicKey(), Quota: q},
+	}
+	if err := e.srv.SetAuthorizedKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseKeyQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		want    KeyQuota
+		wantErr bool
+	}{
+		{name: "none", options: nil},
+		{name: "other options", options: []string{"no-pty", `from="10.0.0.0/8"`}},
+		{
+			name:    "all",
+			options: []string{`expiry-time="20270101"`, `tunnelfy-max-tunnels="3"`, `tunnelfy-bandwidth="1000"`},
+			want:    KeyQuota{Expires: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), MaxTunnels: 3, Bandwidth: 1000},
+		},
+		{name: "expiry with time", options: []string{`expiry-time="202701021504"`}, want: KeyQuota{Expires: time.Date(2027, 1, 2, 15, 4, 0, 0, time.UTC)}},
+		{name: "bad expiry", options: []string{`expiry-time="2027"`}, wantErr: true},
+		{name: "zero tunnels", options: []string{`tunnelfy-max-tunnels="0"`}, wantErr: true},
+		{name: "bad bandwidth", options: []string{`tunnelfy-bandwidth="fast"`}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyQuota(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !got.Expires.Equal(tt.want.Expires) || got.MaxTunnels != tt.want.MaxTunnels || got.Bandwidth != tt.want.Bandwidth {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiredKeyRejected(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	env.setQuota(t, KeyQuota{Expires: time.Now().Add(-time.Hour)})
+
+	var logs bytes.Buffer
+	c := NewClient(ClientConfig{
+		ServerAddress:         env.addr,
+		Username:              "alice",
+		KeyPath:               env.keyPath,
+		InsecureIgnoreHostKey: true,
+		Logger:                log.New(&logs, "", 0),
+	})
+	if _, err := c.Connect(); err == nil {
+		c.Close()
+		t.Fatal("Connect succeeded with an expired key")
+	}
+	// The rejection banner reaches the client's logger.
+	if !strings.Contains(logs.String(), "this key expired") {
+		t.Fatalf("client logs %q don't explain the rejection", logs.String())
+	}
+}
+
+func TestKeyQuotaEnforced(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	env.setQuota(t, KeyQuota{MaxTunnels: 2, Bandwidth: 4096})
+	// The quota spans the key's connections.
+	first := env.dialRaw(t, "alice")
+	second := env.dialRaw(t, "bob")
+	forward(t, first, "app")
+	forward(t, second, "app")
+
+	ok, reply, err := second.SendRequest("tcpip-forward", true, forwardPayload("api", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || !strings.Contains(string(reply), "at most 2 tunnels") {
+		t.Fatalf("third tunnel: ok=%v reply=%q, want the key's tunnel limit", ok, reply)
+	}
+	if info, _ := env.manager.GetRouteInfo("app.alice." + testZone); info.BandwidthLimit != 4096 {
+		t.Fatalf("route bandwidth limit = %d, want the key's 4096", info.BandwidthLimit)
+	}
+
+	// Closing a tunnel frees its slot.
+	first.Close()
+	waitFor(t, "the tunnel slot to free up", func() bool {
+		ok, _, err := second.SendRequest("tcpip-forward", true, forwardPayload("api", 0))
+		return err == nil && ok
+	})
+}
@@ -0,0 +1,194 @@
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Reservations maps subdomains directly under the zone ("api" for
+// "api.<zone>") to the user owning them, even while that user is offline.
+// The owner gets "<name>.<zone>" by requesting the label name; nobody else,
+// including a user called name, can take it.
+type Reservations struct {
+	mu     sync.RWMutex
+	owners map[string]string
+	// path is the JSON file changes are saved to; empty keeps them in memory.
+	path string
+}
+
+// NewReservations loads the reservations saved at path, if any, and adds the
+// "name=user" entries of specs on top. An empty path disables persistence.
+func NewReservations(specs []string, path string) (*Reservations, error) {
+	r := &Reservations{owners: make(map[string]string), path: path}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &r.owners); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	for _, spec := range specs {
+		name, owner, ok := strings.Cut(spec, "=")
+		if !ok || owner == "" {
+			return nil, fmt.Errorf("reservation %q must be name=user", spec)
+		}
+		name = strings.ToLower(name)
+		if !validLabel(name) {
+			return nil, fmt.Errorf("invalid reserved subdomain %q", name)
+		}
+		r.owners[name] = owner
+	}
+	return r, nil
+}
+
+// Owner returns the user owning name, if it is reserved.
+func (r *Reservations) Owner(name string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	owner, ok := r.owners[strings.ToLower(name)]
+	return owner, ok
+}
+
+// List returns a copy of the reservations, name -> owner.
+func (r *Reservations) List() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]string, len(r.owners))
+	for name, owner := range r.owners {
+		out[name] = owner
+	}
+	return out
+}
+
+// Reserve reserves name for owner, replacing any previous owner. A route
+// already registered for the name is left in place until its tunnel closes.
+func (r *Reservations) Reserve(name, owner string) error {
+	name = strings.ToLower(name)
+	if !validLabel(name) {
+		return fmt.Errorf("invalid subdomain %q", name)
+	}
+	if owner == "" {
+		return errors.New("owner is required")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev, had := r.owners[name]
+	r.owners[name] = owner
+	if err := r.save(); err != nil {
+		if had {
+			r.owners[name] = prev
+		} else {
+			delete(r.owners, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Release removes the reservation of name and reports whether there was one.
+func (r *Reservations) Release(name string) (bool, error) {
+	name = strings.ToLower(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	owner, ok := r.owners[name]
+	if !ok {
+		return false, nil
+	}
+	delete(r.owners, name)
+	if err := r.save(); err != nil {
+		r.owners[name] = owner
+		return false, err
+	}
+	return true, nil
+}
+
+// save writes the reservations to path, replacing the file atomically.
+// Callers hold r.mu.
+func (r *Reservations) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.owners, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".reservations-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// ReservationsAPIHandler serves /api/reservations: GET lists the reservations
+// as a JSON map of subdomain to owner.
+func ReservationsAPIHandler(r *Reservations) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(r.List())
+	}
+}
+
+// ReservationAPIHandler serves /api/reservations/{name}: PUT reserves the
+// subdomain for the user in the JSON body {"owner": ...}, DELETE releases it.
+func ReservationAPIHandler(r *Reservations) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := req.PathValue("name")
+		switch req.Method {
+		case http.MethodPut:
+			var body struct {
+				Owner string `json:"owner"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+				http.Error(w, "invalid JSON body", http.StatusBadRequest)
+				return
+			}
+			if err := r.Reserve(name, body.Owner); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			ok, err := r.Release(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReservationsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reservations.json")
+	r, err := NewReservations([]string{"API=alice"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reserve("docs", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reserve("www", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.Release("www"); !ok || err != nil {
+		t.Fatalf("Release(www) = %v, %v", ok, err)
+	}
+
+	reloaded, err := NewReservations(nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"api": "alice", "docs": "bob"}
+	if got := reloaded.List(); !maps.Equal(got, want) {
+		t.Fatalf("reloaded reservations = %v, want %v", got, want)
+	}
+	if owner, ok := reloaded.Owner("Docs"); !ok || owner != "bob" {
+		t.Fatalf("Owner(Docs) = %q, %v", owner, ok)
+	}
+
+	for _, spec := range []string{"api", "api=", "not_a_label=alice"} {
+		if _, err := NewReservations([]string{spec}, ""); err == nil {
+			t.Errorf("NewReservations(%q) succeeded", spec)
+		}
+	}
+	if err := r.Reserve("docs", ""); err == nil {
+		t.Error("Reserve without an owner succeeded")
+	}
+}
+
+func TestReservedSubdomains(t *testing.T) {
+	res, err := NewReservations([]string{"api=alice"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, ServerOptions{Reservations: res})
+
+	tests := []struct {
+		name     string
+		user     string
+		label    string
+		wantHost string // empty when the forward is rejected
+	}{
+		{"owner claims", "alice", "api", "api." + testZone},
+		{"non-owner label stays under their host", "bob", "api", "api.bob." + testZone},
+		{"user named after the reservation", "api", "", ""},
+		{"unreserved", "alice", "web", "web.alice." + testZone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := env.dialRaw(t, tt.user)
+			bind := tt.label
+			if bind == "" {
+				bind = "0.0.0.0"
+			}
+			ok, reply, err := c.SendRequest("tcpip-forward", true, forwardPayload(bind, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantHost == "" {
+				if ok || !strings.Contains(string(reply), errReservedSubdomain.Error()) {
+					t.Fatalf("got ok=%v reply=%q, want the reserved subdomain refused", ok, reply)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("forward refused: %q", reply)
+			}
+			if _, found := env.manager.GetRouteInfo(tt.wantHost); !found {
+				t.Fatalf("no route for %s; routes: %v", tt.wantHost, env.manager.ListRoutes())
+			}
+		})
+	}
+}
+
+func TestReservationAPI(t *testing.T) {
+	res, err := NewReservations(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/reservations", ReservationsAPIHandler(res))
+	mux.Handle("/api/reservations/{name}", ReservationAPIHandler(res))
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/api/reservations/api", `{"owner":"alice"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("PUT = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/api/reservations/api", `{}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("PUT without owner = %d, want 400", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/reservations", ""); !strings.Contains(rec.Body.String(), `"api": "alice"`) {
+		t.Fatalf("GET = %d %s, want the reservation listed", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/api/reservations/api", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/reservations/api", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("second DELETE = %d, want 404", rec.Code)
+	}
+}
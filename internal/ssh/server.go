@@ -1,78 +1,484 @@
 package ssh
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
+	"tunnelfy/internal/fdlimit"
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/metrics"
 	"tunnelfy/internal/proxy"
 )
 
-// parseForwardPort parses the request payload for "tcpip-forward" and returns
-// the requested port as string. Fails if payload is too short or invalid.
-func parseForwardPort(payload []byte) (string, error) {
+// parseForwardRequest parses the request payload for "tcpip-forward" and
+// "cancel-tcpip-forward" and returns the bind address and the requested port
+// as string. Fails if payload is too short or invalid.
+func parseForwardRequest(payload []byte) (string, string, error) {
 	// payload: uint32 addr_len | addr_bytes | uint32 port
 	if len(payload) < 4 {
-		return "", errors.New("payload too short")
+		return "", "", errors.New("payload too short")
 	}
 	addrLen := int(binary.BigEndian.Uint32(payload[0:4]))
 	expected := 4 + addrLen + 4
-	if len(payload) < expected {
-		return "", fmt.Errorf("invalid payload length: want %d have %d", expected, len(payload))
+	if addrLen < 0 || len(payload) < expected {
+		return "", "", fmt.Errorf("invalid payload length: want %d have %d", expected, len(payload))
 	}
+	bindAddr := string(payload[4 : 4+addrLen])
 	port := binary.BigEndian.Uint32(payload[4+addrLen : 4+addrLen+4])
-	return fmt.Sprintf("%d", port), nil
+	return bindAddr, fmt.Sprintf("%d", port), nil
+}
+
+// publicURL returns the URL host is served at.
+func (s *SSHServer) publicURL(host string) string {
+	scheme := s.opts.PublicScheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	if s.opts.PublicPort != "" {
+		host = net.JoinHostPort(host, s.opts.PublicPort)
+	}
+	return scheme + "://" + host
+}
+
+// tunnel is the bookkeeping for a single accepted tcpip-forward.
+type tunnel struct {
+	key      string // user:port in SSHServer.activeTunnelM
+	host     string
+	username string
+	listener net.Listener
+	// conn is the SSH connection that requested the tunnel.
+	conn ssh.Conn
+	// bindAddr and port are the address the client asked to bind and the
+	// port assigned, sent back in each forwarded-tcpip channel.
+	bindAddr string
+	port     uint32
+	// idleTimeout closes proxied connections idle for this long; zero disables it.
+	idleTimeout time.Duration
+	// qos is the tunnel's QoS class.
+	qos QoSClass
+	// ttl closes the tunnel when its TTL runs out; nil without a TTL.
+	ttl *time.Timer
+	// releaseSlot frees the user's tunnel slot held by the tunnel.
+	releaseSlot func()
+	// publicAddr is the public listen address of a TCP-mode tunnel, which has
+	// no host or route; empty for HTTP tunnels.
+	publicAddr string
+	// set is the tunnel set of the connection that requested the tunnel.
+	set *tunnelSet
+}
+
+// tunnelSet holds the open tunnels of one SSH connection, so that cleaning up
+// after a disconnect visits only that connection's tunnels rather than every
+// tunnel on the server, which made mass disconnects quadratic.
+type tunnelSet struct {
+	mu sync.Mutex
+	m  map[*tunnel]struct{}
+	// open counts the tunneled connections in flight, which Shutdown waits for.
+	open atomic.Int64
+}
+
+func (ts *tunnelSet) add(t *tunnel) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.m == nil {
+		ts.m = make(map[*tunnel]struct{})
+	}
+	ts.m[t] = struct{}{}
+}
+
+func (ts *tunnelSet) remove(t *tunnel) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.m, t)
+}
+
+// list returns the tunnels in the set.
+func (ts *tunnelSet) list() []*tunnel {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	out := make([]*tunnel, 0, len(ts.m))
+	for t := range ts.m {
+		out = append(out, t)
+	}
+	return out
+}
+
+// name identifies the tunnel in logs: its host, or the public address of a
+// TCP tunnel.
+func (t *tunnel) name() string {
+	if t.publicAddr != "" {
+		return "tcp://" + t.publicAddr
+	}
+	return t.host
+}
+
+// close removes the tunnel's route, if any, and stops its listener.
+func (t *tunnel) close(manager *proxy.ShardedRouteManager) {
+	if t.host != "" {
+		manager.RemoveRoute(t.host)
+	}
+	t.release()
+}
+
+// release stops the tunnel's listener and TTL and frees its user's tunnel
+// slot, leaving its route alone. Callers remove the tunnel from activeTunnelM
+// first, so it runs once per tunnel.
+func (t *tunnel) release() {
+	t.listener.Close()
+	if t.ttl != nil {
+		t.ttl.Stop()
+	}
+	t.releaseSlot()
+	if t.set != nil {
+		t.set.remove(t)
+	}
+}
+
+// forwardedTCPPayload is the extra data of a forwarded-tcpip channel (RFC 4254 7.2).
+type forwardedTCPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// openChannel opens a forwarded-tcpip channel to the client for a connection
+// from origin accepted on the tunnel's listener.
+func (t *tunnel) openChannel(origin net.Addr) (ssh.Channel, error) {
+	payload := forwardedTCPPayload{Addr: t.bindAddr, Port: t.port}
+	if tcp, ok := origin.(*net.TCPAddr); ok {
+		payload.OriginAddr = tcp.IP.String()
+		payload.OriginPort = uint32(tcp.Port)
+	}
+	ch, reqs, err := t.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&payload))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, nil
+}
+
+// isDefaultBindAddress reports whether a tcpip-forward bind address carries no
+// subdomain label, as sent by `ssh -R 0:...` and clients without a label.
+func isDefaultBindAddress(bindAddr string) bool {
+	switch bindAddr {
+	case "", "0.0.0.0", "::", "*", "localhost", "127.0.0.1":
+		return true
+	}
+	return false
+}
+
+// validLabel reports whether label is usable as a single DNS label.
+func validLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-' && i > 0 && i < len(label)-1:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// errReservedSubdomain rejects forwards for a subdomain reserved for another user.
+var errReservedSubdomain = errors.New("subdomain is reserved for another user")
+
+// hostForForward builds the public host for a forward. A non-default bind
+// address is used as a label in front of the user's host, so one user can hold
+// several routes (e.g. "api.alice.<zone>"), or as a wildcard ("*.api"). A
+// label reserved for the user instead maps to "<label>.<zone>".
+func (s *SSHServer) hostForForward(username, bindAddr string) (string, error) {
+	// Routes are keyed in lowercase to match the proxy's normalized lookups.
+	userHost := strings.ToLower(username + "." + s.zone)
+	if isDefaultBindAddress(bindAddr) {
+		// The user's own host is a zone-level name too, e.g. a user called
+		// "api" would otherwise squat the reserved "api.<zone>".
+		if owner, ok := s.opts.Reservations.Owner(username); ok && owner != username {
+			return "", fmt.Errorf("%w: %s", errReservedSubdomain, userHost)
+		}
+		return userHost, nil
+	}
+	// A "*.label" bind address requests a wildcard route for every host under
+	// "<label>.<username>.<zone>".
+	label := strings.ToLower(bindAddr)
+	wildcard := strings.HasPrefix(label, "*.")
+	if wildcard {
+		label = label[2:]
+	}
+	if !validLabel(label) {
+		return "", fmt.Errorf("invalid subdomain label %q", bindAddr)
+	}
+	if owner, ok := s.opts.Reservations.Owner(label); ok && owner == username && !wildcard {
+		return label + "." + strings.ToLower(s.zone), nil
+	}
+	if wildcard {
+		return "*." + label + "." + userHost, nil
+	}
+	return label + "." + userHost, nil
 }
 
 // SSHServer wraps the SSH configuration and active tunnel bookkeeping.
 type SSHServer struct {
+	log           *slog.Logger
 	config        *ssh.ServerConfig
 	manager       *proxy.ShardedRouteManager
 	zone          string
-	activeTunnelM sync.Map // key user:port -> host string
+	activeTunnelM sync.Map // key user:port -> *tunnel
 	logRequests   bool
+	opts          ServerOptions
+	userConns     *connLimiter
+	userTunnels   *connLimiter
+	connCounts    connCounts
+	sshConns      *connTracker
+	qos           *qosScheduler
+	// keys are the static authorized keys, swapped by SetAuthorizedKeys.
+	keys       atomic.Pointer[keySet]
+	keyTunnels keyTunnels
+	// live are the open SSH connections, drained by Shutdown.
+	live liveConns
+}
+
+// keySet is a set of static authorized keys.
+type keySet struct {
+	// keys maps each canonical marshaled key to its AuthorizedKey.
+	keys map[string]AuthorizedKey
+	// quotas are the quotas of the keys by SHA256 fingerprint; keys without
+	// one aren't listed.
+	quotas map[string]KeyQuota
+}
+
+func newKeySet(keys map[string]AuthorizedKey) *keySet {
+	quotas := make(map[string]KeyQuota)
+	for _, ak := range keys {
+		if ak.Quota != (KeyQuota{}) {
+			quotas[ssh.FingerprintSHA256(ak.PublicKey)] = ak.Quota
+		}
+	}
+	return &keySet{keys: keys, quotas: quotas}
+}
+
+// ServerOptions holds optional SSHServer settings.
+type ServerOptions struct {
+	// Logger receives the server's logs; nil uses slog.Default(). Connection
+	// and tunnel events are logged at level debug, and only when logRequests
+	// is set.
+	Logger *slog.Logger
+
+	// Authenticators are consulted, in order, for keys that aren't in the static
+	// authorized keys. Configuring one allows an empty static key list.
+	Authenticators []Authenticator
+
+	// ForwardDeadline is how long a connection may stay open after the handshake
+	// without establishing a forward before it is closed. Zero disables it.
+	ForwardDeadline time.Duration
+
+	// ConnIdleTimeout closes proxied tunnel connections that carry no data in
+	// either direction for this long. Zero disables it.
+	ConnIdleTimeout time.Duration
+	// ConnIdleTimeoutExempt lists hosts whose connections are never closed for
+	// idleness, for long-lived low-traffic protocols (e.g. WebSockets).
+	ConnIdleTimeoutExempt []string
+
+	// MaxUserConns caps a user's concurrent tunneled connections, aggregated
+	// across all their tunnels. Zero means unlimited.
+	MaxUserConns int
+
+	// MaxTunnelsPerUser caps a user's concurrent tunnels across all their SSH
+	// connections. Zero means unlimited.
+	MaxTunnelsPerUser int
+
+	// MaxUserSSHConns caps a user's concurrent SSH connections. At the cap a
+	// new connection is refused, or, with EvictIdleSSHConns, replaces the
+	// user's connection with the oldest last request. Zero means unlimited.
+	MaxUserSSHConns   int
+	EvictIdleSSHConns bool
+
+	// SniffProtocol peeks at each new tunnel connection to tell HTTP from raw
+	// TCP. Raw streams are piped without ConnIdleTimeout, which targets idle
+	// HTTP keep-alive connections. It adds up to sniffTimeout of latency for
+	// protocols where the server speaks first.
+	SniffProtocol bool
+
+	// UpstreamPorts restricts the ports a forward may request. Nil allows all.
+	UpstreamPorts *PortPolicy
+
+	// SerialRequests handles a connection's global requests one at a time. By
+	// default they are handled concurrently, so a slow forward (e.g. waiting on
+	// ForwardAuthorizer) doesn't hold up the handling of the connection's
+	// other requests; forward and cancel requests for the same port keep their
+	// order, and replies are always sent in the order the requests arrived.
+	SerialRequests bool
+
+	// ForwardAuthorizer, if set, makes the final allow/deny decision on each
+	// forward that passed the built-in checks.
+	ForwardAuthorizer ForwardAuthorizer
+
+	// Reservations assigns zone-level subdomains to their owners. Nil
+	// reserves nothing.
+	Reservations *Reservations
+
+	// HostKey is the server's host key. When nil, an ephemeral key is
+	// generated, which clients can't verify across restarts, unless
+	// StrictHostKey makes NewSSHServer refuse instead.
+	HostKey       ssh.Signer
+	StrictHostKey bool
+
+	// QoS prioritizes tunnels by class under load. The zero value disables it.
+	QoS QoSOptions
+
+	// ReconnectGrace, when positive, keeps the routes of a disconnected
+	// client's tunnels for this long as placeholders answering a retryable
+	// 503, so a client reconnecting within it reclaims them seamlessly.
+	ReconnectGrace time.Duration
+
+	// TunnelTTL, when positive, closes tunnels after this long: from when
+	// they were opened, or with SlidingTTL from their route's last activity.
+	TunnelTTL  time.Duration
+	SlidingTTL bool
+
+	// RequestTimeouts overrides the proxy's request timeout for the tunnels of
+	// some users, e.g. to give a paying tier longer-running requests.
+	RequestTimeouts map[string]time.Duration
+
+	// TCPListenHost is the host the public listeners of TCP-mode tunnels bind
+	// to, e.g. "0.0.0.0". Empty disables TCP mode. See TunnelModeTCP.
+	TCPListenHost string
+	// TCPOnly makes TCP the only tunnel mode, for servers running without the
+	// HTTP proxy: tunnels are TCP-mode without the client asking, and HTTP
+	// mode is rejected. It requires TCPListenHost.
+	TCPOnly bool
+
+	// PublicScheme and PublicPort make up the public URL of HTTP tunnels
+	// reported to clients in the tcpip-forward reply, e.g. "https" and ""
+	// for https://alice.example.com. An empty PublicScheme means "http"; an
+	// empty PublicPort is left out of the URL.
+	PublicScheme string
+	PublicPort   string
 }
 
-// NewSSHServer builds server config with public-key auth using provided keys map.
-func NewSSHServer(authorizedKeys map[string]ssh.PublicKey, zone string, manager *proxy.ShardedRouteManager, logRequests bool) *SSHServer {
+// NewSSHServer builds server config with public-key auth using provided keys map
+// and any additional authenticators. It returns ErrNoAuthConfigured when both are empty,
+// and ErrNoHostKey when StrictHostKey is set without a HostKey.
+func NewSSHServer(authorizedKeys map[string]AuthorizedKey, zone string, manager *proxy.ShardedRouteManager, logRequests bool, opts ServerOptions) (*SSHServer, error) {
+	if len(authorizedKeys) == 0 && len(opts.Authenticators) == 0 {
+		return nil, ErrNoAuthConfigured
+	}
+
 	cfg := &ssh.ServerConfig{
 		// Public key authentication only.
 		// NoClientAuth: false is the default. We will use a callback to enforce public key auth.
 	}
 
-	// PublicKeyCallback validates the incoming key against our authorized list
-	// and injects the username into session permissions for later retrieval.
+	s := &SSHServer{
+		log:         opts.Logger,
+		config:      cfg,
+		manager:     manager,
+		zone:        zone,
+		logRequests: logRequests,
+		opts:        opts,
+		userConns:   newConnLimiter(opts.MaxUserConns, userConnWait),
+		userTunnels: newConnLimiter(opts.MaxTunnelsPerUser, 0),
+		sshConns:    newConnTracker(opts.MaxUserSSHConns, opts.EvictIdleSSHConns),
+		qos:         newQoSScheduler(opts.QoS),
+	}
+	if s.log == nil {
+		s.log = slog.Default()
+	}
+	s.keys.Store(newKeySet(authorizedKeys))
+
+	// PublicKeyCallback validates the incoming key against our authorized list,
+	// then the configured authenticators, and injects the username into session
+	// permissions for later retrieval.
 	cfg.PublicKeyCallback = func(connMeta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-		if _, ok := authorizedKeys[string(ssh.MarshalAuthorizedKey(key))]; ok {
-			// Store username in Permissions so we can access it after handshake.
+		// The username labels the user's hosts, so it must be a DNS label.
+		if !validUsername(connMeta.User()) {
+			return nil, &ssh.BannerError{
+				Err:     errInvalidUsername,
+				Message: "tunnelfy: usernames may only contain letters, digits and inner hyphens, up to 63 characters\n",
+			}
+		}
+		if ak, ok := s.keys.Load().keys[string(ssh.MarshalAuthorizedKey(key))]; ok {
+			fingerprint := ssh.FingerprintSHA256(key)
+			if ak.Quota.expired(time.Now()) {
+				metrics.SSHExpiredKeys.Inc()
+				s.log.Info("rejecting expired key", "key", fingerprint, "user", logsafe.String(connMeta.User()), "expired", ak.Quota.Expires)
+				return nil, &ssh.BannerError{
+					Err:     errKeyExpired,
+					Message: fmt.Sprintf("tunnelfy: this key expired on %s\n", ak.Quota.Expires.Format(time.RFC3339)),
+				}
+			}
+			if !keyUserMatches(ak.User, connMeta.User()) {
+				metrics.SSHKeyUserMismatches.Inc()
+				s.log.Info("rejecting key bound to another user", "key", fingerprint, "user", logsafe.String(connMeta.User()), "bound_user", ak.User)
+				return nil, &ssh.BannerError{
+					Err:     errKeyUserMismatch,
+					Message: fmt.Sprintf("tunnelfy: this key may only log in as %s\n", ak.User),
+				}
+			}
+			// Store username in Permissions so we can access it after
+			// handshake, and the key to find its quota.
 			p := &ssh.Permissions{
-				Extensions: map[string]string{"username": connMeta.User()},
+				Extensions: map[string]string{"username": connMeta.User(), "key": fingerprint},
 			}
 			return p, nil
 		}
+		for _, a := range opts.Authenticators {
+			if username, err := a.Authenticate(connMeta, key); err == nil && validUsername(username) {
+				return &ssh.Permissions{Extensions: map[string]string{"username": username}}, nil
+			}
+		}
+		metrics.SSHUnauthorizedKeys.Inc()
 		return nil, fmt.Errorf("unauthorized key")
 	}
 
-	// Add the host key to the configuration.
-	signer := generateOrFallbackHostKey()
-	if signer != nil {
-		cfg.AddHostKey(signer)
-	} // If signer is nil, the server will generate an ephemeral key.
+	signer, err := hostKey(opts.HostKey, opts.StrictHostKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AddHostKey(signer)
+	return s, nil
+}
 
-	// Build and return SSHServer wrapper.
-	return &SSHServer{
-		config:      cfg,
-		manager:     manager,
-		zone:        zone,
-		logRequests: logRequests,
+// SetAuthorizedKeys replaces the static authorized keys. Connections already
+// authenticated with a removed key stay open, but the key can't authenticate
+// new ones; connections pick up a changed quota when they reconnect. An empty
+// set is refused with ErrNoAuthConfigured unless authenticators are
+// configured, as it would lock every client out.
+func (s *SSHServer) SetAuthorizedKeys(keys map[string]AuthorizedKey) error {
+	if len(keys) == 0 && len(s.opts.Authenticators) == 0 {
+		return ErrNoAuthConfigured
+	}
+	s.keys.Store(newKeySet(keys))
+	return nil
+}
+
+// ReloadAuthorizedKeys replaces the static authorized keys with those parsed
+// from data by LoadAuthorizedKeys; see SetAuthorizedKeys. On a parse error
+// the current keys are kept.
+func (s *SSHServer) ReloadAuthorizedKeys(data string) error {
+	keys, err := LoadAuthorizedKeys(data)
+	if err != nil {
+		return err
 	}
+	return s.SetAuthorizedKeys(keys)
 }
 
 // HandleConn handles a completed SSH connection.
@@ -80,8 +486,9 @@ func (s *SSHServer) HandleConn(nConn net.Conn) {
 	// Perform the SSH handshake and create a server connection.
 	sshConn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
 	if err != nil {
+		metrics.SSHHandshakeFailures.Inc()
 		if s.logRequests {
-			log.Printf("ssh handshake failed: %v", err)
+			s.log.Debug("ssh handshake failed", "remote", nConn.RemoteAddr(), "err", err)
 		}
 		nConn.Close()
 		return
@@ -97,11 +504,36 @@ func (s *SSHServer) HandleConn(nConn net.Conn) {
 	if username == "" {
 		// No username (shouldn't happen if auth callback set it); close.
 		if s.logRequests {
-			log.Printf("ssh connection without username; closing")
+			s.log.Debug("ssh connection without username; closing")
 		}
 		return
 	}
 
+	tracked, evicted, ok := s.sshConns.add(username, sshConn)
+	if !ok {
+		metrics.SSHUserSSHConnsLimited.Inc()
+		if s.logRequests {
+			s.log.Debug("refusing ssh connection: too many connections", "user", logsafe.String(username), "max", s.opts.MaxUserSSHConns)
+		}
+		refuseConn(sshConn, chans, reqs, fmt.Sprintf("too many SSH connections for user %s (max %d)", username, s.opts.MaxUserSSHConns))
+		return
+	}
+	defer s.sshConns.remove(username, tracked)
+	defer close(tracked.done)
+	s.connCounts.add(username, 1)
+	defer s.connCounts.add(username, -1)
+	if evicted != nil {
+		metrics.SSHUserSSHConnsLimited.Inc()
+		if s.logRequests {
+			s.log.Debug("closing idlest ssh connection: too many connections", "user", logsafe.String(username), "max", s.opts.MaxUserSSHConns)
+		}
+		evicted.conn.Close()
+		select {
+		case <-evicted.done:
+		case <-time.After(evictWait):
+		}
+	}
+
 	// reqs receives global requests (including tcpip-forward & cancel-tcpip-forward)
 	// chans receives channel open requests (we reject them since we only use forwarding)
 	// We'll spawn goroutines to handle both; they run for connection lifetime.
@@ -113,160 +545,684 @@ func (s *SSHServer) HandleConn(nConn net.Conn) {
 		}
 	}()
 
+	// Reap connections that authenticate but never establish a forward; they
+	// would otherwise hold this goroutine and the connection indefinitely.
+	var deadline *time.Timer
+	if s.opts.ForwardDeadline > 0 {
+		deadline = time.AfterFunc(s.opts.ForwardDeadline, func() {
+			metrics.SSHForwardDeadlineExceeded.Inc()
+			if s.logRequests {
+				s.log.Debug("closing ssh connection without forward", "user", logsafe.String(username), "deadline", s.opts.ForwardDeadline)
+			}
+			sshConn.Close()
+		})
+		defer deadline.Stop()
+	}
+
+	live := &liveConn{conn: sshConn, tunnels: &tunnelSet{}, done: make(chan struct{})}
+	if !s.live.add(live) {
+		if s.logRequests {
+			s.log.Debug("refusing ssh connection: shutting down", "user", logsafe.String(username))
+		}
+		return
+	}
+	defer s.live.remove(live)
+	defer close(live.done)
+
 	// Handle global requests: these include tcpip-forward and cancel-tcpip-forward.
+	sess := &session{username: username, conn: sshConn, tunnels: live.tunnels}
+	if key := sshConn.Permissions.Extensions["key"]; key != "" {
+		sess.key = key
+		sess.quota = s.keys.Load().quotas[key]
+	}
+	if s.opts.TCPOnly {
+		sess.mode = TunnelModeTCP
+	}
+	queue := newKeyedQueue()
+	order := newReplyOrder()
 	for req := range reqs {
-		switch req.Type {
-		case "tcpip-forward":
-			requestedPortStr, err := parseForwardPort(req.Payload)
-			if err != nil {
-				if s.logRequests {
-					log.Printf("failed parse tcpip-forward payload: %v", err)
-				}
-				req.Reply(false, nil)
-				continue
+		tracked.touch()
+		r := newRequest(req, order)
+		if s.opts.SerialRequests || isSessionRequest(req.Type) {
+			// Labels, access tokens and tunnel modes apply to the forwards requested after
+			// them, so they are handled before reading the next request.
+			if s.handleRequest(r, sess) && deadline != nil {
+				deadline.Stop()
+			}
+			continue
+		}
+		// Handlers see the session as of the request's arrival; see
+		// isSessionRequest.
+		snapshot := *sess
+		queue.run(orderingKey(req.Type, req.Payload), func() {
+			if s.handleRequest(r, &snapshot) && deadline != nil {
+				deadline.Stop()
 			}
+		})
+	}
+	// Let in-flight handlers finish so none registers a tunnel after cleanup.
+	queue.wait()
 
-			// Determine the listen address. If port is "0", the OS assigns a random port.
-			listenAddr := "127.0.0.1:" + requestedPortStr
-			listener, err := net.Listen("tcp", listenAddr)
-			if err != nil {
-				log.Printf("failed to listen on %s: %v", listenAddr, err)
-				req.Reply(false, nil)
-				continue
+	// Clean up the tunnels of this connection on disconnect; the user's other
+	// connections keep theirs. With a reconnect grace their routes are held
+	// for the client to reclaim; tunnels it cancelled are already gone.
+	for _, t := range sess.tunnels.list() {
+		if !s.activeTunnelM.CompareAndDelete(t.key, t) {
+			continue
+		}
+		if s.opts.ReconnectGrace > 0 && s.manager.HoldRoute(t.host, s.opts.ReconnectGrace) {
+			t.release()
+			continue
+		}
+		t.close(s.manager)
+		if s.logRequests {
+			s.log.Debug("cleanup route on disconnect", "tunnel", logsafe.String(t.name()))
+		}
+	}
+}
+
+// refuseConn answers a connection refused after the handshake: its requests
+// are rejected with reason, which clients report, until the first one that
+// wants a reply or connLimitRejectWindow passes.
+func refuseConn(conn ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, reason string) {
+	go func() {
+		for newChan := range chans {
+			newChan.Reject(ssh.Prohibited, reason)
+		}
+	}()
+	timer := time.AfterFunc(connLimitRejectWindow, func() { conn.Close() })
+	defer timer.Stop()
+	for req := range reqs {
+		if req.WantReply {
+			req.Reply(false, []byte(reason))
+			break
+		}
+	}
+	conn.Close()
+	go ssh.DiscardRequests(reqs)
+}
+
+// session is the per-connection state shared by a connection's requests.
+type session struct {
+	username string
+	conn     ssh.Conn
+	// labels are the client-provided metadata attached to new tunnels.
+	labels map[string]string
+	// accessToken gates new tunnels when set.
+	accessToken string
+	// accessControl restricts new tunnels to client addresses when set.
+	accessControl *proxy.AccessControl
+	// basicAuth password-protects new tunnels when set.
+	basicAuth *proxy.BasicAuth
+	// mode is the mode of new tunnels; empty means TunnelModeHTTP.
+	mode TunnelMode
+	// localPort is the port of the local service new tunnels map to, as
+	// declared by the client; zero when undeclared.
+	localPort uint32
+	// tunnels are the connection's open tunnels, shared by all snapshots of
+	// the session.
+	tunnels *tunnelSet
+	// key is the SHA256 fingerprint of the static authorized key the
+	// connection authenticated with, and quota that key's quota; key is
+	// empty for keys accepted by an Authenticator.
+	key   string
+	quota KeyQuota
+}
+
+// isSessionRequest reports whether requests of type typ change the session
+// state subsequent forwards are built from. Those are handled serially on the
+// session itself; every other request is handled concurrently on a shallow
+// copy of it, so its handler must not write to the session: the write would
+// be lost. A handler that needs to must be listed here.
+func isSessionRequest(typ string) bool {
+	switch typ {
+	case labelsRequestType, accessTokenRequestType, accessControlRequestType, basicAuthRequestType, tunnelModeRequestType, localPortRequestType:
+		return true
+	}
+	return false
+}
+
+// request wraps an ssh.Request so that it is replied to exactly once: extra
+// replies are dropped, and handleRequest sends a failure reply for any request
+// a handler returned from (or panicked in) without answering. A client waiting
+// on a reply would otherwise block forever.
+type request struct {
+	*ssh.Request
+	replied bool
+	// order, when set, holds the reply until the replies of the connection's
+	// earlier requests have been sent; slot is the request's position.
+	order *replyOrder
+	slot  uint64
+}
+
+// newRequest wraps req, reserving its reply position in order.
+func newRequest(req *ssh.Request, order *replyOrder) *request {
+	r := &request{Request: req}
+	if req.WantReply {
+		r.order = order
+		r.slot = order.slot()
+	}
+	return r
+}
+
+// Reply sends the reply unless one was already sent. An ordered reply may be
+// sent after Reply returns, in which case its write error is dropped.
+func (r *request) Reply(ok bool, payload []byte) error {
+	if r.replied {
+		return nil
+	}
+	r.replied = true
+	if r.order == nil {
+		return r.Request.Reply(ok, payload)
+	}
+	r.order.deliver(r.slot, func() { r.Request.Reply(ok, payload) })
+	return nil
+}
+
+// handleRequest dispatches a global request and guarantees it gets a reply.
+// It reports whether the request established a forward.
+func (s *SSHServer) handleRequest(req *request, sess *session) (forwarded bool) {
+	username := sess.username
+	defer func() {
+		if p := recover(); p != nil {
+			s.log.Error("panic handling request", "type", logsafe.String(req.Type), "user", logsafe.String(username), "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			forwarded = false
+		}
+		req.Reply(false, nil)
+	}()
+
+	switch req.Type {
+	case "tcpip-forward":
+		return s.handleForward(req, sess)
+
+	case "cancel-tcpip-forward":
+		s.handleCancelForward(req, sess)
+
+	case labelsRequestType:
+		s.handleLabels(req, sess)
+
+	case accessTokenRequestType:
+		s.handleAccessToken(req, sess)
+
+	case accessControlRequestType:
+		s.handleAccessControl(req, sess)
+
+	case basicAuthRequestType:
+		s.handleBasicAuth(req, sess)
+
+	case tunnelModeRequestType:
+		s.handleTunnelMode(req, sess)
+
+	case localPortRequestType:
+		s.handleLocalPort(req, sess)
+
+	case statusRequestType:
+		s.handleStatus(req, sess)
+
+	case keepAliveRequestType:
+		// Answered explicitly so client keepalives see a successful round trip.
+		req.Reply(true, nil)
+
+	default:
+		req.Reply(false, nil)
+	}
+	return false
+}
+
+// handleForward serves a tcpip-forward request: it binds a local listener,
+// registers the route for the forward's host and replies with the assigned port.
+// A TCP-mode forward binds a public listener on TCPListenHost instead and
+// registers no route. It reports whether the forward was established.
+func (s *SSHServer) handleForward(req *request, sess *session) bool {
+	username := sess.username
+	bindAddr, requestedPortStr, err := parseForwardRequest(req.Payload)
+	if err != nil {
+		if s.logRequests {
+			s.log.Debug("failed parse tcpip-forward payload", "err", err)
+		}
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectMalformed)
+		req.Reply(false, nil)
+		return false
+	}
+
+	tcp := sess.mode == TunnelModeTCP
+	var fullHost string
+	if !tcp {
+		var ok bool
+		if fullHost, ok = s.forwardHost(req, username, bindAddr); !ok {
+			return false
+		}
+	}
+
+	if err := s.portAllowed(requestedPortStr, sess); err != nil {
+		if s.logRequests {
+			s.log.Debug("rejecting tcpip-forward: port not allowed", "user", logsafe.String(username), "requested_port", requestedPortStr, "local_port", sess.localPort, "err", err)
+		}
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectPortDenied)
+		req.Reply(false, []byte(err.Error()))
+		return false
+	}
+
+	if err := s.authorizeForward(username, fullHost, bindAddr, requestedPortStr); err != nil {
+		s.log.Info("rejecting tcpip-forward", "user", logsafe.String(username), "host", logsafe.String(fullHost), "err", err)
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectDenied)
+		var denied *ForwardDeniedError
+		if errors.As(err, &denied) {
+			// Clients built on x/crypto/ssh receive the failure payload.
+			req.Reply(false, []byte(denied.Reason))
+		} else {
+			req.Reply(false, nil)
+		}
+		return false
+	}
+
+	// The connection outlives its key's expiry; its new tunnels don't.
+	if sess.quota.expired(time.Now()) {
+		s.log.Info("rejecting tcpip-forward: key expired", "user", logsafe.String(username), "host", logsafe.String(fullHost), "key", sess.key)
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectKeyExpired)
+		req.Reply(false, []byte("key expired on "+sess.quota.Expires.Format(time.RFC3339)))
+		return false
+	}
+
+	// The slot is held for the tunnel's lifetime, across all the user's SSH
+	// connections, and freed when the tunnel is released.
+	releaseUserSlot, ok := s.userTunnels.acquire(username)
+	if !ok {
+		s.log.Info("rejecting tcpip-forward: user tunnel limit", "user", logsafe.String(username), "host", logsafe.String(fullHost), "max", s.opts.MaxTunnelsPerUser)
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectTunnelLimit)
+		req.Reply(false, []byte(fmt.Sprintf("tunnel limit reached: at most %d tunnels per user", s.opts.MaxTunnelsPerUser)))
+		return false
+	}
+	// Likewise for the key's slot, across all the usernames it logs in as.
+	releaseKeySlot, ok := s.keyTunnels.acquire(sess.key, sess.quota.MaxTunnels)
+	if !ok {
+		releaseUserSlot()
+		s.log.Info("rejecting tcpip-forward: key tunnel limit", "user", logsafe.String(username), "host", logsafe.String(fullHost), "key", sess.key, "max", sess.quota.MaxTunnels)
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectKeyTunnelLimit)
+		req.Reply(false, []byte(fmt.Sprintf("tunnel limit reached: at most %d tunnels for this key", sess.quota.MaxTunnels)))
+		return false
+	}
+	releaseSlot := func() {
+		releaseKeySlot()
+		releaseUserSlot()
+	}
+
+	// Determine the listen address. If port is "0", a free port is chosen.
+	listenAddr := "127.0.0.1:" + requestedPortStr
+	var listener net.Listener
+	if tcp {
+		listenAddr = net.JoinHostPort(s.opts.TCPListenHost, requestedPortStr)
+		listener, err = net.Listen("tcp", listenAddr)
+	} else {
+		listener, err = listenLoopback(requestedPortStr)
+	}
+	if err != nil {
+		releaseSlot()
+		s.log.Error("failed to listen for tunnel", "addr", listenAddr, "err", err)
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectListenFailed)
+		if fdlimit.Exhausted(err) {
+			fdlimit.Report(fdlimit.OpListen, listenAddr, err)
+			req.Reply(false, []byte("server is out of file descriptors, try again later"))
+			return false
+		}
+		req.Reply(false, nil)
+		return false
+	}
+	listener = fdlimit.NewListener(listener)
+
+	// Get the actual port the listener is on. This is crucial if "0" was requested.
+	actualPort := listener.Addr().(*net.TCPAddr).Port
+	actualPortStr := fmt.Sprintf("%d", actualPort)
+
+	// The target for the route is the local port the SSH server is listening on.
+	routeTarget := fmt.Sprintf("127.0.0.1:%d", actualPort)
+
+	key := username + ":" + actualPortStr
+	t := &tunnel{
+		key:         key,
+		host:        fullHost,
+		username:    username,
+		listener:    listener,
+		conn:        sess.conn,
+		bindAddr:    bindAddr,
+		port:        uint32(actualPort),
+		idleTimeout: s.connIdleTimeout(fullHost),
+		qos:         s.qos.classFor(username, sess.labels[qosLabel]),
+		releaseSlot: releaseSlot,
+		set:         sess.tunnels,
+	}
+	if tcp {
+		t.publicAddr = listener.Addr().String()
+		// ConnIdleTimeout targets idle HTTP keep-alives; raw protocols such
+		// as SSH or Postgres idle legitimately.
+		t.idleTimeout = 0
+	} else if err := s.manager.AddRouteExclusiveWithOptions(fullHost, routeTarget, proxy.RouteOptions{
+		User:           username,
+		Labels:         sess.labels,
+		BandwidthLimit: sess.quota.Bandwidth,
+		RequestTimeout: s.opts.RequestTimeouts[username],
+		AccessToken:    sess.accessToken,
+		AccessControl:  sess.accessControl,
+		BasicAuth:      sess.basicAuth,
+		OnEvict:        func() { s.evictTunnel(t) },
+	}); err != nil {
+		listener.Close() // Clean up listener
+		releaseSlot()
+		// A host served by another tunnel (or an admin route) is taken;
+		// replacing it would silently steal that tunnel's traffic. A
+		// placeholder waiting for its tunnel to reconnect is reclaimed.
+		if errors.Is(err, proxy.ErrRouteExists) {
+			if s.logRequests {
+				s.log.Debug("rejecting tcpip-forward: host in use", "user", logsafe.String(username), "host", logsafe.String(fullHost))
 			}
+			metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectInUse)
+			req.Reply(false, []byte(fmt.Sprintf("%s is already in use by another tunnel", fullHost)))
+			return false
+		}
+		if s.logRequests {
+			s.log.Debug("failed to add route", "host", logsafe.String(fullHost), "upstream", routeTarget, "err", err)
+		}
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectRouteFailed)
+		req.Reply(false, nil)
+		return false
+	}
+	sess.tunnels.add(t)
+	s.startTTL(t)
+	s.activeTunnelM.Store(key, t)
+
+	// The reply carries the assigned port and, for HTTP tunnels, their URL.
+	var publicURL string
+	if !tcp {
+		publicURL = s.publicURL(fullHost)
+	}
+	req.Reply(true, forwardReply(uint32(actualPort), publicURL))
 
-			// Get the actual port the listener is on. This is crucial if "0" was requested.
-			actualPort := listener.Addr().(*net.TCPAddr).Port
-			actualPortStr := fmt.Sprintf("%d", actualPort)
+	if s.logRequests && tcp {
+		s.log.Debug("tcpip-forward accepted", "tunnel", t.name(), "user", logsafe.String(username), "mode", "tcp", "requested_port", requestedPortStr, "assigned_port", actualPortStr)
+	} else if s.logRequests {
+		s.log.Debug("tcpip-forward accepted", "host", logsafe.String(fullHost), "upstream", routeTarget, "user", logsafe.String(username), "requested_port", requestedPortStr, "assigned_port", actualPortStr, "labels", formatLabels(sess.labels))
+	}
 
-			fullHost := username + "." + s.zone
-			// The target for the route is the local port the SSH server is listening on.
-			routeTarget := fmt.Sprintf("127.0.0.1:%d", actualPort)
+	// Start a goroutine to handle connections to this listener.
+	go s.serveForward(t)
+	return true
+}
 
-			if err := s.manager.AddRoute(fullHost, routeTarget); err != nil {
+// forwardHost resolves the host of an HTTP-mode forward, rejecting the
+// request if the host is invalid or reserved. A host already in use is
+// rejected when the route is added.
+func (s *SSHServer) forwardHost(req *request, username, bindAddr string) (string, bool) {
+	fullHost, err := s.hostForForward(username, bindAddr)
+	if err != nil {
+		if s.logRequests {
+			s.log.Debug("rejecting tcpip-forward", "user", logsafe.String(username), "err", err)
+		}
+		if errors.Is(err, errReservedSubdomain) {
+			metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectReserved)
+			req.Reply(false, []byte(err.Error()))
+			return "", false
+		}
+		metrics.SSHForwardsRejected.Inc(metrics.ForwardRejectInvalidSubdomain)
+		req.Reply(false, nil)
+		return "", false
+	}
+	return fullHost, true
+}
+
+// evictTunnel tears down a tunnel whose route the manager evicted, e.g. for
+// being idle longer than TUNNEL_IDLE_TIMEOUT: the route is already gone, so
+// only the listener is closed and the tunnel forgotten.
+func (s *SSHServer) evictTunnel(t *tunnel) {
+	if s.activeTunnelM.CompareAndDelete(t.key, t) {
+		t.release()
+		metrics.SSHTunnelsEvicted.Inc()
+	}
+}
+
+// handleLabels serves a labels request, replacing the labels attached to the
+// session's subsequent tunnels.
+func (s *SSHServer) handleLabels(req *request, sess *session) {
+	labels, err := parseLabels(req.Payload)
+	if err != nil {
+		if s.logRequests {
+			s.log.Debug("rejecting labels", "user", logsafe.String(sess.username), "err", err)
+		}
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	sess.labels = labels
+	req.Reply(true, nil)
+}
+
+// authorizeForward consults ServerOptions.ForwardAuthorizer, if any.
+func (s *SSHServer) authorizeForward(username, host, bindAddr, requestedPort string) error {
+	if s.opts.ForwardAuthorizer == nil {
+		return nil
+	}
+	req := ForwardRequest{User: username, Host: host}
+	if !isDefaultBindAddress(bindAddr) {
+		req.Label = strings.ToLower(bindAddr)
+	}
+	if port, err := strconv.ParseUint(requestedPort, 10, 32); err == nil {
+		req.RequestedPort = uint32(port)
+	}
+	return s.opts.ForwardAuthorizer.AuthorizeForward(context.Background(), req)
+}
+
+// Bounds of the retry delay after a temporary accept error.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// acceptBackoff returns the delay before the next accept retry, doubling the
+// previous one up to maxAcceptBackoff.
+func acceptBackoff(prev time.Duration) time.Duration {
+	if prev == 0 {
+		return minAcceptBackoff
+	}
+	return min(prev*2, maxAcceptBackoff)
+}
+
+// serveForward accepts connections on a forward's listener and proxies each
+// through a forwarded-tcpip channel to the client, which connects it to its
+// local service. Connections count towards the user's concurrent connection cap.
+func (s *SSHServer) serveForward(t *tunnel) {
+	l := t.listener
+	defer l.Close()
+	// Use the actual listen address for logging, as it contains the correct port.
+	currentRouteTarget := l.Addr().String()
+	var backoff time.Duration
+	for {
+		clientConn, err := l.Accept()
+		if err != nil {
+			// Transient errors such as fd exhaustion must not kill the tunnel.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				backoff = acceptBackoff(backoff)
+				s.log.Warn("temporary accept error", "addr", currentRouteTarget, "err", err, "retry_in", backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			// Listener closed, exit goroutine.
+			if s.logRequests {
+				s.log.Debug("tunnel listener closed", "addr", currentRouteTarget, "err", err)
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				// The listener failed on its own; drop the tunnel rather than
+				// leaving a route to a dead listener.
+				if s.activeTunnelM.CompareAndDelete(t.key, t) {
+					t.close(s.manager)
+				}
+			}
+			return
+		}
+		backoff = 0
+		if s.logRequests {
+			s.log.Debug("new tunnel connection", "addr", currentRouteTarget, "user", logsafe.String(t.username))
+		}
+		// Forward the connection to the upstream service.
+		if t.set != nil {
+			t.set.open.Add(1)
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			if t.set != nil {
+				defer t.set.open.Add(-1)
+			}
+			release, ok := s.userConns.acquire(t.username)
+			if !ok {
+				metrics.SSHUserConnsLimited.Inc()
 				if s.logRequests {
-					log.Printf("failed to add route %s -> %s: %v", fullHost, routeTarget, err)
+					s.log.Debug("refusing tunnel connection: user connection limit", "addr", currentRouteTarget, "user", logsafe.String(t.username), "max", s.opts.MaxUserConns)
 				}
-				listener.Close() // Clean up listener
-				req.Reply(false, nil)
-				continue
+				return
 			}
-			key := username + ":" + actualPortStr
-			s.activeTunnelM.Store(key, fullHost)
-
-			// Construct the reply payload. For tcpip-forward, it's the assigned port.
-			replyPayload := make([]byte, 4)
-			binary.BigEndian.PutUint32(replyPayload, uint32(actualPort))
-			req.Reply(true, replyPayload)
+			defer release()
 
-			if s.logRequests {
-				log.Printf("tcpip-forward accepted and listening: %s -> %s (user=%s, requested_port=%s, assigned_port=%s)", fullHost, routeTarget, username, requestedPortStr, actualPortStr)
+			releaseSlot, ok := s.qos.admit(t.qos)
+			if !ok {
+				metrics.SSHQoSConnsRefused.Inc()
+				if s.logRequests {
+					s.log.Debug("refusing tunnel connection: server connection limit", "addr", currentRouteTarget, "qos", t.qos, "max", s.opts.QoS.MaxConns)
+				}
+				return
 			}
+			defer releaseSlot()
 
-			// Start a goroutine to handle connections to this listener.
-			// This goroutine will forward traffic to the original target specified by the client.
-			// The original target is embedded in the request payload, but our current logic simplifies it.
-			// For now, we assume the client's target is always localhost:3000 for this test.
-			// A more robust solution would parse the original target from the request.
-			go func(l net.Listener, upstreamHost string, upstreamPort string) {
-				defer l.Close()
-				// Use the actual routeTarget for logging, as it contains the correct port.
-				currentRouteTarget := fmt.Sprintf("127.0.0.1:%d", l.Addr().(*net.TCPAddr).Port)
-				for {
-					clientConn, err := l.Accept()
-					if err != nil {
-						// Listener closed, exit goroutine.
-						if s.logRequests {
-							log.Printf("listener on %s closed: %v", currentRouteTarget, err)
-						}
-						return
-					}
-					if s.logRequests {
-						log.Printf("new connection on %s, forwarding to %s:%s", currentRouteTarget, upstreamHost, upstreamPort)
-					}
-					// Forward the connection to the upstream service.
-					go func(c net.Conn) {
-						defer c.Close()
-						upstreamConn, err := net.Dial("tcp", upstreamHost+":"+upstreamPort)
-						if err != nil {
-							if s.logRequests {
-								log.Printf("failed to dial upstream %s:%s: %v", upstreamHost, upstreamPort, err)
-							}
-							return
-						}
-						defer upstreamConn.Close()
-
-						var wg sync.WaitGroup
-						wg.Add(2)
-
-						// Copy data from client to upstream
-						go func() {
-							defer wg.Done()
-							if _, err := io.Copy(upstreamConn, c); err != nil {
-								// It's common to get a connection reset error here when the other side closes.
-								// We can log it as debug if needed, but it's not necessarily an error.
-								if s.logRequests && err.Error() != "EOF" {
-									log.Printf("debug: copying from client to upstream finished: %v", err)
-								}
-							}
-						}()
-
-						// Copy data from upstream to client
-						go func() {
-							defer wg.Done()
-							if _, err := io.Copy(c, upstreamConn); err != nil {
-								if s.logRequests && err.Error() != "EOF" {
-									log.Printf("debug: copying from upstream to client finished: %v", err)
-								}
-							}
-						}()
-
-						wg.Wait()
-						if s.logRequests {
-							log.Printf("finished proxying connection from %s to %s:%s", c.RemoteAddr(), upstreamHost, upstreamPort)
-						}
-					}(clientConn)
+			idleTimeout := t.idleTimeout
+			if s.opts.SniffProtocol {
+				var proto protocol
+				c, proto = sniffConn(c, sniffTimeout)
+				if proto == protocolRaw {
+					idleTimeout = 0
+				}
+				if s.logRequests {
+					s.log.Debug("tunnel connection protocol detected", "addr", currentRouteTarget, "protocol", proto)
 				}
-			}(listener, "localhost", "3000") // Hardcoded for now, parse from payload later.
+			}
 
-		case "cancel-tcpip-forward":
-			port, err := parseForwardPort(req.Payload)
+			ch, err := t.openChannel(c.RemoteAddr())
 			if err != nil {
+				// The client couldn't reach its local service: let the proxy
+				// answer the request it is waiting on accordingly.
+				var oce *ssh.OpenChannelError
+				if errors.As(err, &oce) && oce.Reason == ssh.ConnectionFailed && t.host != "" {
+					s.manager.ReportUpstreamDown(t.host)
+				}
 				if s.logRequests {
-					log.Printf("failed parse cancel-tcpip-forward payload: %v", err)
+					s.log.Debug("failed to open forwarded-tcpip channel", "tunnel", logsafe.String(t.name()), "err", err)
 				}
-				req.Reply(false, nil)
-				continue
+				return
 			}
-			key := username + ":" + port
-			if v, ok := s.activeTunnelM.Load(key); ok {
-				if hostStr, ok2 := v.(string); ok2 {
-					s.manager.RemoveRoute(hostStr)
-				}
-				s.activeTunnelM.Delete(key)
+			defer ch.Close()
+
+			s.pipe(c, ch, idleTimeout, t.qos)
+			if s.logRequests {
+				s.log.Debug("finished proxying tunnel connection", "remote", c.RemoteAddr(), "user", logsafe.String(t.username))
 			}
-			req.Reply(true, nil)
+		}(clientConn)
+	}
+}
+
+// pipe copies data in both directions between c and upstream until both
+// directions finish. Each direction's end of stream is passed on as a
+// half-close. With a positive idleTimeout, a connection idle in both
+// directions is closed. Writes are paced according to the QoS class.
+func (s *SSHServer) pipe(c net.Conn, upstream io.ReadWriteCloser, idleTimeout time.Duration, class QoSClass) {
+	copyFn := func(dst io.Writer, src io.Reader) error {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	done := make(chan struct{})
+	if idleTimeout > 0 {
+		ic := newIdleCopier(idleTimeout)
+		copyFn = ic.copy
+		go ic.watch(done, func() {
 			if s.logRequests {
-				log.Printf("tcpip-forward cancelled: user=%s port=%s", username, port)
+				s.log.Debug("closing idle tunnel connection", "remote", c.RemoteAddr(), "err", errIdleTimeout)
 			}
+			c.Close()
+			upstream.Close()
+		})
+	}
 
-		default:
-			req.Reply(false, nil)
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Copy data from client to upstream
+	go func() {
+		defer wg.Done()
+		if err := copyFn(s.qos.throttle(class, upstream), c); err != nil {
+			// It's common to get a connection reset error here when the other side closes.
+			// We can log it as debug if needed, but it's not necessarily an error.
+			s.logPipeEnd("client to upstream", err)
 		}
+		closeWrite(upstream)
+	}()
+
+	// Copy data from upstream to client
+	go func() {
+		defer wg.Done()
+		if err := copyFn(s.qos.throttle(class, c), upstream); err != nil {
+			s.logPipeEnd("upstream to client", err)
+		}
+		closeWrite(c)
+	}()
+
+	wg.Wait()
+	close(done)
+}
+
+// closeWrite half-closes w if it supports it (TCP connections, SSH channels).
+func closeWrite(w any) {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
 	}
+}
 
-	// Clean up any tunnels associated with this user on disconnect.
-	s.activeTunnelM.Range(func(k, v interface{}) bool {
-		ks, _ := k.(string)
-		if strings.HasPrefix(ks, username+":") {
-			if hostStr, ok := v.(string); ok {
-				s.manager.RemoveRoute(hostStr)
-				if s.logRequests {
-					log.Printf("cleanup route on disconnect: %s", hostStr)
-				}
-			}
-			s.activeTunnelM.Delete(ks)
+// logPipeEnd logs the error that ended one direction of a pipe.
+func (s *SSHServer) logPipeEnd(direction string, err error) {
+	if s.logRequests && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		s.log.Debug("copy finished", "direction", direction, "err", err)
+	}
+}
+
+// connIdleTimeout returns the idle timeout for proxied connections of host,
+// which is zero for hosts exempted via ServerOptions.ConnIdleTimeoutExempt.
+func (s *SSHServer) connIdleTimeout(host string) time.Duration {
+	for _, exempt := range s.opts.ConnIdleTimeoutExempt {
+		if strings.EqualFold(host, exempt) {
+			return 0
 		}
-		return true
-	})
+	}
+	return s.opts.ConnIdleTimeout
+}
+
+// handleCancelForward serves a cancel-tcpip-forward request, tearing down the
+// route and listener of the referenced forward. Only the connection that
+// requested a forward may cancel it; other connections of the same user, and
+// forwards that don't exist, get a failure reply.
+func (s *SSHServer) handleCancelForward(req *request, sess *session) {
+	_, port, err := parseForwardRequest(req.Payload)
+	if err != nil {
+		if s.logRequests {
+			s.log.Debug("failed parse cancel-tcpip-forward payload", "err", err)
+		}
+		req.Reply(false, nil)
+		return
+	}
+	v, ok := s.activeTunnelM.Load(sess.username + ":" + port)
+	t, _ := v.(*tunnel)
+	if !ok || t == nil || t.conn != sess.conn || !s.activeTunnelM.CompareAndDelete(t.key, t) {
+		if s.logRequests {
+			s.log.Debug("rejecting cancel-tcpip-forward: no such forward on this connection", "user", logsafe.String(sess.username), "port", port)
+		}
+		req.Reply(false, nil)
+		return
+	}
+	t.close(s.manager)
+	req.Reply(true, nil)
+	if s.logRequests {
+		s.log.Debug("tcpip-forward cancelled", "user", logsafe.String(sess.username), "port", port)
+	}
 }
@@ -0,0 +1,723 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnelfy/internal/proxy"
+)
+
+const testZone = "tunnelfy.test"
+
+// testEnv is an SSH server, with the HTTP proxy in front of its routes,
+// listening on loopback for the duration of a test.
+type testEnv struct {
+	srv     *SSHServer
+	manager *proxy.ShardedRouteManager
+	addr    string
+	keyPath string
+	signer  ssh.Signer
+	proxy   *httptest.Server
+}
+
+// newTestEnv starts a server with opts accepting a freshly generated key for
+// any username.
+func newTestEnv(t testing.TB, opts ServerOptions) *testEnv {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := proxy.NewShardedRouteManager(proxy.DefaultRouteShards, false, proxy.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]AuthorizedKey{
+		string(ssh.MarshalAuthorizedKey(signer.PublicKey())): {PublicKey: signer.PublicKey()},
+	}
+	srv, err := NewSSHServer(keys, testZone, manager, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.HandleConn(c)
+		}
+	}()
+	ps := httptest.NewServer(proxy.FastProxyHandler(manager, testZone))
+	t.Cleanup(ps.Close)
+	return &testEnv{srv: srv, manager: manager, addr: l.Addr().String(), keyPath: keyPath, signer: signer, proxy: ps}
+}
+
+// connect connects a client as username with cfg, closed when the test ends.
+func (e *testEnv) connect(t testing.TB, username string, cfg ClientConfig) *Client {
+	t.Helper()
+	cfg.ServerAddress = e.addr
+	cfg.Username = username
+	cfg.KeyPath = e.keyPath
+	cfg.InsecureIgnoreHostKey = cfg.KnownHostsPath == "" && len(cfg.PinnedHostKeys) == 0
+	cfg.Logger = log.New(io.Discard, "", 0)
+	c := NewClient(cfg)
+	if _, err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// dialRaw opens a plain SSH connection as username, as OpenSSH would, for
+// requests tunnelfy-client doesn't send.
+func (e *testEnv) dialRaw(t testing.TB, username string) *ssh.Client {
+	t.Helper()
+	c, err := ssh.Dial("tcp", e.addr, e.clientConfig(username))
+	if err != nil {
+		t.Fatalf("ssh.Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// clientConfig is the configuration of dialRaw.
+func (e *testEnv) clientConfig(username string) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(e.signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+}
+
+// get requests path from host through the proxy and returns the status and body.
+func (e *testEnv) get(t testing.TB, host, path string) (int, string) {
+	t.Helper()
+	status, body, err := e.tryGet(host, path)
+	if err != nil {
+		t.Fatalf("GET %s%s: %v", host, path, err)
+	}
+	return status, body
+}
+
+// tryGet is get for goroutines other than the test's.
+func (e *testEnv) tryGet(host, path string) (int, string, error) {
+	req, err := http.NewRequest(http.MethodGet, e.proxy.URL+path, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Host = host
+	resp, err := e.proxy.Client().Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+// localService starts an HTTP service answering every request with body and
+// returns its address.
+func localService(t testing.TB, body string) string {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(s.Close)
+	return s.Listener.Addr().String()
+}
+
+// localPort returns the port of addr.
+func localPort(t testing.TB, addr string) string {
+	t.Helper()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestTunnelReachesLocalServicePort(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	addr := localService(t, "hello")
+	if localPort(t, addr) == "3000" {
+		t.Skip("local service landed on port 3000")
+	}
+	env.connect(t, "alice", ClientConfig{LocalServiceAddress: addr})
+
+	status, body := env.get(t, "alice."+testZone, "/")
+	if status != http.StatusOK || body != "hello" {
+		t.Fatalf("got %d %q, want 200 from the local service on %s", status, body, addr)
+	}
+}
+
+func TestPortPolicy(t *testing.T) {
+	allowed := localService(t, "ok")
+	denied := localService(t, "secret")
+	policy, err := ParsePortPolicy("", localPort(t, denied))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, ServerOptions{UpstreamPorts: policy})
+	c := env.connect(t, "alice", ClientConfig{})
+
+	tests := []struct {
+		name, label, local string
+		wantErr            string
+	}{
+		{name: "allowed", label: "app", local: allowed},
+		{name: "denied", label: "db", local: denied, wantErr: "local port " + localPort(t, denied) + " is not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.AddForward(tt.local, tt.label)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("AddForward: %v", err)
+				}
+				if status, _ := env.get(t, tt.label+".alice."+testZone, "/"); status != http.StatusOK {
+					t.Fatalf("got status %d, want 200", status)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("AddForward error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPortPolicyRequiresDeclaredLocalPort(t *testing.T) {
+	policy, err := ParsePortPolicy("", "22,3306")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, ServerOptions{UpstreamPorts: policy})
+	c := env.dialRaw(t, "alice")
+
+	ok, reply, err := c.SendRequest("tcpip-forward", true, forwardPayload("0.0.0.0", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || string(reply) != errLocalPortRequired.Error() {
+		t.Fatalf("got ok=%v reply=%q, want a rejection asking for the local port", ok, reply)
+	}
+}
+
+func TestForwardsReachTheirOwnLocalService(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	c := env.connect(t, "alice", ClientConfig{})
+	services := map[string]string{
+		"app": localService(t, "app"),
+		"api": localService(t, "api"),
+	}
+	for label, addr := range services {
+		if _, err := c.AddForward(addr, label); err != nil {
+			t.Fatalf("AddForward(%s, %s): %v", addr, label, err)
+		}
+	}
+	for label := range services {
+		status, body := env.get(t, label+".alice."+testZone, "/")
+		if status != http.StatusOK || body != label {
+			t.Errorf("%s: got %d %q, want 200 %q", label, status, body, label)
+		}
+	}
+}
+
+func TestCloseCancelsEveryForward(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	c := env.connect(t, "alice", ClientConfig{})
+	hosts := []string{"app.alice." + testZone, "api.alice." + testZone}
+	for _, label := range []string{"app", "api"} {
+		if _, err := c.AddForward(localService(t, label), label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, host := range hosts {
+		if _, ok := env.manager.GetRouteInfo(host); !ok {
+			t.Fatalf("no route for %s", host)
+		}
+	}
+
+	c.Close()
+	waitFor(t, "the routes to be removed", func() bool {
+		for _, host := range hosts {
+			if _, ok := env.manager.GetRouteInfo(host); ok {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestUsernameMustBeALabel(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	tests := []struct {
+		username string
+		ok       bool
+	}{
+		{"alice", true},
+		{"Alice", true},
+		{"a-1", true},
+		{"a.b", false},
+		{"-alice", false},
+		{"alice/x", false},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			c, err := ssh.Dial("tcp", env.addr, env.clientConfig(tt.username))
+			if err == nil {
+				c.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("ssh.Dial as %q: err = %v, want ok=%v", tt.username, err, tt.ok)
+			}
+		})
+	}
+}
+
+// forward requests a forward for label on c, returning the assigned port.
+func forward(t testing.TB, c *ssh.Client, label string) uint32 {
+	t.Helper()
+	ok, reply, err := c.SendRequest("tcpip-forward", true, forwardPayload(label, 0))
+	if err != nil || !ok || len(reply) < 4 {
+		t.Fatalf("tcpip-forward %s: ok=%v reply=%q err=%v", label, ok, reply, err)
+	}
+	return binary.BigEndian.Uint32(reply)
+}
+
+func TestCancelForwardOnlyOwnConnection(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	owner := env.dialRaw(t, "alice")
+	other := env.dialRaw(t, "alice")
+	host := "app.alice." + testZone
+	port := forward(t, owner, "app")
+
+	tests := []struct {
+		name      string
+		c         *ssh.Client
+		port      uint32
+		wantOK    bool
+		wantRoute bool
+	}{
+		{"other connection of the user", other, port, false, true},
+		{"unknown port", owner, port + 1, false, true},
+		{"owner", owner, port, true, false},
+		{"already cancelled", owner, port, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _, err := tt.c.SendRequest("cancel-tcpip-forward", true, forwardPayload("app", tt.port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("cancel replied %v, want %v", ok, tt.wantOK)
+			}
+			if _, found := env.manager.GetRouteInfo(host); found != tt.wantRoute {
+				t.Fatalf("route registered = %v, want %v", found, tt.wantRoute)
+			}
+		})
+	}
+}
+
+// BenchmarkConcurrentForwardSetup measures many clients connecting and
+// requesting forwards at once, then disconnecting; forward-ns reports the
+// setup latency per forward.
+func BenchmarkConcurrentForwardSetup(b *testing.B) {
+	const clients, forwardsPerClient = 100, 10
+	env := newTestEnv(b, ServerOptions{})
+	b.ResetTimer()
+	var setup time.Duration
+	for i := 0; i < b.N; i++ {
+		conns := make([]*ssh.Client, clients)
+		start := time.Now()
+		var wg sync.WaitGroup
+		for j := range conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := ssh.Dial("tcp", env.addr, env.clientConfig(fmt.Sprintf("user%d", j)))
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				conns[j] = c
+				for k := 0; k < forwardsPerClient; k++ {
+					ok, _, err := c.SendRequest("tcpip-forward", true, forwardPayload(fmt.Sprintf("app%d", k), 0))
+					if err != nil || !ok {
+						b.Errorf("tcpip-forward: ok=%v err=%v", ok, err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		setup += time.Since(start)
+		for _, c := range conns {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	b.ReportMetric(float64(setup.Nanoseconds())/float64(b.N*clients*forwardsPerClient), "forward-ns")
+}
+
+// waitFor polls cond until it holds, failing the test with what after a few
+// seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewSSHServerAuthSources(t *testing.T) {
+	manager, err := proxy.NewShardedRouteManager(proxy.DefaultRouteShards, false, proxy.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := NewCertAuthenticator(nil)
+	tests := []struct {
+		name    string
+		opts    ServerOptions
+		wantErr error
+	}{
+		{name: "authenticator without static keys", opts: ServerOptions{Authenticators: []Authenticator{ca}}},
+		{name: "neither", wantErr: ErrNoAuthConfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := NewSSHServer(nil, testZone, manager, false, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewSSHServer: err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// Reloading an empty key set is fine with an authenticator too.
+			if err := srv.SetAuthorizedKeys(nil); err != nil {
+				t.Fatalf("SetAuthorizedKeys: %v", err)
+			}
+		})
+	}
+}
+
+func TestForwardDeadline(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{ForwardDeadline: 100 * time.Millisecond})
+	idle := env.dialRaw(t, "alice")
+	active := env.dialRaw(t, "bob")
+	forward(t, active, "app")
+
+	closed := make(chan struct{})
+	go func() {
+		idle.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a connection that never forwarded wasn't closed")
+	}
+
+	// The deadline was stopped for the connection that forwarded.
+	time.Sleep(200 * time.Millisecond)
+	if ok, _, err := active.SendRequest(keepAliveRequestType, true, nil); err != nil || !ok {
+		t.Fatalf("connection with a forward was closed: ok=%v err=%v", ok, err)
+	}
+}
+
+// temporaryError is an accept error such as EMFILE.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails Accept with the errors queued on errs before accepting.
+type flakyListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.Listener.Accept()
+	}
+}
+
+// flakyForward serves a copy of user's tunnel on a listener failing with errs
+// first, and returns the copy and the listener.
+func flakyForward(t *testing.T, env *testEnv, user string, errs ...error) (*tunnel, *flakyListener) {
+	t.Helper()
+	var orig *tunnel
+	env.srv.activeTunnelM.Range(func(_, v any) bool {
+		if tun := v.(*tunnel); tun.username == user {
+			orig = tun
+		}
+		return orig == nil
+	})
+	if orig == nil {
+		t.Fatalf("no tunnel for %s", user)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl := &flakyListener{Listener: l, errs: make(chan error, len(errs))}
+	for _, err := range errs {
+		fl.errs <- err
+	}
+	t.Cleanup(func() { fl.Close() })
+	tun := *orig
+	tun.key = user + ":flaky"
+	tun.host = ""
+	tun.set = nil
+	tun.listener = fl
+	tun.releaseSlot = func() {}
+	env.srv.activeTunnelM.Store(tun.key, &tun)
+	go env.srv.serveForward(&tun)
+	return &tun, fl
+}
+
+func TestForwardSurvivesTemporaryAcceptError(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	env.connect(t, "alice", ClientConfig{LocalServiceAddress: localService(t, "hello")})
+
+	tun, l := flakyForward(t, env, "alice", temporaryError{}, temporaryError{}, temporaryError{})
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("GET after temporary accept errors: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Fatalf("body = %q, want the local service's", body)
+	}
+	if _, ok := env.srv.activeTunnelM.Load(tun.key); !ok {
+		t.Fatal("temporary accept errors removed the tunnel")
+	}
+}
+
+func TestForwardDroppedOnPermanentAcceptError(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	env.connect(t, "alice", ClientConfig{LocalServiceAddress: localService(t, "hello")})
+
+	tun, _ := flakyForward(t, env, "alice", errors.New("accept failed"))
+	waitFor(t, "tunnel removed", func() bool {
+		_, ok := env.srv.activeTunnelM.Load(tun.key)
+		return !ok
+	})
+}
+
+func TestIdleTunnelReaped(t *testing.T) {
+	const maxIdle = 100 * time.Millisecond
+	env := newTestEnv(t, ServerOptions{})
+	c := env.connect(t, "alice", ClientConfig{})
+	for _, label := range []string{"idle", "busy"} {
+		if _, err := c.AddForward(localService(t, label), label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idle, busy := "idle.alice."+testZone, "busy.alice."+testZone
+	idleAddr := strings.TrimPrefix(env.manager.ListRoutes()[idle], "http://")
+
+	time.Sleep(maxIdle + 50*time.Millisecond)
+	env.get(t, busy, "/")
+	evicted := env.manager.ReapIdle(maxIdle)
+	if len(evicted) != 1 || evicted[0] != idle {
+		t.Fatalf("ReapIdle = %v, want only %s", evicted, idle)
+	}
+
+	if _, ok := env.manager.GetRouteInfo(idle); ok {
+		t.Fatal("the idle tunnel's route is still registered")
+	}
+	env.srv.activeTunnelM.Range(func(_, v any) bool {
+		if v.(*tunnel).host == idle {
+			t.Errorf("the idle tunnel is still active")
+		}
+		return true
+	})
+	if conn, err := net.DialTimeout("tcp", idleAddr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("the idle tunnel's listener still accepts connections")
+	}
+	if status, body := env.get(t, busy, "/"); status != http.StatusOK || body != "busy" {
+		t.Fatalf("busy tunnel: got %d %q, want it untouched", status, body)
+	}
+}
+
+func TestReconnectGrace(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	host := "app.alice." + testZone
+	tests := []struct {
+		name  string
+		after bool // reconnect only once the grace period has passed
+	}{
+		{name: "within grace"},
+		{name: "after grace", after: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, ServerOptions{ReconnectGrace: grace})
+			// Drop the connection without cancelling the forward, as a
+			// network blip would; Client.Close cancels its forwards.
+			raw := env.dialRaw(t, "alice")
+			forward(t, raw, "app")
+			raw.Close()
+			disconnected := time.Now()
+			waitFor(t, "the route to be held", func() bool {
+				status, _ := env.get(t, host, "/")
+				return status == http.StatusServiceUnavailable
+			})
+
+			if tt.after {
+				waitFor(t, "the held route to expire", func() bool {
+					_, ok := env.manager.GetRouteInfo(host)
+					return !ok
+				})
+				if held := time.Since(disconnected); held < grace {
+					t.Fatalf("the held route expired after %v, before the grace of %v", held, grace)
+				}
+				if status, _ := env.get(t, host, "/"); status != http.StatusNotFound {
+					t.Fatalf("after the grace: got %d, want 404", status)
+				}
+			}
+
+			c := env.connect(t, "alice", ClientConfig{})
+			if _, err := c.AddForward(localService(t, "second"), "app"); err != nil {
+				t.Fatalf("reclaiming the route: %v", err)
+			}
+			if status, body := env.get(t, host, "/"); status != http.StatusOK || body != "second" {
+				t.Fatalf("got %d %q, want the reconnected tunnel", status, body)
+			}
+			// The held route's expiry must leave the reclaimed one alone.
+			time.Sleep(grace)
+			if status, body := env.get(t, host, "/"); status != http.StatusOK || body != "second" {
+				t.Fatalf("after the grace: got %d %q, want the reconnected tunnel", status, body)
+			}
+		})
+	}
+}
+
+func TestDeleteRouteDropsTunnel(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	c := env.connect(t, "alice", ClientConfig{})
+	if _, err := c.AddForward(localService(t, "app"), "app"); err != nil {
+		t.Fatal(err)
+	}
+	host := "app.alice." + testZone
+	addr := strings.TrimPrefix(env.manager.ListRoutes()[host], "http://")
+
+	// The admin API's DELETE /api/routes/{host} and its bulk form call
+	// DeleteRoute.
+	if !env.manager.DeleteRoute(host) {
+		t.Fatal("DeleteRoute found no route")
+	}
+	env.srv.activeTunnelM.Range(func(_, v any) bool {
+		if v.(*tunnel).host == host {
+			t.Errorf("the deleted tunnel is still active")
+		}
+		return true
+	})
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("the deleted tunnel's listener still accepts connections")
+	}
+	if status, _ := env.get(t, host, "/"); status != http.StatusNotFound {
+		t.Fatalf("after delete: got %d, want 404", status)
+	}
+	if env.manager.DeleteRoute(host) {
+		t.Fatal("DeleteRoute found the route again")
+	}
+}
+
+func TestReloadAuthorizedKeys(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSigner, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		cfg := env.clientConfig("alice")
+		cfg.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+		return ssh.Dial("tcp", env.addr, cfg)
+	}
+
+	existing := env.dialRaw(t, "alice")
+	if err := env.srv.ReloadAuthorizedKeys(string(ssh.MarshalAuthorizedKey(newSigner.PublicKey()))); err != nil {
+		t.Fatalf("ReloadAuthorizedKeys: %v", err)
+	}
+	if c, err := dial(env.signer); err == nil {
+		c.Close()
+		t.Fatal("a revoked key authenticated")
+	}
+	c, err := dial(newSigner)
+	if err != nil {
+		t.Fatalf("the added key: %v", err)
+	}
+	c.Close()
+	// Revoking a key doesn't drop the connections it already made.
+	forward(t, existing, "app")
+
+	// A reload that fails to parse keeps the current keys.
+	if err := env.srv.ReloadAuthorizedKeys("garbage"); err == nil {
+		t.Fatal("ReloadAuthorizedKeys accepted garbage")
+	}
+	if err := env.srv.ReloadAuthorizedKeys(""); !errors.Is(err, ErrNoAuthConfigured) {
+		t.Fatalf("reloading no keys: err = %v, want ErrNoAuthConfigured", err)
+	}
+	c, err = dial(newSigner)
+	if err != nil {
+		t.Fatalf("the current key after failed reloads: %v", err)
+	}
+	c.Close()
+}
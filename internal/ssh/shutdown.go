@@ -0,0 +1,164 @@
+package ssh
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shutdownRequestType is the global request the server sends every client
+// when it starts shutting down, so a tunnelfy client can tell the disconnect
+// that follows from a network failure. It has no payload and wants no reply;
+// other clients ignore it.
+const shutdownRequestType = "shutdown@tunnelfy"
+
+// drainPoll is how often Shutdown checks for connections that have drained.
+const drainPoll = 100 * time.Millisecond
+
+// liveConn is an open SSH connection, as tracked for Shutdown.
+type liveConn struct {
+	conn    ssh.Conn
+	tunnels *tunnelSet
+	// done is closed once the connection's handler has cleaned up.
+	done chan struct{}
+}
+
+// liveConns is the set of open SSH connections.
+type liveConns struct {
+	mu       sync.Mutex
+	draining bool
+	m        map[*liveConn]struct{}
+}
+
+// add registers c, unless the server is shutting down.
+func (l *liveConns) add(c *liveConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining {
+		return false
+	}
+	if l.m == nil {
+		l.m = make(map[*liveConn]struct{})
+	}
+	l.m[c] = struct{}{}
+	return true
+}
+
+func (l *liveConns) remove(c *liveConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.m, c)
+}
+
+// drain stops registration and returns the open connections.
+func (l *liveConns) drain() []*liveConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.draining = true
+	out := make([]*liveConn, 0, len(l.m))
+	for c := range l.m {
+		out = append(out, c)
+	}
+	return out
+}
+
+// Shutdown drains the SSH connections. New connections are refused from then
+// on, every client is sent a shutdown@tunnelfy notice, and their tunnels stop
+// accepting connections. Each SSH connection is closed once its in-flight
+// tunneled connections have finished, with the proxy's idle connections to
+// them closed. When ctx is done first, the remaining
+// connections are closed anyway and ctx's error is returned. Shutdown returns
+// once every connection has been cleaned up; it doesn't close the listener
+// the connections were accepted on.
+func (s *SSHServer) Shutdown(ctx context.Context) error {
+	pending := s.live.drain()
+	if len(pending) > 0 {
+		s.log.Info("draining ssh connections", "conns", len(pending))
+	}
+	// Notices are sent concurrently, as a stalled client blocks its send, but
+	// before any connection is closed, so clients receive them.
+	var notified sync.WaitGroup
+	for _, c := range pending {
+		notified.Add(1)
+		go func() {
+			defer notified.Done()
+			c.conn.SendRequest(shutdownRequestType, false, nil)
+		}()
+		for _, t := range c.tunnels.list() {
+			t.listener.Close()
+		}
+	}
+	sent := make(chan struct{})
+	go func() {
+		notified.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+	}
+	all := slices.Clone(pending)
+	defer func() {
+		for _, c := range all {
+			<-c.done
+		}
+	}()
+
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		// The proxy keeps finished tunneled connections open for reuse.
+		s.manager.CloseIdleConnections()
+		pending = slices.DeleteFunc(pending, func(c *liveConn) bool {
+			if c.tunnels.open.Load() > 0 {
+				return false
+			}
+			c.conn.Close()
+			return true
+		})
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.log.Warn("ssh drain timed out; closing connections with open tunnel connections", "conns", len(pending))
+			for _, c := range pending {
+				c.conn.Close()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleGlobalRequests answers the server's global requests on a client
+// connection, noting a shutdown notice; every request is refused.
+func (c *Client) handleGlobalRequests(reqs <-chan *ssh.Request) {
+	defer c.wg.Done()
+	defer close(c.requestsDone)
+	for req := range reqs {
+		if req.Type == shutdownRequestType {
+			c.serverShutdown.Store(true)
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// ServerShutdown reports whether the server announced it was shutting down
+// before the connection ended, as opposed to the connection failing.
+func (c *Client) ServerShutdown() bool {
+	return c.serverShutdown.Load()
+}
+
+// closedRequests is a closed request channel, handed to ssh.NewClient for a
+// connection whose global requests the client serves itself.
+var closedRequests = func() chan *ssh.Request {
+	ch := make(chan *ssh.Request)
+	close(ch)
+	return ch
+}()
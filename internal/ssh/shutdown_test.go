@@ -0,0 +1,92 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownClosesGracefully(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	entered, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		io.WriteString(w, "done")
+	}))
+	t.Cleanup(slow.Close)
+	c := env.connect(t, "alice", ClientConfig{})
+	if _, err := c.AddForward(slow.Listener.Addr().String(), "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		status, body, err := env.tryGet("app.alice."+testZone, "/")
+		inFlight <- result{status, body, err}
+	}()
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- env.srv.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the in-flight request finished: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if r := <-inFlight; r.err != nil || r.status != http.StatusOK || r.body != "done" {
+		t.Fatalf("in-flight request got %d %q (%v), want 200 %q", r.status, r.body, r.err, "done")
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client connection still open after Shutdown")
+	}
+	if !c.ServerShutdown() {
+		t.Fatal("client didn't receive the shutdown notice")
+	}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	entered := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(stuck.Close)
+	c := env.connect(t, "alice", ClientConfig{})
+	if _, err := c.AddForward(stuck.Listener.Addr().String(), "app"); err != nil {
+		t.Fatal(err)
+	}
+	go env.tryGet("app.alice."+testZone, "/")
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := env.srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client connection still open after Shutdown timed out")
+	}
+}
@@ -0,0 +1,91 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+)
+
+// sniffTimeout bounds how long a new tunnel connection is waited on for its
+// first bytes. Server-first protocols (SMTP, SSH, ...) send nothing until the
+// server greets them, so they are classified as raw once it expires.
+const sniffTimeout = 100 * time.Millisecond
+
+// protocol is the traffic type detected on a tunnel connection.
+type protocol string
+
+const (
+	protocolHTTP protocol = "http"
+	protocolRaw  protocol = "raw"
+)
+
+// httpPrefixes are the request line openings of HTTP/1.x methods and the
+// HTTP/2 connection preface.
+var httpPrefixes = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "),
+	[]byte("DELETE "), []byte("CONNECT "), []byte("OPTIONS "), []byte("TRACE "),
+	[]byte("PATCH "), []byte("PRI * HTTP/2"),
+}
+
+// maxHTTPPrefix is the number of bytes needed to match every httpPrefixes entry.
+const maxHTTPPrefix = len("PRI * HTTP/2")
+
+// peekedConn is a net.Conn whose reads are served from a buffered reader first,
+// so bytes inspected during sniffing are still delivered to the upstream.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection, which embedding net.Conn
+// would otherwise hide from pipe.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// sniffConn peeks at the first bytes of c without consuming them and reports
+// whether it carries HTTP. The returned conn must be used in place of c.
+func sniffConn(c net.Conn, timeout time.Duration) (net.Conn, protocol) {
+	pc := &peekedConn{Conn: c, r: bufio.NewReader(c)}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	// Peek more only while what has arrived could still be an HTTP prefix, so a
+	// short non-HTTP greeting is classified without waiting for the timeout.
+	for n := 1; n <= maxHTTPPrefix; n++ {
+		b, _ := pc.r.Peek(n)
+		if len(b) < n {
+			return pc, protocolRaw
+		}
+		match, done := matchHTTPPrefix(b)
+		if !match {
+			return pc, protocolRaw
+		}
+		if done {
+			return pc, protocolHTTP
+		}
+	}
+	return pc, protocolRaw
+}
+
+// matchHTTPPrefix reports whether b is consistent with some HTTP prefix, and
+// whether it already contains a complete one.
+func matchHTTPPrefix(b []byte) (match, done bool) {
+	for _, p := range httpPrefixes {
+		if len(b) >= len(p) && bytes.HasPrefix(b, p) {
+			return true, true
+		}
+		if len(b) < len(p) && bytes.HasPrefix(p, b) {
+			match = true
+		}
+	}
+	return match, false
+}
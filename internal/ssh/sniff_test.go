@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffConn(t *testing.T) {
+	tests := []struct {
+		name string
+		sent string
+		want protocol
+	}{
+		{"HTTP/1.1 request", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", protocolHTTP},
+		{"POST", "POST /api HTTP/1.1\r\n\r\n", protocolHTTP},
+		{"HTTP/2 preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", protocolHTTP},
+		{"SSH", "SSH-2.0-OpenSSH_9.6\r\n", protocolRaw},
+		{"TLS client hello", "\x16\x03\x01\x02\x00\x01", protocolRaw},
+		{"method without space", "GETX", protocolRaw},
+		{"server speaks first", "", protocolRaw},
+		{"truncated method", "GE", protocolRaw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				io.WriteString(client, tt.sent)
+				if len(tt.sent) < maxHTTPPrefix {
+					// Hold the connection open so short inputs hit the timeout.
+					time.Sleep(3 * sniffTimeout)
+				}
+				client.Close()
+			}()
+
+			conn, got := sniffConn(server, sniffTimeout)
+			if got != tt.want {
+				t.Fatalf("sniffed %q as %s, want %s", tt.sent, got, tt.want)
+			}
+			// Sniffing consumes nothing.
+			b, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.sent {
+				t.Fatalf("read %q after sniffing, want %q", b, tt.sent)
+			}
+		})
+	}
+}
+
+// bannerService starts a TCP service that greets every connection with
+// banner before reading anything, as SMTP or SSH servers do, and returns its
+// address.
+func bannerService(t *testing.T, banner string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, banner)
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSniffedTunnelServesBothProtocols(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{SniffProtocol: true})
+	c := env.connect(t, "alice", ClientConfig{})
+	if _, err := c.AddForward(localService(t, "web"), "web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AddForward(bannerService(t, "220 ready\r\n"), "smtp"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, body := env.get(t, "web.alice."+testZone, "/"); status != http.StatusOK || body != "web" {
+		t.Fatalf("HTTP through a sniffing tunnel: got %d %q", status, body)
+	}
+	conn, err := net.Dial("tcp", strings.TrimPrefix(env.manager.ListRoutes()["smtp.alice."+testZone], "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "220 ready\r\n" {
+		t.Fatalf("server-first protocol through a sniffing tunnel: read %q, %v", b, err)
+	}
+}
@@ -0,0 +1,69 @@
+package ssh
+
+import "sync"
+
+// Stats is a point-in-time summary of the server's SSH side.
+type Stats struct {
+	// Connections and Tunnels are the open SSH connections and tunnels.
+	Connections int `json:"connections"`
+	Tunnels     int `json:"tunnels"`
+	// Users rolls connections, tunnels and tunnel requests up per user, for
+	// users with at least one open connection.
+	Users map[string]UserStats `json:"users"`
+}
+
+// UserStats is a single user's share of Stats.
+type UserStats struct {
+	Connections int `json:"connections"`
+	Tunnels     int `json:"tunnels"`
+	// Requests counts the requests proxied through the user's open tunnels.
+	Requests uint64 `json:"requests"`
+}
+
+// connCounts counts each user's open SSH connections, whether or not
+// MaxUserSSHConns is enforced.
+type connCounts struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+// add adjusts user's connection count by delta.
+func (c *connCounts) add(user string, delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]int)
+	}
+	c.m[user] += delta
+	if c.m[user] <= 0 {
+		delete(c.m, user)
+	}
+}
+
+// Stats returns the server's current connections and tunnels, overall and
+// per user.
+func (s *SSHServer) Stats() Stats {
+	st := Stats{Users: make(map[string]UserStats)}
+	s.connCounts.mu.Lock()
+	for user, n := range s.connCounts.m {
+		st.Connections += n
+		st.Users[user] = UserStats{Connections: n}
+	}
+	s.connCounts.mu.Unlock()
+
+	s.activeTunnelM.Range(func(_, v any) bool {
+		t, ok := v.(*tunnel)
+		if !ok {
+			return true
+		}
+		st.Tunnels++
+		u := st.Users[t.username]
+		u.Tunnels++
+		if info, ok := s.manager.GetRouteInfo(t.host); ok {
+			u.Requests += info.Requests
+		}
+		st.Users[t.username] = u
+		return true
+	})
+	return st
+}
@@ -0,0 +1,49 @@
+package ssh
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	alice := env.connect(t, "alice", ClientConfig{})
+	for _, label := range []string{"app", "api"} {
+		if _, err := alice.AddForward(localService(t, label), label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.dialRaw(t, "alice")
+	bob := env.connect(t, "bob", ClientConfig{})
+	if _, err := bob.AddForward(localService(t, "web"), "web"); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		env.get(t, "app.alice."+testZone, "/")
+	}
+	env.get(t, "api.alice."+testZone, "/")
+	env.get(t, "web.bob."+testZone, "/")
+
+	st := env.srv.Stats()
+	if st.Connections != 3 || st.Tunnels != 3 {
+		t.Errorf("connections %d, tunnels %d: want 3 and 3", st.Connections, st.Tunnels)
+	}
+	want := map[string]UserStats{
+		"alice": {Connections: 2, Tunnels: 2, Requests: 4},
+		"bob":   {Connections: 1, Tunnels: 1, Requests: 1},
+	}
+	if len(st.Users) != len(want) {
+		t.Errorf("users = %v, want %v", st.Users, want)
+	}
+	for user, w := range want {
+		if got := st.Users[user]; got != w {
+			t.Errorf("%s: %+v, want %+v", user, got, w)
+		}
+	}
+
+	bob.Close()
+	waitFor(t, "bob to drop out of the stats", func() bool {
+		_, ok := env.srv.Stats().Users["bob"]
+		return !ok
+	})
+	if st := env.srv.Stats(); st.Connections != 2 || st.Tunnels != 2 {
+		t.Errorf("after bob left: connections %d, tunnels %d, want 2 and 2", st.Connections, st.Tunnels)
+	}
+}
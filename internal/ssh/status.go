@@ -0,0 +1,104 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// statusRequestType is the global request a client sends when the local
+// service behind one of its forwards goes down or comes back.
+const statusRequestType = "status@tunnelfy"
+
+// maxProbeTimeout bounds each local service probe.
+const maxProbeTimeout = 2 * time.Second
+
+// forwardStatus is the payload of a status request.
+type forwardStatus struct {
+	// Port is the remote port of the forward, as assigned by the server.
+	Port   uint32 `json:"port"`
+	Online bool   `json:"online"`
+}
+
+// handleStatus serves a status request, marking the route of the referenced
+// forward offline or back online. Only the connection owning the forward may
+// report its status.
+func (s *SSHServer) handleStatus(req *request, sess *session) {
+	var st forwardStatus
+	if err := json.Unmarshal(req.Payload, &st); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	v, ok := s.activeTunnelM.Load(fmt.Sprintf("%s:%d", sess.username, st.Port))
+	if !ok || v.(*tunnel).conn != sess.conn {
+		req.Reply(false, nil)
+		return
+	}
+	t := v.(*tunnel)
+	s.manager.SetRouteOnline(t.host, st.Online)
+	if s.logRequests {
+		s.log.Debug("tunnel status", "host", logsafe.String(t.host), "user", logsafe.String(sess.username), "online", st.Online)
+	}
+	req.Reply(true, nil)
+}
+
+// probeLocalServices dials the local service of every forward each
+// ProbeInterval and reports state changes to the server, until the
+// connection ends.
+func (c *Client) probeLocalServices() {
+	defer c.wg.Done()
+	interval := c.config.ProbeInterval
+	timeout := min(interval, maxProbeTimeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Services are assumed online when their forward is established.
+	offline := make(map[uint32]bool)
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		for _, f := range c.Forwards() {
+			down := false
+			if conn, err := net.DialTimeout("tcp", f.LocalAddress, timeout); err != nil {
+				down = true
+			} else {
+				conn.Close()
+			}
+			if down == offline[f.RemotePort] {
+				continue
+			}
+			if down {
+				c.config.Logger.Printf("Local service %s is down; reporting it offline", f.LocalAddress)
+			} else {
+				c.config.Logger.Printf("Local service %s is back online", f.LocalAddress)
+			}
+			if err := c.sendStatus(f.RemotePort, !down); err != nil {
+				c.config.Logger.Printf("Failed to report status of %s: %v", f.LocalAddress, err)
+				continue
+			}
+			offline[f.RemotePort] = down
+		}
+	}
+}
+
+// sendStatus reports whether the local service of the forward on remotePort is online.
+func (c *Client) sendStatus(remotePort uint32, online bool) error {
+	payload, err := json.Marshal(forwardStatus{Port: remotePort, Online: online})
+	if err != nil {
+		return err
+	}
+	ok, _, err := c.conn.SendRequest(statusRequestType, true, payload)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("server rejected status update")
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveOn serves an HTTP service answering "up" on l until the returned func
+// is called.
+func serveOn(l net.Listener) (stop func()) {
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up")
+	})}
+	go s.Serve(l)
+	return func() { s.Close() }
+}
+
+func TestStatusPropagation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	stop := serveOn(l)
+	defer func() { stop() }()
+
+	env := newTestEnv(t, ServerOptions{})
+	env.connect(t, "alice", ClientConfig{LocalServiceAddress: addr, ProbeInterval: 20 * time.Millisecond})
+	host := "alice." + testZone
+	statusIs := func(want int, body string) func() bool {
+		return func() bool {
+			status, got, err := env.tryGet(host, "/")
+			return err == nil && status == want && strings.Contains(got, body)
+		}
+	}
+	waitFor(t, "the tunnel to serve", statusIs(http.StatusOK, "up"))
+
+	stop()
+	waitFor(t, "the offline page", statusIs(http.StatusServiceUnavailable, "application offline"))
+	if info, _ := env.manager.GetRouteInfo(host); !info.Offline {
+		t.Fatal("route info doesn't report the route offline")
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s again: %v", addr, err)
+	}
+	stop = serveOn(l)
+	waitFor(t, "the tunnel to serve again", statusIs(http.StatusOK, "up"))
+}
+
+func TestStatusOnlyFromOwningConnection(t *testing.T) {
+	env := newTestEnv(t, ServerOptions{})
+	owner := env.dialRaw(t, "alice")
+	other := env.dialRaw(t, "alice")
+	port := forward(t, owner, "app")
+	host := "app.alice." + testZone
+	offline, err := json.Marshal(forwardStatus{Port: port, Online: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		c           *ssh.Client
+		wantOK      bool
+		wantOffline bool
+	}{
+		{"other connection of the user", other, false, false},
+		{"owner", owner, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _, err := tt.c.SendRequest(statusRequestType, true, offline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("status replied %v, want %v", ok, tt.wantOK)
+			}
+			if info, _ := env.manager.GetRouteInfo(host); info.Offline != tt.wantOffline {
+				t.Fatalf("route offline = %v, want %v", info.Offline, tt.wantOffline)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+
+	"tunnelfy/internal/logsafe"
+)
+
+// tunnelModeRequestType is the global request a client sends to choose the
+// mode of the tunnels it establishes afterwards. Its payload is a TunnelMode.
+const tunnelModeRequestType = "tunnel-mode@tunnelfy"
+
+// TunnelMode is how a tunnel is exposed publicly.
+type TunnelMode string
+
+const (
+	// TunnelModeHTTP routes the tunnel's host through the HTTP reverse proxy.
+	// It is the default.
+	TunnelModeHTTP TunnelMode = "http"
+	// TunnelModeTCP exposes the tunnel on a dedicated public TCP port whose
+	// bytes are piped to the client as is, for SSH, databases and other
+	// non-HTTP protocols. The port is the one replied to the tcpip-forward.
+	TunnelModeTCP TunnelMode = "tcp"
+)
+
+// ParseTunnelMode parses "http" or "tcp".
+func ParseTunnelMode(s string) (TunnelMode, error) {
+	switch m := TunnelMode(s); m {
+	case TunnelModeHTTP, TunnelModeTCP:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid tunnel mode %q: must be http or tcp", s)
+}
+
+// errTCPDisabled rejects TCP mode on a server without ServerOptions.TCPListenHost.
+var errTCPDisabled = errors.New("tcp tunnels are disabled on this server")
+
+// errHTTPDisabled rejects HTTP mode on a ServerOptions.TCPOnly server.
+var errHTTPDisabled = errors.New("http tunnels are disabled on this server")
+
+// handleTunnelMode serves a tunnel mode request, replacing the mode of the
+// session's subsequent tunnels.
+func (s *SSHServer) handleTunnelMode(req *request, sess *session) {
+	mode, err := ParseTunnelMode(string(req.Payload))
+	switch {
+	case err != nil:
+	case mode == TunnelModeTCP && s.opts.TCPListenHost == "":
+		err = errTCPDisabled
+	case mode == TunnelModeHTTP && s.opts.TCPOnly:
+		err = errHTTPDisabled
+	}
+	if err != nil {
+		if s.logRequests {
+			s.log.Debug("rejecting tunnel mode", "user", logsafe.String(sess.username), "err", err)
+		}
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	sess.mode = mode
+	req.Reply(true, nil)
+}
+
+// sendTunnelMode sends the configured tunnel mode, which applies to every
+// forward requested afterwards.
+func (c *Client) sendTunnelMode() error {
+	ok, reply, err := c.conn.SendRequest(tunnelModeRequestType, true, []byte(c.config.TunnelMode))
+	if err != nil {
+		return fmt.Errorf("failed to send tunnel mode: %w", err)
+	}
+	if !ok {
+		if len(reply) > 0 {
+			return fmt.Errorf("server rejected tunnel mode: %s", reply)
+		}
+		return errors.New("server rejected tunnel mode")
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package ssh
+
+import (
+	"time"
+
+	"tunnelfy/internal/logsafe"
+	"tunnelfy/internal/metrics"
+)
+
+// startTTL arms the tunnel's TTL, if one is configured. With an absolute TTL
+// the tunnel closes TunnelTTL after it was opened; with a sliding TTL it
+// closes once its route has seen no traffic for TunnelTTL, so a tunnel in use
+// stays up and an unused one closes on its own.
+func (s *SSHServer) startTTL(t *tunnel) {
+	ttl := s.opts.TunnelTTL
+	if ttl <= 0 {
+		return
+	}
+	t.ttl = time.AfterFunc(ttl, func() { s.checkTTL(t) })
+}
+
+// checkTTL closes t if its TTL ran out, or re-arms the timer for the rest of
+// a sliding TTL extended by activity.
+func (s *SSHServer) checkTTL(t *tunnel) {
+	ttl := s.opts.TunnelTTL
+	if s.opts.SlidingTTL {
+		if info, ok := s.manager.GetRouteInfo(t.host); ok {
+			if remaining := ttl - time.Since(info.LastActive); remaining > 0 {
+				t.ttl.Reset(remaining)
+				return
+			}
+		}
+	}
+	if !s.activeTunnelM.CompareAndDelete(t.key, t) {
+		return
+	}
+	t.close(s.manager)
+	metrics.SSHTunnelsExpired.Inc()
+	if s.logRequests {
+		s.log.Debug("tunnel expired", "tunnel", logsafe.String(t.name()), "ttl", ttl, "sliding", s.opts.SlidingTTL)
+	}
+}
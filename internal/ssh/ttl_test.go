@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTunnelTTL(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	for _, sliding := range []bool{false, true} {
+		name := "absolute"
+		if sliding {
+			name = "sliding"
+		}
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t, ServerOptions{TunnelTTL: ttl, SlidingTTL: sliding})
+			c := env.connect(t, "alice", ClientConfig{})
+			opened := time.Now()
+			if _, err := c.AddForward(localService(t, "hello"), "demo"); err != nil {
+				t.Fatal(err)
+			}
+			host := "demo.alice." + testZone
+			registered := func() bool {
+				_, ok := env.manager.GetRouteInfo(host)
+				return ok
+			}
+
+			// Keep the tunnel busy for twice its TTL: an absolute TTL closes
+			// it regardless, a sliding one keeps extending.
+			var closedAt time.Duration
+			for time.Since(opened) < 2*ttl {
+				if !registered() {
+					closedAt = time.Since(opened)
+					break
+				}
+				env.get(t, host, "/")
+				time.Sleep(ttl / 6)
+			}
+			if !sliding {
+				if closedAt == 0 {
+					t.Fatal("the tunnel outlived its absolute TTL while in use")
+				}
+				if closedAt < ttl {
+					t.Fatalf("the tunnel closed after %v, before its TTL of %v", closedAt, ttl)
+				}
+				return
+			}
+			if closedAt != 0 {
+				t.Fatalf("the tunnel closed after %v despite activity", closedAt)
+			}
+			if status, body := env.get(t, host, "/"); status != http.StatusOK || body != "hello" {
+				t.Fatalf("got %d %q, want the tunnel still serving", status, body)
+			}
+
+			// Once idle, the sliding TTL runs out.
+			idleSince := time.Now()
+			waitFor(t, "the idle tunnel to expire", func() bool { return !registered() })
+			if idle := time.Since(idleSince); idle < ttl-ttl/6 {
+				t.Fatalf("the tunnel closed after %v idle, want about %v", idle, ttl)
+			}
+		})
+	}
+}